@@ -1,8 +0,0 @@
-package internal
-
-import "time"
-
-type User struct {
-    Hash      string    `json:"hash"`
-    CreatedAt time.Time `json:"created_at"`
-}
@@ -1,44 +1,410 @@
 package main
 
 import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/pem"
+    "errors"
+    "flag"
+    "fmt"
     "log"
+    "math"
+    "net/url"
     "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
 
     "github.com/gofiber/fiber/v2"
     "github.com/gofiber/fiber/v2/middleware/logger"
-    "github.com/Jeff-Barlow-Spady/docker-setup/services/auths/internal"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "github.com/valyala/fasthttp/fasthttpadaptor"
+    "gorm.io/driver/postgres"
+    "gorm.io/gorm"
+    "github.com/Jeff-Barlow-Spady/edge-device-service/internal/auth/service"
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/audit"
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/config"
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/middleware/auth"
 )
 
+// adminScope is required for user and session administration
+const adminScope = "auth:admin:users"
+
+// localVerifier lets the shared auth middleware verify tokens in-process
+type localVerifier struct {
+    service *service.AuthService
+}
+
+func (v localVerifier) Verify(ctx context.Context, token string) (*auth.Identity, error) {
+    claims, ok := v.service.VerifyTokenClaims(token)
+    if !ok {
+        return nil, auth.ErrInvalidToken
+    }
+    return &auth.Identity{
+        Subject: claims.Subject,
+        Roles:   claims.Roles,
+        Scopes:  claims.Scopes,
+    }, nil
+}
+
+func (v localVerifier) VerifyAPIKey(ctx context.Context, key, remoteIP string) (*auth.Identity, error) {
+    claims, err := v.service.VerifyAPIKey(key, remoteIP)
+    if err != nil {
+        return nil, auth.ErrInvalidToken
+    }
+    return &auth.Identity{
+        Subject: claims.Subject,
+        Roles:   claims.Roles,
+        Scopes:  claims.Scopes,
+    }, nil
+}
+
+func (v localVerifier) VerifyCertificate(ctx context.Context, cert *x509.Certificate) (*auth.Identity, error) {
+    claims, err := v.service.VerifyCertificate(cert)
+    if err != nil {
+        return nil, auth.ErrInvalidToken
+    }
+    return &auth.Identity{
+        Subject: claims.Subject,
+        Roles:   claims.Roles,
+        Scopes:  claims.Scopes,
+    }, nil
+}
+
+// requireBearer rejects requests authenticated with an API key, so that a
+// restricted key cannot be used to manage sessions or mint other keys
+func requireBearer(c *fiber.Ctx) error {
+    if auth.TokenFrom(c) == "" {
+        return c.Status(403).JSON(fiber.Map{
+            "error": "This endpoint requires a bearer token",
+        })
+    }
+    return c.Next()
+}
+
+// newStores opens the account and auth state stores selected by
+// USER_STORE, applying schema migrations for Postgres
+func newStores(cfg *config.Config) (service.UserStore, service.StateStore, error) {
+    switch cfg.UserStore {
+    case "", "file":
+        users, err := service.NewFileUserStore(filepath.Join(cfg.StateDir, "users.json"))
+        if err != nil {
+            return nil, nil, err
+        }
+        state, err := service.NewFileStateStore(cfg.StateDir, cfg.JWT.KeyFile)
+        if err != nil {
+            return nil, nil, err
+        }
+        return users, state, nil
+    case "postgres":
+        db, err := gorm.Open(postgres.Open(cfg.Database.DSN()), &gorm.Config{})
+        if err != nil {
+            return nil, nil, err
+        }
+        users, err := service.NewGormUserStore(db)
+        if err != nil {
+            return nil, nil, err
+        }
+        state, err := service.NewGormStateStore(db)
+        if err != nil {
+            return nil, nil, err
+        }
+        return users, state, nil
+    default:
+        return nil, nil, fmt.Errorf("unknown USER_STORE %q, must be 'file' or 'postgres'", cfg.UserStore)
+    }
+}
+
+// notSelf stops admins from disabling, deleting or demoting their own
+// account, which could leave the device without an administrator
+func notSelf(c *fiber.Ctx) error {
+    if c.Params("username") == auth.Subject(c) {
+        return c.Status(409).JSON(fiber.Map{
+            "error": "Cannot apply this change to your own account",
+        })
+    }
+    return c.Next()
+}
+
+// userError maps user management errors to responses
+func userError(c *fiber.Ctx, err error) error {
+    var policy *service.PasswordPolicyError
+    var throttled *service.ThrottledError
+    switch {
+    case errors.As(err, &throttled):
+        c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+        return c.Status(429).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    case errors.As(err, &policy):
+        return c.Status(400).JSON(fiber.Map{
+            "error":      "Password does not meet policy",
+            "violations": policy.Violations,
+        })
+    case errors.Is(err, service.ErrUserNotFound):
+        return c.Status(404).JSON(fiber.Map{
+            "error": "User not found",
+        })
+    case errors.Is(err, service.ErrUserExists):
+        return c.Status(409).JSON(fiber.Map{
+            "error": "User already exists",
+        })
+    case errors.Is(err, service.ErrRegistrationClosed), errors.Is(err, service.ErrInvalidInvite):
+        return c.Status(403).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    case errors.Is(err, service.ErrInvalidRole), errors.Is(err, service.ErrInvalidPassword):
+        return c.Status(400).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    case errors.Is(err, service.ErrInvalidMFACode), errors.Is(err, service.ErrMFANotPending):
+        return c.Status(400).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    case errors.Is(err, service.ErrMFAAlreadyEnabled):
+        return c.Status(409).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    default:
+        log.Printf("User operation failed: %v", err)
+        return c.Status(500).JSON(fiber.Map{
+            "error": "Internal error",
+        })
+    }
+}
+
+// certificateError maps local CA errors to responses
+func certificateError(c *fiber.Ctx, err error) error {
+    switch {
+    case errors.Is(err, service.ErrMTLSDisabled):
+        return c.Status(404).JSON(fiber.Map{
+            "error": "Mutual TLS is not enabled",
+        })
+    case errors.Is(err, service.ErrCertificateNotFound):
+        return c.Status(404).JSON(fiber.Map{
+            "error": "Certificate not found",
+        })
+    case errors.Is(err, service.ErrInvalidCSR):
+        return c.Status(400).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    default:
+        return userError(c, err)
+    }
+}
+
+// parseClientCert decodes the URL-escaped PEM certificate sent by services
+// in the client certificate header
+func parseClientCert(header string) (*x509.Certificate, error) {
+    data, err := url.QueryUnescape(header)
+    if err != nil {
+        return nil, err
+    }
+    block, _ := pem.Decode([]byte(data))
+    if block == nil || block.Type != "CERTIFICATE" {
+        return nil, errors.New("no PEM certificate")
+    }
+    return x509.ParseCertificate(block.Bytes)
+}
+
+// authenticateClient authenticates an OAuth2 client with HTTP Basic auth
+// or client_id and client_secret form fields
+func authenticateClient(c *fiber.Ctx, authService *service.AuthService) (service.OAuthClient, error) {
+    id, secret := c.FormValue("client_id"), c.FormValue("client_secret")
+    header := c.Get(fiber.HeaderAuthorization)
+    basic := len(header) > 6 && strings.EqualFold(header[:6], "basic ")
+    if basic {
+        decoded, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(header[6:]))
+        user, pass, _ := strings.Cut(string(decoded), ":")
+        // RFC 6749 form-encodes the credentials before base64
+        id, _ = url.QueryUnescape(user)
+        secret, _ = url.QueryUnescape(pass)
+    }
+
+    audit.SetActor(c, id)
+    client, err := authService.AuthenticateClient(id, secret)
+    if err != nil && basic {
+        c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="oauth"`)
+    }
+    return client, err
+}
+
+// oauthError writes an OAuth2 error response
+func oauthError(c *fiber.Ctx, status int, code, description string) error {
+    return c.Status(status).JSON(fiber.Map{
+        "error":             code,
+        "error_description": description,
+    })
+}
+
+// forwardedToken finds a token in a forward-auth request the way the auth
+// middleware does in the original request. The proxy drops the Upgrade
+// header, so WebSocket subprotocols and the query string of the forwarded
+// URI are always checked.
+func forwardedToken(c *fiber.Ctx) string {
+    if header := c.Get(fiber.HeaderAuthorization); header != "" {
+        if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+            return strings.TrimSpace(header[7:])
+        }
+        return ""
+    }
+
+    if cookie := c.Cookies("access_token"); cookie != "" {
+        return cookie
+    }
+
+    for _, protocol := range strings.Split(c.Get(fiber.HeaderSecWebSocketProtocol), ",") {
+        protocol = strings.TrimSpace(protocol)
+        if strings.HasPrefix(protocol, auth.SubprotocolPrefix) {
+            return strings.TrimPrefix(protocol, auth.SubprotocolPrefix)
+        }
+    }
+
+    if uri, err := url.ParseRequestURI(c.Get("X-Forwarded-Uri")); err == nil {
+        return uri.Query().Get("access_token")
+    }
+    return ""
+}
+
+// splitList splits a comma-separated list, dropping empty items
+func splitList(list string) []string {
+    var items []string
+    for _, item := range strings.Split(list, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+// loginResponse issues a session for a user who completed every login step
+func loginResponse(c *fiber.Ctx, authService *service.AuthService, username string) error {
+    tokens, err := authService.IssueTokens(username)
+    if err != nil {
+        return c.Status(500).JSON(fiber.Map{
+            "error": "Failed to issue tokens",
+        })
+    }
+
+    return c.JSON(fiber.Map{
+        "token":         tokens.AccessToken,
+        "access_token":  tokens.AccessToken,
+        "refresh_token": tokens.RefreshToken,
+        "token_type":    tokens.TokenType,
+        "expires_in":    tokens.ExpiresIn,
+    })
+}
+
 func main() {
-    app := fiber.New()
+    fiberConfig := fiber.Config{
+        ErrorHandler: func(c *fiber.Ctx, err error) error {
+            code := fiber.StatusInternalServerError
+            if e, ok := err.(*fiber.Error); ok {
+                code = e.Code
+            }
+            return c.Status(code).JSON(fiber.Map{
+                "error": err.Error(),
+            })
+        },
+    }
+
+    // Behind Caddy the client address comes from X-Forwarded-For, which is
+    // only trusted from the listed proxies so that clients cannot spoof it
+    // to dodge per-IP login limits or API key allowlists. Services that
+    // verify API keys here forward their client's address the same way, so
+    // they must be listed too.
+    if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+        fiberConfig.ProxyHeader = fiber.HeaderXForwardedFor
+        fiberConfig.EnableTrustedProxyCheck = true
+        fiberConfig.TrustedProxies = strings.Split(proxies, ",")
+        fiberConfig.EnableIPValidation = true
+    }
+
+    app := fiber.New(fiberConfig)
     app.Use(logger.New())
 
-    authService := internal.NewAuthService()
+    cfg, err := config.LoadConfig(".")
+    if err != nil {
+        log.Fatalf("Failed to load config: %v", err)
+    }
+
+    importFile := flag.String("import-users", "", "import users from a users.json file into the configured store and exit")
+    flag.Parse()
+
+    users, state, err := newStores(cfg)
+    if err != nil {
+        log.Fatalf("Failed to open stores: %v", err)
+    }
+
+    if *importFile != "" {
+        if _, err := os.Stat(*importFile); err != nil {
+            log.Fatalf("Failed to import users: %v", err)
+        }
+        source, err := service.NewFileUserStore(*importFile)
+        if err != nil {
+            log.Fatalf("Failed to import users: %v", err)
+        }
+        imported, skipped, err := service.ImportUsers(source, users)
+        if err != nil {
+            log.Fatalf("Failed to import users: %v", err)
+        }
+        log.Printf("Imported %d users, skipped %d existing", imported, skipped)
+        return
+    }
+
+    authService, err := service.NewAuthService(cfg, users, state)
+    if err != nil {
+        log.Fatalf("Failed to initialize auth service: %v", err)
+    }
+    requireAuth := auth.New(auth.Config{Verifier: localVerifier{authService}})
+    requireAdmin := auth.RequireScope(func(*fiber.Ctx) string { return adminScope })
 
-    app.Post("/auths/register", func(c *fiber.Ctx) error {
+    // Logins, token, user and credential changes are recorded in the audit
+    // log; a nil log records nothing
+    var auditLog *audit.Logger
+    if cfg.Audit.Enabled {
+        auditLog, err = audit.Open(audit.Config{
+            Path:     cfg.Audit.File,
+            Service:  "auth",
+            MaxSize:  cfg.Audit.MaxSize,
+            MaxFiles: cfg.Audit.MaxFiles,
+        })
+        if err != nil {
+            log.Fatalf("Failed to open audit log: %v", err)
+        }
+        defer auditLog.Close()
+    }
+    requireAuditRead := auth.RequireScope(func(*fiber.Ctx) string { return audit.ReadScope })
+
+    app.Post("/auths/register", auditLog.Middleware("auth.register"), func(c *fiber.Ctx) error {
         var req struct {
             Username string `json:"username"`
             Password string `json:"password"`
+            Invite   string `json:"invite"`
         }
 
-        if err := c.BodyParser(&req); err != nil {
+        if err := c.BodyParser(&req); err != nil || req.Username == "" {
             return c.Status(400).JSON(fiber.Map{
                 "error": "Invalid request",
             })
         }
 
-        if success := authService.CreateUser(req.Username, req.Password); !success {
-            return c.Status(409).JSON(fiber.Map{
-                "error": "User already exists",
-            })
+        audit.SetActor(c, req.Username)
+        role, err := authService.Register(req.Username, req.Password, req.Invite)
+        if err != nil {
+            return userError(c, err)
         }
 
         return c.Status(201).JSON(fiber.Map{
             "message": "User created successfully",
+            "role":    role,
         })
     })
 
-    app.Post("/auths/login", func(c *fiber.Ctx) error {
+    app.Post("/auths/login", auditLog.Middleware("auth.login"), func(c *fiber.Ctx) error {
         var req struct {
             Username string `json:"username"`
             Password string `json:"password"`
@@ -50,22 +416,827 @@ func main() {
             })
         }
 
-        if !authService.VerifyUser(req.Username, req.Password) {
+        audit.SetActor(c, req.Username)
+        if err := authService.Authenticate(req.Username, req.Password, c.IP()); err != nil {
+            var throttled *service.ThrottledError
+            if errors.As(err, &throttled) {
+                c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+                return c.Status(429).JSON(fiber.Map{
+                    "error": err.Error(),
+                })
+            }
+            if errors.Is(err, service.ErrAccountDisabled) {
+                return c.Status(403).JSON(fiber.Map{
+                    "error": "Account disabled",
+                })
+            }
             return c.Status(401).JSON(fiber.Map{
                 "error": "Invalid credentials",
             })
         }
 
-        token := authService.CreateToken(req.Username)
+        // Users with a second factor get a challenge instead of a session
+        challenge, err := authService.MFAChallenge(req.Username)
+        if err != nil {
+            return c.Status(500).JSON(fiber.Map{
+                "error": "Failed to start MFA challenge",
+            })
+        }
+        if challenge != "" {
+            audit.SetDetail(c, "mfa", "challenged")
+            return c.JSON(fiber.Map{
+                "mfa_required": true,
+                "mfa_token":    challenge,
+                "expires_in":   int(service.MFAChallengeTTL.Seconds()),
+            })
+        }
+
+        return loginResponse(c, authService, req.Username)
+    })
+
+    app.Post("/auths/login/mfa", auditLog.Middleware("auth.login.mfa"), func(c *fiber.Ctx) error {
+        var req struct {
+            MFAToken string `json:"mfa_token"`
+            Code     string `json:"code"`
+        }
+
+        if err := c.BodyParser(&req); err != nil || req.MFAToken == "" {
+            return c.Status(400).JSON(fiber.Map{
+                "error": "Invalid request",
+            })
+        }
+
+        username, err := authService.CompleteMFAChallenge(req.MFAToken, req.Code, c.IP())
+        audit.SetActor(c, username)
+        if err != nil {
+            var throttled *service.ThrottledError
+            if errors.As(err, &throttled) {
+                c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+                return c.Status(429).JSON(fiber.Map{
+                    "error": err.Error(),
+                })
+            }
+            if errors.Is(err, service.ErrInvalidMFACode) || errors.Is(err, service.ErrInvalidMFAChallenge) {
+                return c.Status(401).JSON(fiber.Map{
+                    "error": err.Error(),
+                })
+            }
+            return c.Status(500).JSON(fiber.Map{
+                "error": "Failed to verify code",
+            })
+        }
+
+        return loginResponse(c, authService, username)
+    })
+
+    app.Post("/auths/refresh", auditLog.Middleware("token.refresh"), func(c *fiber.Ctx) error {
+        var req struct {
+            RefreshToken string `json:"refresh_token"`
+        }
+
+        if err := c.BodyParser(&req); err != nil || req.RefreshToken == "" {
+            return c.Status(400).JSON(fiber.Map{
+                "error": "Invalid request",
+            })
+        }
+
+        tokens, err := authService.RefreshTokens(req.RefreshToken)
+        if err != nil {
+            return c.Status(401).JSON(fiber.Map{
+                "error": err.Error(),
+            })
+        }
+        if claims, ok := authService.VerifyTokenClaims(tokens.AccessToken); ok {
+            audit.SetActor(c, claims.Subject)
+        }
+
+        return c.JSON(tokens)
+    })
+
+    app.Post("/auths/logout", auditLog.Middleware("auth.logout"), requireAuth, requireBearer, func(c *fiber.Ctx) error {
+        var req struct {
+            RefreshToken string `json:"refresh_token"`
+        }
+        c.BodyParser(&req)
+
+        if err := authService.Logout(auth.TokenFrom(c), req.RefreshToken); err != nil {
+            return c.Status(500).JSON(fiber.Map{
+                "error": "Failed to revoke token",
+            })
+        }
+
+        return c.JSON(fiber.Map{
+            "message": "Logged out",
+        })
+    })
+
+    app.Get("/auths/me", requireAuth, func(c *fiber.Ctx) error {
+        user, err := authService.GetUser(auth.Subject(c))
+        if err != nil {
+            return userError(c, err)
+        }
+        return c.JSON(user)
+    })
+
+    app.Post("/auths/me/password", auditLog.Middleware("user.password.change"), requireAuth, requireBearer, func(c *fiber.Ctx) error {
+        var req struct {
+            CurrentPassword string `json:"current_password"`
+            NewPassword     string `json:"new_password"`
+        }
+
+        if err := c.BodyParser(&req); err != nil {
+            return c.Status(400).JSON(fiber.Map{
+                "error": "Invalid request",
+            })
+        }
+
+        if err := authService.ChangePassword(auth.Subject(c), req.CurrentPassword, req.NewPassword, c.IP()); err != nil {
+            return userError(c, err)
+        }
+
+        return c.JSON(fiber.Map{
+            "message": "Password changed, please log in again",
+        })
+    })
+
+    app.Post("/auths/me/mfa/totp", auditLog.Middleware("mfa.totp.begin"), requireAuth, requireBearer, func(c *fiber.Ctx) error {
+        enrollment, err := authService.BeginTOTPEnrollment(auth.Subject(c))
+        if err != nil {
+            return userError(c, err)
+        }
+        return c.JSON(enrollment)
+    })
+
+    app.Post("/auths/me/mfa/totp/confirm", auditLog.Middleware("mfa.totp.enable"), requireAuth, requireBearer, func(c *fiber.Ctx) error {
+        var req struct {
+            Code string `json:"code"`
+        }
+
+        if err := c.BodyParser(&req); err != nil {
+            return c.Status(400).JSON(fiber.Map{
+                "error": "Invalid request",
+            })
+        }
+
+        codes, err := authService.ConfirmTOTP(auth.Subject(c), req.Code)
+        if err != nil {
+            return userError(c, err)
+        }
+
+        return c.JSON(fiber.Map{
+            "message":        "TOTP enabled and existing sessions signed out, log in again with your code to use your full scopes",
+            "recovery_codes": codes,
+        })
+    })
+
+    app.Delete("/auths/me/mfa/totp", auditLog.Middleware("mfa.totp.disable"), requireAuth, requireBearer, func(c *fiber.Ctx) error {
+        var req struct {
+            Code string `json:"code"`
+        }
+
+        if err := c.BodyParser(&req); err != nil {
+            return c.Status(400).JSON(fiber.Map{
+                "error": "Invalid request",
+            })
+        }
+
+        if err := authService.DisableTOTP(auth.Subject(c), req.Code); err != nil {
+            return userError(c, err)
+        }
+
+        return c.JSON(fiber.Map{
+            "message": "TOTP disabled",
+        })
+    })
+
+    // User administration
+    admin := app.Group("/auths/users", requireAuth, requireBearer, requireAdmin)
+
+    admin.Get("/", func(c *fiber.Ctx) error {
+        users, err := authService.ListUsers()
+        if err != nil {
+            return userError(c, err)
+        }
+        return c.JSON(fiber.Map{
+            "users": users,
+        })
+    })
+
+    admin.Post("/", auditLog.Middleware("user.create"), func(c *fiber.Ctx) error {
+        var req struct {
+            Username string `json:"username"`
+            Password string `json:"password"`
+            Role     string `json:"role"`
+        }
+
+        if err := c.BodyParser(&req); err != nil || req.Username == "" {
+            return c.Status(400).JSON(fiber.Map{
+                "error": "Invalid request",
+            })
+        }
+        if req.Role == "" {
+            req.Role = service.RoleViewer
+        }
+
+        if err := authService.AddUser(req.Username, req.Password, req.Role); err != nil {
+            return userError(c, err)
+        }
+
+        user, _ := authService.GetUser(req.Username)
+        return c.Status(201).JSON(user)
+    })
+
+    admin.Get("/:username", func(c *fiber.Ctx) error {
+        user, err := authService.GetUser(c.Params("username"))
+        if err != nil {
+            return userError(c, err)
+        }
+        return c.JSON(user)
+    })
+
+    admin.Delete("/:username", auditLog.Middleware("user.delete"), notSelf, func(c *fiber.Ctx) error {
+        if err := authService.DeleteUser(c.Params("username")); err != nil {
+            return userError(c, err)
+        }
+        return c.JSON(fiber.Map{
+            "message": "User deleted",
+            "username": c.Params("username"),
+        })
+    })
+
+    admin.Post("/:username/disable", auditLog.Middleware("user.disable"), notSelf, func(c *fiber.Ctx) error {
+        if err := authService.SetUserDisabled(c.Params("username"), true); err != nil {
+            return userError(c, err)
+        }
+        return c.JSON(fiber.Map{
+            "message": "User disabled",
+            "username": c.Params("username"),
+        })
+    })
+
+    admin.Post("/:username/enable", auditLog.Middleware("user.enable"), func(c *fiber.Ctx) error {
+        if err := authService.SetUserDisabled(c.Params("username"), false); err != nil {
+            return userError(c, err)
+        }
+        return c.JSON(fiber.Map{
+            "message": "User enabled",
+            "username": c.Params("username"),
+        })
+    })
+
+    admin.Post("/:username/password", auditLog.Middleware("user.password.reset"), func(c *fiber.Ctx) error {
+        var req struct {
+            Password string `json:"password"`
+        }
+
+        if err := c.BodyParser(&req); err != nil {
+            return c.Status(400).JSON(fiber.Map{
+                "error": "Invalid request",
+            })
+        }
+
+        if err := authService.ResetPassword(c.Params("username"), req.Password); err != nil {
+            return userError(c, err)
+        }
         return c.JSON(fiber.Map{
-            "token": token,
+            "message": "Password reset",
+            "username": c.Params("username"),
+        })
+    })
+
+    admin.Put("/:username/role", auditLog.Middleware("user.role"), notSelf, func(c *fiber.Ctx) error {
+        var req struct {
+            Role   string   `json:"role"`
+            Scopes []string `json:"scopes"`
+        }
+
+        if err := c.BodyParser(&req); err != nil {
+            return c.Status(400).JSON(fiber.Map{
+                "error": "Invalid request",
+            })
+        }
+
+        if err := authService.SetUserRole(c.Params("username"), req.Role, req.Scopes); err != nil {
+            return userError(c, err)
+        }
+
+        user, _ := authService.GetUser(c.Params("username"))
+        return c.JSON(user)
+    })
+
+    app.Post("/auths/invites", auditLog.Middleware("invite.create"), requireAuth, requireBearer, requireAdmin, func(c *fiber.Ctx) error {
+        var req struct {
+            Role      string `json:"role"`
+            ExpiresIn int64  `json:"expires_in"`
+        }
+
+        if err := c.BodyParser(&req); err != nil || req.ExpiresIn < 0 {
+            return c.Status(400).JSON(fiber.Map{
+                "error": "Invalid request",
+            })
+        }
+        if req.Role == "" {
+            req.Role = service.RoleViewer
+        }
+        ttl := 7 * 24 * time.Hour
+        if req.ExpiresIn > 0 {
+            ttl = time.Duration(req.ExpiresIn) * time.Second
+        }
+
+        code, expiresAt, err := authService.CreateInvite(auth.Subject(c), req.Role, ttl)
+        if err != nil {
+            return userError(c, err)
+        }
+
+        return c.Status(201).JSON(fiber.Map{
+            "invite":     code,
+            "role":       req.Role,
+            "expires_at": expiresAt,
         })
     })
 
+    admin.Post("/:username/revoke", auditLog.Middleware("token.revoke.user"), func(c *fiber.Ctx) error {
+        username := c.Params("username")
+        if err := authService.RevokeUserSessions(username); err != nil {
+            if errors.Is(err, service.ErrUserNotFound) {
+                return c.Status(404).JSON(fiber.Map{
+                    "error": "User not found",
+                })
+            }
+            return c.Status(500).JSON(fiber.Map{
+                "error": "Failed to revoke sessions",
+            })
+        }
+
+        return c.JSON(fiber.Map{
+            "message": "All sessions revoked",
+            "username": username,
+        })
+    })
+
+    admin.Post("/:username/unlock", auditLog.Middleware("user.unlock"), func(c *fiber.Ctx) error {
+        username := c.Params("username")
+        if err := authService.UnlockUser(username); err != nil {
+            if errors.Is(err, service.ErrUserNotFound) {
+                return c.Status(404).JSON(fiber.Map{
+                    "error": "User not found",
+                })
+            }
+            return c.Status(500).JSON(fiber.Map{
+                "error": "Failed to unlock user",
+            })
+        }
+
+        return c.JSON(fiber.Map{
+            "message": "User unlocked",
+            "username": username,
+        })
+    })
+
+    admin.Post("/:username/mfa/reset", auditLog.Middleware("mfa.reset"), func(c *fiber.Ctx) error {
+        username := c.Params("username")
+        if err := authService.ResetMFA(username); err != nil {
+            return userError(c, err)
+        }
+
+        return c.JSON(fiber.Map{
+            "message":  "MFA reset, all sessions revoked",
+            "username": username,
+        })
+    })
+
+    app.Post("/auths/apikeys", auditLog.Middleware("apikey.create"), requireAuth, requireBearer, func(c *fiber.Ctx) error {
+        var req struct {
+            service.APIKeyRequest
+            ExpiresIn int64 `json:"expires_in"`
+        }
+
+        if err := c.BodyParser(&req); err != nil || req.Name == "" || req.ExpiresIn < 0 {
+            return c.Status(400).JSON(fiber.Map{
+                "error": "Invalid request",
+            })
+        }
+        req.TTL = time.Duration(req.ExpiresIn) * time.Second
+
+        key, info, err := authService.CreateAPIKey(auth.Subject(c), req.APIKeyRequest)
+        if err != nil {
+            if errors.Is(err, service.ErrScopeNotGranted) {
+                return c.Status(403).JSON(fiber.Map{
+                    "error": err.Error(),
+                })
+            }
+            if errors.Is(err, service.ErrUserNotFound) {
+                return c.Status(404).JSON(fiber.Map{
+                    "error": "User not found",
+                })
+            }
+            return c.Status(400).JSON(fiber.Map{
+                "error": err.Error(),
+            })
+        }
+
+        // The key itself is only ever shown in this response
+        return c.Status(201).JSON(fiber.Map{
+            "key":     key,
+            "api_key": info,
+        })
+    })
+
+    // Lists the caller's keys; admins may pass ?all=true for every key
+    app.Get("/auths/apikeys", requireAuth, requireBearer, func(c *fiber.Ctx) error {
+        owner := auth.Subject(c)
+        if c.QueryBool("all") {
+            if !auth.IdentityFrom(c).HasScope(adminScope) {
+                return c.Status(403).JSON(fiber.Map{
+                    "error": "missing required scope " + adminScope,
+                })
+            }
+            owner = ""
+        }
+
+        keys, err := authService.ListAPIKeys(owner)
+        if err != nil {
+            log.Printf("Failed to list API keys: %v", err)
+            return c.Status(500).JSON(fiber.Map{
+                "error": "Failed to list API keys",
+            })
+        }
+        return c.JSON(fiber.Map{
+            "api_keys": keys,
+        })
+    })
+
+    // Revokes one of the caller's keys, or any key for admins
+    app.Delete("/auths/apikeys/:id", auditLog.Middleware("apikey.revoke"), requireAuth, requireBearer, func(c *fiber.Ctx) error {
+        owner := auth.Subject(c)
+        if auth.IdentityFrom(c).HasScope(adminScope) {
+            owner = ""
+        }
+
+        if err := authService.RevokeAPIKey(c.Params("id"), owner); err != nil {
+            if errors.Is(err, service.ErrAPIKeyNotFound) {
+                return c.Status(404).JSON(fiber.Map{
+                    "error": "API key not found",
+                })
+            }
+            return c.Status(500).JSON(fiber.Map{
+                "error": "Failed to revoke API key",
+            })
+        }
+
+        return c.JSON(fiber.Map{
+            "message": "API key revoked",
+            "id":      c.Params("id"),
+        })
+    })
+
+    // Issues a client certificate for a PEM CSR. The certificate's subject
+    // is the caller, or for admins any user named in the request.
+    app.Post("/auths/certificates", auditLog.Middleware("certificate.issue"), requireAuth, requireBearer, func(c *fiber.Ctx) error {
+        var req struct {
+            CSR      string `json:"csr"`
+            Username string `json:"username"`
+        }
+
+        if err := c.BodyParser(&req); err != nil || req.CSR == "" {
+            return c.Status(400).JSON(fiber.Map{
+                "error": "Invalid request",
+            })
+        }
+
+        username := auth.Subject(c)
+        if req.Username != "" && req.Username != username {
+            if !auth.IdentityFrom(c).HasScope(adminScope) {
+                return c.Status(403).JSON(fiber.Map{
+                    "error": "missing required scope " + adminScope,
+                })
+            }
+            username = req.Username
+        }
+
+        cert, info, err := authService.IssueCertificate(username, auth.Subject(c), []byte(req.CSR))
+        if err != nil {
+            return certificateError(c, err)
+        }
+
+        return c.Status(201).JSON(fiber.Map{
+            "certificate": string(cert),
+            "info":        info,
+        })
+    })
+
+    // Lists the caller's certificates; admins may pass ?all=true for every
+    // certificate
+    app.Get("/auths/certificates", requireAuth, requireBearer, func(c *fiber.Ctx) error {
+        owner := auth.Subject(c)
+        if c.QueryBool("all") {
+            if !auth.IdentityFrom(c).HasScope(adminScope) {
+                return c.Status(403).JSON(fiber.Map{
+                    "error": "missing required scope " + adminScope,
+                })
+            }
+            owner = ""
+        }
+
+        return c.JSON(fiber.Map{
+            "certificates": authService.ListCertificates(owner),
+        })
+    })
+
+    // Revokes one of the caller's certificates, or any certificate for
+    // admins
+    app.Delete("/auths/certificates/:serial", auditLog.Middleware("certificate.revoke"), requireAuth, requireBearer, func(c *fiber.Ctx) error {
+        owner := auth.Subject(c)
+        if auth.IdentityFrom(c).HasScope(adminScope) {
+            owner = ""
+        }
+
+        if err := authService.RevokeCertificate(c.Params("serial"), owner); err != nil {
+            return certificateError(c, err)
+        }
+
+        return c.JSON(fiber.Map{
+            "message": "Certificate revoked",
+            "serial":  c.Params("serial"),
+        })
+    })
+
+    // The local CA certificate, for services verifying client certificates
+    app.Get("/auths/ca", func(c *fiber.Ctx) error {
+        ca, err := authService.CACertificate()
+        if err != nil {
+            return certificateError(c, err)
+        }
+        c.Set(fiber.HeaderContentType, "application/x-pem-file")
+        return c.Send(ca)
+    })
+
+    // Certificate revocation list of the local CA (DER)
+    app.Get("/auths/crl", func(c *fiber.Ctx) error {
+        crl, err := authService.CRL()
+        if err != nil {
+            return certificateError(c, err)
+        }
+        c.Set(fiber.HeaderContentType, "application/pkix-crl")
+        c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+        return c.Send(crl)
+    })
+
+    // Audit log queries, e.g. ?actor=alice&action=auth.login&since=...
+    app.Get("/auths/audit", requireAuth, requireAuditRead, auditLog.QueryHandler())
+    app.Get("/auths/audit/verify", requireAuth, requireAuditRead, auditLog.VerifyHandler())
+
+    // Prometheus metrics, including failed login counters
+    promHandler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+    app.Get("/metrics", func(c *fiber.Ctx) error {
+        promHandler(c.Context())
+        return nil
+    })
+
+    // Public keys for services that verify tokens locally
+    app.Get("/.well-known/jwks.json", func(c *fiber.Ctx) error {
+        c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+        return c.JSON(authService.JWKS())
+    })
+
+    // Token, API key and client certificate verification for services that
+    // do not hold the signing secret
+    app.Get("/auths/verify", func(c *fiber.Ctx) error {
+        // Client certificates have already been verified in the calling
+        // service's TLS handshake; this maps them to a user and checks
+        // revocation
+        if header := c.Get(auth.ClientCertHeader); header != "" {
+            cert, err := parseClientCert(header)
+            if err != nil {
+                return c.Status(400).JSON(fiber.Map{
+                    "error": "Invalid client certificate",
+                })
+            }
+            claims, err := authService.VerifyCertificate(cert)
+            if err != nil {
+                return c.Status(401).JSON(fiber.Map{
+                    "error": "Invalid client certificate",
+                })
+            }
+            return c.JSON(claims)
+        }
+
+        // API keys are checked against the client address, which is taken
+        // from X-Forwarded-For only when the calling service is one of the
+        // TRUSTED_PROXIES
+        if key := c.Get(auth.APIKeyHeader); key != "" {
+            claims, err := authService.VerifyAPIKey(key, c.IP())
+            if err != nil {
+                return c.Status(401).JSON(fiber.Map{
+                    "error": "Invalid API key",
+                })
+            }
+            return c.JSON(claims)
+        }
+
+        header := c.Get(fiber.HeaderAuthorization)
+        if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+            return c.Status(401).JSON(fiber.Map{
+                "error": "Missing bearer token",
+            })
+        }
+
+        claims, ok := authService.VerifyTokenClaims(strings.TrimSpace(header[7:]))
+        if !ok {
+            return c.Status(401).JSON(fiber.Map{
+                "error": "Invalid token",
+            })
+        }
+
+        return c.JSON(claims)
+    })
+
+    // OAuth2 token endpoint (RFC 6749) for confidential clients
+    app.Post("/oauth/token", auditLog.Middleware("token.issue"), func(c *fiber.Ctx) error {
+        c.Set(fiber.HeaderCacheControl, "no-store")
+        c.Set(fiber.HeaderPragma, "no-cache")
+
+        client, err := authenticateClient(c, authService)
+        if err != nil {
+            return oauthError(c, 401, "invalid_client", "client authentication failed")
+        }
+        audit.SetDetail(c, "grant_type", c.FormValue("grant_type"))
+
+        var token service.OAuthToken
+        switch grantType := c.FormValue("grant_type"); grantType {
+        case service.GrantClientCredentials:
+            token, err = authService.ClientCredentialsToken(client, c.FormValue("scope"))
+        case service.GrantPassword:
+            username, password := c.FormValue("username"), c.FormValue("password")
+            if username == "" || password == "" {
+                return oauthError(c, 400, "invalid_request", "username and password are required")
+            }
+            audit.SetDetail(c, "username", username)
+            token, err = authService.PasswordGrant(client, username, password, c.IP())
+        case service.GrantRefreshToken:
+            refreshToken := c.FormValue("refresh_token")
+            if refreshToken == "" {
+                return oauthError(c, 400, "invalid_request", "refresh_token is required")
+            }
+            token, err = authService.RefreshGrant(client, refreshToken)
+        case "":
+            return oauthError(c, 400, "invalid_request", "grant_type is required")
+        default:
+            return oauthError(c, 400, "unsupported_grant_type", grantType)
+        }
+
+        var throttled *service.ThrottledError
+        switch {
+        case err == nil:
+            return c.JSON(token)
+        case errors.As(err, &throttled):
+            c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+            return oauthError(c, 429, "invalid_grant", err.Error())
+        case errors.Is(err, service.ErrUnauthorizedClient):
+            return oauthError(c, 400, "unauthorized_client", err.Error())
+        case errors.Is(err, service.ErrInvalidScope):
+            return oauthError(c, 400, "invalid_scope", err.Error())
+        case errors.Is(err, service.ErrInvalidCredentials), errors.Is(err, service.ErrAccountDisabled),
+            errors.Is(err, service.ErrMFARequired), errors.Is(err, service.ErrInvalidRefreshToken),
+            errors.Is(err, service.ErrRefreshTokenReused):
+            return oauthError(c, 400, "invalid_grant", err.Error())
+        default:
+            log.Printf("OAuth token request from %s failed: %v", client.ID, err)
+            return oauthError(c, 500, "server_error", "failed to issue token")
+        }
+    })
+
+    // Token introspection (RFC 7662), for authenticated clients
+    app.Post("/oauth/introspect", func(c *fiber.Ctx) error {
+        if _, err := authenticateClient(c, authService); err != nil {
+            return oauthError(c, 401, "invalid_client", "client authentication failed")
+        }
+
+        token := c.FormValue("token")
+        if token == "" {
+            return oauthError(c, 400, "invalid_request", "token is required")
+        }
+
+        c.Set(fiber.HeaderCacheControl, "no-store")
+        return c.JSON(authService.Introspect(token, c.FormValue("token_type_hint")))
+    })
+
+    clients := app.Group("/auths/oauth/clients", requireAuth, requireBearer, requireAdmin)
+
+    clients.Post("/", auditLog.Middleware("oauth_client.create"), func(c *fiber.Ctx) error {
+        var req service.OAuthClientRequest
+        if err := c.BodyParser(&req); err != nil || req.Name == "" {
+            return c.Status(400).JSON(fiber.Map{
+                "error": "Invalid request",
+            })
+        }
+
+        secret, client, err := authService.CreateOAuthClient(auth.Subject(c), req)
+        if err != nil {
+            if errors.Is(err, service.ErrScopeNotGranted) || errors.Is(err, service.ErrUnsupportedGrantType) {
+                return c.Status(400).JSON(fiber.Map{
+                    "error": err.Error(),
+                })
+            }
+            return c.Status(500).JSON(fiber.Map{
+                "error": "Failed to create client",
+            })
+        }
+
+        return c.Status(201).JSON(fiber.Map{
+            "client":        client,
+            "client_secret": secret,
+        })
+    })
+
+    clients.Get("/", func(c *fiber.Ctx) error {
+        list, err := authService.ListOAuthClients()
+        if err != nil {
+            log.Printf("Failed to list OAuth clients: %v", err)
+            return c.Status(500).JSON(fiber.Map{
+                "error": "Failed to list OAuth clients",
+            })
+        }
+        return c.JSON(list)
+    })
+
+    clients.Delete("/:id", auditLog.Middleware("oauth_client.revoke"), func(c *fiber.Ctx) error {
+        if err := authService.RevokeOAuthClient(c.Params("id")); err != nil {
+            if errors.Is(err, service.ErrOAuthClientNotFound) {
+                return c.Status(404).JSON(fiber.Map{
+                    "error": "Client not found",
+                })
+            }
+            return c.Status(500).JSON(fiber.Map{
+                "error": "Failed to revoke client",
+            })
+        }
+
+        return c.JSON(fiber.Map{
+            "message": "Client revoked",
+        })
+    })
+
+    // Caddy forward_auth: 2xx lets the request through with the identity
+    // headers copied onto it, anything else is returned to the client.
+    // ?scope= and, for unsafe methods, ?write_scope= list comma-separated
+    // scope patterns the identity needs some scope within.
+    app.Get("/auths/forward", func(c *fiber.Ctx) error {
+        token := forwardedToken(c)
+        apiKey := c.Get(auth.APIKeyHeader)
+        if token == "" && apiKey == "" {
+            c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+            return c.Status(401).JSON(fiber.Map{
+                "error": "Missing credentials",
+            })
+        }
+
+        required := splitList(c.Query("scope"))
+        switch c.Get("X-Forwarded-Method", fiber.MethodGet) {
+        case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+        default:
+            required = append(required, splitList(c.Query("write_scope"))...)
+        }
+
+        claims, err := authService.ForwardAuth(token, apiKey, c.IP(), required)
+        if errors.Is(err, service.ErrScopeNotGranted) {
+            return c.Status(403).JSON(fiber.Map{
+                "error": "Insufficient scope",
+            })
+        }
+        if err != nil {
+            c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+            return c.Status(401).JSON(fiber.Map{
+                "error": "Invalid credentials",
+            })
+        }
+
+        c.Set("X-User", claims.Subject)
+        c.Set("X-Roles", strings.Join(claims.Roles, ","))
+        c.Set("X-Scopes", strings.Join(claims.Scopes, ","))
+        return c.SendStatus(200)
+    })
+
     port := os.Getenv("PORT")
     if port == "" {
         port = "8080"
     }
 
+    // Services and devices with client certificates connect here; the
+    // plain listener stays available behind the proxy
+    if cfg.MTLS.Enabled {
+        tlsConfig, err := authService.ServerTLSConfig(cfg.MTLS.ServerNames)
+        if err != nil {
+            log.Fatalf("Failed to configure mutual TLS: %v", err)
+        }
+        ln, err := tls.Listen("tcp", cfg.MTLS.Addr, tlsConfig)
+        if err != nil {
+            log.Fatalf("Failed to listen on %s: %v", cfg.MTLS.Addr, err)
+        }
+        go func() {
+            log.Fatal(app.Listener(ln))
+        }()
+    }
+
     log.Fatal(app.Listen(":" + port))
 }
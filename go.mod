@@ -1,24 +1,65 @@
 module github.com/Jeff-Barlow-Spady/edge-device-service
 
-go 1.21
+go 1.22.6
 
 require (
-    github.com/gofiber/fiber/v2 v2.51.0
-    github.com/prometheus/client_golang v1.17.0
-    github.com/rs/zerolog v1.31.0
-    github.com/spf13/viper v1.17.0
-    golang.org/x/crypto v0.15.0
-    gorm.io/gorm v1.25.5
-    gorm.io/driver/postgres v1.5.4
+	github.com/gofiber/fiber/v2 v2.51.0
+	github.com/prometheus/client_golang v1.17.0
+	github.com/rs/zerolog v1.31.0
+	github.com/spf13/viper v1.17.0
+	golang.org/x/crypto v0.15.0
+	gorm.io/driver/postgres v1.5.4
+	gorm.io/gorm v1.25.5
 )
 
+require (
+	periph.io/x/conn/v3 v3.7.1
+	periph.io/x/host/v3 v3.8.3
+)
 
 require (
-    periph.io/x/conn/v3 v3.7.1
-    periph.io/x/host/v3 v3.8.3
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/shirou/gopsutil/v3 v3.24.1
+	github.com/valyala/fasthttp v1.50.0
+	gorm.io/driver/sqlite v1.5.4
 )
 
 require (
-    github.com/dgrijalva/jwt-go v3.2.0+incompatible
-    github.com/shirou/gopsutil/v3 v3.24.1
+	github.com/andybalholm/brotli v1.0.5 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/fsnotify/fsnotify v1.6.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/google/uuid v1.4.0 // indirect
+	github.com/hashicorp/hcl v1.0.0 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
+	github.com/jackc/pgx/v5 v5.4.3 // indirect
+	github.com/jinzhu/inflection v1.0.0 // indirect
+	github.com/jinzhu/now v1.1.5 // indirect
+	github.com/klauspost/compress v1.17.0 // indirect
+	github.com/magiconair/properties v1.8.7 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/mattn/go-runewidth v0.0.15 // indirect
+	github.com/mattn/go-sqlite3 v1.14.17 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/mitchellh/mapstructure v1.5.0 // indirect
+	github.com/pelletier/go-toml/v2 v2.1.0 // indirect
+	github.com/prometheus/client_model v0.4.1-0.20230718164431-9a2bf3000d16 // indirect
+	github.com/prometheus/common v0.44.0 // indirect
+	github.com/prometheus/procfs v0.11.1 // indirect
+	github.com/rivo/uniseg v0.2.0 // indirect
+	github.com/sagikazarmark/slog-shim v0.1.0 // indirect
+	github.com/spf13/afero v1.10.0 // indirect
+	github.com/spf13/cast v1.5.1 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/subosito/gotenv v1.6.0 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/valyala/tcplisten v1.0.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+	gopkg.in/ini.v1 v1.67.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -6,6 +6,7 @@ require (
 	github.com/fasthttp/websocket v1.5.7
 	github.com/gofiber/fiber/v2 v2.52.0
 	github.com/prometheus/client_golang v1.18.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
 	github.com/valyala/fasthttp v1.51.0
 	periph.io/x/conn/v3 v3.7.1
 	periph.io/x/host/v3 v3.8.3
@@ -15,7 +16,9 @@ require (
 	github.com/andybalholm/brotli v1.1.0 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
 	github.com/google/uuid v1.5.0 // indirect
+	github.com/jonboulle/clockwork v0.4.0 // indirect
 	github.com/klauspost/compress v1.17.4 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
@@ -31,3 +34,7 @@ require (
 	golang.org/x/sys v0.17.0 // indirect
 	google.golang.org/protobuf v1.32.0 // indirect
 )
+
+require github.com/Jeff-Barlow-Spady/edge-device-service v0.0.0
+
+replace github.com/Jeff-Barlow-Spady/edge-device-service => ../
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/Jeff-Barlow-Spady/edge-device-service/pkg/audit"
+)
+
+// auditPinChange records a pin change requested over a WebSocket
+// connection, including denied and failed ones
+func (wsm *WebSocketManager) auditPinChange(client *wsClient, req request, outcome string, err error) {
+	if wsm.config.Audit == nil {
+		return
+	}
+
+	details := map[string]string{"transport": "websocket"}
+	switch req.Action {
+	case "write", "pulse":
+		value := req.Action == "pulse"
+		if req.Value != nil {
+			value = *req.Value
+		}
+		details["value"] = strconv.FormatBool(value)
+		if req.Action == "pulse" {
+			details["duration_ms"] = strconv.Itoa(req.DurationMS)
+		}
+	case "setup":
+		details["direction"] = req.Direction
+	case "pwm":
+		details["duty"] = strconv.FormatFloat(req.Duty, 'g', -1, 64)
+		details["frequency"] = strconv.FormatFloat(req.Frequency, 'g', -1, 64)
+	}
+	if err != nil {
+		details["error"] = err.Error()
+	}
+
+	if err := wsm.config.Audit.Record(audit.Event{
+		Actor:    client.subject(),
+		Action:   "pin." + req.Action,
+		Target:   strconv.Itoa(req.Pin),
+		SourceIP: client.remoteIP,
+		Outcome:  outcome,
+		Details:  details,
+	}); err != nil {
+		log.Printf("Failed to record audit event for pin %d: %v", req.Pin, err)
+	}
+}
+
+// outcomeOf classifies the result of a pin operation for the audit log
+func outcomeOf(err error) string {
+	if err != nil {
+		return audit.OutcomeFailure
+	}
+	return audit.OutcomeSuccess
+}
@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/Jeff-Barlow-Spady/edge-device-service/pkg/middleware/auth"
+)
+
+// Pin actions used in authorization scopes
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// PinScope returns the scope required to perform action on a pin, e.g.
+// "gpio:write:17"
+func PinScope(action string, pin int) string {
+	return fmt.Sprintf("gpio:%s:%d", action, pin)
+}
+
+// FilterPins returns the pins the identity is allowed to read
+func FilterPins(identity *auth.Identity, pins []PinInfo) []PinInfo {
+	visible := make([]PinInfo, 0, len(pins))
+	for _, pin := range pins {
+		if identity.HasScope(PinScope(ScopeRead, pin.Number)) {
+			visible = append(visible, pin)
+		}
+	}
+	return visible
+}
+
+// actionScope maps WebSocket actions on a single pin to the scope action
+// they require
+var actionScope = map[string]string{
+	"read":    ScopeRead,
+	"write":   ScopeWrite,
+	"setup":   ScopeWrite,
+	"release": ScopeWrite,
+	"pulse":   ScopeWrite,
+	"pwm":     ScopeWrite,
+}
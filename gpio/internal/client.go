@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Jeff-Barlow-Spady/edge-device-service/pkg/audit"
+	"github.com/Jeff-Barlow-Spady/edge-device-service/pkg/middleware/auth"
+	"github.com/fasthttp/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	wsQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "websocket_queue_depth",
+		Help: "Number of messages queued for delivery across all WebSocket connections",
+	})
+	wsDroppedMessages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "websocket_dropped_messages_total",
+			Help: "Number of outbound WebSocket messages dropped due to a full queue",
+		},
+		[]string{"policy"},
+	)
+	wsSlowClientDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "websocket_slow_client_disconnects_total",
+		Help: "Number of WebSocket clients disconnected because their queue overflowed",
+	})
+)
+
+// OverflowPolicy decides what happens when a client's outbound queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest discards the oldest queued event
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowCoalesce replaces a queued event for the same pin, falling
+	// back to dropping the oldest event
+	OverflowCoalesce OverflowPolicy = "coalesce"
+	// OverflowDisconnect closes the connection of a client that cannot keep up
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+// ParseOverflowPolicy validates an overflow policy name
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(name); policy {
+	case OverflowDropOldest, OverflowCoalesce, OverflowDisconnect:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid overflow policy: %s", name)
+	}
+}
+
+// WebSocketConfig controls per-connection queueing and keepalives
+type WebSocketConfig struct {
+	QueueSize    int
+	Overflow     OverflowPolicy
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Audit records pin changes made over connections; nil disables it
+	Audit *audit.Logger
+}
+
+// DefaultWebSocketConfig returns the configuration used by NewWebSocketManager
+func DefaultWebSocketConfig() WebSocketConfig {
+	return WebSocketConfig{
+		QueueSize:    64,
+		Overflow:     OverflowCoalesce,
+		PingInterval: 30 * time.Second,
+		PongTimeout:  60 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+// outbound is a message waiting in a client's queue. Messages with a pin of
+// -1 are responses and never coalesced or dropped.
+type outbound struct {
+	pin     int
+	payload interface{}
+}
+
+// wsClient is a connected WebSocket client with its subscription and a
+// bounded outbound queue drained by a dedicated writer goroutine
+type wsClient struct {
+	conn     *websocket.Conn
+	config   WebSocketConfig
+	identity *auth.Identity
+	remoteIP string
+
+	mu     sync.Mutex
+	sub    *subscription
+	queue  []outbound
+	closed bool
+
+	notify chan struct{}
+	done   chan struct{}
+}
+
+func newWSClient(conn *websocket.Conn, config WebSocketConfig) *wsClient {
+	return &wsClient{
+		conn:   conn,
+		config: config,
+		sub:    newSubscription(),
+		queue:  make([]outbound, 0, config.QueueSize),
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// subject returns the authenticated subject of the client, if any
+func (c *wsClient) subject() string {
+	if c.identity == nil {
+		return ""
+	}
+	return c.identity.Subject
+}
+
+// enqueue adds a message to the client's queue, applying the overflow
+// policy when the queue is full
+func (c *wsClient) enqueue(msg outbound) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+
+	if len(c.queue) >= c.config.QueueSize {
+		switch c.config.Overflow {
+		case OverflowDisconnect:
+			c.mu.Unlock()
+			wsSlowClientDisconnects.Inc()
+			c.close()
+			return
+		case OverflowCoalesce:
+			if c.coalesce(msg) {
+				c.mu.Unlock()
+				wsDroppedMessages.WithLabelValues(string(OverflowCoalesce)).Inc()
+				return
+			}
+			fallthrough
+		default:
+			// Responses are never dropped; a client whose queue holds
+			// nothing but responses is too slow to keep
+			if !c.dropOldestEvent() {
+				c.mu.Unlock()
+				wsSlowClientDisconnects.Inc()
+				c.close()
+				return
+			}
+			wsQueueDepth.Dec()
+			wsDroppedMessages.WithLabelValues(string(c.config.Overflow)).Inc()
+		}
+	}
+
+	c.queue = append(c.queue, msg)
+	wsQueueDepth.Inc()
+	c.mu.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// dropOldestEvent removes the oldest queued event, reporting false when
+// the queue holds only responses. The caller must hold c.mu.
+func (c *wsClient) dropOldestEvent() bool {
+	for i, queued := range c.queue {
+		if queued.pin >= 0 {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// coalesce replaces the most recent queued event for the same pin. The
+// caller must hold c.mu.
+func (c *wsClient) coalesce(msg outbound) bool {
+	if msg.pin < 0 {
+		return false
+	}
+	for i := len(c.queue) - 1; i >= 0; i-- {
+		if c.queue[i].pin == msg.pin {
+			c.queue[i] = msg
+			return true
+		}
+	}
+	return false
+}
+
+// dequeue removes and returns every queued message
+func (c *wsClient) dequeue() []outbound {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	msgs := c.queue
+	c.queue = make([]outbound, 0, c.config.QueueSize)
+	wsQueueDepth.Sub(float64(len(msgs)))
+	return msgs
+}
+
+// close stops the writer and closes the connection, which also unblocks
+// the reader
+func (c *wsClient) close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	wsQueueDepth.Sub(float64(len(c.queue)))
+	c.queue = nil
+	c.mu.Unlock()
+
+	close(c.done)
+	c.conn.Close()
+}
+
+// writePump is the only goroutine that writes to the connection. It
+// drains the queue and sends pings until the client is closed.
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.notify:
+			for _, msg := range c.dequeue() {
+				c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+				if err := c.conn.WriteJSON(msg.payload); err != nil {
+					c.close()
+					return
+				}
+			}
+		case <-ticker.C:
+			deadline := time.Now().Add(c.config.WriteTimeout)
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
@@ -1,17 +1,66 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"sync"
+	"time"
 
 	"periph.io/x/conn/v3/gpio"
 	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/conn/v3/physic"
 	"periph.io/x/host/v3"
 )
 
-// GPIOCallback is a function type for GPIO state change callbacks
-type GPIOCallback func(pin int, value bool)
+// Errors returned by GPIOManager, wrapped with the pin number
+var (
+	ErrPinNotFound      = errors.New("pin not found")
+	ErrPinNotConfigured = errors.New("pin not configured")
+	ErrWrongDirection   = errors.New("pin configured for the wrong direction")
+	ErrInvalidArgument  = errors.New("invalid argument")
+)
+
+// MaxPulseDuration bounds the duration accepted by PulsePin
+const MaxPulseDuration = time.Minute
+
+// edgeWaitTimeout bounds how long an edge watcher blocks before checking
+// whether its pin has been reconfigured
+const edgeWaitTimeout = 500 * time.Millisecond
+
+// EventType classifies the events emitted by the GPIO manager
+type EventType string
+
+const (
+	// EventEdge is emitted when an input pin changes level
+	EventEdge EventType = "edge"
+	// EventWrite is emitted when an output pin is written
+	EventWrite EventType = "write"
+	// EventPWM is emitted when a PWM output changes
+	EventPWM EventType = "pwm"
+	// EventWatchdog is emitted when a watchdog acts on a pin
+	EventWatchdog EventType = "watchdog"
+	// EventSystem is emitted for pin configuration and lifecycle changes
+	EventSystem EventType = "system"
+)
+
+// Event describes a single GPIO event delivered to callbacks
+type Event struct {
+	Type      EventType `json:"event"`
+	Pin       int       `json:"pin"`
+	Value     bool      `json:"value"`
+	Duty      float64   `json:"duty,omitempty"`
+	Frequency float64   `json:"frequency,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// GPIOCallback is a function type for GPIO event callbacks. Callbacks run
+// synchronously in event order while the manager's lock is held, so they
+// must not block or call back into the manager.
+type GPIOCallback func(event Event)
 
 // gpioOperations represents the possible operations on a GPIO pin
 type gpioOperations struct {
@@ -24,6 +73,28 @@ type gpioState struct {
 	pin       gpio.PinIO
 	direction string
 	value     bool
+	duty      float64
+	frequency float64
+	stop      chan struct{}
+	// pulse reverts the pin at the end of a pulse until stopped
+	pulse *time.Timer
+}
+
+// stopPulse cancels a pending pulse revert. The caller must hold gm.mu.
+func (s *gpioState) stopPulse() {
+	if s.pulse != nil {
+		s.pulse.Stop()
+		s.pulse = nil
+	}
+}
+
+// PinInfo describes a configured pin as reported by ListPins
+type PinInfo struct {
+	Number    int     `json:"number"`
+	Direction string  `json:"direction"`
+	Value     bool    `json:"value"`
+	Duty      float64 `json:"duty,omitempty"`
+	Frequency float64 `json:"frequency,omitempty"`
 }
 
 // GPIOManager manages GPIO pins and their states
@@ -46,54 +117,104 @@ func NewGPIOManager() *GPIOManager {
 	}
 }
 
-// SetupPin configures a GPIO pin with the specified direction
-func (gm *GPIOManager) SetupPin(pinNumber int, direction string) error {
+// SetupPin configures a GPIO pin with the specified direction on behalf
+// of actor
+func (gm *GPIOManager) SetupPin(pinNumber int, direction, actor string) error {
 	gm.mu.Lock()
 	defer gm.mu.Unlock()
 
 	// Get the GPIO pin
 	pin := gpioreg.ByName(fmt.Sprintf("GPIO%d", pinNumber))
 	if pin == nil {
-		return fmt.Errorf("failed to find pin %d", pinNumber)
+		return fmt.Errorf("%w: %d", ErrPinNotFound, pinNumber)
 	}
 
 	var err error
 	switch direction {
 	case "in":
-		err = pin.In(gpio.PullUp, gpio.NoEdge)
+		err = pin.In(gpio.PullUp, gpio.BothEdges)
 	case "out":
 		err = pin.Out(gpio.Low)
 	default:
-		return fmt.Errorf("invalid direction: %s", direction)
+		return fmt.Errorf("%w: direction %q", ErrInvalidArgument, direction)
 	}
 
 	if err != nil {
 		return fmt.Errorf("failed to set pin direction: %v", err)
 	}
 
-	gm.pins[pinNumber] = &gpioState{
+	// The previous configuration is only torn down once the new one is in
+	// place, so a failed setup leaves it managed as before
+	if prev, exists := gm.pins[pinNumber]; exists {
+		prev.stopPulse()
+		if prev.stop != nil {
+			close(prev.stop)
+		}
+	}
+
+	state := &gpioState{
 		pin:       pin,
 		direction: direction,
 		value:     false,
 	}
+	if direction == "in" {
+		state.stop = make(chan struct{})
+		go gm.watchEdges(pinNumber, pin, state.stop)
+	}
+	gm.pins[pinNumber] = state
 
+	gm.notifyCallbacks(Event{
+		Type:      EventSystem,
+		Pin:       pinNumber,
+		Message:   "configured as " + direction,
+		Actor:     actor,
+		Timestamp: time.Now(),
+	})
 	return nil
 }
 
-// WritePin sets the value of a GPIO pin
-func (gm *GPIOManager) WritePin(pinNumber int, value bool) error {
+// watchEdges emits edge events for an input pin until stop is closed
+func (gm *GPIOManager) watchEdges(pinNumber int, pin gpio.PinIO, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if !pin.WaitForEdge(edgeWaitTimeout) {
+			continue
+		}
+
+		gm.mu.RLock()
+		gm.notifyCallbacks(Event{
+			Type:      EventEdge,
+			Pin:       pinNumber,
+			Value:     pin.Read() == gpio.High,
+			Timestamp: time.Now(),
+		})
+		gm.mu.RUnlock()
+	}
+}
+
+// WritePin sets the value of a GPIO pin on behalf of actor, cancelling any
+// pulse in progress
+func (gm *GPIOManager) WritePin(pinNumber int, value bool, actor string) error {
 	gm.mu.Lock()
 	defer gm.mu.Unlock()
 
-	state, exists := gm.pins[pinNumber]
-	if !exists {
-		return fmt.Errorf("pin %d not configured", pinNumber)
+	state, err := gm.outputPin(pinNumber)
+	if err != nil {
+		return err
 	}
 
-	if state.direction != "out" {
-		return fmt.Errorf("pin %d not configured for output", pinNumber)
-	}
+	state.stopPulse()
+	return gm.writePin(pinNumber, state, value, actor)
+}
 
+// writePin drives an output pin and notifies callbacks. The caller must
+// hold gm.mu.
+func (gm *GPIOManager) writePin(pinNumber int, state *gpioState, value bool, actor string) error {
 	level := gpio.Low
 	if value {
 		level = gpio.High
@@ -104,7 +225,16 @@ func (gm *GPIOManager) WritePin(pinNumber int, value bool) error {
 	}
 
 	state.value = value
-	gm.notifyCallbacks(pinNumber, value)
+	state.duty = 0
+	state.frequency = 0
+	log.Printf("Pin %d set to %v by %s", pinNumber, value, actorName(actor))
+	gm.notifyCallbacks(Event{
+		Type:      EventWrite,
+		Pin:       pinNumber,
+		Value:     value,
+		Actor:     actor,
+		Timestamp: time.Now(),
+	})
 	return nil
 }
 
@@ -115,16 +245,165 @@ func (gm *GPIOManager) ReadPin(pinNumber int) (bool, error) {
 
 	state, exists := gm.pins[pinNumber]
 	if !exists {
-		return false, fmt.Errorf("pin %d not configured", pinNumber)
+		return false, fmt.Errorf("%w: %d", ErrPinNotConfigured, pinNumber)
 	}
 
 	if state.direction != "in" {
-		return false, fmt.Errorf("pin %d not configured for input", pinNumber)
+		return false, fmt.Errorf("%w: pin %d is not an input", ErrWrongDirection, pinNumber)
 	}
 
 	return state.pin.Read() == gpio.High, nil
 }
 
+// ReleasePin stops managing a pin and returns it to a floating input
+func (gm *GPIOManager) ReleasePin(pinNumber int, actor string) error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	state, exists := gm.pins[pinNumber]
+	if !exists {
+		return fmt.Errorf("%w: %d", ErrPinNotConfigured, pinNumber)
+	}
+
+	state.stopPulse()
+	if state.stop != nil {
+		close(state.stop)
+	}
+	delete(gm.pins, pinNumber)
+
+	if err := state.pin.In(gpio.Float, gpio.NoEdge); err != nil {
+		return fmt.Errorf("failed to release pin: %v", err)
+	}
+
+	gm.notifyCallbacks(Event{
+		Type:      EventSystem,
+		Pin:       pinNumber,
+		Message:   "released",
+		Actor:     actor,
+		Timestamp: time.Now(),
+	})
+	return nil
+}
+
+// ListPins returns the configuration and current value of every managed pin
+func (gm *GPIOManager) ListPins() []PinInfo {
+	gm.mu.RLock()
+	defer gm.mu.RUnlock()
+
+	pins := make([]PinInfo, 0, len(gm.pins))
+	for number, state := range gm.pins {
+		value := state.value
+		if state.direction == "in" {
+			value = state.pin.Read() == gpio.High
+		}
+		pins = append(pins, PinInfo{
+			Number:    number,
+			Direction: state.direction,
+			Value:     value,
+			Duty:      state.duty,
+			Frequency: state.frequency,
+		})
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Number < pins[j].Number })
+	return pins
+}
+
+// PulsePin drives an output pin to value for duration and then back to the
+// opposite level. It returns once the pulse has started. A pin has at most
+// one pulse pending: a new pulse replaces it, and writing, PWM, setting up
+// or releasing the pin cancel it.
+func (gm *GPIOManager) PulsePin(pinNumber int, value bool, duration time.Duration, actor string) error {
+	if duration <= 0 || duration > MaxPulseDuration {
+		return fmt.Errorf("%w: pulse duration must be between 0 and %s", ErrInvalidArgument, MaxPulseDuration)
+	}
+
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	state, err := gm.outputPin(pinNumber)
+	if err != nil {
+		return err
+	}
+
+	state.stopPulse()
+	if err := gm.writePin(pinNumber, state, value, actor); err != nil {
+		return err
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		gm.mu.Lock()
+		defer gm.mu.Unlock()
+
+		// A timer that fired while being stopped must not revert a later
+		// write
+		if state.pulse != timer || gm.pins[pinNumber] != state {
+			return
+		}
+		state.pulse = nil
+		if err := gm.writePin(pinNumber, state, !value, actor); err != nil {
+			log.Printf("Failed to end pulse on pin %d: %v", pinNumber, err)
+		}
+	})
+	state.pulse = timer
+	return nil
+}
+
+// SetPWM drives an output pin with a PWM signal on behalf of actor. duty
+// is a fraction between 0 and 1 and frequency is in hertz.
+func (gm *GPIOManager) SetPWM(pinNumber int, duty, frequency float64, actor string) error {
+	if duty < 0 || duty > 1 {
+		return fmt.Errorf("%w: duty must be between 0 and 1", ErrInvalidArgument)
+	}
+	if frequency <= 0 {
+		return fmt.Errorf("%w: frequency must be positive", ErrInvalidArgument)
+	}
+
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	state, err := gm.outputPin(pinNumber)
+	if err != nil {
+		return err
+	}
+
+	state.stopPulse()
+	d := gpio.Duty(duty * float64(gpio.DutyMax))
+	f := physic.Frequency(frequency * float64(physic.Hertz))
+	if err := state.pin.PWM(d, f); err != nil {
+		return fmt.Errorf("failed to set PWM: %v", err)
+	}
+
+	state.value = duty > 0
+	state.duty = duty
+	state.frequency = frequency
+	log.Printf("Pin %d PWM set to %.3f at %.1f Hz by %s", pinNumber, duty, frequency, actorName(actor))
+	gm.notifyCallbacks(Event{
+		Type:      EventPWM,
+		Pin:       pinNumber,
+		Value:     state.value,
+		Duty:      duty,
+		Frequency: frequency,
+		Actor:     actor,
+		Timestamp: time.Now(),
+	})
+	return nil
+}
+
+// outputPin returns the state of a pin configured for output. The caller
+// must hold gm.mu.
+func (gm *GPIOManager) outputPin(pinNumber int) (*gpioState, error) {
+	state, exists := gm.pins[pinNumber]
+	if !exists {
+		return nil, fmt.Errorf("%w: %d", ErrPinNotConfigured, pinNumber)
+	}
+
+	if state.direction != "out" {
+		return nil, fmt.Errorf("%w: pin %d is not an output", ErrWrongDirection, pinNumber)
+	}
+	return state, nil
+}
+
 // RegisterCallback registers a callback function for GPIO state changes
 func (gm *GPIOManager) RegisterCallback(callback GPIOCallback) {
 	gm.mu.Lock()
@@ -132,11 +411,21 @@ func (gm *GPIOManager) RegisterCallback(callback GPIOCallback) {
 	gm.callbacks = append(gm.callbacks, callback)
 }
 
-// notifyCallbacks notifies all registered callbacks of a GPIO state change
-func (gm *GPIOManager) notifyCallbacks(pin int, value bool) {
+// notifyCallbacks notifies all registered callbacks of a GPIO event.
+// They are called in turn rather than from goroutines, so that events for
+// a pin reach them in the order they happened. The caller must hold gm.mu.
+func (gm *GPIOManager) notifyCallbacks(event Event) {
 	for _, callback := range gm.callbacks {
-		go callback(pin, value)
+		callback(event)
+	}
+}
+
+// actorName formats an actor for log messages
+func actorName(actor string) string {
+	if actor == "" {
+		return "unknown"
 	}
+	return actor
 }
 
 // boolToFloat64 converts a boolean to a float64 (1.0 for true, 0.0 for false)
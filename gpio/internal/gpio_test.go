@@ -1,7 +1,16 @@
 package internal
 
 import (
+	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/Jeff-Barlow-Spady/edge-device-service/pkg/middleware/auth"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/conn/v3/gpio/gpiotest"
 )
 
 func TestNewGPIOManager(t *testing.T) {
@@ -15,13 +24,13 @@ func TestPinOperations(t *testing.T) {
 	manager := NewGPIOManager()
 
 	// Test pin setup
-	err := manager.SetupPin(18, "out")
+	err := manager.SetupPin(18, "out", "test")
 	if err != nil {
 		t.Logf("SetupPin error (expected on non-Pi hardware): %v", err)
 	}
 
 	// Test pin write
-	err = manager.WritePin(18, true)
+	err = manager.WritePin(18, true, "test")
 	if err != nil {
 		t.Logf("WritePin error (expected on non-Pi hardware): %v", err)
 	}
@@ -40,3 +49,306 @@ func TestWebSocketManager(t *testing.T) {
 		t.Error("Expected non-nil WebSocket manager")
 	}
 }
+
+func TestSubscriptionFilter(t *testing.T) {
+	sub := newSubscription()
+	now := time.Now()
+
+	if ok, _ := sub.allow(Event{Type: EventWrite, Pin: 4, Timestamp: now}); !ok {
+		t.Error("Expected new subscription to receive every event")
+	}
+
+	rate := 1.0
+	if err := sub.subscribe([]int{17, 18}, []EventType{EventEdge}, &rate); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	if ok, _ := sub.allow(Event{Type: EventEdge, Pin: 4, Timestamp: now}); ok {
+		t.Error("Expected first subscribe to replace the implicit subscription")
+	}
+	if err := sub.unsubscribe([]int{18}, nil); err != nil {
+		t.Fatalf("unsubscribe failed: %v", err)
+	}
+	if ok, _ := sub.allow(Event{Type: EventEdge, Pin: 18, Timestamp: now}); ok {
+		t.Error("Expected pin 18 to be filtered")
+	}
+	if ok, _ := sub.allow(Event{Type: EventWrite, Pin: 17, Timestamp: now}); ok {
+		t.Error("Expected write events to be filtered")
+	}
+	if ok, _ := sub.allow(Event{Type: EventEdge, Pin: 17, Timestamp: now}); !ok {
+		t.Error("Expected edge event on pin 17 to be delivered")
+	}
+	if ok, _ := sub.allow(Event{Type: EventEdge, Pin: 17, Timestamp: now.Add(100 * time.Millisecond)}); ok {
+		t.Error("Expected rate limit to hold back the second event")
+	}
+	if ok, _ := sub.allow(Event{Type: EventEdge, Pin: 17, Timestamp: now.Add(time.Second)}); !ok {
+		t.Error("Expected event after the rate interval to be delivered")
+	}
+
+	if err := sub.subscribe(nil, []EventType{"bogus"}, nil); err == nil {
+		t.Error("Expected error for unknown event type")
+	}
+}
+
+func TestSubscriptionFlushesTrailingEvent(t *testing.T) {
+	sub := newSubscription()
+	rate := 1.0
+	if err := sub.subscribe([]int{17, 18}, nil, &rate); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	now := time.Now()
+
+	if ok, _ := sub.allow(Event{Type: EventEdge, Pin: 17, Value: false, Timestamp: now}); !ok {
+		t.Fatal("Expected the first event to be delivered")
+	}
+	ok, flushIn := sub.allow(Event{Type: EventEdge, Pin: 17, Value: true, Timestamp: now.Add(100 * time.Millisecond)})
+	if ok || flushIn != 900*time.Millisecond {
+		t.Errorf("Expected the event to be held back for 900ms, got %v, %v", ok, flushIn)
+	}
+	// Later events replace the pending one without another flush
+	ok, flushIn = sub.allow(Event{Type: EventEdge, Pin: 17, Value: false, Timestamp: now.Add(200 * time.Millisecond)})
+	if ok || flushIn != 0 {
+		t.Errorf("Expected the pending event to be replaced, got %v, %v", ok, flushIn)
+	}
+
+	event, ok := sub.flush(17, now.Add(time.Second))
+	if !ok || event.Timestamp != now.Add(200*time.Millisecond) {
+		t.Fatalf("Expected the latest held back event, got %+v, %v", event, ok)
+	}
+	if _, ok := sub.flush(17, now.Add(time.Second)); ok {
+		t.Error("Expected nothing left to flush")
+	}
+	if ok, _ := sub.allow(Event{Type: EventEdge, Pin: 17, Timestamp: now.Add(1500 * time.Millisecond)}); ok {
+		t.Error("Expected the flush to count against the rate limit")
+	}
+
+	// Pins unsubscribed in the meantime are not flushed
+	sub.allow(Event{Type: EventEdge, Pin: 18, Timestamp: now})
+	sub.allow(Event{Type: EventEdge, Pin: 18, Timestamp: now.Add(100 * time.Millisecond)})
+	if err := sub.unsubscribe([]int{18}, nil); err != nil {
+		t.Fatalf("unsubscribe failed: %v", err)
+	}
+	if _, ok := sub.flush(18, now.Add(time.Second)); ok {
+		t.Error("Expected no flush for an unsubscribed pin")
+	}
+}
+
+func TestBroadcastFlushesRateLimitedEvent(t *testing.T) {
+	wsManager := NewWebSocketManager(NewGPIOManager())
+	client := newWSClient(nil, DefaultWebSocketConfig())
+	client.identity = &auth.Identity{Scopes: []string{"*"}}
+	rate := 20.0
+	client.sub.subscribe(nil, nil, &rate)
+	wsManager.mu.Lock()
+	wsManager.clients[client] = true
+	wsManager.mu.Unlock()
+
+	now := time.Now()
+	wsManager.broadcastEvent(Event{Type: EventEdge, Pin: 17, Value: true, Timestamp: now})
+	wsManager.broadcastEvent(Event{Type: EventEdge, Pin: 17, Value: false, Timestamp: now})
+
+	deadline := time.Now().Add(time.Second)
+	var msgs []outbound
+	for len(msgs) < 2 && time.Now().Before(deadline) {
+		msgs = append(msgs, client.dequeue()...)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("Expected the held back event to be flushed, got %d messages", len(msgs))
+	}
+	var last Event
+	data, _ := json.Marshal(msgs[1].payload)
+	if err := json.Unmarshal(data, &last); err != nil || last.Pin != 17 || last.Value {
+		t.Errorf("Expected the flushed event to carry the latest value, got %s", data)
+	}
+}
+
+func TestClientQueueOverflow(t *testing.T) {
+	config := DefaultWebSocketConfig()
+	config.QueueSize = 2
+
+	config.Overflow = OverflowDropOldest
+	client := newWSClient(nil, config)
+	client.enqueue(outbound{pin: 1, payload: "a"})
+	client.enqueue(outbound{pin: 2, payload: "b"})
+	client.enqueue(outbound{pin: 3, payload: "c"})
+	msgs := client.dequeue()
+	if len(msgs) != 2 || msgs[0].payload != "b" || msgs[1].payload != "c" {
+		t.Errorf("Expected oldest message to be dropped, got %v", msgs)
+	}
+
+	client = newWSClient(nil, config)
+	client.enqueue(outbound{pin: -1, payload: "reply"})
+	client.enqueue(outbound{pin: 1, payload: "a"})
+	client.enqueue(outbound{pin: 2, payload: "b"})
+	msgs = client.dequeue()
+	if len(msgs) != 2 || msgs[0].payload != "reply" || msgs[1].payload != "b" {
+		t.Errorf("Expected the oldest event to be dropped instead of the reply, got %v", msgs)
+	}
+
+	config.Overflow = OverflowCoalesce
+	client = newWSClient(nil, config)
+	client.enqueue(outbound{pin: 1, payload: "a"})
+	client.enqueue(outbound{pin: 2, payload: "b"})
+	client.enqueue(outbound{pin: 1, payload: "c"})
+	msgs = client.dequeue()
+	if len(msgs) != 2 || msgs[0].payload != "c" || msgs[1].payload != "b" {
+		t.Errorf("Expected pin 1 event to be coalesced, got %v", msgs)
+	}
+
+	client = newWSClient(nil, config)
+	client.enqueue(outbound{pin: 1, payload: "a"})
+	client.enqueue(outbound{pin: -1, payload: "reply"})
+	client.enqueue(outbound{pin: -1, payload: "reply2"})
+	msgs = client.dequeue()
+	if len(msgs) != 2 || msgs[0].payload != "reply" || msgs[1].payload != "reply2" {
+		t.Errorf("Expected replies to be kept when the queue overflows, got %v", msgs)
+	}
+
+	if _, err := ParseOverflowPolicy("bogus"); err == nil {
+		t.Error("Expected error for unknown overflow policy")
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		code    ErrorCode
+	}{
+		{"valid write", `{"version":1,"id":"a1","action":"write","pin":17,"value":true}`, ""},
+		{"legacy read", `{"action":"read","pin":4}`, ""},
+		{"invalid json", `{"action":`, CodeInvalidJSON},
+		{"unknown action", `{"id":"a2","action":"explode","pin":4}`, CodeUnknownAction},
+		{"future version", `{"version":2,"id":"a3","action":"list"}`, CodeUnsupportedVersion},
+		{"missing value", `{"id":"a4","action":"write","pin":17}`, CodeInvalidMessage},
+		{"pin out of range", `{"action":"read","pin":99}`, CodeInvalidMessage},
+		{"bad duty", `{"action":"pwm","pin":18,"duty":1.5,"frequency":1000}`, CodeInvalidMessage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, perr := decodeRequest([]byte(tt.message))
+			if tt.code == "" {
+				if perr != nil {
+					t.Fatalf("Expected valid request, got %v", perr)
+				}
+				return
+			}
+			if perr == nil || perr.Code != tt.code {
+				t.Fatalf("Expected error code %s, got %v", tt.code, perr)
+			}
+			if tt.code != CodeInvalidJSON && strings.Contains(tt.message, `"id"`) && req.ID == "" {
+				t.Error("Expected request ID to be preserved on error")
+			}
+		})
+	}
+}
+
+func TestWriteDuringPulse(t *testing.T) {
+	pin := &gpiotest.Pin{N: "GPIO90", Num: 90}
+	if err := gpioreg.Register(pin); err != nil {
+		t.Fatalf("Failed to register test pin: %v", err)
+	}
+	t.Cleanup(func() { gpioreg.Unregister(pin.N) })
+	manager := NewGPIOManager()
+	if err := manager.SetupPin(90, "out", "test"); err != nil {
+		t.Fatalf("SetupPin failed: %v", err)
+	}
+
+	if err := manager.PulsePin(90, true, 20*time.Millisecond, "test"); err != nil {
+		t.Fatalf("PulsePin failed: %v", err)
+	}
+	if err := manager.WritePin(90, true, "test"); err != nil {
+		t.Fatalf("WritePin failed: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	if level := pin.Read(); level != gpio.High {
+		t.Errorf("Expected the write during the pulse to hold the pin high, got %v", level)
+	}
+	if pins := manager.ListPins(); len(pins) != 1 || !pins[0].Value {
+		t.Errorf("Expected pin 90 to be reported high, got %+v", pins)
+	}
+
+	// A pulse that is left alone still reverts
+	if err := manager.PulsePin(90, false, 20*time.Millisecond, "test"); err != nil {
+		t.Fatalf("PulsePin failed: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if level := pin.Read(); level != gpio.High {
+		t.Errorf("Expected the pulse to revert the pin high, got %v", level)
+	}
+}
+
+func TestFailedSetupKeepsPin(t *testing.T) {
+	pin := &gpiotest.Pin{N: "GPIO91", Num: 91, EdgesChan: make(chan gpio.Level)}
+	if err := gpioreg.Register(pin); err != nil {
+		t.Fatalf("Failed to register test pin: %v", err)
+	}
+	t.Cleanup(func() { gpioreg.Unregister(pin.N) })
+	manager := NewGPIOManager()
+
+	if err := manager.SetupPin(91, "in", "test"); err != nil {
+		t.Fatalf("SetupPin failed: %v", err)
+	}
+	if err := manager.SetupPin(91, "sideways", "test"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("Expected ErrInvalidArgument, got %v", err)
+	}
+	if pins := manager.ListPins(); len(pins) != 1 || pins[0].Direction != "in" {
+		t.Errorf("Expected pin 91 to stay an input, got %+v", pins)
+	}
+
+	// Releasing after the failed setup must not close the watcher twice
+	if err := manager.ReleasePin(91, "test"); err != nil {
+		t.Fatalf("ReleasePin failed: %v", err)
+	}
+
+	// A pin that cannot watch edges fails to become an input
+	output := &gpiotest.Pin{N: "GPIO92", Num: 92}
+	if err := gpioreg.Register(output); err != nil {
+		t.Fatalf("Failed to register test pin: %v", err)
+	}
+	t.Cleanup(func() { gpioreg.Unregister(output.N) })
+	if err := manager.SetupPin(92, "out", "test"); err != nil {
+		t.Fatalf("SetupPin failed: %v", err)
+	}
+	if err := manager.SetupPin(92, "in", "test"); err == nil {
+		t.Fatal("Expected setup as input to fail without edge support")
+	}
+	if err := manager.ReleasePin(92, "test"); err != nil {
+		t.Fatalf("ReleasePin failed: %v", err)
+	}
+}
+
+func TestCallbacksInOrder(t *testing.T) {
+	pin := &gpiotest.Pin{N: "GPIO93", Num: 93}
+	if err := gpioreg.Register(pin); err != nil {
+		t.Fatalf("Failed to register test pin: %v", err)
+	}
+	t.Cleanup(func() { gpioreg.Unregister(pin.N) })
+	manager := NewGPIOManager()
+	if err := manager.SetupPin(93, "out", "test"); err != nil {
+		t.Fatalf("SetupPin failed: %v", err)
+	}
+
+	var values []bool
+	manager.RegisterCallback(func(event Event) {
+		if event.Type == EventWrite {
+			values = append(values, event.Value)
+		}
+	})
+	for i := 0; i < 100; i++ {
+		if err := manager.WritePin(93, i%2 == 0, "test"); err != nil {
+			t.Fatalf("WritePin failed: %v", err)
+		}
+	}
+
+	if len(values) != 100 {
+		t.Fatalf("Expected 100 write events, got %d", len(values))
+	}
+	for i, value := range values {
+		if value != (i%2 == 0) {
+			t.Fatalf("Expected write events in order, event %d was %v", i, value)
+		}
+	}
+}
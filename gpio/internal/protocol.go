@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ProtocolVersion is the current version of the /ws/gpio message envelope
+const ProtocolVersion = 1
+
+//go:embed protocol.schema.json
+var protocolSchemaJSON string
+
+// ProtocolSchema is the JSON Schema every client message is validated against
+var ProtocolSchema = jsonschema.MustCompileString("protocol.schema.json", protocolSchemaJSON)
+
+// ErrorCode is a machine-readable error code sent in error replies
+type ErrorCode string
+
+const (
+	CodeInvalidJSON        ErrorCode = "invalid_json"
+	CodeInvalidMessage     ErrorCode = "invalid_message"
+	CodeUnsupportedVersion ErrorCode = "unsupported_version"
+	CodeUnknownAction      ErrorCode = "unknown_action"
+	CodePinNotFound        ErrorCode = "pin_not_found"
+	CodePinNotConfigured   ErrorCode = "pin_not_configured"
+	CodeWrongDirection     ErrorCode = "wrong_direction"
+	CodeInvalidArgument    ErrorCode = "invalid_argument"
+	CodeHardwareError      ErrorCode = "hardware_error"
+	CodeForbidden          ErrorCode = "forbidden"
+)
+
+// protocolError is an error with the code reported to the client
+type protocolError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *protocolError) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// request is a decoded client message
+type request struct {
+	Version    int         `json:"version"`
+	ID         string      `json:"id"`
+	Action     string      `json:"action"`
+	Pin        int         `json:"pin"`
+	Value      *bool       `json:"value"`
+	Direction  string      `json:"direction"`
+	DurationMS int         `json:"duration_ms"`
+	Duty       float64     `json:"duty"`
+	Frequency  float64     `json:"frequency"`
+	Pins       []int       `json:"pins"`
+	Events     []EventType `json:"events"`
+	MaxRate    *float64    `json:"max_rate"`
+}
+
+// reply is the envelope for responses to client requests
+type reply struct {
+	Version      int               `json:"version"`
+	ID           string            `json:"id,omitempty"`
+	Status       string            `json:"status"`
+	Action       string            `json:"action,omitempty"`
+	Pin          *int              `json:"pin,omitempty"`
+	Value        *bool             `json:"value,omitempty"`
+	Direction    string            `json:"direction,omitempty"`
+	Duty         *float64          `json:"duty,omitempty"`
+	Frequency    float64           `json:"frequency,omitempty"`
+	DurationMS   int               `json:"duration_ms,omitempty"`
+	Pins         *[]PinInfo        `json:"pins,omitempty"`
+	Subscription *subscriptionInfo `json:"subscription,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	Code         ErrorCode         `json:"code,omitempty"`
+}
+
+// knownActions lists the actions accepted on /ws/gpio
+var knownActions = map[string]bool{
+	"read": true, "write": true, "setup": true, "release": true, "list": true,
+	"pulse": true, "pwm": true, "subscribe": true, "unsubscribe": true,
+}
+
+// decodeRequest parses and validates a client message. The returned request
+// carries the client's ID even when validation fails so errors can be
+// correlated.
+func decodeRequest(message []byte) (request, *protocolError) {
+	var req request
+
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return req, &protocolError{Code: CodeInvalidJSON, Message: "Invalid JSON format"}
+	}
+
+	fields, ok := doc.(map[string]interface{})
+	if !ok {
+		return req, &protocolError{Code: CodeInvalidMessage, Message: "message must be a JSON object"}
+	}
+	if id, ok := fields["id"].(string); ok {
+		req.ID = id
+	}
+	if action, ok := fields["action"].(string); ok {
+		req.Action = action
+	}
+
+	if v, ok := fields["version"]; ok {
+		if n, ok := v.(json.Number); !ok || n.String() != strconv.Itoa(ProtocolVersion) {
+			return req, &protocolError{
+				Code:    CodeUnsupportedVersion,
+				Message: fmt.Sprintf("unsupported protocol version %v, server speaks %d", v, ProtocolVersion),
+			}
+		}
+	}
+
+	if req.Action != "" && !knownActions[req.Action] {
+		return req, &protocolError{Code: CodeUnknownAction, Message: "unknown action: " + req.Action}
+	}
+
+	if err := ProtocolSchema.Validate(doc); err != nil {
+		return req, &protocolError{Code: CodeInvalidMessage, Message: schemaErrorMessage(err)}
+	}
+
+	id, action := req.ID, req.Action
+	if err := json.Unmarshal(message, &req); err != nil {
+		return request{ID: id, Action: action}, &protocolError{Code: CodeInvalidMessage, Message: err.Error()}
+	}
+	req.Version = ProtocolVersion
+	return req, nil
+}
+
+// schemaErrorMessage reduces a schema validation error to its most specific
+// cause
+func schemaErrorMessage(err error) string {
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err.Error()
+	}
+	for len(ve.Causes) > 0 {
+		ve = ve.Causes[0]
+	}
+	location := ve.InstanceLocation
+	if location == "" {
+		location = "/"
+	}
+	return location + ": " + ve.Message
+}
+
+// toProtocolError maps errors from GPIOManager to protocol error codes
+func toProtocolError(err error) *protocolError {
+	var perr *protocolError
+	if errors.As(err, &perr) {
+		return perr
+	}
+
+	code := CodeHardwareError
+	switch {
+	case errors.Is(err, ErrPinNotFound):
+		code = CodePinNotFound
+	case errors.Is(err, ErrPinNotConfigured):
+		code = CodePinNotConfigured
+	case errors.Is(err, ErrWrongDirection):
+		code = CodeWrongDirection
+	case errors.Is(err, ErrInvalidArgument):
+		code = CodeInvalidArgument
+	}
+	return &protocolError{Code: code, Message: err.Error()}
+}
@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// allEventTypes lists every event type a client may subscribe to
+var allEventTypes = []EventType{EventEdge, EventWrite, EventPWM, EventWatchdog, EventSystem}
+
+// subscription tracks which events a WebSocket client wants to receive.
+// A nil pin or event set matches everything. New connections start with an
+// implicit subscription to everything so that clients that never subscribe
+// keep receiving all events; the first subscribe replaces it.
+type subscription struct {
+	implicit bool
+	pins     map[int]bool
+	excluded map[int]bool
+	events   map[EventType]bool
+	interval time.Duration
+	lastSent map[int]time.Time
+	// pending holds the latest event per pin held back by the rate limit,
+	// delivered by flush once the interval has passed
+	pending map[int]Event
+}
+
+// subscriptionInfo is the client-facing view of a subscription
+type subscriptionInfo struct {
+	Pins     []int       `json:"pins"`
+	Excluded []int       `json:"excluded,omitempty"`
+	Events   []EventType `json:"events"`
+	MaxRate  float64     `json:"max_rate,omitempty"`
+}
+
+func newSubscription() *subscription {
+	return &subscription{
+		implicit: true,
+		excluded: make(map[int]bool),
+		lastSent: make(map[int]time.Time),
+		pending:  make(map[int]Event),
+	}
+}
+
+// subscribe widens the subscription. An empty pin list subscribes to every
+// pin; a non-empty event list replaces the event filter; maxRate, when set,
+// replaces the per-pin rate limit (0 removes it).
+func (s *subscription) subscribe(pins []int, events []EventType, maxRate *float64) error {
+	if err := validateEventTypes(events); err != nil {
+		return err
+	}
+	if maxRate != nil && *maxRate < 0 {
+		return fmt.Errorf("max_rate must not be negative")
+	}
+
+	if s.implicit {
+		s.implicit = false
+		s.pins = make(map[int]bool)
+	}
+
+	if len(pins) == 0 {
+		s.pins = nil
+		s.excluded = make(map[int]bool)
+	} else {
+		for _, pin := range pins {
+			if s.pins == nil {
+				delete(s.excluded, pin)
+			} else {
+				s.pins[pin] = true
+			}
+		}
+	}
+
+	if len(events) > 0 {
+		s.events = make(map[EventType]bool, len(events))
+		for _, event := range events {
+			s.events[event] = true
+		}
+	}
+
+	if maxRate != nil {
+		s.interval = 0
+		if *maxRate > 0 {
+			s.interval = time.Duration(float64(time.Second) / *maxRate)
+		}
+	}
+	return nil
+}
+
+// unsubscribe narrows the subscription. With neither pins nor events it
+// stops all delivery to the client.
+func (s *subscription) unsubscribe(pins []int, events []EventType) error {
+	if err := validateEventTypes(events); err != nil {
+		return err
+	}
+	s.implicit = false
+
+	if len(pins) == 0 && len(events) == 0 {
+		s.pins = make(map[int]bool)
+		s.excluded = make(map[int]bool)
+		return nil
+	}
+
+	for _, pin := range pins {
+		if s.pins == nil {
+			s.excluded[pin] = true
+		} else {
+			delete(s.pins, pin)
+		}
+		delete(s.lastSent, pin)
+		delete(s.pending, pin)
+	}
+
+	if len(events) > 0 {
+		if s.events == nil {
+			s.events = make(map[EventType]bool, len(allEventTypes))
+			for _, event := range allEventTypes {
+				s.events[event] = true
+			}
+		}
+		for _, event := range events {
+			delete(s.events, event)
+		}
+	}
+	return nil
+}
+
+// matches reports whether an event passes the pin and event filters
+func (s *subscription) matches(event Event) bool {
+	if s.pins != nil && !s.pins[event.Pin] {
+		return false
+	}
+	if s.excluded[event.Pin] {
+		return false
+	}
+	return s.events == nil || s.events[event.Type]
+}
+
+// allow reports whether an event should be delivered now and, if so,
+// records it against the pin's rate limit. An event held back by the rate
+// limit becomes the pin's pending event so that the latest value is not
+// lost; flushIn is then the time until flush is due, or zero when a flush
+// is already due for the pin.
+func (s *subscription) allow(event Event) (ok bool, flushIn time.Duration) {
+	if !s.matches(event) {
+		return false, 0
+	}
+
+	if s.interval > 0 {
+		if last, ok := s.lastSent[event.Pin]; ok && event.Timestamp.Sub(last) < s.interval {
+			_, scheduled := s.pending[event.Pin]
+			s.pending[event.Pin] = event
+			if scheduled {
+				return false, 0
+			}
+			return false, s.interval - event.Timestamp.Sub(last)
+		}
+		s.lastSent[event.Pin] = event.Timestamp
+	}
+	delete(s.pending, event.Pin)
+	return true, 0
+}
+
+// flush returns the pin's pending event, recording it as sent at now.
+// Events that no longer match the subscription are discarded.
+func (s *subscription) flush(pin int, now time.Time) (Event, bool) {
+	event, ok := s.pending[pin]
+	delete(s.pending, pin)
+	if !ok || !s.matches(event) {
+		return Event{}, false
+	}
+	s.lastSent[pin] = now
+	return event, true
+}
+
+// info returns a snapshot of the subscription for acknowledgements
+func (s *subscription) info() subscriptionInfo {
+	info := subscriptionInfo{
+		Pins:     sortedPins(s.pins),
+		Excluded: sortedPins(s.excluded),
+		Events:   allEventTypes,
+	}
+	if s.events != nil {
+		info.Events = make([]EventType, 0, len(s.events))
+		for _, event := range allEventTypes {
+			if s.events[event] {
+				info.Events = append(info.Events, event)
+			}
+		}
+	}
+	if s.interval > 0 {
+		info.MaxRate = float64(time.Second) / float64(s.interval)
+	}
+	return info
+}
+
+func validateEventTypes(events []EventType) error {
+	for _, event := range events {
+		known := false
+		for _, t := range allEventTypes {
+			if event == t {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown event type: %s", event)
+		}
+	}
+	return nil
+}
+
+func sortedPins(set map[int]bool) []int {
+	if set == nil {
+		return nil
+	}
+	pins := make([]int, 0, len(set))
+	for pin := range set {
+		pins = append(pins, pin)
+	}
+	sort.Ints(pins)
+	return pins
+}
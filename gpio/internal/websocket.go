@@ -1,126 +1,299 @@
 package internal
 
 import (
-    "encoding/json"
-    "sync"
+	"sync"
+	"time"
 
-    "github.com/fasthttp/websocket"
-    "github.com/gofiber/fiber/v2"
-    "github.com/prometheus/client_golang/prometheus"
-    "github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/Jeff-Barlow-Spady/edge-device-service/pkg/audit"
+	"github.com/Jeff-Barlow-Spady/edge-device-service/pkg/middleware/auth"
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
-    wsConnections = promauto.NewGauge(prometheus.GaugeOpts{
-        Name: "active_websocket_connections",
-        Help: "Number of active WebSocket connections",
-    })
+	wsConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "active_websocket_connections",
+		Help: "Number of active WebSocket connections",
+	})
 )
 
+// maxMessageSize limits the size of messages read from clients
+const maxMessageSize = 4096
+
+// Subprotocol is the WebSocket subprotocol negotiated for the current
+// protocol version. Browsers that pass a token as a subprotocol must also
+// offer this one.
+const Subprotocol = "gpio.v1"
+
 type WebSocketManager struct {
-    upgrader    websocket.FastHTTPUpgrader
-    gpio       *GPIOManager
-    clients    map[*websocket.Conn]bool
-    mu         sync.RWMutex
+	upgrader websocket.FastHTTPUpgrader
+	gpio     *GPIOManager
+	config   WebSocketConfig
+	clients  map[*wsClient]bool
+	mu       sync.RWMutex
 }
 
 func NewWebSocketManager(gpio *GPIOManager) *WebSocketManager {
-    wsm := &WebSocketManager{
-        upgrader: websocket.FastHTTPUpgrader{
-            ReadBufferSize:  1024,
-            WriteBufferSize: 1024,
-        },
-        gpio:    gpio,
-        clients: make(map[*websocket.Conn]bool),
-    }
-
-    gpio.RegisterCallback(wsm.broadcastPinChange)
-    return wsm
+	return NewWebSocketManagerWithConfig(gpio, DefaultWebSocketConfig())
 }
 
+// NewWebSocketManagerWithConfig creates a WebSocket manager with custom
+// queueing and keepalive settings
+func NewWebSocketManagerWithConfig(gpio *GPIOManager, config WebSocketConfig) *WebSocketManager {
+	defaults := DefaultWebSocketConfig()
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaults.QueueSize
+	}
+	if config.Overflow == "" {
+		config.Overflow = defaults.Overflow
+	}
+	if config.PingInterval <= 0 {
+		config.PingInterval = defaults.PingInterval
+	}
+	if config.PongTimeout <= config.PingInterval {
+		config.PongTimeout = 2 * config.PingInterval
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = defaults.WriteTimeout
+	}
+
+	wsm := &WebSocketManager{
+		upgrader: websocket.FastHTTPUpgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			Subprotocols:    []string{Subprotocol},
+		},
+		gpio:    gpio,
+		config:  config,
+		clients: make(map[*wsClient]bool),
+	}
+
+	gpio.RegisterCallback(wsm.broadcastEvent)
+	return wsm
+}
+
+// HandleWebSocket upgrades the request and serves the GPIO protocol. The
+// authenticated identity is read from the request before upgrading; its
+// scopes authorize every action and its subject is attached to every pin
+// change made over the connection.
 func (wsm *WebSocketManager) HandleWebSocket(c *fiber.Ctx) error {
-    return wsm.upgrader.Upgrade(c.Context(), func(conn *websocket.Conn) {
-        wsm.mu.Lock()
-        wsm.clients[conn] = true
-        wsm.mu.Unlock()
-        wsConnections.Inc()
-
-        defer func() {
-            wsm.mu.Lock()
-            delete(wsm.clients, conn)
-            wsm.mu.Unlock()
-            wsConnections.Dec()
-            conn.Close()
-        }()
-
-        for {
-            messageType, message, err := conn.ReadMessage()
-            if err != nil {
-                return
-            }
-
-            if messageType == websocket.TextMessage {
-                var req struct {
-                    Action string `json:"action"`
-                    Pin    int    `json:"pin"`
-                    Value  bool   `json:"value,omitempty"`
-                }
-
-                if err := json.Unmarshal(message, &req); err != nil {
-                    wsm.sendError(conn, "Invalid JSON format")
-                    continue
-                }
-
-                switch req.Action {
-                case "write":
-                    if err := wsm.gpio.WritePin(req.Pin, req.Value); err != nil {
-                        wsm.sendError(conn, err.Error())
-                        continue
-                    }
-                case "read":
-                    value, err := wsm.gpio.ReadPin(req.Pin)
-                    if err != nil {
-                        wsm.sendError(conn, err.Error())
-                        continue
-                    }
-                    wsm.sendResponse(conn, "read", req.Pin, value)
-                }
-            }
-        }
-    })
+	identity := auth.IdentityFrom(c)
+	remoteIP := c.IP()
+
+	return wsm.upgrader.Upgrade(c.Context(), func(conn *websocket.Conn) {
+		client := newWSClient(conn, wsm.config)
+		client.identity = identity
+		client.remoteIP = remoteIP
+
+		wsm.mu.Lock()
+		wsm.clients[client] = true
+		wsm.mu.Unlock()
+		wsConnections.Inc()
+
+		writerDone := make(chan struct{})
+		go func() {
+			defer close(writerDone)
+			client.writePump()
+		}()
+
+		defer func() {
+			wsm.mu.Lock()
+			delete(wsm.clients, client)
+			wsm.mu.Unlock()
+			wsConnections.Dec()
+			client.close()
+			<-writerDone
+		}()
+
+		conn.SetReadLimit(maxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(wsm.config.PongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsm.config.PongTimeout))
+		})
+
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			if messageType == websocket.TextMessage {
+				wsm.handleMessage(client, message)
+			}
+		}
+	})
 }
 
-func (wsm *WebSocketManager) broadcastPinChange(pin int, value bool) {
-    wsm.mu.RLock()
-    defer wsm.mu.RUnlock()
+// handleMessage decodes, validates and executes a single client request.
+// Every request receives exactly one reply carrying its ID.
+func (wsm *WebSocketManager) handleMessage(client *wsClient, message []byte) {
+	req, perr := decodeRequest(message)
+	if perr != nil {
+		wsm.sendError(client, req, perr)
+		return
+	}
+
+	if action, ok := actionScope[req.Action]; ok {
+		if scope := PinScope(action, req.Pin); !client.identity.HasScope(scope) {
+			perr := &protocolError{Code: CodeForbidden, Message: "missing required scope " + scope}
+			if action == ScopeWrite {
+				wsm.auditPinChange(client, req, audit.OutcomeDenied, perr)
+			}
+			wsm.sendError(client, req, perr)
+			return
+		}
+	}
+
+	resp := reply{Action: req.Action}
+	pin := req.Pin
+
+	switch req.Action {
+	case "write":
+		err := wsm.gpio.WritePin(req.Pin, *req.Value, client.subject())
+		wsm.auditPinChange(client, req, outcomeOf(err), err)
+		if err != nil {
+			wsm.sendError(client, req, toProtocolError(err))
+			return
+		}
+		resp.Pin, resp.Value = &pin, req.Value
+	case "read":
+		value, err := wsm.gpio.ReadPin(req.Pin)
+		if err != nil {
+			wsm.sendError(client, req, toProtocolError(err))
+			return
+		}
+		resp.Pin, resp.Value = &pin, &value
+	case "setup":
+		err := wsm.gpio.SetupPin(req.Pin, req.Direction, client.subject())
+		wsm.auditPinChange(client, req, outcomeOf(err), err)
+		if err != nil {
+			wsm.sendError(client, req, toProtocolError(err))
+			return
+		}
+		resp.Pin, resp.Direction = &pin, req.Direction
+	case "release":
+		err := wsm.gpio.ReleasePin(req.Pin, client.subject())
+		wsm.auditPinChange(client, req, outcomeOf(err), err)
+		if err != nil {
+			wsm.sendError(client, req, toProtocolError(err))
+			return
+		}
+		resp.Pin = &pin
+	case "list":
+		pins := FilterPins(client.identity, wsm.gpio.ListPins())
+		resp.Pins = &pins
+	case "pulse":
+		value := true
+		if req.Value != nil {
+			value = *req.Value
+		}
+		duration := time.Duration(req.DurationMS) * time.Millisecond
+		err := wsm.gpio.PulsePin(req.Pin, value, duration, client.subject())
+		wsm.auditPinChange(client, req, outcomeOf(err), err)
+		if err != nil {
+			wsm.sendError(client, req, toProtocolError(err))
+			return
+		}
+		resp.Pin, resp.Value, resp.DurationMS = &pin, &value, req.DurationMS
+	case "pwm":
+		err := wsm.gpio.SetPWM(req.Pin, req.Duty, req.Frequency, client.subject())
+		wsm.auditPinChange(client, req, outcomeOf(err), err)
+		if err != nil {
+			wsm.sendError(client, req, toProtocolError(err))
+			return
+		}
+		duty := req.Duty
+		resp.Pin, resp.Duty, resp.Frequency = &pin, &duty, req.Frequency
+	case "subscribe", "unsubscribe":
+		var err error
+		client.mu.Lock()
+		if req.Action == "subscribe" {
+			err = client.sub.subscribe(req.Pins, req.Events, req.MaxRate)
+		} else {
+			err = client.sub.unsubscribe(req.Pins, req.Events)
+		}
+		info := client.sub.info()
+		client.mu.Unlock()
+
+		if err != nil {
+			wsm.sendError(client, req, &protocolError{Code: CodeInvalidArgument, Message: err.Error()})
+			return
+		}
+		resp.Subscription = &info
+	}
+
+	wsm.sendReply(client, req, resp)
+}
+
+// broadcastEvent queues an event for every client whose subscription
+// matches it and who may read the pin. Delivery happens on each client's
+// writer goroutine, so a slow client never blocks the others. Events held
+// back by a client's rate limit are flushed when its interval ends.
+func (wsm *WebSocketManager) broadcastEvent(event Event) {
+	wsm.mu.RLock()
+	defer wsm.mu.RUnlock()
+
+	scope := PinScope(ScopeRead, event.Pin)
+	for client := range wsm.clients {
+		if !client.identity.HasScope(scope) {
+			continue
+		}
+
+		client.mu.Lock()
+		allowed, flushIn := client.sub.allow(event)
+		client.mu.Unlock()
+
+		if allowed {
+			wsm.sendEvent(client, event)
+		} else if flushIn > 0 {
+			time.AfterFunc(flushIn, func() { wsm.flushEvent(client, event.Pin) })
+		}
+	}
+}
+
+// flushEvent delivers the latest event a client's rate limit held back on
+// pin. Closed clients ignore it.
+func (wsm *WebSocketManager) flushEvent(client *wsClient, pin int) {
+	client.mu.Lock()
+	event, ok := client.sub.flush(pin, time.Now())
+	client.mu.Unlock()
+
+	if ok {
+		wsm.sendEvent(client, event)
+	}
+}
 
-    for conn := range wsm.clients {
-        wsm.sendResponse(conn, "pin_change", pin, value)
-    }
+func (wsm *WebSocketManager) sendError(client *wsClient, req request, perr *protocolError) {
+	wsm.sendReply(client, req, reply{
+		Status: "error",
+		Action: req.Action,
+		Error:  perr.Message,
+		Code:   perr.Code,
+	})
 }
 
-func (wsm *WebSocketManager) sendError(conn *websocket.Conn, message string) {
-    response := struct {
-        Status  string `json:"status"`
-        Error   string `json:"error"`
-    }{
-        Status:  "error",
-        Error:   message,
-    }
-    conn.WriteJSON(response)
+func (wsm *WebSocketManager) sendReply(client *wsClient, req request, resp reply) {
+	resp.Version = ProtocolVersion
+	resp.ID = req.ID
+	if resp.Status == "" {
+		resp.Status = "success"
+	}
+	client.enqueue(outbound{pin: -1, payload: resp})
 }
 
-func (wsm *WebSocketManager) sendResponse(conn *websocket.Conn, action string, pin int, value bool) {
-    response := struct {
-        Status  string `json:"status"`
-        Action  string `json:"action"`
-        Pin     int    `json:"pin"`
-        Value   bool   `json:"value"`
-    }{
-        Status:  "success",
-        Action:  action,
-        Pin:     pin,
-        Value:   value,
-    }
-    conn.WriteJSON(response)
+func (wsm *WebSocketManager) sendEvent(client *wsClient, event Event) {
+	response := struct {
+		Version int    `json:"version"`
+		Status  string `json:"status"`
+		Action  string `json:"action"`
+		Event
+	}{
+		Version: ProtocolVersion,
+		Status:  "success",
+		Action:  "pin_change",
+		Event:   event,
+	}
+	client.enqueue(outbound{pin: event.Pin, payload: response})
 }
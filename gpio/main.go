@@ -1,8 +1,13 @@
 package main
 
 import (
+    "crypto/tls"
+    "errors"
     "log"
     "os"
+    "strconv"
+    "strings"
+    "time"
 
     "github.com/gofiber/fiber/v2"
     "github.com/gofiber/fiber/v2/middleware/logger"
@@ -10,10 +15,12 @@ import (
     "github.com/prometheus/client_golang/prometheus/promhttp"
     "github.com/valyala/fasthttp/fasthttpadaptor"
     "github.com/Jeff-Barlow-Spady/docker-setup/services/gpio/internal"
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/audit"
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/middleware/auth"
 )
 
 func main() {
-    app := fiber.New(fiber.Config{
+    fiberConfig := fiber.Config{
         ErrorHandler: func(c *fiber.Ctx, err error) error {
             code := fiber.StatusInternalServerError
             if e, ok := err.(*fiber.Error); ok {
@@ -23,15 +30,36 @@ func main() {
                 "error": err.Error(),
             })
         },
-    })
+    }
+
+    // Behind Caddy the client address comes from X-Forwarded-For, which is
+    // only trusted from the listed proxies. It is what API key allowlists
+    // are checked against and what audit events record.
+    if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+        fiberConfig.ProxyHeader = fiber.HeaderXForwardedFor
+        fiberConfig.EnableTrustedProxyCheck = true
+        fiberConfig.TrustedProxies = strings.Split(proxies, ",")
+        fiberConfig.EnableIPValidation = true
+    } else {
+        log.Printf("TRUSTED_PROXIES is not set, audit events record the address of the proxy in front of this service")
+    }
+
+    app := fiber.New(fiberConfig)
 
     app.Use(recover.New())
     app.Use(logger.New(logger.Config{
         Format: "[${time}] ${status} - ${latency} ${method} ${path}\n",
     }))
 
+    requireAuth := auth.New(auth.Config{Verifier: newVerifier()})
+    auditLog := openAuditLog()
+    defer auditLog.Close()
+    requireAuditRead := auth.RequireScope(func(*fiber.Ctx) string { return audit.ReadScope })
+
     gpioManager := internal.NewGPIOManager()
-    wsManager := internal.NewWebSocketManager(gpioManager)
+    wsConfig := loadWebSocketConfig()
+    wsConfig.Audit = auditLog
+    wsManager := internal.NewWebSocketManagerWithConfig(gpioManager, wsConfig)
 
     // Metrics endpoint with proper Prometheus handler
     promHandler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
@@ -41,19 +69,20 @@ func main() {
     })
 
     // GPIO endpoints
-    app.Post("/gpio/:pin/setup", func(c *fiber.Ctx) error {
+    app.Post("/gpio/:pin/setup", auditLog.Middleware("pin.setup"), requireAuth, requirePinScope(internal.ScopeWrite), func(c *fiber.Ctx) error {
         pin, err := c.ParamsInt("pin")
         if err != nil {
             return fiber.NewError(fiber.StatusBadRequest, "Invalid pin")
         }
 
         direction := c.Query("direction", "out")
+        audit.SetDetail(c, "direction", direction)
         if direction != "in" && direction != "out" {
             return fiber.NewError(fiber.StatusBadRequest, "Invalid direction. Must be 'in' or 'out'")
         }
 
-        if err := gpioManager.SetupPin(pin, direction); err != nil {
-            return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+        if err := gpioManager.SetupPin(pin, direction, auth.Subject(c)); err != nil {
+            return gpioError(err)
         }
 
         return c.JSON(fiber.Map{
@@ -64,7 +93,7 @@ func main() {
         })
     })
 
-    app.Post("/gpio/:pin/write", func(c *fiber.Ctx) error {
+    app.Post("/gpio/:pin/write", auditLog.Middleware("pin.write"), requireAuth, requirePinScope(internal.ScopeWrite), func(c *fiber.Ctx) error {
         pin, err := c.ParamsInt("pin")
         if err != nil {
             return fiber.NewError(fiber.StatusBadRequest, "Invalid pin")
@@ -78,8 +107,9 @@ func main() {
             return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
         }
 
-        if err := gpioManager.WritePin(pin, req.Value); err != nil {
-            return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+        audit.SetDetail(c, "value", strconv.FormatBool(req.Value))
+        if err := gpioManager.WritePin(pin, req.Value, auth.Subject(c)); err != nil {
+            return gpioError(err)
         }
 
         return c.JSON(fiber.Map{
@@ -89,7 +119,7 @@ func main() {
         })
     })
 
-    app.Get("/gpio/:pin/read", func(c *fiber.Ctx) error {
+    app.Get("/gpio/:pin/read", requireAuth, requirePinScope(internal.ScopeRead), func(c *fiber.Ctx) error {
         pin, err := c.ParamsInt("pin")
         if err != nil {
             return fiber.NewError(fiber.StatusBadRequest, "Invalid pin")
@@ -97,7 +127,7 @@ func main() {
 
         value, err := gpioManager.ReadPin(pin)
         if err != nil {
-            return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+            return gpioError(err)
         }
 
         return c.JSON(fiber.Map{
@@ -107,8 +137,95 @@ func main() {
         })
     })
 
+    app.Post("/gpio/:pin/release", auditLog.Middleware("pin.release"), requireAuth, requirePinScope(internal.ScopeWrite), func(c *fiber.Ctx) error {
+        pin, err := c.ParamsInt("pin")
+        if err != nil {
+            return fiber.NewError(fiber.StatusBadRequest, "Invalid pin")
+        }
+
+        if err := gpioManager.ReleasePin(pin, auth.Subject(c)); err != nil {
+            return gpioError(err)
+        }
+
+        return c.JSON(fiber.Map{
+            "status": "success",
+            "message": "Pin released",
+            "pin": pin,
+        })
+    })
+
+    app.Get("/gpio", requireAuth, func(c *fiber.Ctx) error {
+        return c.JSON(fiber.Map{
+            "status": "success",
+            "pins": internal.FilterPins(auth.IdentityFrom(c), gpioManager.ListPins()),
+        })
+    })
+
+    app.Post("/gpio/:pin/pulse", auditLog.Middleware("pin.pulse"), requireAuth, requirePinScope(internal.ScopeWrite), func(c *fiber.Ctx) error {
+        pin, err := c.ParamsInt("pin")
+        if err != nil {
+            return fiber.NewError(fiber.StatusBadRequest, "Invalid pin")
+        }
+
+        req := struct {
+            Value      bool `json:"value"`
+            DurationMS int  `json:"duration_ms"`
+        }{Value: true}
+
+        if err := c.BodyParser(&req); err != nil {
+            return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+        }
+
+        audit.SetDetail(c, "value", strconv.FormatBool(req.Value))
+        audit.SetDetail(c, "duration_ms", strconv.Itoa(req.DurationMS))
+        duration := time.Duration(req.DurationMS) * time.Millisecond
+        if err := gpioManager.PulsePin(pin, req.Value, duration, auth.Subject(c)); err != nil {
+            return gpioError(err)
+        }
+
+        return c.JSON(fiber.Map{
+            "status": "success",
+            "pin": pin,
+            "value": req.Value,
+            "duration_ms": req.DurationMS,
+        })
+    })
+
+    app.Post("/gpio/:pin/pwm", auditLog.Middleware("pin.pwm"), requireAuth, requirePinScope(internal.ScopeWrite), func(c *fiber.Ctx) error {
+        pin, err := c.ParamsInt("pin")
+        if err != nil {
+            return fiber.NewError(fiber.StatusBadRequest, "Invalid pin")
+        }
+
+        var req struct {
+            Duty      float64 `json:"duty"`
+            Frequency float64 `json:"frequency"`
+        }
+
+        if err := c.BodyParser(&req); err != nil {
+            return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+        }
+
+        audit.SetDetail(c, "duty", strconv.FormatFloat(req.Duty, 'g', -1, 64))
+        audit.SetDetail(c, "frequency", strconv.FormatFloat(req.Frequency, 'g', -1, 64))
+        if err := gpioManager.SetPWM(pin, req.Duty, req.Frequency, auth.Subject(c)); err != nil {
+            return gpioError(err)
+        }
+
+        return c.JSON(fiber.Map{
+            "status": "success",
+            "pin": pin,
+            "duty": req.Duty,
+            "frequency": req.Frequency,
+        })
+    })
+
+    // Audit log of pin changes, e.g. ?action=pin.write&actor=alice
+    app.Get("/gpio/audit", requireAuth, requireAuditRead, auditLog.QueryHandler())
+    app.Get("/gpio/audit/verify", requireAuth, requireAuditRead, auditLog.VerifyHandler())
+
     // WebSocket endpoint
-    app.Get("/ws/gpio", wsManager.HandleWebSocket)
+    app.Get("/ws/gpio", requireAuth, wsManager.HandleWebSocket)
 
     // Health check endpoint
     app.Get("/health", func(c *fiber.Ctx) error {
@@ -123,6 +240,160 @@ func main() {
         port = "8000"
     }
 
+    // With TLS_CERT_FILE and TLS_KEY_FILE the service terminates TLS
+    // itself, and with TLS_CLIENT_CA_FILE (the auth service's /auths/ca)
+    // also accepts client certificates, which the auth service maps to
+    // users unless tokens are verified with the shared secret
+    if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+        tlsConfig, err := auth.MutualTLSConfig(certFile, os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE"))
+        if err != nil {
+            log.Fatalf("Failed to configure TLS: %v", err)
+        }
+        ln, err := tls.Listen("tcp", ":"+port, tlsConfig)
+        if err != nil {
+            log.Fatalf("Failed to listen on port %s: %v", port, err)
+        }
+
+        log.Printf("Starting GPIO service with TLS on port %s", port)
+        log.Fatal(app.Listener(ln))
+    }
+
     log.Printf("Starting GPIO service on port %s", port)
     log.Fatal(app.Listen(":" + port))
 }
+
+// newVerifier selects how bearer tokens are verified: locally with the
+// shared JWT_SECRET_KEY when it is set, otherwise against the auth service
+// at AUTH_SERVICE_URL, either locally with its published JWKS (the default)
+// or by calling /auths/verify when AUTH_VERIFY_MODE=remote. Only remote
+// verification sees token revocations before expiry.
+func newVerifier() auth.Verifier {
+    if secret := os.Getenv("JWT_SECRET_KEY"); secret != "" {
+        log.Println("Verifying tokens with shared secret")
+        return auth.NewSecretVerifier([]byte(secret))
+    }
+
+    if url := os.Getenv("AUTH_SERVICE_URL"); url != "" {
+        switch mode := os.Getenv("AUTH_VERIFY_MODE"); mode {
+        case "", "jwks":
+            log.Printf("Verifying tokens with keys from %s", url)
+            return auth.NewJWKSVerifier(url)
+        case "remote":
+            log.Printf("Verifying tokens against auth service at %s", url)
+            return auth.NewRemoteVerifier(url)
+        default:
+            log.Fatalf("Invalid AUTH_VERIFY_MODE %q, must be 'jwks' or 'remote'", mode)
+        }
+    }
+
+    log.Fatal("Either JWT_SECRET_KEY or AUTH_SERVICE_URL must be set")
+    return nil
+}
+
+// requirePinScope rejects requests whose token lacks the scope for action
+// on the pin in the route, e.g. gpio:write:17. The pin is parsed the same
+// way as by the handlers, so that "017" needs the scope for pin 17.
+func requirePinScope(action string) fiber.Handler {
+    return func(c *fiber.Ctx) error {
+        pin, err := c.ParamsInt("pin")
+        if err != nil || pin < 0 {
+            return fiber.NewError(fiber.StatusBadRequest, "Invalid pin")
+        }
+
+        required := internal.PinScope(action, pin)
+        if !auth.IdentityFrom(c).HasScope(required) {
+            return fiber.NewError(fiber.StatusForbidden, "missing required scope "+required)
+        }
+        return c.Next()
+    }
+}
+
+// gpioError maps GPIOManager errors to HTTP status codes
+func gpioError(err error) error {
+    switch {
+    case errors.Is(err, internal.ErrPinNotFound):
+        return fiber.NewError(fiber.StatusNotFound, err.Error())
+    case errors.Is(err, internal.ErrPinNotConfigured), errors.Is(err, internal.ErrWrongDirection):
+        return fiber.NewError(fiber.StatusConflict, err.Error())
+    case errors.Is(err, internal.ErrInvalidArgument):
+        return fiber.NewError(fiber.StatusBadRequest, err.Error())
+    default:
+        return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+    }
+}
+
+// openAuditLog opens the audit log of pin changes at AUDIT_FILE (default
+// audit/gpio.log), or returns nil when AUDIT_ENABLED=false
+func openAuditLog() *audit.Logger {
+    if enabled, err := strconv.ParseBool(os.Getenv("AUDIT_ENABLED")); err == nil && !enabled {
+        log.Println("Audit log disabled")
+        return nil
+    }
+
+    config := audit.Config{
+        Path:    os.Getenv("AUDIT_FILE"),
+        Service: "gpio",
+    }
+    if config.Path == "" {
+        config.Path = "audit/gpio.log"
+    }
+    if v := os.Getenv("AUDIT_MAX_SIZE"); v != "" {
+        if size, err := strconv.ParseInt(v, 10, 64); err == nil && size > 0 {
+            config.MaxSize = size
+        } else {
+            log.Printf("Ignoring invalid AUDIT_MAX_SIZE %q", v)
+        }
+    }
+    if v := os.Getenv("AUDIT_MAX_FILES"); v != "" {
+        if files, err := strconv.Atoi(v); err == nil && files > 0 {
+            config.MaxFiles = files
+        } else {
+            log.Printf("Ignoring invalid AUDIT_MAX_FILES %q", v)
+        }
+    }
+
+    auditLog, err := audit.Open(config)
+    if err != nil {
+        log.Fatalf("Failed to open audit log: %v", err)
+    }
+    return auditLog
+}
+
+// loadWebSocketConfig reads WebSocket queueing and keepalive settings from
+// the environment, falling back to the defaults for unset or invalid values
+func loadWebSocketConfig() internal.WebSocketConfig {
+    config := internal.DefaultWebSocketConfig()
+
+    if v := os.Getenv("WS_QUEUE_SIZE"); v != "" {
+        if size, err := strconv.Atoi(v); err == nil && size > 0 {
+            config.QueueSize = size
+        } else {
+            log.Printf("Ignoring invalid WS_QUEUE_SIZE %q", v)
+        }
+    }
+
+    if v := os.Getenv("WS_OVERFLOW_POLICY"); v != "" {
+        if policy, err := internal.ParseOverflowPolicy(v); err == nil {
+            config.Overflow = policy
+        } else {
+            log.Printf("Ignoring WS_OVERFLOW_POLICY: %v", err)
+        }
+    }
+
+    durations := map[string]*time.Duration{
+        "WS_PING_INTERVAL": &config.PingInterval,
+        "WS_PONG_TIMEOUT":  &config.PongTimeout,
+        "WS_WRITE_TIMEOUT": &config.WriteTimeout,
+    }
+    for name, target := range durations {
+        if v := os.Getenv(name); v != "" {
+            if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+                *target = parsed
+            } else {
+                log.Printf("Ignoring invalid %s %q", name, v)
+            }
+        }
+    }
+
+    return config
+}
@@ -0,0 +1,362 @@
+package service
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/middleware/auth"
+)
+
+// APIKeyPrefix starts every API key so that keys are recognisable in logs
+// and secret scanners
+const APIKeyPrefix = "edk_"
+
+// apiKeyTouchInterval limits how often last-used updates are written
+const apiKeyTouchInterval = time.Minute
+
+var (
+    // ErrAPIKeyNotFound is returned for operations on unknown API keys
+    ErrAPIKeyNotFound = errors.New("api key not found")
+    // ErrInvalidAPIKey is returned for unknown, expired, revoked or
+    // disallowed API keys
+    ErrInvalidAPIKey = errors.New("invalid api key")
+    // ErrScopeNotGranted is returned when an API key requests scopes its
+    // owner does not hold
+    ErrScopeNotGranted = errors.New("scope not granted to owner")
+)
+
+// APIKey is a long-lived credential for a machine client. Only the SHA-256
+// hash of the secret is stored; the full key is returned once on creation.
+type APIKey struct {
+    ID         string     `json:"id"`
+    Name       string     `json:"name"`
+    Owner      string     `json:"owner"`
+    Hash       string     `json:"hash,omitempty"`
+    Scopes     []string   `json:"scopes,omitempty"`
+    AllowedIPs []string   `json:"allowed_ips,omitempty"`
+    CreatedAt  time.Time  `json:"created_at"`
+    ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+    LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+    LastUsedIP string     `json:"last_used_ip,omitempty"`
+    RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// APIKeyRequest describes a key to create
+type APIKeyRequest struct {
+    Name string `json:"name"`
+    // Scopes restricts the key to a subset of the owner's scopes. Empty
+    // means the key carries all of the owner's scopes.
+    Scopes []string `json:"scopes"`
+    // AllowedIPs restricts use to these addresses or CIDR ranges
+    AllowedIPs []string `json:"allowed_ips"`
+    // TTL is the key's lifetime; zero means it does not expire
+    TTL time.Duration `json:"-"`
+}
+
+// apiKeyStore holds API keys by ID, persisted to a JSON file
+type apiKeyStore struct {
+    mu        sync.Mutex
+    file      string
+    keys      map[string]*APIKey
+    lastSaved time.Time
+}
+
+// newAPIKeyStore loads API keys from file. A missing file starts empty; a
+// corrupt one is an error, since ignoring it would drop every key.
+func newAPIKeyStore(file string) (*apiKeyStore, error) {
+    store := &apiKeyStore{
+        file: file,
+        keys: make(map[string]*APIKey),
+    }
+    if err := store.load(); err != nil {
+        return nil, err
+    }
+    return store, nil
+}
+
+// CreateAPIKey creates a key for owner and returns the full key, which is
+// not stored and cannot be retrieved again
+func (s *AuthService) CreateAPIKey(owner string, req APIKeyRequest) (string, APIKey, error) {
+    user, err := s.users.Get(owner)
+    if err != nil {
+        return "", APIKey{}, err
+    }
+
+    granted := &auth.Identity{Scopes: s.grantedScopes(user)}
+    for _, scope := range req.Scopes {
+        if !granted.HasScope(scope) {
+            return "", APIKey{}, fmt.Errorf("%w: %s", ErrScopeNotGranted, scope)
+        }
+    }
+    for _, allowed := range req.AllowedIPs {
+        if parseAllowedIP(allowed) == nil {
+            return "", APIKey{}, fmt.Errorf("invalid allowed IP %q", allowed)
+        }
+    }
+
+    id, err := randomToken(9)
+    if err != nil {
+        return "", APIKey{}, err
+    }
+    secret, err := randomToken(32)
+    if err != nil {
+        return "", APIKey{}, err
+    }
+
+    key := APIKey{
+        ID:         id,
+        Name:       req.Name,
+        Owner:      owner,
+        Hash:       hashToken(secret),
+        Scopes:     req.Scopes,
+        AllowedIPs: req.AllowedIPs,
+        CreatedAt:  time.Now(),
+    }
+    if req.TTL > 0 {
+        expiresAt := key.CreatedAt.Add(req.TTL)
+        key.ExpiresAt = &expiresAt
+    }
+
+    if err := s.state.addAPIKey(key); err != nil {
+        return "", APIKey{}, err
+    }
+
+    log.Printf("API key %s created for %s", id, owner)
+    return APIKeyPrefix + id + "." + secret, key.public(), nil
+}
+
+// ListAPIKeys returns the keys owned by owner, or every key when owner is
+// empty, without their hashes
+func (s *AuthService) ListAPIKeys(owner string) ([]APIKey, error) {
+    keys, err := s.state.listAPIKeys(owner)
+    if err != nil {
+        return nil, err
+    }
+    for i := range keys {
+        keys[i] = keys[i].public()
+    }
+    return keys, nil
+}
+
+// RevokeAPIKey revokes a key. A non-empty owner restricts revocation to
+// that owner's keys.
+func (s *AuthService) RevokeAPIKey(id, owner string) error {
+    if err := s.state.revokeAPIKey(id, owner); err != nil {
+        return err
+    }
+
+    log.Printf("API key %s revoked", id)
+    s.decisions.clear()
+    return nil
+}
+
+// VerifyAPIKey validates a key presented from remoteIP and returns the
+// identity it acts as. The key's scopes are limited to those its owner
+// currently holds, so role changes apply to existing keys.
+func (s *AuthService) VerifyAPIKey(presented, remoteIP string) (*Claims, error) {
+    id, secret, ok := strings.Cut(strings.TrimPrefix(presented, APIKeyPrefix), ".")
+    if !ok || !strings.HasPrefix(presented, APIKeyPrefix) {
+        return nil, ErrInvalidAPIKey
+    }
+
+    key, exists, err := s.state.apiKey(id)
+    if err != nil {
+        return nil, err
+    }
+    if !exists || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashToken(secret))) != 1 {
+        return nil, ErrInvalidAPIKey
+    }
+
+    now := time.Now()
+    if key.RevokedAt != nil || (key.ExpiresAt != nil && now.After(*key.ExpiresAt)) || !key.allows(remoteIP) {
+        return nil, ErrInvalidAPIKey
+    }
+
+    if err := s.state.touchAPIKey(id, remoteIP, now); err != nil {
+        log.Printf("Failed to record use of API key %s: %v", id, err)
+    }
+    owner, scopes := key.Owner, key.Scopes
+
+    user, err := s.users.Get(owner)
+    if err != nil || user.Disabled {
+        return nil, ErrInvalidAPIKey
+    }
+
+    role := user.Role
+    if role == "" {
+        role = RoleViewer
+    }
+
+    granted := s.grantedScopes(user)
+    if len(scopes) > 0 {
+        ownerIdentity := &auth.Identity{Scopes: granted}
+        granted = make([]string, 0, len(scopes))
+        for _, scope := range scopes {
+            if ownerIdentity.HasScope(scope) {
+                granted = append(granted, scope)
+            }
+        }
+    }
+
+    return &Claims{
+        Subject: owner,
+        Roles:   []string{role},
+        Scopes:  granted,
+    }, nil
+}
+
+// public returns a copy of the key without its hash
+func (k APIKey) public() APIKey {
+    k.Hash = ""
+    return k
+}
+
+// allows reports whether the key may be used from ip
+func (k *APIKey) allows(ip string) bool {
+    if len(k.AllowedIPs) == 0 {
+        return true
+    }
+
+    addr := net.ParseIP(ip)
+    if addr == nil {
+        return false
+    }
+    for _, allowed := range k.AllowedIPs {
+        if network := parseAllowedIP(allowed); network != nil && network.Contains(addr) {
+            return true
+        }
+    }
+    return false
+}
+
+// parseAllowedIP parses an address or CIDR range into a network
+func parseAllowedIP(value string) *net.IPNet {
+    if _, network, err := net.ParseCIDR(value); err == nil {
+        return network
+    }
+
+    ip := net.ParseIP(value)
+    if ip == nil {
+        return nil
+    }
+    bits := 128
+    if ip.To4() != nil {
+        ip = ip.To4()
+        bits = 32
+    }
+    return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func (a *apiKeyStore) addAPIKey(key APIKey) error {
+    a.mu.Lock()
+    a.keys[key.ID] = &key
+    a.mu.Unlock()
+    return a.save()
+}
+
+func (a *apiKeyStore) apiKey(id string) (APIKey, bool, error) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    key, exists := a.keys[id]
+    if !exists {
+        return APIKey{}, false, nil
+    }
+    return *key, true, nil
+}
+
+func (a *apiKeyStore) listAPIKeys(owner string) ([]APIKey, error) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    keys := make([]APIKey, 0, len(a.keys))
+    for _, key := range a.keys {
+        if owner == "" || key.Owner == owner {
+            keys = append(keys, *key)
+        }
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+    })
+    return keys, nil
+}
+
+func (a *apiKeyStore) revokeAPIKey(id, owner string) error {
+    a.mu.Lock()
+    key, exists := a.keys[id]
+    if !exists || (owner != "" && key.Owner != owner) {
+        a.mu.Unlock()
+        return ErrAPIKeyNotFound
+    }
+    if key.RevokedAt == nil {
+        now := time.Now()
+        key.RevokedAt = &now
+    }
+    a.mu.Unlock()
+    return a.save()
+}
+
+// touchAPIKey records the use in memory right away and saves it once the
+// last save is apiKeyTouchInterval ago
+func (a *apiKeyStore) touchAPIKey(id, ip string, at time.Time) error {
+    a.mu.Lock()
+    key, exists := a.keys[id]
+    if !exists {
+        a.mu.Unlock()
+        return nil
+    }
+    key.LastUsedAt = &at
+    key.LastUsedIP = ip
+    persist := at.Sub(a.lastSaved) >= apiKeyTouchInterval
+    a.mu.Unlock()
+
+    if !persist {
+        return nil
+    }
+    return a.save()
+}
+
+func (a *apiKeyStore) load() error {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    data, err := os.ReadFile(a.file)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to read API key file %s: %v", a.file, err)
+    }
+
+    if len(data) > 0 {
+        if err := json.Unmarshal(data, &a.keys); err != nil {
+            return fmt.Errorf("failed to parse API key file %s: %v", a.file, err)
+        }
+    }
+    if a.keys == nil {
+        a.keys = make(map[string]*APIKey)
+    }
+    return nil
+}
+
+func (a *apiKeyStore) save() error {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    data, err := json.Marshal(a.keys)
+    if err != nil {
+        return err
+    }
+
+    a.lastSaved = time.Now()
+    return writeFileAtomic(a.file, data, 0600)
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+    "errors"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestCreateAPIKey(t *testing.T) {
+    service, _ := newTestService(t)
+    service.AddUser("alice", "password", RoleOperator)
+    service.AddUser("bob", "password", RoleViewer)
+
+    tests := []struct {
+        name    string
+        owner   string
+        req     APIKeyRequest
+        wantErr error
+    }{
+        {"all owner scopes", "alice", APIKeyRequest{Name: "ci"}, nil},
+        {"subset of scopes", "alice", APIKeyRequest{Scopes: []string{"gpio:write:17"}}, nil},
+        {"allowed IPs", "alice", APIKeyRequest{AllowedIPs: []string{"10.0.0.1", "10.1.0.0/16"}}, nil},
+        {"expiring", "alice", APIKeyRequest{TTL: time.Hour}, nil},
+        {"scope beyond owner", "bob", APIKeyRequest{Scopes: []string{"gpio:write:*"}}, ErrScopeNotGranted},
+        {"unknown owner", "nobody", APIKeyRequest{}, ErrUserNotFound},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            key, info, err := service.CreateAPIKey(test.owner, test.req)
+            if !errors.Is(err, test.wantErr) {
+                t.Fatalf("Expected %v, got %v", test.wantErr, err)
+            }
+            if err != nil {
+                return
+            }
+            if !strings.HasPrefix(key, APIKeyPrefix+info.ID+".") {
+                t.Errorf("Expected key to start with %s%s., got %s", APIKeyPrefix, info.ID, key)
+            }
+            if info.Hash != "" || info.Owner != test.owner || !reflect.DeepEqual(info.Scopes, test.req.Scopes) {
+                t.Errorf("Expected public key info for %s, got %+v", test.owner, info)
+            }
+            if (test.req.TTL > 0) != (info.ExpiresAt != nil) {
+                t.Errorf("Expected expiry only with a TTL, got %v", info.ExpiresAt)
+            }
+        })
+    }
+
+    if _, _, err := service.CreateAPIKey("alice", APIKeyRequest{AllowedIPs: []string{"not-an-ip"}}); err == nil {
+        t.Error("Expected an invalid allowed IP to be rejected")
+    }
+}
+
+func TestVerifyAPIKey(t *testing.T) {
+    service, _ := newTestService(t)
+    service.AddUser("alice", "password", RoleOperator)
+    service.AddUser("bob", "password", RoleOperator)
+    service.AddUser("carol", "password", RoleOperator)
+
+    create := func(owner string, req APIKeyRequest) string {
+        t.Helper()
+        key, _, err := service.CreateAPIKey(owner, req)
+        if err != nil {
+            t.Fatalf("CreateAPIKey failed: %v", err)
+        }
+        return key
+    }
+    plain := create("alice", APIKeyRequest{})
+    restricted := create("alice", APIKeyRequest{AllowedIPs: []string{"10.0.0.0/24"}})
+    expired := create("alice", APIKeyRequest{TTL: time.Hour})
+    revoked := create("alice", APIKeyRequest{})
+    narrowed := create("bob", APIKeyRequest{Scopes: []string{"gpio:read:*", "gpio:write:*"}})
+    disabled := create("carol", APIKeyRequest{})
+
+    id := func(key string) string {
+        id, _, _ := strings.Cut(strings.TrimPrefix(key, APIKeyPrefix), ".")
+        return id
+    }
+    past := time.Now().Add(-time.Minute)
+    service.state.(*FileStateStore).apiKeyStore.keys[id(expired)].ExpiresAt = &past
+    if err := service.RevokeAPIKey(id(revoked), ""); err != nil {
+        t.Fatalf("RevokeAPIKey failed: %v", err)
+    }
+    // Keys follow their owner's current role and status
+    service.users.Update("bob", func(user *User) error {
+        user.Role = RoleViewer
+        return nil
+    })
+    if err := service.SetUserDisabled("carol", true); err != nil {
+        t.Fatalf("SetUserDisabled failed: %v", err)
+    }
+
+    tests := []struct {
+        name       string
+        key        string
+        ip         string
+        wantErr    error
+        wantScopes []string
+    }{
+        {"valid", plain, "192.168.1.1", nil, RoleScopes[RoleOperator]},
+        {"wrong secret", APIKeyPrefix + id(plain) + ".wrong", "192.168.1.1", ErrInvalidAPIKey, nil},
+        {"missing prefix", strings.TrimPrefix(plain, APIKeyPrefix), "192.168.1.1", ErrInvalidAPIKey, nil},
+        {"unknown id", APIKeyPrefix + "unknown.secret", "192.168.1.1", ErrInvalidAPIKey, nil},
+        {"allowed IP", restricted, "10.0.0.7", nil, RoleScopes[RoleOperator]},
+        {"disallowed IP", restricted, "10.0.1.7", ErrInvalidAPIKey, nil},
+        {"unparsable IP", restricted, "garbage", ErrInvalidAPIKey, nil},
+        {"expired", expired, "192.168.1.1", ErrInvalidAPIKey, nil},
+        {"revoked", revoked, "192.168.1.1", ErrInvalidAPIKey, nil},
+        {"narrowed to owner", narrowed, "192.168.1.1", nil, []string{"gpio:read:*"}},
+        {"disabled owner", disabled, "192.168.1.1", ErrInvalidAPIKey, nil},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            claims, err := service.VerifyAPIKey(test.key, test.ip)
+            if !errors.Is(err, test.wantErr) {
+                t.Fatalf("Expected %v, got %v", test.wantErr, err)
+            }
+            if err == nil && !reflect.DeepEqual(claims.Scopes, test.wantScopes) {
+                t.Errorf("Expected scopes %v, got %v", test.wantScopes, claims.Scopes)
+            }
+        })
+    }
+}
+
+func TestAPIKeyLastUsed(t *testing.T) {
+    service, dir := newTestService(t)
+    service.AddUser("alice", "password", RoleViewer)
+    key, info, err := service.CreateAPIKey("alice", APIKeyRequest{})
+    if err != nil {
+        t.Fatalf("CreateAPIKey failed: %v", err)
+    }
+    if info.LastUsedAt != nil {
+        t.Fatalf("Expected a new key to be unused, got %v", info.LastUsedAt)
+    }
+
+    // Creating the key just saved the store, so this use is not written yet
+    if _, err := service.VerifyAPIKey(key, "10.0.0.1"); err != nil {
+        t.Fatalf("VerifyAPIKey failed: %v", err)
+    }
+    keys, err := service.ListAPIKeys("alice")
+    if err != nil || len(keys) != 1 || keys[0].LastUsedAt == nil || keys[0].LastUsedIP != "10.0.0.1" {
+        t.Fatalf("Expected last use from 10.0.0.1, got %+v", keys)
+    }
+    reloaded, err := newAPIKeyStore(filepath.Join(dir, "api_keys.json"))
+    if err != nil {
+        t.Fatalf("Failed to reload API keys: %v", err)
+    }
+    if reloaded.keys[info.ID].LastUsedAt != nil {
+        t.Error("Expected last use within the touch interval not to be saved")
+    }
+
+    // Once the interval has passed the next use is saved
+    service.state.(*FileStateStore).apiKeyStore.lastSaved = time.Now().Add(-apiKeyTouchInterval)
+    if _, err := service.VerifyAPIKey(key, "10.0.0.2"); err != nil {
+        t.Fatalf("VerifyAPIKey failed: %v", err)
+    }
+    reloaded, err = newAPIKeyStore(filepath.Join(dir, "api_keys.json"))
+    if err != nil {
+        t.Fatalf("Failed to reload API keys: %v", err)
+    }
+    if used := reloaded.keys[info.ID]; used.LastUsedAt == nil || used.LastUsedIP != "10.0.0.2" {
+        t.Errorf("Expected saved last use from 10.0.0.2, got %+v", used)
+    }
+}
+
+func TestListAndRevokeAPIKeys(t *testing.T) {
+    service, _ := newTestService(t)
+    service.AddUser("alice", "password", RoleViewer)
+    service.AddUser("bob", "password", RoleViewer)
+
+    var ids []string
+    for _, owner := range []string{"alice", "bob", "alice"} {
+        _, info, err := service.CreateAPIKey(owner, APIKeyRequest{Name: owner})
+        if err != nil {
+            t.Fatalf("CreateAPIKey failed: %v", err)
+        }
+        ids = append(ids, info.ID)
+    }
+
+    tests := []struct {
+        owner string
+        want  []string
+    }{
+        {"alice", []string{ids[0], ids[2]}},
+        {"bob", []string{ids[1]}},
+        {"carol", []string{}},
+        {"", ids},
+    }
+    for _, test := range tests {
+        keys, err := service.ListAPIKeys(test.owner)
+        if err != nil {
+            t.Fatalf("ListAPIKeys failed: %v", err)
+        }
+        got := make([]string, 0, len(keys))
+        for _, key := range keys {
+            if key.Hash != "" {
+                t.Errorf("Expected listed key %s without its hash", key.ID)
+            }
+            got = append(got, key.ID)
+        }
+        if !reflect.DeepEqual(got, test.want) {
+            t.Errorf("ListAPIKeys(%q) = %v, want %v", test.owner, got, test.want)
+        }
+    }
+
+    revokes := []struct {
+        name    string
+        id      string
+        owner   string
+        wantErr error
+    }{
+        {"other owner's key", ids[1], "alice", ErrAPIKeyNotFound},
+        {"unknown key", "unknown", "", ErrAPIKeyNotFound},
+        {"own key", ids[0], "alice", nil},
+        {"as admin", ids[1], "", nil},
+        {"already revoked", ids[0], "alice", nil},
+    }
+    for _, test := range revokes {
+        t.Run(test.name, func(t *testing.T) {
+            if err := service.RevokeAPIKey(test.id, test.owner); !errors.Is(err, test.wantErr) {
+                t.Errorf("Expected %v, got %v", test.wantErr, err)
+            }
+        })
+    }
+
+    keys, err := service.ListAPIKeys("")
+    if err != nil {
+        t.Fatalf("ListAPIKeys failed: %v", err)
+    }
+    revokedAt := map[string]*time.Time{}
+    for _, key := range keys {
+        revokedAt[key.ID] = key.RevokedAt
+    }
+    if revokedAt[ids[0]] == nil || revokedAt[ids[1]] == nil || revokedAt[ids[2]] != nil {
+        t.Errorf("Expected only the first two keys to be revoked, got %v", revokedAt)
+    }
+}
@@ -3,125 +3,384 @@ package service
 import (
     "crypto/rand"
     "encoding/hex"
-    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
     "os"
     "sync"
     "time"
 
     "github.com/dgrijalva/jwt-go"
-    "golang.org/x/crypto/bcrypt"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/config"
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/jwks"
+)
+
+var (
+    // ErrUserNotFound is returned for operations on unknown users
+    ErrUserNotFound = errors.New("user not found")
+    // ErrInvalidRole is returned when assigning a role that does not exist
+    ErrInvalidRole = errors.New("invalid role")
+    // ErrInvalidToken is returned for malformed, expired or revoked tokens
+    ErrInvalidToken = errors.New("invalid token")
 )
 
+// Claims is the identity carried by a verified token
+type Claims struct {
+    Subject string   `json:"subject"`
+    Roles   []string `json:"roles"`
+    Scopes  []string `json:"scopes"`
+}
+
 type AuthService struct {
-    secretKey   []byte
-    tokenExpiry time.Duration
-    usersFile   string
-    users      map[string]User
-    mu         sync.RWMutex
+    secretKey     []byte
+    tokenExpiry   time.Duration
+    refreshExpiry time.Duration
+    users         UserStore
+    state         StateStore
+
+    keys      *keyManager
+    limiter   *loginLimiter
+    decisions *decisionCache
+    // ca is nil unless mutual TLS is enabled
+    ca *certificateAuthority
+
+    mfaIssuer string
+    mfaRoles  []string
+
+    registrationMode string
+    registerMu       sync.Mutex
+
+    // dummyHash is compared against for unknown users
+    passwords *passwordPolicy
+    dummyHash string
 }
 
-func NewAuthService() *AuthService {
-    secretKey := os.Getenv("JWT_SECRET_KEY")
-    if secretKey == "" {
-        key := make([]byte, 32)
-        rand.Read(key)
-        secretKey = hex.EncodeToString(key)
+// NewAuthService creates an auth service keeping accounts in users and
+// tokens, keys and other auth state in state. With HS256 the signing
+// secret falls back to the JWT_SECRET_KEY environment variable and then to
+// a random key; with RS256 or EdDSA keys are loaded from, or generated
+// into, the state store. Password logins are rate limited
+// as set in the login section, and new passwords must satisfy the password
+// policy. With mutual TLS enabled a local CA issues client certificates.
+func NewAuthService(conf *config.Config, users UserStore, state StateStore) (*AuthService, error) {
+    cfg := conf.JWT
+
+    switch conf.RegistrationMode {
+    case RegistrationInvite, RegistrationFirstAdmin, RegistrationDisabled:
+    case "":
+        conf.RegistrationMode = RegistrationFirstAdmin
+    default:
+        return nil, fmt.Errorf("invalid registration mode %q", conf.RegistrationMode)
     }
 
-    service := &AuthService{
-        secretKey:   []byte(secretKey),
-        tokenExpiry: 24 * time.Hour,
-        usersFile:   "auth/users.json",
-        users:       make(map[string]User),
+    tokenExpiry := cfg.AccessTokenTTL()
+    if tokenExpiry <= 0 {
+        tokenExpiry = 15 * time.Minute
+    }
+    refreshExpiry := cfg.RefreshTokenTTL
+    if refreshExpiry <= 0 {
+        refreshExpiry = 30 * 24 * time.Hour
     }
 
-    service.loadUsers()
-    return service
-}
+    service := &AuthService{
+        tokenExpiry:   tokenExpiry,
+        refreshExpiry: refreshExpiry,
+        users:         users,
+        state:         state,
+        limiter:       newLoginLimiter(conf.Login),
+        decisions:     newDecisionCache(conf.ForwardAuthCacheTTL),
+
+        mfaIssuer: conf.MFA.Issuer,
+        mfaRoles:  conf.MFA.RequiredRoles,
 
-func (s *AuthService) loadUsers() {
-    s.mu.Lock()
-    defer s.mu.Unlock()
+        registrationMode: conf.RegistrationMode,
+    }
 
-    data, err := os.ReadFile(s.usersFile)
+    passwords, err := newPasswordPolicy(conf.Password)
     if err != nil {
-        return
+        return nil, err
     }
+    service.passwords = passwords
 
-    json.Unmarshal(data, &s.users)
-}
+    dummyHash, err := passwords.hash("unknown user")
+    if err != nil {
+        return nil, err
+    }
+    service.dummyHash = dummyHash
 
-func (s *AuthService) saveUsers() error {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
+    if conf.MTLS.Enabled {
+        ca, err := newCertificateAuthority(conf.MTLS)
+        if err != nil {
+            return nil, err
+        }
+        service.ca = ca
+    }
 
-    data, err := json.Marshal(s.users)
-    if err != nil {
-        return err
+    if cfg.Algorithm == "" || cfg.Algorithm == "HS256" {
+        secretKey := cfg.Secret
+        if secretKey == "" {
+            secretKey = os.Getenv("JWT_SECRET_KEY")
+        }
+        if secretKey == "" {
+            key := make([]byte, 32)
+            rand.Read(key)
+            secretKey = hex.EncodeToString(key)
+        }
+        service.secretKey = []byte(secretKey)
+    } else {
+        // Retired keys must stay published for at least one token lifetime
+        overlap := cfg.KeyOverlap
+        if overlap < tokenExpiry {
+            overlap = tokenExpiry
+        }
+
+        keys, err := newKeyManager(state, cfg.Algorithm, cfg.KeyRotation, overlap)
+        if err != nil {
+            return nil, err
+        }
+        service.keys = keys
+        go keys.runRotation()
     }
 
-    return os.WriteFile(s.usersFile, data, 0644)
+    go service.runGC(tokenExpiry)
+    go service.limiter.runGC()
+    return service, nil
 }
 
+// CreateUser creates a viewer account, reporting false when the username
+// is taken or the account could not be saved
 func (s *AuthService) CreateUser(username, password string) bool {
-    s.mu.Lock()
-    defer s.mu.Unlock()
-
-    if _, exists := s.users[username]; exists {
-        return false
+    err := s.AddUser(username, password, RoleViewer)
+    if err != nil && !errors.Is(err, ErrUserExists) {
+        log.Printf("Failed to create user %s: %v", username, err)
     }
+    return err == nil
+}
 
-    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+func (s *AuthService) VerifyUser(username, password string) bool {
+    user, err := s.users.Get(username)
     if err != nil {
         return false
     }
 
-    s.users[username] = User{
-        Hash:      string(hash),
-        CreatedAt: time.Now(),
+    ok, _ := s.passwords.verify(user.Hash, password)
+    return ok
+}
+
+// SetUserRole assigns a role and additional scopes to a user
+func (s *AuthService) SetUserRole(username, role string, scopes []string) error {
+    if _, ok := RoleScopes[role]; !ok {
+        return ErrInvalidRole
     }
 
-    s.saveUsers()
-    return true
+    return s.users.Update(username, func(user *User) error {
+        user.Role = role
+        user.Scopes = scopes
+        return nil
+    })
 }
 
-func (s *AuthService) VerifyUser(username, password string) bool {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
+// CreateToken signs an access token for username with the user's role and
+// scopes
+func (s *AuthService) CreateToken(username string) (string, error) {
+    return s.createToken(username, "")
+}
 
-    user, exists := s.users[username]
-    if !exists {
-        return false
+// createToken is CreateToken for a token issued through the OAuth client
+// clientID, which is recorded in the token's client_id claim when set
+func (s *AuthService) createToken(username, clientID string) (string, error) {
+    user, err := s.users.Get(username)
+    if err != nil {
+        return "", err
     }
 
-    return bcrypt.CompareHashAndPassword([]byte(user.Hash), []byte(password)) == nil
-}
+    role := user.Role
+    if role == "" {
+        role = RoleViewer
+    }
 
-func (s *AuthService) CreateToken(username string) string {
-    token := jwt.New(jwt.SigningMethodHS256)
-    claims := token.Claims.(jwt.MapClaims)
-    claims["sub"] = username
-    claims["exp"] = time.Now().Add(s.tokenExpiry).Unix()
+    scopes := s.grantedScopes(user)
+    if clientID != "" {
+        client, ok := s.activeOAuthClient(clientID)
+        if !ok {
+            return "", ErrInvalidClient
+        }
+        scopes = delegatedScopes(client, scopes)
+    }
 
-    tokenString, _ := token.SignedString(s.secretKey)
-    return tokenString
+    jti, err := randomToken(16)
+    if err != nil {
+        return "", err
+    }
+
+    now := time.Now()
+    claims := jwt.MapClaims{
+        "jti":    jti,
+        "sub":    username,
+        "iat":    issuedAt(now),
+        "roles":  []string{role},
+        "scopes": scopes,
+        "exp":    now.Add(s.tokenExpiry).Unix(),
+    }
+    if clientID != "" {
+        claims["client_id"] = clientID
+    }
+    return s.signToken(claims)
 }
 
-func (s *AuthService) VerifyToken(tokenString string) (string, bool) {
-    token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+// signToken signs claims with the current key or the shared secret
+func (s *AuthService) signToken(claims jwt.MapClaims) (string, error) {
+    if s.keys != nil {
+        return s.keys.sign(claims)
+    }
+    return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secretKey)
+}
+
+// parseToken verifies a token's signature and expiry with the configured
+// keys
+func (s *AuthService) parseToken(tokenString string) (*jwt.Token, error) {
+    return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+        if s.keys != nil {
+            return s.keys.keyFunc(token)
+        }
+        if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+            return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+        }
         return s.secretKey, nil
     })
+}
 
-    if err != nil || !token.Valid {
+// JWKS returns the public keys tokens may be verified with. It is empty
+// when tokens are signed with a shared secret.
+func (s *AuthService) JWKS() jwks.Set {
+    if s.keys == nil {
+        return jwks.Set{Keys: []jwks.Key{}}
+    }
+    return s.keys.publicKeys()
+}
+
+// VerifyToken validates a token and returns the subject it was issued to
+func (s *AuthService) VerifyToken(tokenString string) (string, bool) {
+    claims, ok := s.VerifyTokenClaims(tokenString)
+    if !ok {
         return "", false
     }
+    return claims.Subject, true
+}
+
+// VerifyTokenClaims validates a token and returns its subject, roles and
+// scopes. Roles and scopes are taken from the current user record so that
+// changes apply to tokens that are already issued.
+func (s *AuthService) VerifyTokenClaims(tokenString string) (*Claims, bool) {
+    claims, _, ok := s.verifyToken(tokenString)
+    return claims, ok
+}
+
+// verifyToken is VerifyTokenClaims also returning the raw token claims
+func (s *AuthService) verifyToken(tokenString string) (*Claims, jwt.MapClaims, bool) {
+    token, err := s.parseToken(tokenString)
+
+    if err != nil || !token.Valid {
+        return nil, nil, false
+    }
 
     claims := token.Claims.(jwt.MapClaims)
-    username := claims["sub"].(string)
+    username, ok := claims["sub"].(string)
+    if !ok {
+        return nil, nil, false
+    }
 
-    s.mu.RLock()
-    _, exists := s.users[username]
-    s.mu.RUnlock()
+    jti, _ := claims["jti"].(string)
+    iat, _ := claims["iat"].(float64)
+    revoked, err := s.state.isRevoked(jti, username, issuedAtTime(iat))
+    if err != nil {
+        // Fail closed: a revoked token must not pass while the store is down
+        log.Printf("Failed to check token revocation: %v", err)
+        return nil, nil, false
+    }
+    if revoked {
+        return nil, nil, false
+    }
+
+    clientID, _ := claims["client_id"].(string)
+    if clientID != "" && clientID == username {
+        verified, ok := s.verifyClientToken(clientID, claims)
+        return verified, claims, ok
+    }
+
+    user, err := s.users.Get(username)
+    if err != nil || user.Disabled {
+        return nil, nil, false
+    }
+
+    role := user.Role
+    if role == "" {
+        role = RoleViewer
+    }
+
+    // Tokens issued through a client stop verifying once it is revoked and
+    // never carry more than it is registered for
+    scopes := s.grantedScopes(user)
+    if clientID != "" {
+        client, ok := s.activeOAuthClient(clientID)
+        if !ok {
+            return nil, nil, false
+        }
+        scopes = delegatedScopes(client, scopes)
+    }
+
+    return &Claims{
+        Subject: username,
+        Roles:   []string{role},
+        Scopes:  scopes,
+    }, claims, true
+}
+
+// Logout revokes an access token and, when given, the refresh token family
+// it was issued with
+func (s *AuthService) Logout(accessToken, refreshToken string) error {
+    token, err := s.parseToken(accessToken)
+    if err != nil || !token.Valid {
+        return ErrInvalidToken
+    }
+
+    claims := token.Claims.(jwt.MapClaims)
+    jti, _ := claims["jti"].(string)
+    exp, _ := claims["exp"].(float64)
+    if jti == "" {
+        return ErrInvalidToken
+    }
+
+    if refreshToken != "" {
+        record, exists, err := s.state.refreshToken(hashToken(refreshToken))
+        if err != nil {
+            return err
+        }
+        if exists {
+            if err := s.state.revokeRefreshTokens(refreshMatch{Family: record.Family}); err != nil {
+                return err
+            }
+        }
+    }
+
+    err = s.state.revokeToken(jti, time.Unix(int64(exp), 0))
+    s.decisions.clear()
+    return err
+}
+
+// RevokeUserSessions revokes every access and refresh token issued to a
+// user so far
+func (s *AuthService) RevokeUserSessions(username string) error {
+    if _, err := s.users.Get(username); err != nil {
+        return err
+    }
+
+    if err := s.state.revokeRefreshTokens(refreshMatch{Username: username}); err != nil {
+        return err
+    }
 
-    return username, exists
+    err := s.state.revokeUser(username)
+    s.decisions.clear()
+    return err
 }
@@ -0,0 +1,471 @@
+package service
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "log"
+    "math/big"
+    "net"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/config"
+)
+
+const (
+    caValidity = 10 * 365 * 24 * time.Hour
+    // crlValidity is how long a published CRL stays current. It is
+    // regenerated well before then and on every revocation.
+    crlValidity = 24 * time.Hour
+    // serverCertValidity is the lifetime of the TLS listener's own
+    // certificate, which is reissued on every start
+    serverCertValidity = 90 * 24 * time.Hour
+)
+
+var (
+    // ErrMTLSDisabled is returned by certificate operations when the local
+    // CA is not enabled
+    ErrMTLSDisabled = errors.New("mutual tls is not enabled")
+    // ErrInvalidCSR is returned for unparseable or badly signed requests
+    // and unsupported key types
+    ErrInvalidCSR = errors.New("invalid certificate signing request")
+    // ErrCertificateNotFound is returned for operations on unknown
+    // certificates
+    ErrCertificateNotFound = errors.New("certificate not found")
+    // ErrInvalidCertificate is returned for certificates not issued by the
+    // local CA, or expired or revoked ones
+    ErrInvalidCertificate = errors.New("invalid or revoked certificate")
+)
+
+// IssuedCertificate records a client certificate issued by the local CA.
+// The certificate's subject maps to Username, whose current role and scopes
+// apply to connections authenticated with it.
+type IssuedCertificate struct {
+    Serial      string     `json:"serial"`
+    Username    string     `json:"username"`
+    Fingerprint string     `json:"fingerprint"`
+    IssuedBy    string     `json:"issued_by"`
+    NotBefore   time.Time  `json:"not_before"`
+    NotAfter    time.Time  `json:"not_after"`
+    RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+// certificateAuthority is a small local CA that issues client certificates
+// and publishes a CRL. Issued certificates are recorded in a JSON file.
+type certificateAuthority struct {
+    cert    *x509.Certificate
+    certPEM []byte
+    key     crypto.Signer
+    ttl     time.Duration
+
+    mu      sync.Mutex
+    file    string
+    issued  map[string]*IssuedCertificate
+    crl     []byte
+    crlAt   time.Time
+    crlNext int64
+}
+
+// newCertificateAuthority loads the CA key and certificate, generating them
+// on first start
+func newCertificateAuthority(cfg config.MTLSConfig) (*certificateAuthority, error) {
+    ca := &certificateAuthority{
+        ttl:    cfg.CertTTL,
+        file:   filepath.Join(filepath.Dir(cfg.CACert), "certificates.json"),
+        issued: make(map[string]*IssuedCertificate),
+    }
+    if ca.ttl <= 0 {
+        ca.ttl = 90 * 24 * time.Hour
+    }
+
+    certPEM, certErr := os.ReadFile(cfg.CACert)
+    keyPEM, keyErr := os.ReadFile(cfg.CAKey)
+    if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+        var err error
+        if certPEM, keyPEM, err = generateCA(); err != nil {
+            return nil, err
+        }
+        if err := writeFileAtomic(cfg.CAKey, keyPEM, 0600); err != nil {
+            return nil, err
+        }
+        if err := writeFileAtomic(cfg.CACert, certPEM, 0644); err != nil {
+            return nil, err
+        }
+        log.Printf("Generated local certificate authority in %s", cfg.CACert)
+    } else if certErr != nil {
+        return nil, certErr
+    } else if keyErr != nil {
+        return nil, keyErr
+    }
+
+    pair, err := tls.X509KeyPair(certPEM, keyPEM)
+    if err != nil {
+        return nil, fmt.Errorf("invalid CA key pair: %v", err)
+    }
+    ca.cert, err = x509.ParseCertificate(pair.Certificate[0])
+    if err != nil {
+        return nil, err
+    }
+    signer, ok := pair.PrivateKey.(crypto.Signer)
+    if !ok || !ca.cert.IsCA {
+        return nil, fmt.Errorf("%s is not a CA certificate", cfg.CACert)
+    }
+    ca.key = signer
+    ca.certPEM = certPEM
+
+    if data, err := os.ReadFile(ca.file); err == nil {
+        if err := json.Unmarshal(data, &ca.issued); err != nil {
+            return nil, fmt.Errorf("failed to parse %s: %v", ca.file, err)
+        }
+    }
+    return ca, nil
+}
+
+// generateCA creates a self-signed ECDSA P-256 CA
+func generateCA() ([]byte, []byte, error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return nil, nil, err
+    }
+    serial, err := randomSerial()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    now := time.Now()
+    template := &x509.Certificate{
+        SerialNumber:          serial,
+        Subject:               pkix.Name{CommonName: "Edge Device Local CA"},
+        NotBefore:             now.Add(-5 * time.Minute),
+        NotAfter:              now.Add(caValidity),
+        KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+        MaxPathLenZero:        true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return nil, nil, err
+    }
+    keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+        pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+func randomSerial() (*big.Int, error) {
+    return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+}
+
+func (ca *certificateAuthority) saveLocked() error {
+    data, err := json.Marshal(ca.issued)
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(ca.file, data, 0600)
+}
+
+// sign issues a certificate for pub from template, filling in the serial,
+// validity and issuer
+func (ca *certificateAuthority) sign(template *x509.Certificate, pub crypto.PublicKey, ttl time.Duration) (*x509.Certificate, error) {
+    serial, err := randomSerial()
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now()
+    template.SerialNumber = serial
+    template.NotBefore = now.Add(-5 * time.Minute)
+    template.NotAfter = now.Add(ttl)
+    if template.NotAfter.After(ca.cert.NotAfter) {
+        template.NotAfter = ca.cert.NotAfter
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+    if err != nil {
+        return nil, err
+    }
+    return x509.ParseCertificate(der)
+}
+
+// IssueCertificate signs a PEM certificate signing request from or for
+// username and returns the PEM certificate. The subject is set to the
+// username whatever the request asks for.
+func (s *AuthService) IssueCertificate(username, issuedBy string, csrPEM []byte) ([]byte, IssuedCertificate, error) {
+    if s.ca == nil {
+        return nil, IssuedCertificate{}, ErrMTLSDisabled
+    }
+    if _, err := s.users.Get(username); err != nil {
+        return nil, IssuedCertificate{}, err
+    }
+
+    block, _ := pem.Decode(csrPEM)
+    if block == nil || block.Type != "CERTIFICATE REQUEST" {
+        return nil, IssuedCertificate{}, ErrInvalidCSR
+    }
+    csr, err := x509.ParseCertificateRequest(block.Bytes)
+    if err != nil || csr.CheckSignature() != nil {
+        return nil, IssuedCertificate{}, ErrInvalidCSR
+    }
+    switch pub := csr.PublicKey.(type) {
+    case *ecdsa.PublicKey, ed25519.PublicKey:
+    case *rsa.PublicKey:
+        if pub.N.BitLen() < 2048 {
+            return nil, IssuedCertificate{}, fmt.Errorf("%w: RSA keys must be at least 2048 bits", ErrInvalidCSR)
+        }
+    default:
+        return nil, IssuedCertificate{}, fmt.Errorf("%w: unsupported key type", ErrInvalidCSR)
+    }
+
+    cert, err := s.ca.sign(&x509.Certificate{
+        Subject:     pkix.Name{CommonName: username},
+        KeyUsage:    x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    }, csr.PublicKey, s.ca.ttl)
+    if err != nil {
+        return nil, IssuedCertificate{}, err
+    }
+
+    record := &IssuedCertificate{
+        Serial:      cert.SerialNumber.Text(16),
+        Username:    username,
+        Fingerprint: certificateFingerprint(cert),
+        IssuedBy:    issuedBy,
+        NotBefore:   cert.NotBefore,
+        NotAfter:    cert.NotAfter,
+    }
+
+    s.ca.mu.Lock()
+    s.ca.issued[record.Serial] = record
+    err = s.ca.saveLocked()
+    s.ca.mu.Unlock()
+    if err != nil {
+        return nil, IssuedCertificate{}, err
+    }
+
+    log.Printf("Issued client certificate %s for %s by %s", record.Serial, username, issuedBy)
+    return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), *record, nil
+}
+
+// ListCertificates returns the certificates issued to username, or every
+// certificate when username is empty
+func (s *AuthService) ListCertificates(username string) []IssuedCertificate {
+    if s.ca == nil {
+        return []IssuedCertificate{}
+    }
+
+    s.ca.mu.Lock()
+    defer s.ca.mu.Unlock()
+
+    certs := make([]IssuedCertificate, 0, len(s.ca.issued))
+    for _, record := range s.ca.issued {
+        if username == "" || record.Username == username {
+            certs = append(certs, *record)
+        }
+    }
+    sort.Slice(certs, func(i, j int) bool {
+        return certs[i].NotBefore.Before(certs[j].NotBefore)
+    })
+    return certs
+}
+
+// RevokeCertificate revokes a certificate and adds it to the CRL. A
+// non-empty owner restricts revocation to that user's certificates.
+func (s *AuthService) RevokeCertificate(serial, owner string) error {
+    if s.ca == nil {
+        return ErrMTLSDisabled
+    }
+
+    s.ca.mu.Lock()
+    record, exists := s.ca.issued[serial]
+    if !exists || (owner != "" && record.Username != owner) {
+        s.ca.mu.Unlock()
+        return ErrCertificateNotFound
+    }
+    if record.RevokedAt == nil {
+        now := time.Now()
+        record.RevokedAt = &now
+    }
+    s.ca.crl = nil
+    err := s.ca.saveLocked()
+    s.ca.mu.Unlock()
+
+    log.Printf("Client certificate %s of %s revoked", serial, record.Username)
+    s.decisions.clear()
+    return err
+}
+
+// CACertificate returns the PEM certificate of the local CA
+func (s *AuthService) CACertificate() ([]byte, error) {
+    if s.ca == nil {
+        return nil, ErrMTLSDisabled
+    }
+    return s.ca.certPEM, nil
+}
+
+// CRL returns the DER certificate revocation list of the local CA. It is
+// regenerated after revocations and before it goes stale.
+func (s *AuthService) CRL() ([]byte, error) {
+    if s.ca == nil {
+        return nil, ErrMTLSDisabled
+    }
+
+    s.ca.mu.Lock()
+    defer s.ca.mu.Unlock()
+
+    now := time.Now()
+    if s.ca.crl != nil && now.Sub(s.ca.crlAt) < crlValidity/2 {
+        return s.ca.crl, nil
+    }
+
+    var revoked []pkix.RevokedCertificate
+    for _, record := range s.ca.issued {
+        if record.RevokedAt == nil || now.After(record.NotAfter) {
+            continue
+        }
+        serial, ok := new(big.Int).SetString(record.Serial, 16)
+        if !ok {
+            continue
+        }
+        revoked = append(revoked, pkix.RevokedCertificate{
+            SerialNumber:   serial,
+            RevocationTime: *record.RevokedAt,
+        })
+    }
+
+    // CRL numbers must increase; the time keeps them increasing across
+    // restarts
+    number := now.UnixNano()
+    if number <= s.ca.crlNext {
+        number = s.ca.crlNext + 1
+    }
+    crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+        Number:              big.NewInt(number),
+        ThisUpdate:          now,
+        NextUpdate:          now.Add(crlValidity),
+        RevokedCertificates: revoked,
+    }, s.ca.cert, s.ca.key)
+    if err != nil {
+        return nil, err
+    }
+
+    s.ca.crl, s.ca.crlAt, s.ca.crlNext = crl, now, number
+    return crl, nil
+}
+
+// VerifyCertificate maps a client certificate to the claims of the user it
+// was issued to. The certificate must have been issued by the local CA and
+// be current and unrevoked, and the user must be enabled.
+func (s *AuthService) VerifyCertificate(cert *x509.Certificate) (*Claims, error) {
+    if s.ca == nil {
+        return nil, ErrMTLSDisabled
+    }
+
+    roots := x509.NewCertPool()
+    roots.AddCert(s.ca.cert)
+    _, err := cert.Verify(x509.VerifyOptions{
+        Roots:     roots,
+        KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    })
+    if err != nil {
+        return nil, ErrInvalidCertificate
+    }
+
+    s.ca.mu.Lock()
+    record, exists := s.ca.issued[cert.SerialNumber.Text(16)]
+    valid := exists && record.RevokedAt == nil && record.Fingerprint == certificateFingerprint(cert)
+    var username string
+    if valid {
+        username = record.Username
+    }
+    s.ca.mu.Unlock()
+    if !valid {
+        return nil, ErrInvalidCertificate
+    }
+
+    user, err := s.users.Get(username)
+    if err != nil || user.Disabled {
+        return nil, ErrInvalidCertificate
+    }
+
+    role := user.Role
+    if role == "" {
+        role = RoleViewer
+    }
+    return &Claims{
+        Subject: username,
+        Roles:   []string{role},
+        Scopes:  s.grantedScopes(user),
+    }, nil
+}
+
+// ServerTLSConfig returns the configuration for the auth service's own
+// mutual TLS listener, with a server certificate for names issued by the
+// local CA. Client certificates are verified when presented.
+func (s *AuthService) ServerTLSConfig(names []string) (*tls.Config, error) {
+    if s.ca == nil {
+        return nil, ErrMTLSDisabled
+    }
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+
+    template := &x509.Certificate{
+        KeyUsage:    x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }
+    if len(names) > 0 {
+        template.Subject = pkix.Name{CommonName: names[0]}
+    }
+    for _, name := range names {
+        if ip := net.ParseIP(name); ip != nil {
+            template.IPAddresses = append(template.IPAddresses, ip)
+        } else {
+            template.DNSNames = append(template.DNSNames, name)
+        }
+    }
+
+    cert, err := s.ca.sign(template, &key.PublicKey, serverCertValidity)
+    if err != nil {
+        return nil, err
+    }
+
+    pool := x509.NewCertPool()
+    pool.AddCert(s.ca.cert)
+    return &tls.Config{
+        Certificates: []tls.Certificate{{
+            Certificate: [][]byte{cert.Raw, s.ca.cert.Raw},
+            PrivateKey:  key,
+            Leaf:        cert,
+        }},
+        ClientAuth: tls.VerifyClientCertIfGiven,
+        ClientCAs:  pool,
+        MinVersion: tls.VersionTLS12,
+    }, nil
+}
+
+func certificateFingerprint(cert *x509.Certificate) string {
+    sum := sha256.Sum256(cert.Raw)
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "errors"
+    "path/filepath"
+    "testing"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/config"
+)
+
+func newTestCSR(t *testing.T, commonName string) []byte {
+    t.Helper()
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatalf("Failed to generate key: %v", err)
+    }
+    der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+        Subject: pkix.Name{CommonName: commonName},
+    }, key)
+    if err != nil {
+        t.Fatalf("Failed to create CSR: %v", err)
+    }
+    return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+// caConfig keeps the CA certificate and key in dir
+func caConfig(dir string) config.MTLSConfig {
+    return config.MTLSConfig{
+        CACert: filepath.Join(dir, "ca.crt"),
+        CAKey:  filepath.Join(dir, "ca.key"),
+    }
+}
+
+func TestClientCertificates(t *testing.T) {
+    service, dir := newTestService(t)
+    if _, _, err := service.IssueCertificate("alice", "alice", nil); !errors.Is(err, ErrMTLSDisabled) {
+        t.Errorf("Expected ErrMTLSDisabled, got %v", err)
+    }
+
+    ca, err := newCertificateAuthority(caConfig(dir))
+    if err != nil {
+        t.Fatalf("Failed to create CA: %v", err)
+    }
+    service.ca = ca
+    service.AddUser("alice", "password", RoleOperator)
+
+    if _, _, err := service.IssueCertificate("alice", "alice", []byte("garbage")); !errors.Is(err, ErrInvalidCSR) {
+        t.Errorf("Expected ErrInvalidCSR, got %v", err)
+    }
+
+    // The subject is the user whatever the request asks for
+    certPEM, info, err := service.IssueCertificate("alice", "alice", newTestCSR(t, "root"))
+    if err != nil {
+        t.Fatalf("IssueCertificate failed: %v", err)
+    }
+    block, _ := pem.Decode(certPEM)
+    cert, err := x509.ParseCertificate(block.Bytes)
+    if err != nil || cert.Subject.CommonName != "alice" {
+        t.Fatalf("Expected certificate for alice, got %v", err)
+    }
+
+    claims, err := service.VerifyCertificate(cert)
+    if err != nil || claims.Subject != "alice" || claims.Roles[0] != RoleOperator {
+        t.Fatalf("Expected operator claims for alice, got %+v, %v", claims, err)
+    }
+
+    // A reloaded CA keeps its key and issued certificates
+    reloaded, err := newCertificateAuthority(caConfig(dir))
+    if err != nil {
+        t.Fatalf("Failed to reload CA: %v", err)
+    }
+    service.ca = reloaded
+    if _, err := service.VerifyCertificate(cert); err != nil {
+        t.Fatalf("Expected certificate to verify after reload, got %v", err)
+    }
+
+    if err := service.RevokeCertificate(info.Serial, "bob"); !errors.Is(err, ErrCertificateNotFound) {
+        t.Errorf("Expected other users not to revoke the certificate, got %v", err)
+    }
+    if err := service.RevokeCertificate(info.Serial, "alice"); err != nil {
+        t.Fatalf("RevokeCertificate failed: %v", err)
+    }
+    if _, err := service.VerifyCertificate(cert); !errors.Is(err, ErrInvalidCertificate) {
+        t.Errorf("Expected revoked certificate to be rejected, got %v", err)
+    }
+
+    der, err := service.CRL()
+    if err != nil {
+        t.Fatalf("CRL failed: %v", err)
+    }
+    crl, err := x509.ParseRevocationList(der)
+    if err != nil || crl.CheckSignatureFrom(reloaded.cert) != nil {
+        t.Fatalf("Invalid CRL: %v", err)
+    }
+    if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(cert.SerialNumber) != 0 {
+        t.Errorf("Expected CRL to list the revoked certificate, got %+v", crl.RevokedCertificateEntries)
+    }
+}
+
+func TestCertificateFromOtherCA(t *testing.T) {
+    service, dir := newTestService(t)
+    service.AddUser("alice", "password", RoleViewer)
+
+    other, err := newCertificateAuthority(caConfig(t.TempDir()))
+    if err != nil {
+        t.Fatalf("Failed to create CA: %v", err)
+    }
+    service.ca = other
+    certPEM, _, err := service.IssueCertificate("alice", "alice", newTestCSR(t, "alice"))
+    if err != nil {
+        t.Fatalf("IssueCertificate failed: %v", err)
+    }
+
+    service.ca, err = newCertificateAuthority(caConfig(dir))
+    if err != nil {
+        t.Fatalf("Failed to create CA: %v", err)
+    }
+    block, _ := pem.Decode(certPEM)
+    cert, _ := x509.ParseCertificate(block.Bytes)
+    if _, err := service.VerifyCertificate(cert); !errors.Is(err, ErrInvalidCertificate) {
+        t.Errorf("Expected certificate from another CA to be rejected, got %v", err)
+    }
+}
+
+func TestDeleteUserRevokesCertificates(t *testing.T) {
+    service, dir := newTestService(t)
+    ca, err := newCertificateAuthority(caConfig(dir))
+    if err != nil {
+        t.Fatalf("Failed to create CA: %v", err)
+    }
+    service.ca = ca
+    service.AddUser("alice", "password", RoleOperator)
+    service.AddUser("bob", "password", RoleOperator)
+
+    _, alice, err := service.IssueCertificate("alice", "alice", newTestCSR(t, "alice"))
+    if err != nil {
+        t.Fatalf("IssueCertificate failed: %v", err)
+    }
+    if _, _, err := service.IssueCertificate("bob", "bob", newTestCSR(t, "bob")); err != nil {
+        t.Fatalf("IssueCertificate failed: %v", err)
+    }
+
+    if err := service.DeleteUser("alice"); err != nil {
+        t.Fatalf("DeleteUser failed: %v", err)
+    }
+    for _, cert := range service.ListCertificates("") {
+        if revoked := cert.RevokedAt != nil; revoked != (cert.Username == "alice") {
+            t.Errorf("Expected only alice's certificate to be revoked, got %s revoked=%v", cert.Username, revoked)
+        }
+    }
+
+    der, err := service.CRL()
+    if err != nil {
+        t.Fatalf("CRL failed: %v", err)
+    }
+    crl, err := x509.ParseRevocationList(der)
+    if err != nil {
+        t.Fatalf("Invalid CRL: %v", err)
+    }
+    if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Text(16) != alice.Serial {
+        t.Errorf("Expected CRL to list alice's certificate %s, got %+v", alice.Serial, crl.RevokedCertificateEntries)
+    }
+}
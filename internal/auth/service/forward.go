@@ -0,0 +1,137 @@
+package service
+
+import (
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/middleware/auth"
+)
+
+var forwardAuthDecisions = promauto.NewCounterVec(
+    prometheus.CounterOpts{
+        Name: "auth_forward_auth_decisions_total",
+        Help: "Number of forward-auth decisions by result (allowed, unauthorized, forbidden) and whether they came from the cache",
+    },
+    []string{"result", "cached"},
+)
+
+// decisionCacheMaxEntries bounds the decision cache; it is emptied when full
+const decisionCacheMaxEntries = 10000
+
+// decision is a cached credential check. A nil claims records a rejected
+// credential.
+type decision struct {
+    claims    *Claims
+    expiresAt time.Time
+}
+
+// decisionCache remembers recent credential checks for forward auth, keyed
+// by the hash of the credential and, for API keys, the client address.
+// Revoking sessions or keys empties it; other changes such as a new role
+// take effect once entries expire.
+type decisionCache struct {
+    mu        sync.Mutex
+    ttl       time.Duration
+    decisions map[string]decision
+}
+
+func newDecisionCache(ttl time.Duration) *decisionCache {
+    return &decisionCache{
+        ttl:       ttl,
+        decisions: make(map[string]decision),
+    }
+}
+
+func (d *decisionCache) get(key string) (decision, bool) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    entry, found := d.decisions[key]
+    if !found || time.Now().After(entry.expiresAt) {
+        return decision{}, false
+    }
+    return entry, true
+}
+
+func (d *decisionCache) put(key string, claims *Claims) {
+    if d.ttl <= 0 {
+        return
+    }
+
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    now := time.Now()
+    if len(d.decisions) >= decisionCacheMaxEntries {
+        for k, entry := range d.decisions {
+            if now.After(entry.expiresAt) {
+                delete(d.decisions, k)
+            }
+        }
+        if len(d.decisions) >= decisionCacheMaxEntries {
+            d.decisions = make(map[string]decision)
+        }
+    }
+    d.decisions[key] = decision{claims: claims, expiresAt: now.Add(d.ttl)}
+}
+
+func (d *decisionCache) clear() {
+    d.mu.Lock()
+    d.decisions = make(map[string]decision)
+    d.mu.Unlock()
+}
+
+// ForwardAuth checks a bearer token or, when token is empty, an API key
+// presented from remoteIP, for use by a reverse proxy on every request.
+// The identity must hold some scope within each of the required scope
+// patterns, e.g. any gpio scope for "gpio:*"; backends still check the
+// exact scope. Credential checks are cached briefly.
+func (s *AuthService) ForwardAuth(token, apiKey, remoteIP string, required []string) (*Claims, error) {
+    var key string
+    if token != "" {
+        key = "token:" + hashToken(token)
+    } else {
+        key = "apikey:" + hashToken(apiKey) + ":" + remoteIP
+    }
+
+    cached := "true"
+    entry, found := s.decisions.get(key)
+    if !found {
+        cached = "false"
+        if token != "" {
+            entry.claims, _ = s.VerifyTokenClaims(token)
+        } else {
+            entry.claims, _ = s.VerifyAPIKey(apiKey, remoteIP)
+        }
+        s.decisions.put(key, entry.claims)
+    }
+
+    if entry.claims == nil {
+        forwardAuthDecisions.WithLabelValues("unauthorized", cached).Inc()
+        return nil, ErrInvalidToken
+    }
+
+    identity := &auth.Identity{Scopes: entry.claims.Scopes}
+    for _, pattern := range required {
+        if !identity.HasScope(pattern) && !withinScope(entry.claims.Scopes, pattern) {
+            forwardAuthDecisions.WithLabelValues("forbidden", cached).Inc()
+            return entry.claims, ErrScopeNotGranted
+        }
+    }
+
+    forwardAuthDecisions.WithLabelValues("allowed", cached).Inc()
+    return entry.claims, nil
+}
+
+// withinScope reports whether any granted scope falls within pattern
+func withinScope(granted []string, pattern string) bool {
+    for _, scope := range granted {
+        if auth.MatchScope(pattern, scope) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestForwardAuth(t *testing.T) {
+    service, _ := newTestService(t)
+    service.decisions = newDecisionCache(time.Minute)
+    service.AddUser("alice", "password", RoleViewer)
+    token, err := service.CreateToken("alice")
+    if err != nil {
+        t.Fatalf("CreateToken failed: %v", err)
+    }
+
+    claims, err := service.ForwardAuth(token, "", "10.0.0.1", []string{"gpio:*"})
+    if err != nil || claims.Subject != "alice" {
+        t.Fatalf("Expected viewer to pass gpio:*, got %v", err)
+    }
+    if _, err := service.ForwardAuth(token, "", "10.0.0.1", []string{"gpio:*", "gpio:write:*"}); !errors.Is(err, ErrScopeNotGranted) {
+        t.Errorf("Expected ErrScopeNotGranted for writes, got %v", err)
+    }
+    if _, err := service.ForwardAuth("garbage", "", "10.0.0.1", nil); !errors.Is(err, ErrInvalidToken) {
+        t.Errorf("Expected ErrInvalidToken, got %v", err)
+    }
+
+    // Cached decisions survive user changes until revocation clears them
+    service.users.Update("alice", func(user *User) error {
+        user.Role = RoleOperator
+        return nil
+    })
+    if _, err := service.ForwardAuth(token, "", "10.0.0.1", []string{"gpio:write:*"}); !errors.Is(err, ErrScopeNotGranted) {
+        t.Errorf("Expected cached viewer decision, got %v", err)
+    }
+
+    if err := service.RevokeUserSessions("alice"); err != nil {
+        t.Fatalf("Revoke failed: %v", err)
+    }
+    if _, err := service.ForwardAuth(token, "", "10.0.0.1", nil); !errors.Is(err, ErrInvalidToken) {
+        t.Errorf("Expected revoked token to be rejected, got %v", err)
+    }
+}
+
+func TestWithinScope(t *testing.T) {
+    tests := []struct {
+        granted []string
+        pattern string
+        want    bool
+    }{
+        {[]string{"gpio:write:17"}, "gpio:*", true},
+        {[]string{"gpio:write:17"}, "gpio:write:*", true},
+        {[]string{"gpio:read:*"}, "gpio:write:*", false},
+        {[]string{"metrics:read:*"}, "gpio:*", false},
+    }
+    for _, test := range tests {
+        if got := withinScope(test.granted, test.pattern); got != test.want {
+            t.Errorf("withinScope(%v, %q) = %v, want %v", test.granted, test.pattern, got, test.want)
+        }
+    }
+}
@@ -0,0 +1,374 @@
+package service
+
+import (
+    "crypto"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/dgrijalva/jwt-go"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/jwks"
+)
+
+// keyRotationCheckInterval is how often the key manager checks whether the
+// active key is due for rotation
+const keyRotationCheckInterval = time.Hour
+
+// signingKey is a persisted asymmetric token signing key
+type signingKey struct {
+    ID         string     `json:"kid"`
+    Algorithm  string     `json:"alg"`
+    CreatedAt  time.Time  `json:"created_at"`
+    RetiredAt  *time.Time `json:"retired_at,omitempty"`
+    PrivateKey string     `json:"private_key"`
+
+    signer crypto.Signer
+}
+
+// keyReloadInterval limits how often the key manager reloads the keys from
+// the store to find a key another instance rotated to
+const keyReloadInterval = 10 * time.Second
+
+// keyManager owns the signing keys. The newest key signs new tokens;
+// retired keys are still published and accepted for the overlap window so
+// that tokens signed before a rotation stay valid until they expire. Keys
+// live in the state store, so every instance signs with and accepts the
+// same ones; the manager caches them and reloads when it sees an unknown
+// key ID.
+type keyManager struct {
+    mu         sync.RWMutex
+    store      StateStore
+    algorithm  string
+    rotation   time.Duration
+    overlap    time.Duration
+    keys       []*signingKey
+    lastReload time.Time
+}
+
+func newKeyManager(store StateStore, algorithm string, rotation, overlap time.Duration) (*keyManager, error) {
+    if algorithm != jwks.AlgRS256 && algorithm != jwks.AlgEdDSA {
+        return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+    }
+
+    m := &keyManager{
+        store:     store,
+        algorithm: algorithm,
+        rotation:  rotation,
+        overlap:   overlap,
+    }
+    if err := m.rotateIfDue(); err != nil {
+        return nil, err
+    }
+    return m, nil
+}
+
+// active returns the key used to sign new tokens
+func (m *keyManager) active() *signingKey {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    if len(m.keys) == 0 {
+        return nil
+    }
+    return m.keys[len(m.keys)-1]
+}
+
+// needsRotation reports whether key cannot stay the active key, because
+// there is none, it uses another algorithm or it is older than the
+// rotation interval
+func (m *keyManager) needsRotation(key *signingKey) bool {
+    return key == nil || key.Algorithm != m.algorithm ||
+        (m.rotation > 0 && time.Since(key.CreatedAt) >= m.rotation)
+}
+
+// sign signs claims with the active key and sets the kid header
+func (m *keyManager) sign(claims jwt.MapClaims) (string, error) {
+    key := m.active()
+    if key == nil {
+        return "", errors.New("no signing key available")
+    }
+
+    var method jwt.SigningMethod = jwt.SigningMethodRS256
+    if key.Algorithm == jwks.AlgEdDSA {
+        method = jwks.SigningMethodEdDSA
+    }
+
+    token := jwt.NewWithClaims(method, claims)
+    token.Header["kid"] = key.ID
+    return token.SignedString(key.signer)
+}
+
+// keyFunc resolves the verification key for a token by its kid header
+func (m *keyManager) keyFunc(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+
+    key := m.find(kid)
+    if key == nil {
+        // Another instance may have rotated to a key not loaded here yet
+        m.reloadIfStale()
+        key = m.find(kid)
+    }
+    if key == nil {
+        return nil, fmt.Errorf("unknown key id %q", kid)
+    }
+    if token.Method.Alg() != key.Algorithm {
+        return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+    }
+    return key.signer.Public(), nil
+}
+
+func (m *keyManager) find(kid string) *signingKey {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    for _, key := range m.keys {
+        if key.ID == kid {
+            return key
+        }
+    }
+    return nil
+}
+
+// publicKeys returns the JWKS for every key that may have signed a valid token
+func (m *keyManager) publicKeys() jwks.Set {
+    m.reloadIfStale()
+
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    set := jwks.Set{Keys: make([]jwks.Key, 0, len(m.keys))}
+    for _, key := range m.keys {
+        jwk, err := jwks.NewKey(key.ID, key.signer.Public())
+        if err != nil {
+            continue
+        }
+        set.Keys = append(set.Keys, jwk)
+    }
+    return set
+}
+
+// rotate generates a new active key, retires the previous one and drops
+// keys retired longer than the overlap window
+func (m *keyManager) rotate() error {
+    return m.update(m.rotated)
+}
+
+// rotateIfDue rotates unless the active key, as stored, can stay active.
+// The check is repeated inside the update so that instances starting or
+// rotating together add a single key.
+func (m *keyManager) rotateIfDue() error {
+    if err := m.reload(); err != nil {
+        return err
+    }
+    if !m.needsRotation(m.active()) {
+        return nil
+    }
+
+    return m.update(func(keys []*signingKey) ([]*signingKey, error) {
+        if len(keys) > 0 && !m.needsRotation(keys[len(keys)-1]) {
+            return keys, nil
+        }
+        return m.rotated(keys)
+    })
+}
+
+// rotated returns keys with a new active key added, the others retired and
+// those retired longer than the overlap window dropped
+func (m *keyManager) rotated(keys []*signingKey) ([]*signingKey, error) {
+    key, err := generateSigningKey(m.algorithm)
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now()
+    kept := make([]*signingKey, 0, len(keys)+1)
+    for _, k := range keys {
+        if k.RetiredAt == nil {
+            k.RetiredAt = &now
+        }
+        if now.Sub(*k.RetiredAt) < m.overlap {
+            kept = append(kept, k)
+        }
+    }
+
+    log.Printf("Rotated token signing key, new kid %s", key.ID)
+    return append(kept, key), nil
+}
+
+// update applies fn to the stored keys and caches the result
+func (m *keyManager) update(fn func([]*signingKey) ([]*signingKey, error)) error {
+    var updated []*signingKey
+    err := m.store.updateSigningKeys(func(keys []*signingKey) ([]*signingKey, error) {
+        keys, err := fn(keys)
+        updated = keys
+        return keys, err
+    })
+    if err != nil {
+        return err
+    }
+
+    m.mu.Lock()
+    m.keys = updated
+    m.lastReload = time.Now()
+    m.mu.Unlock()
+    return nil
+}
+
+// runRotation rotates the active key whenever it is older than the
+// rotation interval, and otherwise picks up keys rotated by other
+// instances, for the lifetime of the process
+func (m *keyManager) runRotation() {
+    ticker := time.NewTicker(keyRotationCheckInterval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        if err := m.rotateIfDue(); err != nil {
+            log.Printf("Failed to rotate signing key: %v", err)
+        }
+    }
+}
+
+func (m *keyManager) reload() error {
+    keys, err := m.store.signingKeys()
+    if err != nil {
+        return err
+    }
+
+    m.mu.Lock()
+    m.keys = keys
+    m.lastReload = time.Now()
+    m.mu.Unlock()
+    return nil
+}
+
+// reloadIfStale reloads the keys unless that was done within
+// keyReloadInterval, keeping the cached keys if the store fails
+func (m *keyManager) reloadIfStale() {
+    m.mu.RLock()
+    stale := time.Since(m.lastReload) >= keyReloadInterval
+    m.mu.RUnlock()
+    if !stale {
+        return
+    }
+
+    if err := m.reload(); err != nil {
+        log.Printf("Failed to reload signing keys: %v", err)
+    }
+}
+
+// signingKeyFile keeps the signing keys in a JSON file
+type signingKeyFile struct {
+    mu   sync.Mutex
+    file string
+}
+
+func (f *signingKeyFile) signingKeys() ([]*signingKey, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    return f.load()
+}
+
+func (f *signingKeyFile) updateSigningKeys(fn func([]*signingKey) ([]*signingKey, error)) error {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    keys, err := f.load()
+    if err != nil {
+        return err
+    }
+    keys, err = fn(keys)
+    if err != nil {
+        return err
+    }
+
+    data, err := json.MarshalIndent(keys, "", "  ")
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(f.file, data, 0600)
+}
+
+func (f *signingKeyFile) load() ([]*signingKey, error) {
+    data, err := os.ReadFile(f.file)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read signing keys: %v", err)
+    }
+
+    var keys []*signingKey
+    if err := json.Unmarshal(data, &keys); err != nil {
+        return nil, fmt.Errorf("failed to parse signing keys: %v", err)
+    }
+    for _, key := range keys {
+        if err := key.parse(); err != nil {
+            return nil, err
+        }
+    }
+    return keys, nil
+}
+
+// parse loads the signer from the PEM encoded private key
+func (k *signingKey) parse() error {
+    block, _ := pem.Decode([]byte(k.PrivateKey))
+    if block == nil {
+        return fmt.Errorf("invalid PEM for signing key %s", k.ID)
+    }
+    parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return fmt.Errorf("invalid signing key %s: %v", k.ID, err)
+    }
+    signer, ok := parsed.(crypto.Signer)
+    if !ok {
+        return fmt.Errorf("signing key %s is not a signer", k.ID)
+    }
+    k.signer = signer
+    return nil
+}
+
+func generateSigningKey(algorithm string) (*signingKey, error) {
+    var signer crypto.Signer
+    var err error
+
+    switch algorithm {
+    case jwks.AlgRS256:
+        signer, err = rsa.GenerateKey(rand.Reader, 2048)
+    case jwks.AlgEdDSA:
+        _, signer, err = ed25519.GenerateKey(rand.Reader)
+    default:
+        err = fmt.Errorf("unsupported signing algorithm %q", algorithm)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    der, err := x509.MarshalPKCS8PrivateKey(signer)
+    if err != nil {
+        return nil, err
+    }
+
+    kid, err := randomToken(12)
+    if err != nil {
+        return nil, err
+    }
+
+    return &signingKey{
+        ID:         kid,
+        Algorithm:  algorithm,
+        CreatedAt:  time.Now(),
+        PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+        signer:     signer,
+    }, nil
+}
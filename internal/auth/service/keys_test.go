@@ -0,0 +1,88 @@
+package service
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/jwks"
+)
+
+func TestKeyRotationOverlap(t *testing.T) {
+    service, dir := newTestService(t)
+    keysFile := filepath.Join(dir, "signing_keys.json")
+    keys, err := newKeyManager(service.state, jwks.AlgEdDSA, 0, time.Hour)
+    if err != nil {
+        t.Fatalf("Failed to create key manager: %v", err)
+    }
+    service.keys = keys
+    service.AddUser("alice", "password", RoleViewer)
+
+    before, err := service.CreateToken("alice")
+    if err != nil {
+        t.Fatalf("CreateToken failed: %v", err)
+    }
+    first := keys.active()
+
+    if err := keys.rotate(); err != nil {
+        t.Fatalf("Rotate failed: %v", err)
+    }
+    if keys.active().ID == first.ID {
+        t.Fatal("Expected rotation to activate a new key")
+    }
+    if set := service.JWKS(); len(set.Keys) != 2 {
+        t.Errorf("Expected the retired key to stay published, got %d keys", len(set.Keys))
+    }
+
+    // Tokens signed before the rotation stay valid during the overlap
+    if _, ok := service.VerifyTokenClaims(before); !ok {
+        t.Error("Expected token signed with the retired key to verify")
+    }
+    after, err := service.CreateToken("alice")
+    if err != nil {
+        t.Fatalf("CreateToken failed: %v", err)
+    }
+    token, err := service.parseToken(after)
+    if err != nil || token.Header["kid"] != keys.active().ID {
+        t.Errorf("Expected new tokens to be signed with the active key, got %v", err)
+    }
+
+    // A reloaded manager keeps the same keys
+    reloaded, err := newKeyManager(service.state, jwks.AlgEdDSA, 0, time.Hour)
+    if err != nil {
+        t.Fatalf("Failed to reload keys: %v", err)
+    }
+    if reloaded.active().ID != keys.active().ID {
+        t.Errorf("Expected active key %s after reload, got %s", keys.active().ID, reloaded.active().ID)
+    }
+
+    // Keys retired longer than the overlap are dropped at the next rotation
+    err = service.state.updateSigningKeys(func(stored []*signingKey) ([]*signingKey, error) {
+        retired := time.Now().Add(-2 * time.Hour)
+        stored[0].RetiredAt = &retired
+        return stored, nil
+    })
+    if err != nil {
+        t.Fatalf("Failed to update keys: %v", err)
+    }
+    if err := keys.rotate(); err != nil {
+        t.Fatalf("Rotate failed: %v", err)
+    }
+    if _, ok := service.VerifyTokenClaims(before); ok {
+        t.Error("Expected token signed with an expired key to be rejected")
+    }
+    if _, ok := service.VerifyTokenClaims(after); !ok {
+        t.Error("Expected token signed with the key retired within the overlap to verify")
+    }
+    if set := service.JWKS(); len(set.Keys) != 2 {
+        t.Errorf("Expected 2 published keys, got %d", len(set.Keys))
+    }
+
+    if err := os.WriteFile(keysFile, []byte("["), 0600); err != nil {
+        t.Fatalf("Failed to corrupt keys: %v", err)
+    }
+    if _, err := newKeyManager(service.state, jwks.AlgEdDSA, 0, time.Hour); err == nil {
+        t.Error("Expected a corrupt key file to be an error")
+    }
+}
@@ -0,0 +1,255 @@
+package service
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/config"
+)
+
+var (
+    loginAttempts = promauto.NewCounterVec(
+        prometheus.CounterOpts{
+            Name: "auth_login_attempts_total",
+            Help: "Number of login attempts by result (success, invalid_credentials, throttled, locked, disabled)",
+        },
+        []string{"result"},
+    )
+    loginLockouts = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "auth_login_lockouts_total",
+        Help: "Number of accounts temporarily locked after repeated failed logins",
+    })
+)
+
+// limiterGCInterval is how often idle limiter entries are dropped
+const limiterGCInterval = 10 * time.Minute
+
+var (
+    // ErrInvalidCredentials is returned for a wrong username or password
+    ErrInvalidCredentials = errors.New("invalid credentials")
+    // ErrAccountLocked is returned while an account is locked after too
+    // many failed logins
+    ErrAccountLocked = errors.New("account temporarily locked")
+)
+
+// ThrottledError is returned when a login is attempted before the backoff
+// from earlier failures has elapsed
+type ThrottledError struct {
+    RetryAfter time.Duration
+    Locked     bool
+}
+
+func (e *ThrottledError) Error() string {
+    if e.Locked {
+        return fmt.Sprintf("%v, retry in %s", ErrAccountLocked, e.RetryAfter.Round(time.Second))
+    }
+    return fmt.Sprintf("too many failed login attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+func (e *ThrottledError) Unwrap() error {
+    if e.Locked {
+        return ErrAccountLocked
+    }
+    return nil
+}
+
+// failureRecord tracks failed logins for one username or IP address
+type failureRecord struct {
+    failures     int
+    lastFailure  time.Time
+    blockedUntil time.Time
+    lockedUntil  time.Time
+}
+
+// loginLimiter applies exponential backoff per username and per client IP
+// once the free attempts are used up, and locks a username after the
+// lockout threshold. Failures are forgotten after a quiet period as long as
+// the lockout duration. State is kept in memory per auth instance.
+type loginLimiter struct {
+    mu     sync.Mutex
+    config config.LoginConfig
+    users  map[string]*failureRecord
+    ips    map[string]*failureRecord
+}
+
+func newLoginLimiter(cfg config.LoginConfig) *loginLimiter {
+    return &loginLimiter{
+        config: cfg,
+        users:  make(map[string]*failureRecord),
+        ips:    make(map[string]*failureRecord),
+    }
+}
+
+// check returns a ThrottledError when a login for username from ip must
+// not be attempted yet
+func (l *loginLimiter) check(username, ip string) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    now := time.Now()
+    if record := l.users[username]; record != nil {
+        if now.Before(record.lockedUntil) {
+            return &ThrottledError{RetryAfter: record.lockedUntil.Sub(now), Locked: true}
+        }
+        if now.Before(record.blockedUntil) {
+            return &ThrottledError{RetryAfter: record.blockedUntil.Sub(now)}
+        }
+    }
+    if record := l.ips[ip]; record != nil && now.Before(record.blockedUntil) {
+        return &ThrottledError{RetryAfter: record.blockedUntil.Sub(now)}
+    }
+    return nil
+}
+
+// fail records a failed login and reports whether it locked the account
+func (l *loginLimiter) fail(username, ip string) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    now := time.Now()
+    user := l.record(l.users, username, now)
+    l.backoff(user, l.config.FreeAttempts, now)
+
+    locked := false
+    if l.config.LockoutThreshold > 0 && user.failures >= l.config.LockoutThreshold {
+        user.lockedUntil = now.Add(l.config.LockoutDuration)
+        user.failures = 0
+        locked = true
+    }
+
+    l.backoff(l.record(l.ips, ip, now), l.config.IPFreeAttempts, now)
+    return locked
+}
+
+// succeed clears the username's failures. The IP record is kept so that a
+// valid account cannot be used to reset the backoff for guessing others.
+func (l *loginLimiter) succeed(username string) {
+    l.mu.Lock()
+    delete(l.users, username)
+    l.mu.Unlock()
+}
+
+// unlock clears any lockout and backoff for username
+func (l *loginLimiter) unlock(username string) {
+    l.succeed(username)
+}
+
+// record returns the entry for key, starting over when its failures are
+// older than the lockout duration. The caller must hold l.mu.
+func (l *loginLimiter) record(records map[string]*failureRecord, key string, now time.Time) *failureRecord {
+    record := records[key]
+    if record == nil || (now.Sub(record.lastFailure) > l.config.LockoutDuration && now.After(record.lockedUntil)) {
+        record = &failureRecord{}
+        records[key] = record
+    }
+    return record
+}
+
+// backoff counts a failure and blocks further attempts for an exponentially
+// growing delay once free attempts are used up. The caller must hold l.mu.
+func (l *loginLimiter) backoff(record *failureRecord, free int, now time.Time) {
+    record.failures++
+    record.lastFailure = now
+
+    excess := record.failures - free + 1
+    if excess <= 0 || l.config.BackoffBase <= 0 {
+        return
+    }
+
+    delay := l.config.BackoffBase
+    for i := 1; i < excess && delay < l.config.BackoffMax; i++ {
+        delay *= 2
+    }
+    if l.config.BackoffMax > 0 && delay > l.config.BackoffMax {
+        delay = l.config.BackoffMax
+    }
+    record.blockedUntil = now.Add(delay)
+}
+
+// collectGarbage drops entries with no recent failures and no active block
+func (l *loginLimiter) collectGarbage() {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    now := time.Now()
+    for _, records := range []map[string]*failureRecord{l.users, l.ips} {
+        for key, record := range records {
+            if now.Sub(record.lastFailure) > l.config.LockoutDuration &&
+                now.After(record.lockedUntil) && now.After(record.blockedUntil) {
+                delete(records, key)
+            }
+        }
+    }
+}
+
+// runGC periodically collects garbage for the lifetime of the process
+func (l *loginLimiter) runGC() {
+    ticker := time.NewTicker(limiterGCInterval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        l.collectGarbage()
+    }
+}
+
+// Authenticate checks a username and password presented from ip, applying
+// login rate limits. Unknown users cost the same hash comparison as known
+// ones so that response times do not reveal which usernames exist. Hashes
+// made with an outdated algorithm or cost are replaced on success. Failures
+// of users with a second factor are only cleared once it is passed.
+func (s *AuthService) Authenticate(username, password, ip string) error {
+    if err := s.limiter.check(username, ip); err != nil {
+        result := "throttled"
+        if errors.Is(err, ErrAccountLocked) {
+            result = "locked"
+        }
+        loginAttempts.WithLabelValues(result).Inc()
+        return err
+    }
+
+    hash := s.dummyHash
+    user, err := s.users.Get(username)
+    if err == nil {
+        hash = user.Hash
+    }
+
+    ok, rehash := s.passwords.verify(hash, password)
+    if !ok || err != nil {
+        loginAttempts.WithLabelValues("invalid_credentials").Inc()
+        if s.limiter.fail(username, ip) {
+            loginLockouts.Inc()
+            log.Printf("Locked account %s after repeated failed logins from %s", username, ip)
+        }
+        return ErrInvalidCredentials
+    }
+
+    if !user.TOTPEnabled {
+        s.limiter.succeed(username)
+    }
+    if rehash {
+        s.rehashPassword(username, user.Hash, password)
+    }
+    if user.Disabled {
+        loginAttempts.WithLabelValues("disabled").Inc()
+        return ErrAccountDisabled
+    }
+    loginAttempts.WithLabelValues("success").Inc()
+    return nil
+}
+
+// UnlockUser clears a lockout and login backoff for username
+func (s *AuthService) UnlockUser(username string) error {
+    if _, err := s.users.Get(username); err != nil {
+        return err
+    }
+
+    s.limiter.unlock(username)
+    log.Printf("Unlocked account %s", username)
+    return nil
+}
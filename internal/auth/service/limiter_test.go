@@ -0,0 +1,112 @@
+package service
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/config"
+)
+
+var testLoginConfig = config.LoginConfig{
+    FreeAttempts:     3,
+    IPFreeAttempts:   10,
+    BackoffBase:      time.Second,
+    BackoffMax:       time.Minute,
+    LockoutThreshold: 5,
+    LockoutDuration:  15 * time.Minute,
+}
+
+func TestLoginLimiterBackoff(t *testing.T) {
+    limiter := newLoginLimiter(testLoginConfig)
+
+    for i := 0; i < testLoginConfig.FreeAttempts; i++ {
+        if err := limiter.check("alice", "10.0.0.1"); err != nil {
+            t.Fatalf("Attempt %d throttled: %v", i+1, err)
+        }
+        limiter.fail("alice", "10.0.0.1")
+    }
+
+    var throttled *ThrottledError
+    if err := limiter.check("alice", "10.0.0.1"); !errors.As(err, &throttled) || throttled.Locked {
+        t.Fatalf("Expected backoff after free attempts, got %v", err)
+    }
+
+    // Each further failure doubles the delay
+    limiter.fail("alice", "10.0.0.1")
+    limiter.check("alice", "10.0.0.1")
+    err := limiter.check("alice", "10.0.0.1")
+    if !errors.As(err, &throttled) || throttled.RetryAfter <= time.Second {
+        t.Errorf("Expected doubled backoff, got %v", err)
+    }
+
+    // Other users from other addresses are unaffected
+    if err := limiter.check("bob", "10.0.0.2"); err != nil {
+        t.Errorf("Unexpected throttling for bob: %v", err)
+    }
+}
+
+func TestLoginLimiterLockout(t *testing.T) {
+    limiter := newLoginLimiter(testLoginConfig)
+
+    locked := false
+    for i := 0; i < testLoginConfig.LockoutThreshold; i++ {
+        locked = limiter.fail("alice", "10.0.0.1")
+    }
+    if !locked {
+        t.Fatal("Expected lockout after threshold")
+    }
+
+    if err := limiter.check("alice", "10.0.0.9"); !errors.Is(err, ErrAccountLocked) {
+        t.Errorf("Expected locked account from any address, got %v", err)
+    }
+
+    limiter.unlock("alice")
+    if err := limiter.check("alice", "10.0.0.9"); err != nil {
+        t.Errorf("Expected unlocked account, got %v", err)
+    }
+}
+
+func TestLoginLimiterPerIP(t *testing.T) {
+    limiter := newLoginLimiter(testLoginConfig)
+
+    // Spraying one guess at many usernames still trips the per-IP limit
+    for i := 0; i < testLoginConfig.IPFreeAttempts; i++ {
+        limiter.fail(string(rune('a'+i)), "10.0.0.1")
+    }
+    if err := limiter.check("zed", "10.0.0.1"); err == nil {
+        t.Error("Expected per-IP backoff")
+    }
+    if err := limiter.check("zed", "10.0.0.2"); err != nil {
+        t.Errorf("Unexpected throttling from another address: %v", err)
+    }
+}
+
+func TestAuthenticate(t *testing.T) {
+    service, _ := newTestService(t)
+    service.CreateUser("alice", "correct horse")
+
+    if err := service.Authenticate("alice", "correct horse", "10.0.0.1"); err != nil {
+        t.Fatalf("Expected successful login, got %v", err)
+    }
+    if err := service.Authenticate("alice", "wrong", "10.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+        t.Errorf("Expected ErrInvalidCredentials, got %v", err)
+    }
+    if err := service.Authenticate("nobody", "wrong", "10.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+        t.Errorf("Expected ErrInvalidCredentials for unknown user, got %v", err)
+    }
+
+    for i := 0; i < testLoginConfig.LockoutThreshold; i++ {
+        service.limiter.fail("alice", "10.0.0.3")
+    }
+    if err := service.Authenticate("alice", "correct horse", "10.0.0.4"); !errors.Is(err, ErrAccountLocked) {
+        t.Errorf("Expected locked account, got %v", err)
+    }
+
+    if err := service.UnlockUser("alice"); err != nil {
+        t.Fatalf("Unlock failed: %v", err)
+    }
+    if err := service.Authenticate("alice", "correct horse", "10.0.0.4"); err != nil {
+        t.Errorf("Expected login after unlock, got %v", err)
+    }
+}
@@ -2,7 +2,46 @@ package service
 
 import "time"
 
+// Role names assignable to users
+const (
+    RoleViewer   = "viewer"
+    RoleOperator = "operator"
+    RoleAdmin    = "admin"
+)
+
+// RoleScopes lists the scopes granted by each role. Scopes have the form
+// "<resource>:<action>:<target>", where any segment may be "*".
+var RoleScopes = map[string][]string{
+    RoleViewer:   {"gpio:read:*", "metrics:read:*"},
+    RoleOperator: {"gpio:read:*", "gpio:write:*", "metrics:read:*"},
+    RoleAdmin:    {"*"},
+}
+
 type User struct {
     Hash      string    `json:"hash"`
+    Role      string    `json:"role,omitempty"`
+    Scopes    []string  `json:"scopes,omitempty"`
+    Disabled  bool      `json:"disabled,omitempty"`
     CreatedAt time.Time `json:"created_at"`
+
+    // TOTP second factor. TOTPPending holds a secret awaiting confirmation,
+    // TOTPLastStep the last accepted time step to prevent code replay, and
+    // RecoveryCodes the hashes of unused recovery codes.
+    TOTPEnabled   bool     `json:"totp_enabled,omitempty"`
+    TOTPSecret    string   `json:"totp_secret,omitempty"`
+    TOTPPending   string   `json:"totp_pending,omitempty"`
+    TOTPLastStep  int64    `json:"totp_last_step,omitempty"`
+    RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// EffectiveScopes returns the scopes granted by the user's role plus any
+// scopes assigned directly. Users without a role are treated as viewers.
+func (u User) EffectiveScopes() []string {
+    role := u.Role
+    if role == "" {
+        role = RoleViewer
+    }
+
+    scopes := append([]string{}, RoleScopes[role]...)
+    return append(scopes, u.Scopes...)
 }
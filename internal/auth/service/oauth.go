@@ -0,0 +1,544 @@
+package service
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/dgrijalva/jwt-go"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/middleware/auth"
+)
+
+// OAuth2 grant types supported by the token endpoint
+const (
+    GrantClientCredentials = "client_credentials"
+    GrantPassword          = "password"
+    GrantRefreshToken      = "refresh_token"
+)
+
+// RoleClient is the role carried by tokens issued to OAuth2 clients for
+// themselves
+const RoleClient = "client"
+
+// OAuthClientPrefix starts every client ID
+const OAuthClientPrefix = "edc_"
+
+var (
+    // ErrOAuthClientNotFound is returned for operations on unknown clients
+    ErrOAuthClientNotFound = errors.New("oauth client not found")
+    // ErrInvalidClient is returned when client authentication fails
+    ErrInvalidClient = errors.New("invalid client credentials")
+    // ErrUnauthorizedClient is returned when a client uses a grant type it
+    // was not registered for
+    ErrUnauthorizedClient = errors.New("grant type not allowed for this client")
+    // ErrInvalidScope is returned when a client requests scopes it was not
+    // registered for
+    ErrInvalidScope = errors.New("requested scope not allowed for this client")
+    // ErrUnsupportedGrantType is returned for unknown grant types
+    ErrUnsupportedGrantType = errors.New("unsupported grant type")
+    // ErrMFARequired is returned by the password grant for users with a
+    // second factor, which the grant cannot carry
+    ErrMFARequired = errors.New("multi-factor authentication required, use the login endpoint")
+)
+
+// OAuthClient is a registered confidential OAuth2 client. Only the SHA-256
+// hash of its secret is stored; the secret is returned once on creation.
+type OAuthClient struct {
+    ID         string     `json:"client_id"`
+    Name       string     `json:"name"`
+    Hash       string     `json:"hash,omitempty"`
+    Scopes     []string   `json:"scopes"`
+    GrantTypes []string   `json:"grant_types"`
+    CreatedBy  string     `json:"created_by"`
+    CreatedAt  time.Time  `json:"created_at"`
+    RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// OAuthClientRequest describes a client to register
+type OAuthClientRequest struct {
+    Name string `json:"name"`
+    // Scopes are the scopes client_credentials tokens may carry. Tokens
+    // issued to users through the client are limited to them as well.
+    Scopes []string `json:"scopes"`
+    // GrantTypes defaults to client_credentials
+    GrantTypes []string `json:"grant_types"`
+}
+
+// OAuthToken is a token endpoint response as defined by RFC 6749
+type OAuthToken struct {
+    AccessToken  string `json:"access_token"`
+    TokenType    string `json:"token_type"`
+    ExpiresIn    int64  `json:"expires_in"`
+    RefreshToken string `json:"refresh_token,omitempty"`
+    Scope        string `json:"scope,omitempty"`
+}
+
+// Introspection is a token introspection response as defined by RFC 7662
+type Introspection struct {
+    Active    bool     `json:"active"`
+    Scope     string   `json:"scope,omitempty"`
+    ClientID  string   `json:"client_id,omitempty"`
+    Username  string   `json:"username,omitempty"`
+    TokenType string   `json:"token_type,omitempty"`
+    Exp       int64    `json:"exp,omitempty"`
+    Iat       int64    `json:"iat,omitempty"`
+    Sub       string   `json:"sub,omitempty"`
+    Jti       string   `json:"jti,omitempty"`
+    Roles     []string `json:"roles,omitempty"`
+}
+
+// oauthClientStore holds clients by ID, persisted to a JSON file
+type oauthClientStore struct {
+    mu      sync.Mutex
+    file    string
+    clients map[string]*OAuthClient
+}
+
+// newOAuthClientStore loads clients from file. A missing file starts
+// empty; a corrupt one is an error, since the next save would drop every
+// registered client.
+func newOAuthClientStore(file string) (*oauthClientStore, error) {
+    store := &oauthClientStore{
+        file:    file,
+        clients: make(map[string]*OAuthClient),
+    }
+
+    data, err := os.ReadFile(file)
+    if errors.Is(err, os.ErrNotExist) {
+        return store, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read OAuth client file %s: %v", file, err)
+    }
+    if len(data) > 0 {
+        if err := json.Unmarshal(data, &store.clients); err != nil {
+            return nil, fmt.Errorf("failed to parse OAuth client file %s: %v", file, err)
+        }
+    }
+    if store.clients == nil {
+        store.clients = make(map[string]*OAuthClient)
+    }
+    return store, nil
+}
+
+func (o *oauthClientStore) save() error {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    data, err := json.Marshal(o.clients)
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(o.file, data, 0600)
+}
+
+func (o *oauthClientStore) addOAuthClient(client OAuthClient) error {
+    o.mu.Lock()
+    o.clients[client.ID] = &client
+    o.mu.Unlock()
+    return o.save()
+}
+
+func (o *oauthClientStore) oauthClient(id string) (OAuthClient, bool, error) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    client, exists := o.clients[id]
+    if !exists {
+        return OAuthClient{}, false, nil
+    }
+    return *client, true, nil
+}
+
+func (o *oauthClientStore) listOAuthClients() ([]OAuthClient, error) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    clients := make([]OAuthClient, 0, len(o.clients))
+    for _, client := range o.clients {
+        clients = append(clients, *client)
+    }
+    sort.Slice(clients, func(i, j int) bool {
+        return clients[i].CreatedAt.Before(clients[j].CreatedAt)
+    })
+    return clients, nil
+}
+
+func (o *oauthClientStore) revokeOAuthClient(id string) error {
+    o.mu.Lock()
+    client, exists := o.clients[id]
+    if !exists {
+        o.mu.Unlock()
+        return ErrOAuthClientNotFound
+    }
+    if client.RevokedAt == nil {
+        now := time.Now()
+        client.RevokedAt = &now
+    }
+    o.mu.Unlock()
+    return o.save()
+}
+
+// activeOAuthClient returns a client that has not been revoked. Clients
+// that cannot be looked up are treated as revoked.
+func (s *AuthService) activeOAuthClient(id string) (OAuthClient, bool) {
+    client, exists, err := s.state.oauthClient(id)
+    if err != nil {
+        log.Printf("Failed to look up OAuth client %s: %v", id, err)
+        return OAuthClient{}, false
+    }
+    if !exists || client.RevokedAt != nil {
+        return OAuthClient{}, false
+    }
+    return client, true
+}
+
+// CreateOAuthClient registers a client and returns its secret, which is not
+// stored and cannot be retrieved again. The creator must hold the scopes
+// the client is registered for.
+func (s *AuthService) CreateOAuthClient(createdBy string, req OAuthClientRequest) (string, OAuthClient, error) {
+    user, err := s.users.Get(createdBy)
+    if err != nil {
+        return "", OAuthClient{}, err
+    }
+
+    granted := &auth.Identity{Scopes: s.grantedScopes(user)}
+    for _, scope := range req.Scopes {
+        if !granted.HasScope(scope) {
+            return "", OAuthClient{}, fmt.Errorf("%w: %s", ErrScopeNotGranted, scope)
+        }
+    }
+
+    grantTypes := req.GrantTypes
+    if len(grantTypes) == 0 {
+        grantTypes = []string{GrantClientCredentials}
+    }
+    for _, grantType := range grantTypes {
+        switch grantType {
+        case GrantClientCredentials, GrantPassword, GrantRefreshToken:
+        default:
+            return "", OAuthClient{}, fmt.Errorf("%w: %s", ErrUnsupportedGrantType, grantType)
+        }
+    }
+
+    id, err := randomToken(12)
+    if err != nil {
+        return "", OAuthClient{}, err
+    }
+    secret, err := randomToken(32)
+    if err != nil {
+        return "", OAuthClient{}, err
+    }
+
+    scopes := req.Scopes
+    if scopes == nil {
+        scopes = []string{}
+    }
+    client := OAuthClient{
+        ID:         OAuthClientPrefix + id,
+        Name:       req.Name,
+        Hash:       hashToken(secret),
+        Scopes:     scopes,
+        GrantTypes: grantTypes,
+        CreatedBy:  createdBy,
+        CreatedAt:  time.Now(),
+    }
+
+    if err := s.state.addOAuthClient(client); err != nil {
+        return "", OAuthClient{}, err
+    }
+
+    log.Printf("OAuth client %s created by %s", client.ID, createdBy)
+    return secret, client.public(), nil
+}
+
+// ListOAuthClients returns every client without its hash
+func (s *AuthService) ListOAuthClients() ([]OAuthClient, error) {
+    clients, err := s.state.listOAuthClients()
+    if err != nil {
+        return nil, err
+    }
+    for i := range clients {
+        clients[i] = clients[i].public()
+    }
+    return clients, nil
+}
+
+// RevokeOAuthClient revokes a client. Its access tokens stop verifying and
+// its refresh tokens are revoked.
+func (s *AuthService) RevokeOAuthClient(id string) error {
+    if err := s.state.revokeOAuthClient(id); err != nil {
+        return err
+    }
+    if err := s.state.revokeRefreshTokens(refreshMatch{ClientID: id}); err != nil {
+        return err
+    }
+
+    log.Printf("OAuth client %s revoked", id)
+    s.decisions.clear()
+    return nil
+}
+
+// AuthenticateClient checks a client ID and secret
+func (s *AuthService) AuthenticateClient(id, secret string) (OAuthClient, error) {
+    client, ok := s.activeOAuthClient(id)
+    if !ok || subtle.ConstantTimeCompare([]byte(client.Hash), []byte(hashToken(secret))) != 1 {
+        return OAuthClient{}, ErrInvalidClient
+    }
+    return client, nil
+}
+
+// ClientCredentialsToken issues an access token to the client itself. An
+// empty scope requests every scope the client is registered for; no
+// refresh token is issued since the client can always authenticate again.
+func (s *AuthService) ClientCredentialsToken(client OAuthClient, scope string) (OAuthToken, error) {
+    if !client.allowsGrant(GrantClientCredentials) {
+        return OAuthToken{}, ErrUnauthorizedClient
+    }
+
+    scopes := client.Scopes
+    if requested := strings.Fields(scope); len(requested) > 0 {
+        registered := &auth.Identity{Scopes: client.Scopes}
+        for _, scope := range requested {
+            if !registered.HasScope(scope) {
+                return OAuthToken{}, fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+            }
+        }
+        scopes = requested
+    }
+
+    jti, err := randomToken(16)
+    if err != nil {
+        return OAuthToken{}, err
+    }
+
+    now := time.Now()
+    token, err := s.signToken(jwt.MapClaims{
+        "jti":       jti,
+        "sub":       client.ID,
+        "client_id": client.ID,
+        "iat":       issuedAt(now),
+        "roles":     []string{RoleClient},
+        "scopes":    scopes,
+        "exp":       now.Add(s.tokenExpiry).Unix(),
+    })
+    if err != nil {
+        return OAuthToken{}, err
+    }
+
+    log.Printf("Issued client_credentials token to %s", client.ID)
+    return OAuthToken{
+        AccessToken: token,
+        TokenType:   "Bearer",
+        ExpiresIn:   int64(s.tokenExpiry.Seconds()),
+        Scope:       strings.Join(scopes, " "),
+    }, nil
+}
+
+// PasswordGrant authenticates a user on behalf of a client, applying the
+// same rate limits as the login endpoint. Users with a second factor must
+// use the login endpoint instead.
+func (s *AuthService) PasswordGrant(client OAuthClient, username, password, ip string) (OAuthToken, error) {
+    if !client.allowsGrant(GrantPassword) {
+        return OAuthToken{}, ErrUnauthorizedClient
+    }
+    if err := s.Authenticate(username, password, ip); err != nil {
+        return OAuthToken{}, err
+    }
+
+    user, err := s.users.Get(username)
+    if err != nil {
+        return OAuthToken{}, err
+    }
+    if user.TOTPEnabled {
+        return OAuthToken{}, ErrMFARequired
+    }
+
+    family, err := randomToken(16)
+    if err != nil {
+        return OAuthToken{}, err
+    }
+    pair, err := s.issueTokens(username, family, client.ID)
+    if err != nil {
+        return OAuthToken{}, err
+    }
+    return s.oauthToken(pair, client, user), nil
+}
+
+// RefreshGrant rotates a refresh token issued to the client by the
+// password grant
+func (s *AuthService) RefreshGrant(client OAuthClient, refreshToken string) (OAuthToken, error) {
+    if !client.allowsGrant(GrantRefreshToken) {
+        return OAuthToken{}, ErrUnauthorizedClient
+    }
+
+    pair, username, err := s.refreshTokensFor(refreshToken, client.ID)
+    if err != nil {
+        return OAuthToken{}, err
+    }
+
+    user, err := s.users.Get(username)
+    if err != nil {
+        return OAuthToken{}, err
+    }
+    return s.oauthToken(pair, client, user), nil
+}
+
+func (s *AuthService) oauthToken(pair TokenPair, client OAuthClient, user User) OAuthToken {
+    return OAuthToken{
+        AccessToken:  pair.AccessToken,
+        TokenType:    pair.TokenType,
+        ExpiresIn:    pair.ExpiresIn,
+        RefreshToken: pair.RefreshToken,
+        Scope:        strings.Join(delegatedScopes(client, s.grantedScopes(user)), " "),
+    }
+}
+
+// delegatedScopes limits the scopes of a user acting through client to
+// those the client is registered for. A scope is kept when the other side
+// also covers it, so that wildcards on either side narrow to the other.
+func delegatedScopes(client OAuthClient, granted []string) []string {
+    registered := &auth.Identity{Scopes: client.Scopes}
+    user := &auth.Identity{Scopes: granted}
+
+    scopes := []string{}
+    seen := make(map[string]bool)
+    for _, list := range [][]string{granted, client.Scopes} {
+        for _, scope := range list {
+            if !seen[scope] && registered.HasScope(scope) && user.HasScope(scope) {
+                seen[scope] = true
+                scopes = append(scopes, scope)
+            }
+        }
+    }
+    return scopes
+}
+
+// Introspect describes an access or refresh token as defined by RFC 7662.
+// Invalid, expired and revoked tokens are reported as inactive.
+func (s *AuthService) Introspect(token, hint string) Introspection {
+    if hint != GrantRefreshToken {
+        if result, ok := s.introspectAccessToken(token); ok {
+            return result
+        }
+    }
+    if result, ok := s.introspectRefreshToken(token); ok {
+        return result
+    }
+    if hint == GrantRefreshToken {
+        if result, ok := s.introspectAccessToken(token); ok {
+            return result
+        }
+    }
+    return Introspection{Active: false}
+}
+
+func (s *AuthService) introspectAccessToken(token string) (Introspection, bool) {
+    claims, raw, ok := s.verifyToken(token)
+    if !ok {
+        return Introspection{}, false
+    }
+
+    result := Introspection{
+        Active:    true,
+        Scope:     strings.Join(claims.Scopes, " "),
+        TokenType: "Bearer",
+        Sub:       claims.Subject,
+        Roles:     claims.Roles,
+    }
+    result.ClientID, _ = raw["client_id"].(string)
+    if result.ClientID != claims.Subject {
+        result.Username = claims.Subject
+    }
+    result.Jti, _ = raw["jti"].(string)
+    if exp, ok := raw["exp"].(float64); ok {
+        result.Exp = int64(exp)
+    }
+    if iat, ok := raw["iat"].(float64); ok {
+        result.Iat = int64(iat)
+    }
+    return result, true
+}
+
+func (s *AuthService) introspectRefreshToken(token string) (Introspection, bool) {
+    record, exists, err := s.state.refreshToken(hashToken(token))
+    if err != nil {
+        log.Printf("Failed to look up refresh token: %v", err)
+        return Introspection{}, false
+    }
+    if !exists || record.Used || record.Revoked || time.Now().After(record.ExpiresAt) {
+        return Introspection{}, false
+    }
+    user, err := s.users.Get(record.Username)
+    if err != nil || user.Disabled {
+        return Introspection{}, false
+    }
+
+    scopes := s.grantedScopes(user)
+    if record.ClientID != "" {
+        client, ok := s.activeOAuthClient(record.ClientID)
+        if !ok {
+            return Introspection{}, false
+        }
+        scopes = delegatedScopes(client, scopes)
+    }
+    return Introspection{
+        Active:    true,
+        Scope:     strings.Join(scopes, " "),
+        ClientID:  record.ClientID,
+        Username:  record.Username,
+        TokenType: GrantRefreshToken,
+        Exp:       record.ExpiresAt.Unix(),
+        Sub:       record.Username,
+    }, true
+}
+
+// verifyClientToken checks a client_credentials token against the current
+// client registration. Scopes removed from the client since the token was
+// issued are dropped.
+func (s *AuthService) verifyClientToken(clientID string, claims jwt.MapClaims) (*Claims, bool) {
+    client, ok := s.activeOAuthClient(clientID)
+    if !ok || claims["sub"] != clientID {
+        return nil, false
+    }
+
+    registered := &auth.Identity{Scopes: client.Scopes}
+    var scopes []string
+    if list, ok := claims["scopes"].([]interface{}); ok {
+        for _, value := range list {
+            if scope, ok := value.(string); ok && registered.HasScope(scope) {
+                scopes = append(scopes, scope)
+            }
+        }
+    }
+
+    return &Claims{
+        Subject: clientID,
+        Roles:   []string{RoleClient},
+        Scopes:  scopes,
+    }, true
+}
+
+// allowsGrant reports whether the client is registered for grantType
+func (c OAuthClient) allowsGrant(grantType string) bool {
+    for _, allowed := range c.GrantTypes {
+        if allowed == grantType {
+            return true
+        }
+    }
+    return false
+}
+
+// public returns a copy of the client without its hash
+func (c OAuthClient) public() OAuthClient {
+    c.Hash = ""
+    return c
+}
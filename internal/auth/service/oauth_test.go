@@ -0,0 +1,137 @@
+package service
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func newTestClient(t *testing.T, service *AuthService, grantTypes ...string) (OAuthClient, string) {
+    t.Helper()
+
+    service.AddUser("root", "password", RoleAdmin)
+    secret, client, err := service.CreateOAuthClient("root", OAuthClientRequest{
+        Name:       "cloud",
+        Scopes:     []string{"metrics:read:*", "gpio:read:*"},
+        GrantTypes: grantTypes,
+    })
+    if err != nil {
+        t.Fatalf("CreateOAuthClient failed: %v", err)
+    }
+    return client, secret
+}
+
+func TestClientCredentials(t *testing.T) {
+    service, _ := newTestService(t)
+    client, secret := newTestClient(t, service)
+
+    if _, err := service.AuthenticateClient(client.ID, "wrong"); !errors.Is(err, ErrInvalidClient) {
+        t.Errorf("Expected ErrInvalidClient, got %v", err)
+    }
+    client, err := service.AuthenticateClient(client.ID, secret)
+    if err != nil {
+        t.Fatalf("AuthenticateClient failed: %v", err)
+    }
+
+    if _, err := service.ClientCredentialsToken(client, "gpio:write:17"); !errors.Is(err, ErrInvalidScope) {
+        t.Errorf("Expected ErrInvalidScope, got %v", err)
+    }
+    if _, err := service.PasswordGrant(client, "root", "password", "10.0.0.1"); !errors.Is(err, ErrUnauthorizedClient) {
+        t.Errorf("Expected ErrUnauthorizedClient, got %v", err)
+    }
+
+    token, err := service.ClientCredentialsToken(client, "metrics:read:*")
+    if err != nil || token.Scope != "metrics:read:*" || token.RefreshToken != "" {
+        t.Fatalf("Unexpected token %+v, %v", token, err)
+    }
+
+    claims, ok := service.VerifyTokenClaims(token.AccessToken)
+    if !ok || claims.Subject != client.ID || claims.Roles[0] != RoleClient {
+        t.Fatalf("Expected client claims, got %+v", claims)
+    }
+
+    info := service.Introspect(token.AccessToken, "")
+    if !info.Active || info.ClientID != client.ID || info.Username != "" || info.Exp == 0 {
+        t.Errorf("Unexpected introspection %+v", info)
+    }
+
+    if err := service.RevokeOAuthClient(client.ID); err != nil {
+        t.Fatalf("Revoke failed: %v", err)
+    }
+    if _, ok := service.VerifyTokenClaims(token.AccessToken); ok {
+        t.Error("Expected token of revoked client to be rejected")
+    }
+    if _, err := service.AuthenticateClient(client.ID, secret); !errors.Is(err, ErrInvalidClient) {
+        t.Errorf("Expected revoked client to fail authentication, got %v", err)
+    }
+}
+
+func TestPasswordAndRefreshGrant(t *testing.T) {
+    service, _ := newTestService(t)
+    client, _ := newTestClient(t, service, GrantPassword, GrantRefreshToken)
+    service.AddUser("alice", "password", RoleOperator)
+
+    if _, err := service.PasswordGrant(client, "alice", "wrong", "10.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+        t.Errorf("Expected ErrInvalidCredentials, got %v", err)
+    }
+    token, err := service.PasswordGrant(client, "alice", "password", "10.0.0.1")
+    if err != nil || token.RefreshToken == "" {
+        t.Fatalf("PasswordGrant failed: %+v, %v", token, err)
+    }
+    if subject, ok := service.VerifyToken(token.AccessToken); !ok || subject != "alice" {
+        t.Errorf("Expected token for alice, got %q", subject)
+    }
+    // Scopes are limited to those the client is registered for
+    if token.Scope != "gpio:read:* metrics:read:*" {
+        t.Errorf("Expected the operator's scopes limited to the client's, got %q", token.Scope)
+    }
+    claims, ok := service.VerifyTokenClaims(token.AccessToken)
+    if !ok || strings.Join(claims.Scopes, " ") != token.Scope {
+        t.Errorf("Expected token scopes limited to the client's, got %+v", claims)
+    }
+    info := service.Introspect(token.AccessToken, "")
+    if !info.Active || info.ClientID != client.ID || info.Username != "alice" {
+        t.Errorf("Unexpected access token introspection %+v", info)
+    }
+
+    info = service.Introspect(token.RefreshToken, GrantRefreshToken)
+    if !info.Active || info.Username != "alice" || info.ClientID != client.ID {
+        t.Errorf("Unexpected refresh token introspection %+v", info)
+    }
+
+    // Client refresh tokens are bound to the client
+    if _, err := service.RefreshTokens(token.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+        t.Errorf("Expected client refresh token to be rejected by the login flow, got %v", err)
+    }
+    refreshed, err := service.RefreshGrant(client, token.RefreshToken)
+    if err != nil || refreshed.RefreshToken == token.RefreshToken {
+        t.Fatalf("RefreshGrant failed: %v", err)
+    }
+    if info := service.Introspect(token.RefreshToken, ""); info.Active {
+        t.Error("Expected rotated refresh token to be inactive")
+    }
+
+    // Revoking the client revokes the tokens it obtained for users
+    if err := service.RevokeOAuthClient(client.ID); err != nil {
+        t.Fatalf("Revoke failed: %v", err)
+    }
+    if _, ok := service.VerifyTokenClaims(refreshed.AccessToken); ok {
+        t.Error("Expected access token of revoked client to be rejected")
+    }
+}
+
+func TestCorruptOAuthClientFile(t *testing.T) {
+    dir := t.TempDir()
+    file := filepath.Join(dir, "clients.json")
+    if err := os.WriteFile(file, []byte("{"), 0600); err != nil {
+        t.Fatalf("Failed to write clients: %v", err)
+    }
+    if _, err := newOAuthClientStore(file); err == nil {
+        t.Error("Expected a corrupt OAuth client file to be an error")
+    }
+    if _, err := newOAuthClientStore(filepath.Join(dir, "missing.json")); err != nil {
+        t.Errorf("Expected a missing OAuth client file to start empty, got %v", err)
+    }
+}
@@ -0,0 +1,264 @@
+package service
+
+import (
+    "bufio"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/hex"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "unicode/utf8"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/bcrypt"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/config"
+)
+
+// Password hashing algorithms
+const (
+    HashBcrypt   = "bcrypt"
+    HashArgon2id = "argon2id"
+)
+
+// bcryptMaxLength is the number of bytes bcrypt looks at
+const bcryptMaxLength = 72
+
+// PasswordPolicyError lists the rules a new password breaks. It matches
+// ErrInvalidPassword with errors.Is.
+type PasswordPolicyError struct {
+    Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+    return "password does not meet policy: " + strings.Join(e.Violations, "; ")
+}
+
+func (e *PasswordPolicyError) Unwrap() error {
+    return ErrInvalidPassword
+}
+
+// passwordPolicy validates new passwords and hashes them with the
+// configured algorithm
+type passwordPolicy struct {
+    config   config.PasswordConfig
+    breached map[string]struct{}
+}
+
+func newPasswordPolicy(cfg config.PasswordConfig) (*passwordPolicy, error) {
+    switch cfg.Algorithm {
+    case "":
+        cfg.Algorithm = HashBcrypt
+    case HashBcrypt, HashArgon2id:
+    default:
+        return nil, fmt.Errorf("invalid password hash algorithm %q", cfg.Algorithm)
+    }
+    if cfg.BcryptCost == 0 {
+        cfg.BcryptCost = bcrypt.DefaultCost
+    }
+    if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+        return nil, fmt.Errorf("invalid bcrypt cost %d", cfg.BcryptCost)
+    }
+    if cfg.Argon2Time == 0 {
+        cfg.Argon2Time = 3
+    }
+    if cfg.Argon2Memory == 0 {
+        cfg.Argon2Memory = 64 * 1024
+    }
+    if cfg.Argon2Threads == 0 {
+        cfg.Argon2Threads = 2
+    }
+
+    policy := &passwordPolicy{config: cfg}
+    if cfg.BreachedFile != "" {
+        breached, err := loadBreachedPasswords(cfg.BreachedFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to load breached passwords: %v", err)
+        }
+        policy.breached = breached
+    }
+    return policy, nil
+}
+
+// loadBreachedPasswords reads a list of plain-text or SHA-1 hex passwords
+// into a set of upper-case SHA-1 hex digests
+func loadBreachedPasswords(file string) (map[string]struct{}, error) {
+    f, err := os.Open(file)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    breached := make(map[string]struct{})
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimRight(scanner.Text(), "\r")
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        digest, _, _ := strings.Cut(line, ":")
+        if len(digest) == 2*sha1.Size {
+            if _, err := hex.DecodeString(digest); err == nil {
+                breached[strings.ToUpper(digest)] = struct{}{}
+                continue
+            }
+        }
+        breached[sha1Hex(line)] = struct{}{}
+    }
+    return breached, scanner.Err()
+}
+
+func sha1Hex(s string) string {
+    sum := sha1.Sum([]byte(s))
+    return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// validate checks a new password for username against the policy
+func (p *passwordPolicy) validate(username, password string) error {
+    var violations []string
+
+    length := utf8.RuneCountInString(password)
+    if length == 0 || length < p.config.MinLength {
+        violations = append(violations, fmt.Sprintf("must be at least %d characters", max(p.config.MinLength, 1)))
+    }
+    if p.config.MaxLength > 0 && length > p.config.MaxLength {
+        violations = append(violations, fmt.Sprintf("must be at most %d characters", p.config.MaxLength))
+    }
+    if p.config.Algorithm == HashBcrypt && len(password) > bcryptMaxLength {
+        violations = append(violations, fmt.Sprintf("must be at most %d bytes", bcryptMaxLength))
+    }
+    if similarToUsername(username, password) {
+        violations = append(violations, "must not contain or resemble the username")
+    }
+    if _, found := p.breached[sha1Hex(password)]; found {
+        violations = append(violations, "appears in a list of breached passwords")
+    }
+
+    if len(violations) > 0 {
+        return &PasswordPolicyError{Violations: violations}
+    }
+    return nil
+}
+
+// similarToUsername reports whether the password contains the username,
+// forwards or reversed, or is contained in it, ignoring case
+func similarToUsername(username, password string) bool {
+    username = strings.ToLower(username)
+    password = strings.ToLower(password)
+    if len(username) < 3 || password == "" {
+        return false
+    }
+
+    reversed := []rune(username)
+    for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+        reversed[i], reversed[j] = reversed[j], reversed[i]
+    }
+    return strings.Contains(password, username) ||
+        strings.Contains(password, string(reversed)) ||
+        strings.Contains(username, password)
+}
+
+// hash hashes password with the configured algorithm
+func (p *passwordPolicy) hash(password string) (string, error) {
+    if p.config.Algorithm == HashArgon2id {
+        salt := make([]byte, 16)
+        if _, err := rand.Read(salt); err != nil {
+            return "", err
+        }
+        key := argon2.IDKey([]byte(password), salt, p.config.Argon2Time, p.config.Argon2Memory, p.config.Argon2Threads, 32)
+        return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+            argon2.Version, p.config.Argon2Memory, p.config.Argon2Time, p.config.Argon2Threads,
+            base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+    }
+
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), p.config.BcryptCost)
+    return string(hash), err
+}
+
+// verify compares password with a stored bcrypt or argon2id hash and
+// reports whether the hash should be replaced because the algorithm or its
+// parameters have changed
+func (p *passwordPolicy) verify(hash, password string) (ok, rehash bool) {
+    if strings.HasPrefix(hash, "$argon2id$") {
+        params, salt, key, err := parseArgon2id(hash)
+        if err != nil {
+            return false, false
+        }
+        computed := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+        if subtle.ConstantTimeCompare(computed, key) != 1 {
+            return false, false
+        }
+        return true, p.config.Algorithm != HashArgon2id ||
+            params.time != p.config.Argon2Time ||
+            params.memory != p.config.Argon2Memory ||
+            params.threads != p.config.Argon2Threads
+    }
+
+    if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+        return false, false
+    }
+    cost, err := bcrypt.Cost([]byte(hash))
+    return true, p.config.Algorithm != HashBcrypt || err != nil || cost != p.config.BcryptCost
+}
+
+type argon2Params struct {
+    time    uint32
+    memory  uint32
+    threads uint8
+}
+
+// parseArgon2id decodes a hash in the PHC string format
+func parseArgon2id(hash string) (argon2Params, []byte, []byte, error) {
+    var params argon2Params
+
+    parts := strings.Split(hash, "$")
+    if len(parts) != 6 {
+        return params, nil, nil, fmt.Errorf("malformed argon2id hash")
+    }
+
+    var version int
+    if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+        return params, nil, nil, fmt.Errorf("unsupported argon2 version")
+    }
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+        return params, nil, nil, fmt.Errorf("malformed argon2id parameters: %v", err)
+    }
+
+    salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+    if err != nil {
+        return params, nil, nil, err
+    }
+    key, err := base64.RawStdEncoding.DecodeString(parts[5])
+    if err != nil || len(key) == 0 {
+        return params, nil, nil, fmt.Errorf("malformed argon2id key")
+    }
+    return params, salt, key, nil
+}
+
+// rehashPassword replaces a user's outdated password hash after a
+// successful login. The hash is only replaced if it has not changed since
+// it was checked; failures are logged since the login itself succeeded.
+func (s *AuthService) rehashPassword(username, oldHash, password string) {
+    hash, err := s.passwords.hash(password)
+    if err != nil {
+        log.Printf("Failed to rehash password for %s: %v", username, err)
+        return
+    }
+
+    err = s.users.Update(username, func(user *User) error {
+        if user.Hash == oldHash {
+            user.Hash = hash
+        }
+        return nil
+    })
+    if err != nil {
+        log.Printf("Failed to store rehashed password for %s: %v", username, err)
+        return
+    }
+    log.Printf("Upgraded password hash for %s to %s", username, s.passwords.config.Algorithm)
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "golang.org/x/crypto/bcrypt"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/config"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+    breachedFile := filepath.Join(t.TempDir(), "breached.txt")
+    os.WriteFile(breachedFile, []byte("# common passwords\npassword123\n"+sha1Hex("letmein12345")+":42\n"), 0600)
+
+    policy, err := newPasswordPolicy(config.PasswordConfig{
+        MinLength:    10,
+        MaxLength:    64,
+        BreachedFile: breachedFile,
+        BcryptCost:   bcrypt.MinCost,
+    })
+    if err != nil {
+        t.Fatalf("Failed to create policy: %v", err)
+    }
+
+    tests := []struct {
+        password  string
+        violation string
+    }{
+        {"", "at least"},
+        {"short", "at least"},
+        {strings.Repeat("x", 65), "at most"},
+        {"password123", "breached"},
+        {"letmein12345", "breached"},
+        {"my-alice-password", "username"},
+        {"my-ecila-password", "username"},
+        {"a perfectly fine passphrase", ""},
+    }
+    for _, test := range tests {
+        err := policy.validate("Alice", test.password)
+        if test.violation == "" {
+            if err != nil {
+                t.Errorf("%q: unexpected error %v", test.password, err)
+            }
+            continue
+        }
+
+        var policyErr *PasswordPolicyError
+        if !errors.As(err, &policyErr) || !errors.Is(err, ErrInvalidPassword) {
+            t.Errorf("%q: expected policy error, got %v", test.password, err)
+            continue
+        }
+        if !strings.Contains(err.Error(), test.violation) {
+            t.Errorf("%q: expected %q violation, got %v", test.password, test.violation, policyErr.Violations)
+        }
+    }
+}
+
+func TestPasswordHashes(t *testing.T) {
+    bcryptPolicy, _ := newPasswordPolicy(config.PasswordConfig{BcryptCost: bcrypt.MinCost})
+    argonPolicy, _ := newPasswordPolicy(config.PasswordConfig{
+        Algorithm:     HashArgon2id,
+        Argon2Time:    1,
+        Argon2Memory:  1024,
+        Argon2Threads: 1,
+    })
+
+    hash, err := argonPolicy.hash("secret")
+    if err != nil || !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+        t.Fatalf("Unexpected argon2id hash %q, %v", hash, err)
+    }
+    if ok, rehash := argonPolicy.verify(hash, "secret"); !ok || rehash {
+        t.Errorf("Expected current argon2id hash to verify, got ok=%v rehash=%v", ok, rehash)
+    }
+    if ok, _ := argonPolicy.verify(hash, "wrong"); ok {
+        t.Error("Expected wrong password to fail")
+    }
+    if ok, rehash := bcryptPolicy.verify(hash, "secret"); !ok || !rehash {
+        t.Errorf("Expected argon2id hash to need rehash under bcrypt, got ok=%v rehash=%v", ok, rehash)
+    }
+
+    hash, _ = bcryptPolicy.hash("secret")
+    if ok, rehash := bcryptPolicy.verify(hash, "secret"); !ok || rehash {
+        t.Errorf("Expected current bcrypt hash to verify, got ok=%v rehash=%v", ok, rehash)
+    }
+    if ok, rehash := argonPolicy.verify(hash, "secret"); !ok || !rehash {
+        t.Errorf("Expected bcrypt hash to need rehash under argon2id, got ok=%v rehash=%v", ok, rehash)
+    }
+}
+
+func TestAuthenticateRehash(t *testing.T) {
+    service, _ := newTestService(t)
+    service.passwords, _ = newPasswordPolicy(config.PasswordConfig{BcryptCost: bcrypt.MinCost})
+    service.AddUser("alice", "correct horse", RoleViewer)
+
+    service.passwords, _ = newPasswordPolicy(config.PasswordConfig{
+        Algorithm:     HashArgon2id,
+        Argon2Time:    1,
+        Argon2Memory:  1024,
+        Argon2Threads: 1,
+    })
+    if err := service.Authenticate("alice", "correct horse", "10.0.0.1"); err != nil {
+        t.Fatalf("Expected successful login, got %v", err)
+    }
+
+    user, _ := service.users.Get("alice")
+    if !strings.HasPrefix(user.Hash, "$argon2id$") {
+        t.Fatalf("Expected hash upgraded to argon2id, got %q", user.Hash)
+    }
+    if err := service.Authenticate("alice", "correct horse", "10.0.0.1"); err != nil {
+        t.Errorf("Expected login with upgraded hash, got %v", err)
+    }
+}
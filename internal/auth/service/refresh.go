@@ -0,0 +1,254 @@
+package service
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "sync"
+    "time"
+)
+
+var (
+    // ErrInvalidRefreshToken is returned for unknown, expired or revoked
+    // refresh tokens
+    ErrInvalidRefreshToken = errors.New("invalid refresh token")
+    // ErrRefreshTokenReused is returned when an already rotated refresh
+    // token is presented again. The whole token family is revoked.
+    ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+)
+
+// TokenPair is the result of a login or refresh
+type TokenPair struct {
+    AccessToken  string `json:"access_token"`
+    RefreshToken string `json:"refresh_token"`
+    TokenType    string `json:"token_type"`
+    ExpiresIn    int64  `json:"expires_in"`
+}
+
+// refreshRecord is the server-side state of a refresh token, keyed by the
+// SHA-256 hash of the token so that the store never holds usable tokens
+type refreshRecord struct {
+    Username  string    `json:"username"`
+    Family    string    `json:"family"`
+    // ClientID is the OAuth2 client the token was issued to, which alone
+    // may redeem it
+    ClientID  string    `json:"client_id,omitempty"`
+    ExpiresAt time.Time `json:"expires_at"`
+    Used      bool      `json:"used,omitempty"`
+    Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// IssueTokens creates an access token and a refresh token starting a new
+// token family
+func (s *AuthService) IssueTokens(username string) (TokenPair, error) {
+    family, err := randomToken(16)
+    if err != nil {
+        return TokenPair{}, err
+    }
+    return s.issueTokens(username, family, "")
+}
+
+// RefreshTokens rotates a refresh token: the presented token is consumed
+// and a new pair is issued in the same family. Presenting a consumed token
+// revokes the family, logging out both the legitimate client and whoever
+// replayed it.
+func (s *AuthService) RefreshTokens(refreshToken string) (TokenPair, error) {
+    pair, _, err := s.refreshTokensFor(refreshToken, "")
+    return pair, err
+}
+
+// refreshTokensFor rotates a refresh token issued to clientID, which is
+// empty for tokens from the login endpoint, and returns the user it
+// belongs to
+func (s *AuthService) refreshTokensFor(refreshToken, clientID string) (TokenPair, string, error) {
+    key := hashToken(refreshToken)
+
+    record, exists, err := s.state.refreshToken(key)
+    if err != nil {
+        return TokenPair{}, "", err
+    }
+    if !exists || record.Revoked || time.Now().After(record.ExpiresAt) || record.ClientID != clientID {
+        return TokenPair{}, "", ErrInvalidRefreshToken
+    }
+
+    // Marking the token used decides which of two concurrent rotations,
+    // possibly on different instances, wins
+    record, exists, err = s.state.useRefreshToken(key)
+    if err != nil {
+        return TokenPair{}, "", err
+    }
+    if !exists {
+        return TokenPair{}, "", ErrInvalidRefreshToken
+    }
+    if record.Used {
+        if err := s.state.revokeRefreshTokens(refreshMatch{Family: record.Family}); err != nil {
+            return TokenPair{}, "", err
+        }
+        log.Printf("Refresh token reuse detected for user %s, revoked token family", record.Username)
+        return TokenPair{}, "", ErrRefreshTokenReused
+    }
+
+    if user, err := s.users.Get(record.Username); err != nil || user.Disabled {
+        return TokenPair{}, "", ErrInvalidRefreshToken
+    }
+
+    pair, err := s.issueTokens(record.Username, record.Family, record.ClientID)
+    return pair, record.Username, err
+}
+
+func (s *AuthService) issueTokens(username, family, clientID string) (TokenPair, error) {
+    accessToken, err := s.createToken(username, clientID)
+    if err != nil {
+        return TokenPair{}, err
+    }
+
+    refreshToken, err := randomToken(32)
+    if err != nil {
+        return TokenPair{}, err
+    }
+
+    err = s.state.addRefreshToken(hashToken(refreshToken), refreshRecord{
+        Username:  username,
+        Family:    family,
+        ClientID:  clientID,
+        ExpiresAt: time.Now().Add(s.refreshExpiry),
+    })
+    if err != nil {
+        return TokenPair{}, err
+    }
+
+    return TokenPair{
+        AccessToken:  accessToken,
+        RefreshToken: refreshToken,
+        TokenType:    "Bearer",
+        ExpiresIn:    int64(s.tokenExpiry.Seconds()),
+    }, nil
+}
+
+// refreshTokenStore holds refresh tokens by hash, persisted to a JSON file
+type refreshTokenStore struct {
+    mu      sync.Mutex
+    file    string
+    records map[string]refreshRecord
+}
+
+// newRefreshTokenStore loads refresh tokens from file. A missing file
+// starts empty; a corrupt one is an error, since ignoring it would forget
+// which tokens were used or revoked.
+func newRefreshTokenStore(file string) (*refreshTokenStore, error) {
+    store := &refreshTokenStore{
+        file:    file,
+        records: make(map[string]refreshRecord),
+    }
+
+    data, err := os.ReadFile(file)
+    if errors.Is(err, os.ErrNotExist) {
+        return store, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read refresh token file %s: %v", file, err)
+    }
+    if len(data) > 0 {
+        if err := json.Unmarshal(data, &store.records); err != nil {
+            return nil, fmt.Errorf("failed to parse refresh token file %s: %v", file, err)
+        }
+    }
+    if store.records == nil {
+        store.records = make(map[string]refreshRecord)
+    }
+    return store, nil
+}
+
+func (r *refreshTokenStore) addRefreshToken(hash string, record refreshRecord) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    r.records[hash] = record
+    return r.saveLocked()
+}
+
+func (r *refreshTokenStore) refreshToken(hash string) (refreshRecord, bool, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    record, exists := r.records[hash]
+    return record, exists, nil
+}
+
+func (r *refreshTokenStore) useRefreshToken(hash string) (refreshRecord, bool, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    record, exists := r.records[hash]
+    if !exists || record.Used {
+        return record, exists, nil
+    }
+
+    used := record
+    used.Used = true
+    r.records[hash] = used
+    return record, true, r.saveLocked()
+}
+
+func (r *refreshTokenStore) revokeRefreshTokens(match refreshMatch) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    for hash, record := range r.records {
+        if match.matches(record) {
+            record.Revoked = true
+            r.records[hash] = record
+        }
+    }
+    return r.saveLocked()
+}
+
+// collectGarbage saves the store if any token expired, which drops them
+func (r *refreshTokenStore) collectGarbage() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    now := time.Now()
+    for _, record := range r.records {
+        if now.After(record.ExpiresAt) {
+            return r.saveLocked()
+        }
+    }
+    return nil
+}
+
+// saveLocked persists the store, dropping expired records. The caller must
+// hold r.mu.
+func (r *refreshTokenStore) saveLocked() error {
+    now := time.Now()
+    for hash, record := range r.records {
+        if now.After(record.ExpiresAt) {
+            delete(r.records, hash)
+        }
+    }
+
+    data, err := json.Marshal(r.records)
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(r.file, data, 0600)
+}
+
+func randomToken(size int) (string, error) {
+    b := make([]byte, size)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/config"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+    service, _ := newTestService(t)
+    service.AddUser("alice", "password", RoleViewer)
+
+    pair, err := service.IssueTokens("alice")
+    if err != nil {
+        t.Fatalf("IssueTokens failed: %v", err)
+    }
+    other, err := service.IssueTokens("alice")
+    if err != nil {
+        t.Fatalf("IssueTokens failed: %v", err)
+    }
+
+    rotated, err := service.RefreshTokens(pair.RefreshToken)
+    if err != nil {
+        t.Fatalf("RefreshTokens failed: %v", err)
+    }
+    if rotated.RefreshToken == pair.RefreshToken || rotated.AccessToken == "" {
+        t.Fatalf("Expected a new token pair, got %+v", rotated)
+    }
+    if subject, ok := service.VerifyToken(rotated.AccessToken); !ok || subject != "alice" {
+        t.Errorf("Expected rotated access token for alice, got %q", subject)
+    }
+
+    // Replaying the consumed token revokes the whole family
+    if _, err := service.RefreshTokens(pair.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+        t.Fatalf("Expected ErrRefreshTokenReused, got %v", err)
+    }
+    if _, err := service.RefreshTokens(rotated.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+        t.Errorf("Expected the rotated token to be revoked with its family, got %v", err)
+    }
+
+    // Other sessions of the user are separate families
+    if _, err := service.RefreshTokens(other.RefreshToken); err != nil {
+        t.Errorf("Expected another family to be unaffected, got %v", err)
+    }
+
+    if _, err := service.RefreshTokens("unknown"); !errors.Is(err, ErrInvalidRefreshToken) {
+        t.Errorf("Expected ErrInvalidRefreshToken, got %v", err)
+    }
+}
+
+func TestRefreshTokensPersisted(t *testing.T) {
+    service, dir := newTestService(t)
+    service.AddUser("alice", "password", RoleViewer)
+
+    pair, err := service.IssueTokens("alice")
+    if err != nil {
+        t.Fatalf("IssueTokens failed: %v", err)
+    }
+    if _, err := service.RefreshTokens(pair.RefreshToken); err != nil {
+        t.Fatalf("RefreshTokens failed: %v", err)
+    }
+
+    // A restarted service still detects the reuse
+    state, err := NewFileStateStore(dir, "")
+    if err != nil {
+        t.Fatalf("Failed to reload state: %v", err)
+    }
+    reloaded, err := NewAuthService(&config.Config{
+        JWT:   config.JWTConfig{Algorithm: "HS256", Secret: "test"},
+        Login: testLoginConfig,
+    }, service.users, state)
+    if err != nil {
+        t.Fatalf("Failed to reload service: %v", err)
+    }
+    if _, err := reloaded.RefreshTokens(pair.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+        t.Errorf("Expected ErrRefreshTokenReused after reload, got %v", err)
+    }
+
+    if err := os.WriteFile(filepath.Join(dir, "refresh_tokens.json"), []byte("{"), 0600); err != nil {
+        t.Fatalf("Failed to corrupt refresh tokens: %v", err)
+    }
+    if _, err := NewFileStateStore(dir, ""); err == nil {
+        t.Error("Expected a corrupt refresh token file to fail startup")
+    }
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "os"
+    "sync"
+    "time"
+)
+
+// revocationStore records revoked access tokens by jti and per-user cutoffs
+// before which all tokens are revoked, persisted to a JSON file. Entries
+// are kept only until the tokens they cover would have expired anyway.
+type revocationStore struct {
+    mu   sync.Mutex
+    file string
+
+    // Tokens maps a revoked jti to the token's expiry
+    Tokens map[string]time.Time `json:"tokens"`
+    // Users maps a username to the time all of its sessions were revoked
+    Users map[string]time.Time `json:"users"`
+}
+
+// newRevocationStore loads revocations from file. A missing file starts
+// empty; an unreadable or corrupt one is an error, since ignoring it would
+// reinstate revoked tokens.
+func newRevocationStore(file string) (*revocationStore, error) {
+    store := &revocationStore{
+        file:   file,
+        Tokens: make(map[string]time.Time),
+        Users:  make(map[string]time.Time),
+    }
+    if err := store.load(); err != nil {
+        return nil, err
+    }
+    return store, nil
+}
+
+// issuedAt encodes t as an iat claim with microsecond precision, so that a
+// login right after a user's sessions were revoked is told apart from the
+// tokens issued before it in the same second
+func issuedAt(t time.Time) float64 {
+    return float64(t.UnixMicro()) / 1e6
+}
+
+// issuedAtTime decodes an iat claim written by issuedAt
+func issuedAtTime(iat float64) time.Time {
+    return time.UnixMicro(int64(math.Round(iat * 1e6)))
+}
+
+// revokeToken revokes a single token until its expiry
+func (r *revocationStore) revokeToken(jti string, expiresAt time.Time) error {
+    r.mu.Lock()
+    r.Tokens[jti] = expiresAt
+    r.mu.Unlock()
+    return r.save()
+}
+
+// revokeUser revokes every token issued to a user before now
+func (r *revocationStore) revokeUser(username string) error {
+    r.mu.Lock()
+    r.Users[username] = time.Now()
+    r.mu.Unlock()
+    return r.save()
+}
+
+// isRevoked reports whether a token issued to username at issuedAt with the
+// given jti has been revoked
+func (r *revocationStore) isRevoked(jti, username string, issuedAt time.Time) (bool, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if _, revoked := r.Tokens[jti]; revoked {
+        return true, nil
+    }
+    cutoff, exists := r.Users[username]
+    return exists && issuedAt.Before(cutoff), nil
+}
+
+// collectGarbage drops token revocations past their expiry and user
+// cutoffs older than maxTokenAge
+func (r *revocationStore) collectGarbage(maxTokenAge time.Duration) error {
+    r.mu.Lock()
+    now := time.Now()
+    removed := 0
+    for jti, expiresAt := range r.Tokens {
+        if now.After(expiresAt) {
+            delete(r.Tokens, jti)
+            removed++
+        }
+    }
+    for username, cutoff := range r.Users {
+        if now.Sub(cutoff) > maxTokenAge {
+            delete(r.Users, username)
+            removed++
+        }
+    }
+    r.mu.Unlock()
+
+    if removed == 0 {
+        return nil
+    }
+    return r.save()
+}
+
+func (r *revocationStore) load() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    data, err := os.ReadFile(r.file)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to read revocation file %s: %v", r.file, err)
+    }
+
+    if len(data) > 0 {
+        if err := json.Unmarshal(data, r); err != nil {
+            return fmt.Errorf("failed to parse revocation file %s: %v", r.file, err)
+        }
+    }
+    if r.Tokens == nil {
+        r.Tokens = make(map[string]time.Time)
+    }
+    if r.Users == nil {
+        r.Users = make(map[string]time.Time)
+    }
+    return nil
+}
+
+func (r *revocationStore) save() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    data, err := json.Marshal(r)
+    if err != nil {
+        return err
+    }
+
+    return writeFileAtomic(r.file, data, 0600)
+}
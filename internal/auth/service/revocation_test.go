@@ -0,0 +1,124 @@
+package service
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestLogoutRevokesToken(t *testing.T) {
+    service, _ := newTestService(t)
+    service.AddUser("alice", "password", RoleViewer)
+
+    pair, err := service.IssueTokens("alice")
+    if err != nil {
+        t.Fatalf("IssueTokens failed: %v", err)
+    }
+    other, err := service.IssueTokens("alice")
+    if err != nil {
+        t.Fatalf("IssueTokens failed: %v", err)
+    }
+
+    if err := service.Logout(pair.AccessToken, pair.RefreshToken); err != nil {
+        t.Fatalf("Logout failed: %v", err)
+    }
+    if _, ok := service.VerifyTokenClaims(pair.AccessToken); ok {
+        t.Error("Expected logged out access token to be rejected")
+    }
+    if _, err := service.RefreshTokens(pair.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+        t.Errorf("Expected logged out refresh token to be rejected, got %v", err)
+    }
+    if _, ok := service.VerifyTokenClaims(other.AccessToken); !ok {
+        t.Error("Expected other sessions to stay valid")
+    }
+
+    if err := service.Logout("garbage", ""); !errors.Is(err, ErrInvalidToken) {
+        t.Errorf("Expected ErrInvalidToken, got %v", err)
+    }
+}
+
+func TestRevokeUserSessions(t *testing.T) {
+    service, _ := newTestService(t)
+    service.AddUser("alice", "password", RoleViewer)
+    service.AddUser("bob", "password", RoleViewer)
+
+    alice, err := service.IssueTokens("alice")
+    if err != nil {
+        t.Fatalf("IssueTokens failed: %v", err)
+    }
+    bob, err := service.CreateToken("bob")
+    if err != nil {
+        t.Fatalf("CreateToken failed: %v", err)
+    }
+
+    if err := service.RevokeUserSessions("alice"); err != nil {
+        t.Fatalf("RevokeUserSessions failed: %v", err)
+    }
+    if _, ok := service.VerifyTokenClaims(alice.AccessToken); ok {
+        t.Error("Expected access token issued before the cutoff to be rejected")
+    }
+    if _, err := service.RefreshTokens(alice.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+        t.Errorf("Expected refresh token to be revoked, got %v", err)
+    }
+    if _, ok := service.VerifyTokenClaims(bob); !ok {
+        t.Error("Expected other users' tokens to stay valid")
+    }
+
+    // Logging in again right away, within the cutoff's second, works
+    pair, err := service.IssueTokens("alice")
+    if err != nil {
+        t.Fatalf("IssueTokens failed: %v", err)
+    }
+    if _, ok := service.VerifyTokenClaims(pair.AccessToken); !ok {
+        t.Error("Expected a token issued right after the cutoff to be accepted")
+    }
+    if _, err := service.RefreshTokens(pair.RefreshToken); err != nil {
+        t.Errorf("Expected a refresh token issued after the cutoff to work, got %v", err)
+    }
+
+    if err := service.RevokeUserSessions("nobody"); !errors.Is(err, ErrUserNotFound) {
+        t.Errorf("Expected ErrUserNotFound, got %v", err)
+    }
+}
+
+func TestRevocationGarbageCollection(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "revocations.json")
+    store, err := newRevocationStore(file)
+    if err != nil {
+        t.Fatalf("Failed to open revocations: %v", err)
+    }
+    now := time.Now()
+    store.revokeToken("expired", now.Add(-time.Minute))
+    store.revokeToken("live", now.Add(time.Minute))
+    store.revokeUser("alice")
+    store.mu.Lock()
+    store.Users["bob"] = now.Add(-2 * time.Hour)
+    store.mu.Unlock()
+
+    store.collectGarbage(time.Hour)
+
+    reloaded, err := newRevocationStore(file)
+    if err != nil {
+        t.Fatalf("Failed to reload revocations: %v", err)
+    }
+    for _, s := range []*revocationStore{store, reloaded} {
+        if _, ok := s.Tokens["expired"]; ok || len(s.Tokens) != 1 {
+            t.Errorf("Expected only the live token revocation to be kept, got %v", s.Tokens)
+        }
+        if _, ok := s.Users["bob"]; ok || len(s.Users) != 1 {
+            t.Errorf("Expected only alice's recent cutoff to be kept, got %v", s.Users)
+        }
+    }
+    if revoked, _ := reloaded.isRevoked("live", "carol", now); !revoked {
+        t.Error("Expected the live token to stay revoked after reload")
+    }
+
+    if err := os.WriteFile(file, []byte("{"), 0600); err != nil {
+        t.Fatalf("Failed to corrupt revocations: %v", err)
+    }
+    if _, err := newRevocationStore(file); err == nil {
+        t.Error("Expected a corrupt revocation file to be an error")
+    }
+}
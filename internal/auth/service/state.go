@@ -0,0 +1,187 @@
+package service
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// gcInterval is how often expired state is dropped
+const gcInterval = 10 * time.Minute
+
+// StateStore persists the auth state besides accounts: revoked tokens,
+// refresh tokens, API keys, signing keys, invites, OAuth clients and
+// pending MFA challenges. Every instance serving the same users must share
+// it, so that a logout, a revoked key or a rotated signing key on one
+// instance applies on all of them. GormStateStore provides that for any
+// number of instances; FileStateStore is for a single one.
+//
+// The methods are unexported, so the implementations are the ones in this
+// package. They must be safe for concurrent use.
+type StateStore interface {
+    // revokeToken revokes the token with jti until it expires
+    revokeToken(jti string, expiresAt time.Time) error
+    // revokeUser revokes every token issued to username before now
+    revokeUser(username string) error
+    // isRevoked reports whether the token with jti, issued to username at
+    // issuedAt, was revoked by itself or with the user's sessions
+    isRevoked(jti, username string, issuedAt time.Time) (bool, error)
+
+    // addRefreshToken stores a refresh token by the hash of the token
+    addRefreshToken(hash string, record refreshRecord) error
+    // refreshToken returns a refresh token by hash
+    refreshToken(hash string) (refreshRecord, bool, error)
+    // useRefreshToken marks a refresh token used and returns it as it was
+    // before, so that only one caller ever sees it unused
+    useRefreshToken(hash string) (refreshRecord, bool, error)
+    // revokeRefreshTokens revokes every refresh token matching all
+    // non-empty fields of match
+    revokeRefreshTokens(match refreshMatch) error
+
+    // addAPIKey stores a new API key
+    addAPIKey(key APIKey) error
+    // apiKey returns an API key by ID
+    apiKey(id string) (APIKey, bool, error)
+    // listAPIKeys returns the keys of owner, or every key when owner is
+    // empty, oldest first
+    listAPIKeys(owner string) ([]APIKey, error)
+    // revokeAPIKey revokes a key, restricted to owner's keys unless owner
+    // is empty, or returns ErrAPIKeyNotFound
+    revokeAPIKey(id, owner string) error
+    // touchAPIKey records a use of a key from ip. Stores may write it at
+    // most once per apiKeyTouchInterval.
+    touchAPIKey(id, ip string, at time.Time) error
+
+    // signingKeys returns the signing keys, oldest first
+    signingKeys() ([]*signingKey, error)
+    // updateSigningKeys replaces the signing keys with the result of fn,
+    // which is applied to the current ones. Updates from other instances
+    // are serialized, and nothing is saved when fn returns an error.
+    updateSigningKeys(fn func([]*signingKey) ([]*signingKey, error)) error
+
+    // addInvite stores an invite by the hash of its code
+    addInvite(hash string, inv invite) error
+    // consumeInvite removes and returns an invite by hash. Only one caller
+    // gets it.
+    consumeInvite(hash string) (invite, bool, error)
+
+    // addOAuthClient stores a new OAuth client
+    addOAuthClient(client OAuthClient) error
+    // oauthClient returns a client by ID, including revoked ones
+    oauthClient(id string) (OAuthClient, bool, error)
+    // listOAuthClients returns every client, oldest first
+    listOAuthClients() ([]OAuthClient, error)
+    // revokeOAuthClient revokes a client, or returns ErrOAuthClientNotFound
+    revokeOAuthClient(id string) error
+
+    // addMFAChallenge stores a challenge by the hash of its token
+    addMFAChallenge(hash string, challenge mfaChallenge) error
+    // attemptMFAChallenge counts an attempt at a challenge and returns it
+    // with the attempt included
+    attemptMFAChallenge(hash string) (mfaChallenge, bool, error)
+    // deleteMFAChallenge removes a challenge
+    deleteMFAChallenge(hash string) error
+
+    // collectGarbage drops expired revocations, refresh tokens, invites and
+    // challenges, and session cutoffs older than maxTokenAge
+    collectGarbage(maxTokenAge time.Duration) error
+}
+
+// refreshMatch selects refresh tokens by family, user or client
+type refreshMatch struct {
+    Family   string
+    Username string
+    ClientID string
+}
+
+// matches reports whether record has every non-empty field of m
+func (m refreshMatch) matches(record refreshRecord) bool {
+    return (m.Family == "" || record.Family == m.Family) &&
+        (m.Username == "" || record.Username == m.Username) &&
+        (m.ClientID == "" || record.ClientID == m.ClientID)
+}
+
+// FileStateStore keeps the auth state in JSON files in one directory, and
+// pending MFA challenges, which only live for minutes, in memory. Each
+// instance would have its own copy, so it only suits a single instance.
+type FileStateStore struct {
+    *revocationStore
+    *refreshTokenStore
+    *apiKeyStore
+    *signingKeyFile
+    *inviteStore
+    *oauthClientStore
+    *mfaChallenges
+}
+
+// NewFileStateStore opens the state files in dir, creating it if needed.
+// Signing keys are kept in keyFile, or in dir when it is empty. Missing
+// files start empty; unreadable or corrupt ones are an error, since the
+// next write would drop their contents.
+func NewFileStateStore(dir, keyFile string) (*FileStateStore, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, fmt.Errorf("failed to create state directory: %v", err)
+    }
+    if keyFile == "" {
+        keyFile = filepath.Join(dir, "signing_keys.json")
+    }
+
+    revocations, err := newRevocationStore(filepath.Join(dir, "revocations.json"))
+    if err != nil {
+        return nil, err
+    }
+    refreshTokens, err := newRefreshTokenStore(filepath.Join(dir, "refresh_tokens.json"))
+    if err != nil {
+        return nil, err
+    }
+    apiKeys, err := newAPIKeyStore(filepath.Join(dir, "api_keys.json"))
+    if err != nil {
+        return nil, err
+    }
+    invites, err := newInviteStore(filepath.Join(dir, "invites.json"))
+    if err != nil {
+        return nil, err
+    }
+    oauthClients, err := newOAuthClientStore(filepath.Join(dir, "oauth_clients.json"))
+    if err != nil {
+        return nil, err
+    }
+
+    return &FileStateStore{
+        revocationStore:   revocations,
+        refreshTokenStore: refreshTokens,
+        apiKeyStore:       apiKeys,
+        signingKeyFile:    &signingKeyFile{file: keyFile},
+        inviteStore:       invites,
+        oauthClientStore:  oauthClients,
+        mfaChallenges:     newMFAChallenges(),
+    }, nil
+}
+
+func (f *FileStateStore) collectGarbage(maxTokenAge time.Duration) error {
+    if err := f.revocationStore.collectGarbage(maxTokenAge); err != nil {
+        return err
+    }
+    if err := f.refreshTokenStore.collectGarbage(); err != nil {
+        return err
+    }
+    if err := f.inviteStore.collectGarbage(); err != nil {
+        return err
+    }
+    f.mfaChallenges.collectGarbage()
+    return nil
+}
+
+// runGC periodically drops expired state for the lifetime of the process
+func (s *AuthService) runGC(maxTokenAge time.Duration) {
+    ticker := time.NewTicker(gcInterval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        if err := s.state.collectGarbage(maxTokenAge); err != nil {
+            log.Printf("Failed to collect expired auth state: %v", err)
+        }
+    }
+}
@@ -0,0 +1,566 @@
+package service
+
+import (
+    "errors"
+    "fmt"
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// signingKeyLockID is the Postgres advisory lock key held while updating
+// signing keys
+const signingKeyLockID = 0x6b657973 // "keys"
+
+// The state tables store times in UTC. SQLite keeps them as text, and
+// only text in the same zone compares in time order.
+
+// revokedTokenRecord is the revoked_tokens table row
+type revokedTokenRecord struct {
+    JTI       string    `gorm:"column:jti;primaryKey"`
+    ExpiresAt time.Time `gorm:"not null"`
+}
+
+func (revokedTokenRecord) TableName() string {
+    return "revoked_tokens"
+}
+
+// sessionCutoffRecord is the session_cutoffs table row
+type sessionCutoffRecord struct {
+    Username string    `gorm:"primaryKey"`
+    Cutoff   time.Time `gorm:"not null"`
+}
+
+func (sessionCutoffRecord) TableName() string {
+    return "session_cutoffs"
+}
+
+// refreshTokenRecord is the refresh_tokens table row
+type refreshTokenRecord struct {
+    Hash      string    `gorm:"primaryKey"`
+    Username  string    `gorm:"not null"`
+    Family    string    `gorm:"not null"`
+    ClientID  string    `gorm:"not null"`
+    ExpiresAt time.Time `gorm:"not null"`
+    Used      bool      `gorm:"not null"`
+    Revoked   bool      `gorm:"not null"`
+}
+
+func (refreshTokenRecord) TableName() string {
+    return "refresh_tokens"
+}
+
+func (r refreshTokenRecord) record() refreshRecord {
+    return refreshRecord{
+        Username:  r.Username,
+        Family:    r.Family,
+        ClientID:  r.ClientID,
+        ExpiresAt: r.ExpiresAt,
+        Used:      r.Used,
+        Revoked:   r.Revoked,
+    }
+}
+
+// apiKeyRecord is the api_keys table row
+type apiKeyRecord struct {
+    ID         string    `gorm:"primaryKey"`
+    Name       string    `gorm:"not null"`
+    Owner      string    `gorm:"not null"`
+    Hash       string    `gorm:"not null"`
+    Scopes     []string  `gorm:"serializer:json;not null"`
+    AllowedIPs []string  `gorm:"column:allowed_ips;serializer:json;not null"`
+    CreatedAt  time.Time `gorm:"not null"`
+    ExpiresAt  *time.Time
+    LastUsedAt *time.Time
+    LastUsedIP string `gorm:"column:last_used_ip;not null"`
+    RevokedAt  *time.Time
+}
+
+func (apiKeyRecord) TableName() string {
+    return "api_keys"
+}
+
+func (r apiKeyRecord) key() APIKey {
+    return APIKey{
+        ID:         r.ID,
+        Name:       r.Name,
+        Owner:      r.Owner,
+        Hash:       r.Hash,
+        Scopes:     r.Scopes,
+        AllowedIPs: r.AllowedIPs,
+        CreatedAt:  r.CreatedAt,
+        ExpiresAt:  r.ExpiresAt,
+        LastUsedAt: r.LastUsedAt,
+        LastUsedIP: r.LastUsedIP,
+        RevokedAt:  r.RevokedAt,
+    }
+}
+
+// signingKeyRecord is the signing_keys table row
+type signingKeyRecord struct {
+    KID        string    `gorm:"column:kid;primaryKey"`
+    Algorithm  string    `gorm:"not null"`
+    CreatedAt  time.Time `gorm:"not null"`
+    RetiredAt  *time.Time
+    PrivateKey string `gorm:"not null"`
+}
+
+func (signingKeyRecord) TableName() string {
+    return "signing_keys"
+}
+
+// inviteRecord is the invites table row
+type inviteRecord struct {
+    Hash      string    `gorm:"primaryKey"`
+    Role      string    `gorm:"not null"`
+    CreatedBy string    `gorm:"not null"`
+    ExpiresAt time.Time `gorm:"not null"`
+}
+
+func (inviteRecord) TableName() string {
+    return "invites"
+}
+
+// oauthClientRecord is the oauth_clients table row
+type oauthClientRecord struct {
+    ID         string    `gorm:"primaryKey"`
+    Name       string    `gorm:"not null"`
+    Hash       string    `gorm:"not null"`
+    Scopes     []string  `gorm:"serializer:json;not null"`
+    GrantTypes []string  `gorm:"serializer:json;not null"`
+    CreatedBy  string    `gorm:"not null"`
+    CreatedAt  time.Time `gorm:"not null"`
+    RevokedAt  *time.Time
+}
+
+func (oauthClientRecord) TableName() string {
+    return "oauth_clients"
+}
+
+func (r oauthClientRecord) client() OAuthClient {
+    return OAuthClient{
+        ID:         r.ID,
+        Name:       r.Name,
+        Hash:       r.Hash,
+        Scopes:     r.Scopes,
+        GrantTypes: r.GrantTypes,
+        CreatedBy:  r.CreatedBy,
+        CreatedAt:  r.CreatedAt,
+        RevokedAt:  r.RevokedAt,
+    }
+}
+
+// mfaChallengeRecord is the mfa_challenges table row
+type mfaChallengeRecord struct {
+    Hash      string    `gorm:"primaryKey"`
+    Username  string    `gorm:"not null"`
+    ExpiresAt time.Time `gorm:"not null"`
+    Attempts  int       `gorm:"not null"`
+}
+
+func (mfaChallengeRecord) TableName() string {
+    return "mfa_challenges"
+}
+
+// GormStateStore keeps the auth state in a SQL database, normally the
+// Postgres database holding the users, so that any number of auth
+// instances share it
+type GormStateStore struct {
+    db *gorm.DB
+}
+
+// NewGormStateStore applies pending schema migrations and returns a store
+// backed by db
+func NewGormStateStore(db *gorm.DB) (*GormStateStore, error) {
+    if err := migrate(db); err != nil {
+        return nil, fmt.Errorf("failed to migrate state store: %v", err)
+    }
+    return &GormStateStore{db: db}, nil
+}
+
+func (g *GormStateStore) revokeToken(jti string, expiresAt time.Time) error {
+    record := revokedTokenRecord{JTI: jti, ExpiresAt: expiresAt.UTC()}
+    return g.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&record).Error
+}
+
+func (g *GormStateStore) revokeUser(username string) error {
+    record := sessionCutoffRecord{Username: username, Cutoff: time.Now().UTC()}
+    return g.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&record).Error
+}
+
+func (g *GormStateStore) isRevoked(jti, username string, issuedAt time.Time) (bool, error) {
+    var count int64
+    if err := g.db.Model(&revokedTokenRecord{}).Where("jti = ?", jti).Count(&count).Error; err != nil {
+        return false, err
+    }
+    if count > 0 {
+        return true, nil
+    }
+
+    var cutoff sessionCutoffRecord
+    err := g.db.Where("username = ?", username).Take(&cutoff).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    return issuedAt.Before(cutoff.Cutoff), nil
+}
+
+func (g *GormStateStore) addRefreshToken(hash string, record refreshRecord) error {
+    return g.db.Create(&refreshTokenRecord{
+        Hash:      hash,
+        Username:  record.Username,
+        Family:    record.Family,
+        ClientID:  record.ClientID,
+        ExpiresAt: record.ExpiresAt.UTC(),
+        Used:      record.Used,
+        Revoked:   record.Revoked,
+    }).Error
+}
+
+func (g *GormStateStore) refreshToken(hash string) (refreshRecord, bool, error) {
+    var record refreshTokenRecord
+    err := g.db.Where("hash = ?", hash).Take(&record).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return refreshRecord{}, false, nil
+    }
+    if err != nil {
+        return refreshRecord{}, false, err
+    }
+    return record.record(), true, nil
+}
+
+func (g *GormStateStore) useRefreshToken(hash string) (refreshRecord, bool, error) {
+    var used refreshTokenRecord
+    err := g.db.Transaction(func(tx *gorm.DB) error {
+        err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+            Where("hash = ?", hash).Take(&used).Error
+        if err != nil {
+            return err
+        }
+        if used.Used {
+            return nil
+        }
+        return tx.Model(&refreshTokenRecord{}).Where("hash = ?", hash).Update("used", true).Error
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return refreshRecord{}, false, nil
+    }
+    if err != nil {
+        return refreshRecord{}, false, err
+    }
+    return used.record(), true, nil
+}
+
+func (g *GormStateStore) revokeRefreshTokens(match refreshMatch) error {
+    query := g.db.Model(&refreshTokenRecord{})
+    if match.Family != "" {
+        query = query.Where("family = ?", match.Family)
+    }
+    if match.Username != "" {
+        query = query.Where("username = ?", match.Username)
+    }
+    if match.ClientID != "" {
+        query = query.Where("client_id = ?", match.ClientID)
+    }
+    return query.Where("revoked = ?", false).Update("revoked", true).Error
+}
+
+func (g *GormStateStore) addAPIKey(key APIKey) error {
+    return g.db.Create(&apiKeyRecord{
+        ID:         key.ID,
+        Name:       key.Name,
+        Owner:      key.Owner,
+        Hash:       key.Hash,
+        Scopes:     key.Scopes,
+        AllowedIPs: key.AllowedIPs,
+        CreatedAt:  key.CreatedAt.UTC(),
+        ExpiresAt:  utcPtr(key.ExpiresAt),
+        LastUsedAt: utcPtr(key.LastUsedAt),
+        LastUsedIP: key.LastUsedIP,
+        RevokedAt:  utcPtr(key.RevokedAt),
+    }).Error
+}
+
+func (g *GormStateStore) apiKey(id string) (APIKey, bool, error) {
+    var record apiKeyRecord
+    err := g.db.Where("id = ?", id).Take(&record).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return APIKey{}, false, nil
+    }
+    if err != nil {
+        return APIKey{}, false, err
+    }
+    return record.key(), true, nil
+}
+
+func (g *GormStateStore) listAPIKeys(owner string) ([]APIKey, error) {
+    query := g.db.Order("created_at")
+    if owner != "" {
+        query = query.Where("owner = ?", owner)
+    }
+    var records []apiKeyRecord
+    if err := query.Find(&records).Error; err != nil {
+        return nil, err
+    }
+
+    keys := make([]APIKey, 0, len(records))
+    for _, record := range records {
+        keys = append(keys, record.key())
+    }
+    return keys, nil
+}
+
+func (g *GormStateStore) revokeAPIKey(id, owner string) error {
+    query := g.db.Model(&apiKeyRecord{}).Where("id = ?", id)
+    if owner != "" {
+        query = query.Where("owner = ?", owner)
+    }
+    result := query.Update("revoked_at", gorm.Expr("COALESCE(revoked_at, ?)", time.Now().UTC()))
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return ErrAPIKeyNotFound
+    }
+    return nil
+}
+
+// touchAPIKey writes the use unless the recorded one is more recent than
+// apiKeyTouchInterval, so that busy keys do not write on every request
+func (g *GormStateStore) touchAPIKey(id, ip string, at time.Time) error {
+    key, exists, err := g.apiKey(id)
+    if err != nil || !exists {
+        return err
+    }
+    if key.LastUsedAt != nil && at.Sub(*key.LastUsedAt) < apiKeyTouchInterval {
+        return nil
+    }
+
+    return g.db.Model(&apiKeyRecord{}).Where("id = ?", id).Updates(map[string]interface{}{
+        "last_used_at": at.UTC(),
+        "last_used_ip": ip,
+    }).Error
+}
+
+func (g *GormStateStore) signingKeys() ([]*signingKey, error) {
+    return loadSigningKeys(g.db)
+}
+
+// updateSigningKeys replaces the keys in a transaction. On Postgres it
+// holds an advisory lock, so that instances rotating together see each
+// other's keys.
+func (g *GormStateStore) updateSigningKeys(fn func([]*signingKey) ([]*signingKey, error)) error {
+    return g.db.Transaction(func(tx *gorm.DB) error {
+        if tx.Dialector.Name() == "postgres" {
+            if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", signingKeyLockID).Error; err != nil {
+                return fmt.Errorf("failed to lock signing keys: %v", err)
+            }
+        }
+
+        keys, err := loadSigningKeys(tx)
+        if err != nil {
+            return err
+        }
+        keys, err = fn(keys)
+        if err != nil {
+            return err
+        }
+
+        if err := tx.Exec("DELETE FROM signing_keys").Error; err != nil {
+            return err
+        }
+        for _, key := range keys {
+            record := signingKeyRecord{
+                KID:        key.ID,
+                Algorithm:  key.Algorithm,
+                CreatedAt:  key.CreatedAt.UTC(),
+                RetiredAt:  utcPtr(key.RetiredAt),
+                PrivateKey: key.PrivateKey,
+            }
+            if err := tx.Create(&record).Error; err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// loadSigningKeys reads the signing keys, oldest first
+func loadSigningKeys(db *gorm.DB) ([]*signingKey, error) {
+    var records []signingKeyRecord
+    if err := db.Order("created_at").Find(&records).Error; err != nil {
+        return nil, err
+    }
+
+    keys := make([]*signingKey, 0, len(records))
+    for _, record := range records {
+        key := &signingKey{
+            ID:         record.KID,
+            Algorithm:  record.Algorithm,
+            CreatedAt:  record.CreatedAt,
+            RetiredAt:  record.RetiredAt,
+            PrivateKey: record.PrivateKey,
+        }
+        if err := key.parse(); err != nil {
+            return nil, err
+        }
+        keys = append(keys, key)
+    }
+    return keys, nil
+}
+
+func (g *GormStateStore) addInvite(hash string, inv invite) error {
+    return g.db.Create(&inviteRecord{
+        Hash:      hash,
+        Role:      inv.Role,
+        CreatedBy: inv.CreatedBy,
+        ExpiresAt: inv.ExpiresAt.UTC(),
+    }).Error
+}
+
+func (g *GormStateStore) consumeInvite(hash string) (invite, bool, error) {
+    var record inviteRecord
+    err := g.db.Where("hash = ?", hash).Take(&record).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return invite{}, false, nil
+    }
+    if err != nil {
+        return invite{}, false, err
+    }
+
+    // Only the caller that deletes the invite gets it
+    result := g.db.Where("hash = ?", hash).Delete(&inviteRecord{})
+    if result.Error != nil {
+        return invite{}, false, result.Error
+    }
+    if result.RowsAffected == 0 {
+        return invite{}, false, nil
+    }
+    return invite{
+        Role:      record.Role,
+        CreatedBy: record.CreatedBy,
+        ExpiresAt: record.ExpiresAt,
+    }, true, nil
+}
+
+func (g *GormStateStore) addOAuthClient(client OAuthClient) error {
+    return g.db.Create(&oauthClientRecord{
+        ID:         client.ID,
+        Name:       client.Name,
+        Hash:       client.Hash,
+        Scopes:     client.Scopes,
+        GrantTypes: client.GrantTypes,
+        CreatedBy:  client.CreatedBy,
+        CreatedAt:  client.CreatedAt.UTC(),
+        RevokedAt:  utcPtr(client.RevokedAt),
+    }).Error
+}
+
+func (g *GormStateStore) oauthClient(id string) (OAuthClient, bool, error) {
+    var record oauthClientRecord
+    err := g.db.Where("id = ?", id).Take(&record).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return OAuthClient{}, false, nil
+    }
+    if err != nil {
+        return OAuthClient{}, false, err
+    }
+    return record.client(), true, nil
+}
+
+func (g *GormStateStore) listOAuthClients() ([]OAuthClient, error) {
+    var records []oauthClientRecord
+    if err := g.db.Order("created_at").Find(&records).Error; err != nil {
+        return nil, err
+    }
+
+    clients := make([]OAuthClient, 0, len(records))
+    for _, record := range records {
+        clients = append(clients, record.client())
+    }
+    return clients, nil
+}
+
+func (g *GormStateStore) revokeOAuthClient(id string) error {
+    result := g.db.Model(&oauthClientRecord{}).Where("id = ?", id).
+        Update("revoked_at", gorm.Expr("COALESCE(revoked_at, ?)", time.Now().UTC()))
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return ErrOAuthClientNotFound
+    }
+    return nil
+}
+
+func (g *GormStateStore) addMFAChallenge(hash string, challenge mfaChallenge) error {
+    return g.db.Create(&mfaChallengeRecord{
+        Hash:      hash,
+        Username:  challenge.username,
+        ExpiresAt: challenge.expiresAt.UTC(),
+        Attempts:  challenge.attempts,
+    }).Error
+}
+
+func (g *GormStateStore) attemptMFAChallenge(hash string) (mfaChallenge, bool, error) {
+    result := g.db.Model(&mfaChallengeRecord{}).Where("hash = ?", hash).
+        Update("attempts", gorm.Expr("attempts + 1"))
+    if result.Error != nil {
+        return mfaChallenge{}, false, result.Error
+    }
+    if result.RowsAffected == 0 {
+        return mfaChallenge{}, false, nil
+    }
+
+    var record mfaChallengeRecord
+    err := g.db.Where("hash = ?", hash).Take(&record).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return mfaChallenge{}, false, nil
+    }
+    if err != nil {
+        return mfaChallenge{}, false, err
+    }
+    return mfaChallenge{
+        username:  record.Username,
+        expiresAt: record.ExpiresAt,
+        attempts:  record.Attempts,
+    }, true, nil
+}
+
+func (g *GormStateStore) deleteMFAChallenge(hash string) error {
+    return g.db.Where("hash = ?", hash).Delete(&mfaChallengeRecord{}).Error
+}
+
+func (g *GormStateStore) collectGarbage(maxTokenAge time.Duration) error {
+    now := time.Now().UTC()
+    deletes := []struct {
+        model     interface{}
+        condition string
+        before    time.Time
+    }{
+        {&revokedTokenRecord{}, "expires_at < ?", now},
+        {&sessionCutoffRecord{}, "cutoff < ?", now.Add(-maxTokenAge)},
+        {&refreshTokenRecord{}, "expires_at < ?", now},
+        {&inviteRecord{}, "expires_at < ?", now},
+        {&mfaChallengeRecord{}, "expires_at < ?", now},
+    }
+    for _, d := range deletes {
+        if err := g.db.Where(d.condition, d.before).Delete(d.model).Error; err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// utcPtr returns t in UTC, or nil for nil
+func utcPtr(t *time.Time) *time.Time {
+    if t == nil {
+        return nil
+    }
+    utc := t.UTC()
+    return &utc
+}
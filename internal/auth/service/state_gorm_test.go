@@ -0,0 +1,410 @@
+package service
+
+import (
+    "errors"
+    "reflect"
+    "testing"
+    "time"
+
+    "gorm.io/gorm"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/config"
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/jwks"
+)
+
+func newTestStateStore(t *testing.T) *GormStateStore {
+    t.Helper()
+
+    store, err := NewGormStateStore(newTestDB(t))
+    if err != nil {
+        t.Fatalf("Failed to open state store: %v", err)
+    }
+    return store
+}
+
+func TestGormStateRevocations(t *testing.T) {
+    store := newTestStateStore(t)
+    now := time.Now()
+
+    store.revokeToken("expired", now.Add(-time.Minute))
+    store.revokeToken("live", now.Add(time.Minute))
+    if err := store.revokeUser("alice"); err != nil {
+        t.Fatalf("revokeUser failed: %v", err)
+    }
+
+    tests := []struct {
+        name     string
+        jti      string
+        username string
+        issuedAt time.Time
+        want     bool
+    }{
+        {"revoked token", "live", "bob", now, true},
+        {"other token", "other", "bob", now, false},
+        {"issued before cutoff", "other", "alice", now.Add(-time.Second), true},
+        {"issued after cutoff", "other", "alice", time.Now().Add(time.Millisecond), false},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            revoked, err := store.isRevoked(test.jti, test.username, test.issuedAt)
+            if err != nil || revoked != test.want {
+                t.Errorf("Expected revoked %v, got %v, %v", test.want, revoked, err)
+            }
+        })
+    }
+
+    // Expired revocations and cutoffs older than any token are dropped
+    store.db.Create(&sessionCutoffRecord{Username: "bob", Cutoff: now.Add(-2 * time.Hour).UTC()})
+    if err := store.collectGarbage(time.Hour); err != nil {
+        t.Fatalf("collectGarbage failed: %v", err)
+    }
+    var tokens, cutoffs int64
+    store.db.Model(&revokedTokenRecord{}).Count(&tokens)
+    store.db.Model(&sessionCutoffRecord{}).Count(&cutoffs)
+    if tokens != 1 || cutoffs != 1 {
+        t.Errorf("Expected one token revocation and one cutoff to be kept, got %d and %d", tokens, cutoffs)
+    }
+    if revoked, _ := store.isRevoked("live", "carol", now); !revoked {
+        t.Error("Expected the live token to stay revoked")
+    }
+}
+
+func TestGormStateRefreshTokens(t *testing.T) {
+    store := newTestStateStore(t)
+    expires := time.Now().Add(time.Hour)
+
+    records := map[string]refreshRecord{
+        "a1": {Username: "alice", Family: "fa", ExpiresAt: expires},
+        "a2": {Username: "alice", Family: "fb", ClientID: "client", ExpiresAt: expires},
+        "b1": {Username: "bob", Family: "fc", ExpiresAt: expires},
+        "x1": {Username: "bob", Family: "fd", ExpiresAt: time.Now().Add(-time.Minute)},
+    }
+    for hash, record := range records {
+        if err := store.addRefreshToken(hash, record); err != nil {
+            t.Fatalf("addRefreshToken failed: %v", err)
+        }
+    }
+
+    // Only the first use sees the token unused
+    first, ok, err := store.useRefreshToken("a1")
+    if err != nil || !ok || first.Used || first.Username != "alice" || !first.ExpiresAt.Equal(expires) {
+        t.Fatalf("Expected the unused token, got %+v, %v, %v", first, ok, err)
+    }
+    second, ok, err := store.useRefreshToken("a1")
+    if err != nil || !ok || !second.Used {
+        t.Errorf("Expected the token to be used already, got %+v, %v, %v", second, ok, err)
+    }
+    if _, ok, err := store.useRefreshToken("unknown"); ok || err != nil {
+        t.Errorf("Expected an unknown token not to be found, got %v, %v", ok, err)
+    }
+
+    if err := store.revokeRefreshTokens(refreshMatch{ClientID: "client"}); err != nil {
+        t.Fatalf("revokeRefreshTokens failed: %v", err)
+    }
+    if err := store.revokeRefreshTokens(refreshMatch{Username: "bob", Family: "fd"}); err != nil {
+        t.Fatalf("revokeRefreshTokens failed: %v", err)
+    }
+    for hash, want := range map[string]bool{"a1": false, "a2": true, "b1": false, "x1": true} {
+        record, _, err := store.refreshToken(hash)
+        if err != nil || record.Revoked != want {
+            t.Errorf("Expected %s revoked %v, got %+v, %v", hash, want, record, err)
+        }
+    }
+
+    if err := store.collectGarbage(time.Hour); err != nil {
+        t.Fatalf("collectGarbage failed: %v", err)
+    }
+    if _, ok, _ := store.refreshToken("x1"); ok {
+        t.Error("Expected the expired token to be dropped")
+    }
+}
+
+func TestGormStateAPIKeys(t *testing.T) {
+    store := newTestStateStore(t)
+    created := time.Now().Add(-time.Hour)
+    expires := time.Now().Add(time.Hour)
+
+    keys := []APIKey{
+        {ID: "k1", Name: "ci", Owner: "alice", Hash: "h1", Scopes: []string{"gpio:read:*"}, CreatedAt: created},
+        {ID: "k2", Owner: "bob", Hash: "h2", AllowedIPs: []string{"10.0.0.0/8"}, CreatedAt: created.Add(time.Minute), ExpiresAt: &expires},
+        {ID: "k3", Owner: "alice", Hash: "h3", CreatedAt: created.Add(2 * time.Minute)},
+    }
+    for _, key := range keys {
+        if err := store.addAPIKey(key); err != nil {
+            t.Fatalf("addAPIKey failed: %v", err)
+        }
+    }
+
+    got, ok, err := store.apiKey("k2")
+    if err != nil || !ok || got.Hash != "h2" || !reflect.DeepEqual(got.AllowedIPs, keys[1].AllowedIPs) || !got.ExpiresAt.Equal(expires) {
+        t.Errorf("Expected key k2, got %+v, %v, %v", got, ok, err)
+    }
+    if _, ok, err := store.apiKey("unknown"); ok || err != nil {
+        t.Errorf("Expected an unknown key not to be found, got %v, %v", ok, err)
+    }
+
+    for owner, want := range map[string][]string{"alice": {"k1", "k3"}, "": {"k1", "k2", "k3"}, "carol": {}} {
+        list, err := store.listAPIKeys(owner)
+        if err != nil {
+            t.Fatalf("listAPIKeys failed: %v", err)
+        }
+        ids := []string{}
+        for _, key := range list {
+            ids = append(ids, key.ID)
+        }
+        if !reflect.DeepEqual(ids, want) {
+            t.Errorf("listAPIKeys(%q) = %v, want %v", owner, ids, want)
+        }
+    }
+
+    if err := store.revokeAPIKey("k2", "alice"); !errors.Is(err, ErrAPIKeyNotFound) {
+        t.Errorf("Expected ErrAPIKeyNotFound for another owner's key, got %v", err)
+    }
+    if err := store.revokeAPIKey("k1", "alice"); err != nil {
+        t.Fatalf("revokeAPIKey failed: %v", err)
+    }
+    revoked, _, _ := store.apiKey("k1")
+    if revoked.RevokedAt == nil {
+        t.Fatal("Expected the key to be revoked")
+    }
+    // Revoking again keeps the original time
+    if err := store.revokeAPIKey("k1", ""); err != nil {
+        t.Fatalf("revokeAPIKey failed: %v", err)
+    }
+    if again, _, _ := store.apiKey("k1"); !again.RevokedAt.Equal(*revoked.RevokedAt) {
+        t.Errorf("Expected revocation time %v to be kept, got %v", revoked.RevokedAt, again.RevokedAt)
+    }
+
+    // Uses within the touch interval of the recorded one are not written
+    used := time.Now()
+    store.touchAPIKey("k3", "10.0.0.1", used)
+    store.touchAPIKey("k3", "10.0.0.2", used.Add(time.Second))
+    if key, _, _ := store.apiKey("k3"); key.LastUsedAt == nil || !key.LastUsedAt.Equal(used) || key.LastUsedIP != "10.0.0.1" {
+        t.Errorf("Expected last use from 10.0.0.1, got %+v", key)
+    }
+    store.touchAPIKey("k3", "10.0.0.3", used.Add(apiKeyTouchInterval))
+    if key, _, _ := store.apiKey("k3"); key.LastUsedIP != "10.0.0.3" {
+        t.Errorf("Expected last use from 10.0.0.3, got %+v", key)
+    }
+}
+
+func TestGormStateInvitesAndChallenges(t *testing.T) {
+    store := newTestStateStore(t)
+    expires := time.Now().Add(time.Hour)
+
+    store.addInvite("live", invite{Role: RoleOperator, CreatedBy: "root", ExpiresAt: expires})
+    store.addInvite("expired", invite{Role: RoleViewer, CreatedBy: "root", ExpiresAt: time.Now().Add(-time.Minute)})
+
+    inv, ok, err := store.consumeInvite("live")
+    if err != nil || !ok || inv.Role != RoleOperator || inv.CreatedBy != "root" || !inv.ExpiresAt.Equal(expires) {
+        t.Errorf("Expected the invite, got %+v, %v, %v", inv, ok, err)
+    }
+    if _, ok, err := store.consumeInvite("live"); ok || err != nil {
+        t.Errorf("Expected an invite to be consumed once, got %v, %v", ok, err)
+    }
+
+    store.addMFAChallenge("live", mfaChallenge{username: "alice", expiresAt: expires})
+    store.addMFAChallenge("expired", mfaChallenge{username: "bob", expiresAt: time.Now().Add(-time.Minute)})
+    for i := 1; i <= 2; i++ {
+        challenge, ok, err := store.attemptMFAChallenge("live")
+        if err != nil || !ok || challenge.username != "alice" || challenge.attempts != i {
+            t.Errorf("Attempt %d: expected the challenge with %d attempts, got %+v, %v, %v", i, i, challenge, ok, err)
+        }
+    }
+    store.deleteMFAChallenge("live")
+    if _, ok, err := store.attemptMFAChallenge("live"); ok || err != nil {
+        t.Errorf("Expected a deleted challenge not to be found, got %v, %v", ok, err)
+    }
+
+    if err := store.collectGarbage(time.Hour); err != nil {
+        t.Fatalf("collectGarbage failed: %v", err)
+    }
+    var invites, challenges int64
+    store.db.Model(&inviteRecord{}).Count(&invites)
+    store.db.Model(&mfaChallengeRecord{}).Count(&challenges)
+    if invites != 0 || challenges != 0 {
+        t.Errorf("Expected expired invites and challenges to be dropped, got %d and %d", invites, challenges)
+    }
+}
+
+func TestGormStateOAuthClients(t *testing.T) {
+    store := newTestStateStore(t)
+    created := time.Now()
+
+    for i, id := range []string{"c1", "c2"} {
+        err := store.addOAuthClient(OAuthClient{
+            ID:         id,
+            Hash:       "hash",
+            Scopes:     []string{"gpio:read:*"},
+            GrantTypes: []string{GrantClientCredentials},
+            CreatedBy:  "root",
+            CreatedAt:  created.Add(time.Duration(i) * time.Minute),
+        })
+        if err != nil {
+            t.Fatalf("addOAuthClient failed: %v", err)
+        }
+    }
+
+    if err := store.revokeOAuthClient("unknown"); !errors.Is(err, ErrOAuthClientNotFound) {
+        t.Errorf("Expected ErrOAuthClientNotFound, got %v", err)
+    }
+    if err := store.revokeOAuthClient("c1"); err != nil {
+        t.Fatalf("revokeOAuthClient failed: %v", err)
+    }
+
+    clients, err := store.listOAuthClients()
+    if err != nil || len(clients) != 2 || clients[0].ID != "c1" || clients[1].ID != "c2" {
+        t.Fatalf("Expected clients c1 and c2, got %+v, %v", clients, err)
+    }
+    if clients[0].RevokedAt == nil || clients[1].RevokedAt != nil {
+        t.Error("Expected only c1 to be revoked")
+    }
+    if !reflect.DeepEqual(clients[1].GrantTypes, []string{GrantClientCredentials}) {
+        t.Errorf("Expected grant types to be kept, got %v", clients[1].GrantTypes)
+    }
+}
+
+func TestGormStateSigningKeys(t *testing.T) {
+    store := newTestStateStore(t)
+
+    keys, err := newKeyManager(store, jwks.AlgEdDSA, 0, time.Hour)
+    if err != nil {
+        t.Fatalf("Failed to create key manager: %v", err)
+    }
+    first := keys.active()
+
+    // A second instance starting on the same store keeps the active key
+    other, err := newKeyManager(store, jwks.AlgEdDSA, 0, time.Hour)
+    if err != nil {
+        t.Fatalf("Failed to create key manager: %v", err)
+    }
+    if other.active().ID != first.ID {
+        t.Errorf("Expected active key %s on both instances, got %s", first.ID, other.active().ID)
+    }
+
+    failed := errors.New("failed")
+    err = store.updateSigningKeys(func([]*signingKey) ([]*signingKey, error) {
+        return nil, failed
+    })
+    if !errors.Is(err, failed) {
+        t.Errorf("Expected the update error, got %v", err)
+    }
+    if stored, _ := store.signingKeys(); len(stored) != 1 {
+        t.Errorf("Expected a failed update not to be saved, got %d keys", len(stored))
+    }
+
+    if err := keys.rotate(); err != nil {
+        t.Fatalf("Rotate failed: %v", err)
+    }
+    stored, err := store.signingKeys()
+    if err != nil || len(stored) != 2 {
+        t.Fatalf("Expected 2 stored keys, got %d, %v", len(stored), err)
+    }
+    if stored[0].ID != first.ID || stored[0].RetiredAt == nil || stored[1].ID != keys.active().ID {
+        t.Errorf("Expected the first key retired and the new one active, got %+v", stored)
+    }
+    if stored[1].signer == nil {
+        t.Error("Expected stored keys to be parsed")
+    }
+}
+
+// newTestGormService creates a service keeping users and state in db, like
+// one of several instances sharing a Postgres database
+func newTestGormService(t *testing.T, db *gorm.DB) *AuthService {
+    t.Helper()
+
+    users, err := NewGormUserStore(db)
+    if err != nil {
+        t.Fatalf("Failed to open user store: %v", err)
+    }
+    state, err := NewGormStateStore(db)
+    if err != nil {
+        t.Fatalf("Failed to open state store: %v", err)
+    }
+    service, err := NewAuthService(&config.Config{
+        JWT:   config.JWTConfig{Algorithm: jwks.AlgEdDSA},
+        Login: testLoginConfig,
+    }, users, state)
+    if err != nil {
+        t.Fatalf("Failed to create service: %v", err)
+    }
+    return service
+}
+
+func TestSharedStateAcrossInstances(t *testing.T) {
+    testSharedState(t, newTestDB(t))
+}
+
+// testSharedState checks that changes made through one service apply on
+// another using the same database
+func testSharedState(t *testing.T, db *gorm.DB) {
+    first := newTestGormService(t, db)
+    second := newTestGormService(t, db)
+    first.AddUser("alice", "password", RoleOperator)
+
+    // Tokens issued by one instance verify on the other
+    pair, err := first.IssueTokens("alice")
+    if err != nil {
+        t.Fatalf("IssueTokens failed: %v", err)
+    }
+    if _, ok := second.VerifyTokenClaims(pair.AccessToken); !ok {
+        t.Fatal("Expected a token from the first instance to verify on the second")
+    }
+
+    // A refresh token rotated on one instance is reuse on the other
+    if _, err := first.RefreshTokens(pair.RefreshToken); err != nil {
+        t.Fatalf("RefreshTokens failed: %v", err)
+    }
+    if _, err := second.RefreshTokens(pair.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+        t.Errorf("Expected ErrRefreshTokenReused on the second instance, got %v", err)
+    }
+
+    // A logout on one instance applies on the other
+    pair, err = second.IssueTokens("alice")
+    if err != nil {
+        t.Fatalf("IssueTokens failed: %v", err)
+    }
+    if err := second.Logout(pair.AccessToken, pair.RefreshToken); err != nil {
+        t.Fatalf("Logout failed: %v", err)
+    }
+    if _, ok := first.VerifyTokenClaims(pair.AccessToken); ok {
+        t.Error("Expected a logged out token to be rejected on the first instance")
+    }
+    if _, err := first.RefreshTokens(pair.RefreshToken); err == nil {
+        t.Error("Expected a logged out refresh token to be rejected on the first instance")
+    }
+
+    // API keys revoked on one instance stop working on the other
+    key, info, err := first.CreateAPIKey("alice", APIKeyRequest{})
+    if err != nil {
+        t.Fatalf("CreateAPIKey failed: %v", err)
+    }
+    if _, err := second.VerifyAPIKey(key, "10.0.0.1"); err != nil {
+        t.Errorf("Expected the key to verify on the second instance, got %v", err)
+    }
+    if err := second.RevokeAPIKey(info.ID, ""); err != nil {
+        t.Fatalf("RevokeAPIKey failed: %v", err)
+    }
+    if _, err := first.VerifyAPIKey(key, "10.0.0.1"); !errors.Is(err, ErrInvalidAPIKey) {
+        t.Errorf("Expected ErrInvalidAPIKey on the first instance, got %v", err)
+    }
+
+    // Tokens signed with a key rotated on one instance verify on the other,
+    // which loads the new key when it sees its ID
+    if err := first.keys.rotate(); err != nil {
+        t.Fatalf("Rotate failed: %v", err)
+    }
+    token, err := first.CreateToken("alice")
+    if err != nil {
+        t.Fatalf("CreateToken failed: %v", err)
+    }
+    second.keys.mu.Lock()
+    second.keys.lastReload = time.Time{}
+    second.keys.mu.Unlock()
+    if _, ok := second.VerifyTokenClaims(token); !ok {
+        t.Error("Expected a token signed with the rotated key to verify on the second instance")
+    }
+    if set := second.JWKS(); len(set.Keys) != 2 {
+        t.Errorf("Expected the second instance to publish both keys, got %d", len(set.Keys))
+    }
+}
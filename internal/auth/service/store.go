@@ -0,0 +1,278 @@
+package service
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// ErrUserExists is returned when creating a user whose name is taken
+var ErrUserExists = errors.New("user already exists")
+
+// UserStore persists user accounts. Implementations must be safe for
+// concurrent use. Several auth instances can serve the same users with
+// GormUserStore and GormStateStore on one Postgres database, which holds
+// the tokens, revocations, keys and clients as well. Login throttling, the
+// forward-auth decision cache and the mTLS CA files stay per instance.
+type UserStore interface {
+    // Get returns a user, or ErrUserNotFound
+    Get(username string) (User, error)
+    // List returns every user keyed by username
+    List() (map[string]User, error)
+    // Create adds a user, or returns ErrUserExists
+    Create(username string, user User) error
+    // Update applies fn to a user and saves the result atomically, or
+    // returns ErrUserNotFound. Nothing is saved when fn returns an error.
+    Update(username string, fn func(*User) error) error
+    // Delete removes a user, or returns ErrUserNotFound
+    Delete(username string) error
+}
+
+// FileUserStore keeps users in memory and persists them to a JSON file. It
+// is only suitable for a single auth instance. Writes replace the file
+// atomically, and edits made to the file by hand are picked up before the
+// next read or write instead of being overwritten.
+type FileUserStore struct {
+    mu    sync.Mutex
+    file  string
+    users map[string]User
+
+    // modTime and size identify the file version last read or written
+    modTime time.Time
+    size    int64
+}
+
+// NewFileUserStore opens the JSON user file at path, starting empty when
+// it does not exist yet. Unreadable or malformed files are reported rather
+// than treated as empty, which would lose every account on the next write.
+func NewFileUserStore(path string) (*FileUserStore, error) {
+    store := &FileUserStore{
+        file:  path,
+        users: make(map[string]User),
+    }
+
+    store.mu.Lock()
+    defer store.mu.Unlock()
+    if err := store.reloadLocked(); err != nil {
+        return nil, err
+    }
+    return store, nil
+}
+
+func (f *FileUserStore) Get(username string) (User, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if err := f.reloadLocked(); err != nil {
+        return User{}, err
+    }
+
+    user, exists := f.users[username]
+    if !exists {
+        return User{}, ErrUserNotFound
+    }
+    return user, nil
+}
+
+func (f *FileUserStore) List() (map[string]User, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if err := f.reloadLocked(); err != nil {
+        return nil, err
+    }
+
+    users := make(map[string]User, len(f.users))
+    for username, user := range f.users {
+        users[username] = user
+    }
+    return users, nil
+}
+
+func (f *FileUserStore) Create(username string, user User) error {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if err := f.reloadLocked(); err != nil {
+        return err
+    }
+    if _, exists := f.users[username]; exists {
+        return ErrUserExists
+    }
+
+    f.users[username] = user
+    if err := f.saveLocked(); err != nil {
+        delete(f.users, username)
+        return err
+    }
+    return nil
+}
+
+func (f *FileUserStore) Update(username string, fn func(*User) error) error {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if err := f.reloadLocked(); err != nil {
+        return err
+    }
+    user, exists := f.users[username]
+    if !exists {
+        return ErrUserNotFound
+    }
+
+    previous := user
+    if err := fn(&user); err != nil {
+        return err
+    }
+
+    f.users[username] = user
+    if err := f.saveLocked(); err != nil {
+        f.users[username] = previous
+        return err
+    }
+    return nil
+}
+
+func (f *FileUserStore) Delete(username string) error {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if err := f.reloadLocked(); err != nil {
+        return err
+    }
+    user, exists := f.users[username]
+    if !exists {
+        return ErrUserNotFound
+    }
+
+    delete(f.users, username)
+    if err := f.saveLocked(); err != nil {
+        f.users[username] = user
+        return err
+    }
+    return nil
+}
+
+// reloadLocked rereads the file when it changed since it was last read or
+// written. A file that fails to parse is an error, and the in-memory users
+// are kept so that nothing is written over the broken file. The caller must
+// hold f.mu.
+func (f *FileUserStore) reloadLocked() error {
+    info, err := os.Stat(f.file)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to stat user file: %v", err)
+    }
+    if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+        return nil
+    }
+
+    data, err := os.ReadFile(f.file)
+    if err != nil {
+        return fmt.Errorf("failed to read user file: %v", err)
+    }
+
+    users := make(map[string]User)
+    if len(data) > 0 {
+        if err := json.Unmarshal(data, &users); err != nil {
+            return fmt.Errorf("failed to parse user file %s: %v", f.file, err)
+        }
+    }
+
+    if !f.modTime.IsZero() {
+        log.Printf("User file %s changed on disk, reloaded %d users", f.file, len(users))
+    }
+    f.users = users
+    f.modTime = info.ModTime()
+    f.size = info.Size()
+    return nil
+}
+
+// saveLocked atomically replaces the user file: the data is written to a
+// temporary file in the same directory, synced, and renamed over the old
+// file, so a crash leaves either the old or the new version. The caller
+// must hold f.mu.
+func (f *FileUserStore) saveLocked() error {
+    data, err := json.Marshal(f.users)
+    if err != nil {
+        return err
+    }
+
+    if err := writeFileAtomic(f.file, data, 0600); err != nil {
+        return fmt.Errorf("failed to save user file: %v", err)
+    }
+
+    info, err := os.Stat(f.file)
+    if err != nil {
+        return err
+    }
+    f.modTime = info.ModTime()
+    f.size = info.Size()
+    return nil
+}
+
+// writeFileAtomic writes data to path via a synced temporary file and a
+// rename, then syncs the directory so the rename itself is durable
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+    dir := filepath.Dir(path)
+    tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    if err := tmp.Chmod(perm); err != nil {
+        tmp.Close()
+        return err
+    }
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+
+    if err := os.Rename(tmp.Name(), path); err != nil {
+        return err
+    }
+
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+    return d.Sync()
+}
+
+// ImportUsers copies every user from src into dst, skipping usernames that
+// already exist in dst. It is used to migrate users.json into Postgres.
+func ImportUsers(src, dst UserStore) (imported, skipped int, err error) {
+    users, err := src.List()
+    if err != nil {
+        return 0, 0, err
+    }
+
+    for username, user := range users {
+        switch err := dst.Create(username, user); {
+        case err == nil:
+            imported++
+        case errors.Is(err, ErrUserExists):
+            skipped++
+        default:
+            return imported, skipped, err
+        }
+    }
+    return imported, skipped, nil
+}
@@ -0,0 +1,343 @@
+package service
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// userRecord is the users table row
+type userRecord struct {
+    Username  string    `gorm:"primaryKey"`
+    Hash      string    `gorm:"not null"`
+    Role      string    `gorm:"not null"`
+    Scopes    []string  `gorm:"serializer:json;not null"`
+    Disabled  bool      `gorm:"not null"`
+    CreatedAt time.Time `gorm:"not null"`
+    UpdatedAt time.Time `gorm:"not null"`
+
+    TOTPEnabled   bool     `gorm:"column:totp_enabled;not null"`
+    TOTPSecret    string   `gorm:"column:totp_secret;not null"`
+    TOTPPending   string   `gorm:"column:totp_pending;not null"`
+    TOTPLastStep  int64    `gorm:"column:totp_last_step;not null"`
+    RecoveryCodes []string `gorm:"serializer:json;not null"`
+}
+
+func (userRecord) TableName() string {
+    return "users"
+}
+
+func (r userRecord) user() User {
+    return User{
+        Hash:      r.Hash,
+        Role:      r.Role,
+        Scopes:    r.Scopes,
+        Disabled:  r.Disabled,
+        CreatedAt: r.CreatedAt,
+
+        TOTPEnabled:   r.TOTPEnabled,
+        TOTPSecret:    r.TOTPSecret,
+        TOTPPending:   r.TOTPPending,
+        TOTPLastStep:  r.TOTPLastStep,
+        RecoveryCodes: r.RecoveryCodes,
+    }
+}
+
+// migration is a schema change applied once, in order
+type migration struct {
+    ID      string
+    Migrate func(tx *gorm.DB) error
+}
+
+// schemaMigration records an applied migration
+type schemaMigration struct {
+    ID        string `gorm:"primaryKey"`
+    AppliedAt time.Time
+}
+
+// migrations must only ever be appended to
+var migrations = []migration{
+    {
+        ID: "0001_create_users",
+        Migrate: func(tx *gorm.DB) error {
+            return tx.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS users (
+                username   TEXT PRIMARY KEY,
+                hash       TEXT NOT NULL,
+                role       TEXT NOT NULL DEFAULT 'viewer',
+                scopes     TEXT NOT NULL DEFAULT '[]',
+                created_at %[1]s NOT NULL,
+                updated_at %[1]s NOT NULL
+            )`, timestampType(tx))).Error
+        },
+    },
+    {
+        ID: "0002_add_users_disabled",
+        Migrate: func(tx *gorm.DB) error {
+            return tx.Exec(`ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE`).Error
+        },
+    },
+    {
+        ID: "0003_add_users_totp",
+        Migrate: func(tx *gorm.DB) error {
+            return execAll(tx,
+                `ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+                `ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT ''`,
+                `ALTER TABLE users ADD COLUMN totp_pending TEXT NOT NULL DEFAULT ''`,
+                `ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0`,
+                `ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT '[]'`,
+            )
+        },
+    },
+    {
+        ID: "0004_create_auth_state",
+        Migrate: func(tx *gorm.DB) error {
+            ts := timestampType(tx)
+            return execAll(tx,
+                fmt.Sprintf(`CREATE TABLE revoked_tokens (
+                    jti        TEXT PRIMARY KEY,
+                    expires_at %s NOT NULL
+                )`, ts),
+                fmt.Sprintf(`CREATE TABLE session_cutoffs (
+                    username TEXT PRIMARY KEY,
+                    cutoff   %s NOT NULL
+                )`, ts),
+                fmt.Sprintf(`CREATE TABLE refresh_tokens (
+                    hash       TEXT PRIMARY KEY,
+                    username   TEXT NOT NULL,
+                    family     TEXT NOT NULL,
+                    client_id  TEXT NOT NULL DEFAULT '',
+                    expires_at %s NOT NULL,
+                    used       BOOLEAN NOT NULL DEFAULT FALSE,
+                    revoked    BOOLEAN NOT NULL DEFAULT FALSE
+                )`, ts),
+                `CREATE INDEX refresh_tokens_family ON refresh_tokens (family)`,
+                `CREATE INDEX refresh_tokens_username ON refresh_tokens (username)`,
+                `CREATE INDEX refresh_tokens_client_id ON refresh_tokens (client_id)`,
+                fmt.Sprintf(`CREATE TABLE api_keys (
+                    id           TEXT PRIMARY KEY,
+                    name         TEXT NOT NULL DEFAULT '',
+                    owner        TEXT NOT NULL,
+                    hash         TEXT NOT NULL,
+                    scopes       TEXT NOT NULL DEFAULT '[]',
+                    allowed_ips  TEXT NOT NULL DEFAULT '[]',
+                    created_at   %[1]s NOT NULL,
+                    expires_at   %[1]s,
+                    last_used_at %[1]s,
+                    last_used_ip TEXT NOT NULL DEFAULT '',
+                    revoked_at   %[1]s
+                )`, ts),
+                `CREATE INDEX api_keys_owner ON api_keys (owner)`,
+                fmt.Sprintf(`CREATE TABLE signing_keys (
+                    kid         TEXT PRIMARY KEY,
+                    algorithm   TEXT NOT NULL,
+                    created_at  %[1]s NOT NULL,
+                    retired_at  %[1]s,
+                    private_key TEXT NOT NULL
+                )`, ts),
+                fmt.Sprintf(`CREATE TABLE invites (
+                    hash       TEXT PRIMARY KEY,
+                    role       TEXT NOT NULL,
+                    created_by TEXT NOT NULL,
+                    expires_at %s NOT NULL
+                )`, ts),
+                fmt.Sprintf(`CREATE TABLE oauth_clients (
+                    id          TEXT PRIMARY KEY,
+                    name        TEXT NOT NULL DEFAULT '',
+                    hash        TEXT NOT NULL,
+                    scopes      TEXT NOT NULL DEFAULT '[]',
+                    grant_types TEXT NOT NULL DEFAULT '[]',
+                    created_by  TEXT NOT NULL,
+                    created_at  %[1]s NOT NULL,
+                    revoked_at  %[1]s
+                )`, ts),
+                fmt.Sprintf(`CREATE TABLE mfa_challenges (
+                    hash       TEXT PRIMARY KEY,
+                    username   TEXT NOT NULL,
+                    expires_at %s NOT NULL,
+                    attempts   INTEGER NOT NULL DEFAULT 0
+                )`, ts),
+            )
+        },
+    },
+}
+
+// timestampType is the column type for times: TIMESTAMPTZ on Postgres, and
+// TIMESTAMP elsewhere since SQLite drivers only read that back as a time
+func timestampType(tx *gorm.DB) string {
+    if tx.Dialector.Name() == "postgres" {
+        return "TIMESTAMPTZ"
+    }
+    return "TIMESTAMP"
+}
+
+// execAll runs statements in order, stopping at the first error. Migrations
+// keep to one change per statement so that they also run on SQLite, which
+// the tests use.
+func execAll(tx *gorm.DB, statements ...string) error {
+    for _, statement := range statements {
+        if err := tx.Exec(statement).Error; err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// GormUserStore keeps users in a SQL database, normally Postgres
+type GormUserStore struct {
+    db *gorm.DB
+}
+
+// NewGormUserStore applies pending schema migrations and returns a store
+// backed by db
+func NewGormUserStore(db *gorm.DB) (*GormUserStore, error) {
+    if err := migrate(db); err != nil {
+        return nil, fmt.Errorf("failed to migrate user store: %v", err)
+    }
+    return &GormUserStore{db: db}, nil
+}
+
+// migrationLockID is the Postgres advisory lock key held while migrating
+const migrationLockID = 0x65646765 // "edge"
+
+// migrate applies pending migrations in one transaction. On Postgres it
+// first takes an advisory lock, so that auth containers starting together
+// apply each migration once instead of racing on the schema.
+func migrate(db *gorm.DB) error {
+    return db.Transaction(func(tx *gorm.DB) error {
+        if tx.Dialector.Name() == "postgres" {
+            if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockID).Error; err != nil {
+                return fmt.Errorf("failed to lock migrations: %v", err)
+            }
+        }
+        if err := tx.AutoMigrate(&schemaMigration{}); err != nil {
+            return err
+        }
+
+        for _, m := range migrations {
+            var count int64
+            if err := tx.Model(&schemaMigration{}).Where("id = ?", m.ID).Count(&count).Error; err != nil {
+                return fmt.Errorf("migration %s: %v", m.ID, err)
+            }
+            if count > 0 {
+                continue
+            }
+
+            if err := m.Migrate(tx); err != nil {
+                return fmt.Errorf("migration %s: %v", m.ID, err)
+            }
+            if err := tx.Create(&schemaMigration{ID: m.ID, AppliedAt: time.Now()}).Error; err != nil {
+                return fmt.Errorf("migration %s: %v", m.ID, err)
+            }
+            log.Printf("Applied migration %s", m.ID)
+        }
+        return nil
+    })
+}
+
+func (g *GormUserStore) Get(username string) (User, error) {
+    var record userRecord
+    err := g.db.Where("username = ?", username).Take(&record).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return User{}, ErrUserNotFound
+    }
+    if err != nil {
+        return User{}, err
+    }
+    return record.user(), nil
+}
+
+func (g *GormUserStore) List() (map[string]User, error) {
+    var records []userRecord
+    if err := g.db.Find(&records).Error; err != nil {
+        return nil, err
+    }
+
+    users := make(map[string]User, len(records))
+    for _, record := range records {
+        users[record.Username] = record.user()
+    }
+    return users, nil
+}
+
+func (g *GormUserStore) Create(username string, user User) error {
+    record := newUserRecord(username, user)
+    result := g.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return ErrUserExists
+    }
+    return nil
+}
+
+func (g *GormUserStore) Update(username string, fn func(*User) error) error {
+    return g.db.Transaction(func(tx *gorm.DB) error {
+        var record userRecord
+        err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+            Where("username = ?", username).Take(&record).Error
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            return ErrUserNotFound
+        }
+        if err != nil {
+            return err
+        }
+
+        user := record.user()
+        if err := fn(&user); err != nil {
+            return err
+        }
+
+        updated := newUserRecord(username, user)
+        return tx.Save(&updated).Error
+    })
+}
+
+func (g *GormUserStore) Delete(username string) error {
+    result := g.db.Where("username = ?", username).Delete(&userRecord{})
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return ErrUserNotFound
+    }
+    return nil
+}
+
+func newUserRecord(username string, user User) userRecord {
+    role := user.Role
+    if role == "" {
+        role = RoleViewer
+    }
+    scopes := user.Scopes
+    if scopes == nil {
+        scopes = []string{}
+    }
+    recoveryCodes := user.RecoveryCodes
+    if recoveryCodes == nil {
+        recoveryCodes = []string{}
+    }
+    createdAt := user.CreatedAt
+    if createdAt.IsZero() {
+        createdAt = time.Now()
+    }
+
+    return userRecord{
+        Username:  username,
+        Hash:      user.Hash,
+        Role:      role,
+        Scopes:    scopes,
+        Disabled:  user.Disabled,
+        CreatedAt: createdAt,
+
+        TOTPEnabled:   user.TOTPEnabled,
+        TOTPSecret:    user.TOTPSecret,
+        TOTPPending:   user.TOTPPending,
+        TOTPLastStep:  user.TOTPLastStep,
+        RecoveryCodes: recoveryCodes,
+    }
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+    "errors"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+
+    "gorm.io/driver/sqlite"
+    "gorm.io/gorm"
+    "gorm.io/gorm/logger"
+)
+
+// newTestDB opens an SQLite database in a temporary directory. The schema
+// is the Postgres one; SQLite accepts its column types.
+func newTestDB(t *testing.T) *gorm.DB {
+    t.Helper()
+
+    dsn := filepath.Join(t.TempDir(), "auth.db") + "?_busy_timeout=5000"
+    db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    t.Cleanup(func() {
+        if sqlDB, err := db.DB(); err == nil {
+            sqlDB.Close()
+        }
+    })
+    return db
+}
+
+func TestGormUserStore(t *testing.T) {
+    store, err := NewGormUserStore(newTestDB(t))
+    if err != nil {
+        t.Fatalf("Failed to open store: %v", err)
+    }
+
+    created := time.Now().Truncate(time.Second)
+    alice := User{
+        Hash:          "hash",
+        Role:          RoleOperator,
+        Scopes:        []string{"gpio:write:17"},
+        CreatedAt:     created,
+        TOTPEnabled:   true,
+        TOTPSecret:    "secret",
+        TOTPLastStep:  42,
+        RecoveryCodes: []string{"a", "b"},
+    }
+    if err := store.Create("alice", alice); err != nil {
+        t.Fatalf("Create failed: %v", err)
+    }
+    if err := store.Create("alice", User{Hash: "other"}); !errors.Is(err, ErrUserExists) {
+        t.Errorf("Expected ErrUserExists, got %v", err)
+    }
+    // Users without a role or creation time get the defaults
+    if err := store.Create("bob", User{Hash: "hash"}); err != nil {
+        t.Fatalf("Create failed: %v", err)
+    }
+
+    got, err := store.Get("alice")
+    if err != nil {
+        t.Fatalf("Get failed: %v", err)
+    }
+    got.CreatedAt = got.CreatedAt.Local()
+    if !reflect.DeepEqual(got, alice) {
+        t.Errorf("Expected %+v, got %+v", alice, got)
+    }
+    if bob, err := store.Get("bob"); err != nil || bob.Role != RoleViewer || bob.CreatedAt.IsZero() {
+        t.Errorf("Expected defaults for bob, got %+v, %v", bob, err)
+    }
+    if _, err := store.Get("nobody"); !errors.Is(err, ErrUserNotFound) {
+        t.Errorf("Expected ErrUserNotFound, got %v", err)
+    }
+
+    failed := errors.New("failed")
+    err = store.Update("alice", func(user *User) error {
+        user.Disabled = true
+        return failed
+    })
+    if !errors.Is(err, failed) {
+        t.Errorf("Expected the update error, got %v", err)
+    }
+    if got, _ := store.Get("alice"); got.Disabled {
+        t.Error("Expected a failed update not to be saved")
+    }
+    err = store.Update("alice", func(user *User) error {
+        user.Disabled = true
+        user.RecoveryCodes = user.RecoveryCodes[1:]
+        return nil
+    })
+    if err != nil {
+        t.Fatalf("Update failed: %v", err)
+    }
+    if got, _ := store.Get("alice"); !got.Disabled || !reflect.DeepEqual(got.RecoveryCodes, []string{"b"}) {
+        t.Errorf("Expected the update to be saved, got %+v", got)
+    }
+    if err := store.Update("nobody", func(*User) error { return nil }); !errors.Is(err, ErrUserNotFound) {
+        t.Errorf("Expected ErrUserNotFound, got %v", err)
+    }
+
+    users, err := store.List()
+    if err != nil || len(users) != 2 {
+        t.Errorf("Expected 2 users, got %d, %v", len(users), err)
+    }
+
+    if err := store.Delete("bob"); err != nil {
+        t.Fatalf("Delete failed: %v", err)
+    }
+    if err := store.Delete("bob"); !errors.Is(err, ErrUserNotFound) {
+        t.Errorf("Expected ErrUserNotFound, got %v", err)
+    }
+}
+
+func TestMigrate(t *testing.T) {
+    db := newTestDB(t)
+
+    // Running the migrations again, as every restart does, is a no-op
+    for i := 0; i < 2; i++ {
+        if err := migrate(db); err != nil {
+            t.Fatalf("Run %d: migrate failed: %v", i, err)
+        }
+    }
+    var applied []schemaMigration
+    if err := db.Order("id").Find(&applied).Error; err != nil {
+        t.Fatalf("Failed to read applied migrations: %v", err)
+    }
+    if len(applied) != len(migrations) {
+        t.Fatalf("Expected %d applied migrations, got %d", len(migrations), len(applied))
+    }
+    for i, m := range migrations {
+        if applied[i].ID != m.ID {
+            t.Errorf("Expected migration %s, got %s", m.ID, applied[i].ID)
+        }
+    }
+
+    // A failing migration rolls back with everything applied in its run
+    saved := migrations
+    t.Cleanup(func() { migrations = saved })
+    migrations = append(append([]migration{}, saved...),
+        migration{ID: "9998_create_extra", Migrate: func(tx *gorm.DB) error {
+            return tx.Exec(`CREATE TABLE extra (id TEXT PRIMARY KEY)`).Error
+        }},
+        migration{ID: "9999_fail", Migrate: func(tx *gorm.DB) error {
+            return errors.New("failed")
+        }},
+    )
+    if err := migrate(db); err == nil {
+        t.Fatal("Expected the failing migration to be reported")
+    }
+    var count int64
+    db.Model(&schemaMigration{}).Count(&count)
+    if count != int64(len(saved)) || db.Migrator().HasTable("extra") {
+        t.Errorf("Expected the failed run to be rolled back, got %d migrations", count)
+    }
+}
+
+func TestImportUsers(t *testing.T) {
+    src, err := NewFileUserStore(filepath.Join(t.TempDir(), "users.json"))
+    if err != nil {
+        t.Fatalf("Failed to open file store: %v", err)
+    }
+    for _, name := range []string{"alice", "bob", "carol"} {
+        if err := src.Create(name, User{Hash: name, Role: RoleOperator}); err != nil {
+            t.Fatalf("Create failed: %v", err)
+        }
+    }
+
+    dst, err := NewGormUserStore(newTestDB(t))
+    if err != nil {
+        t.Fatalf("Failed to open store: %v", err)
+    }
+    if err := dst.Create("bob", User{Hash: "existing", Role: RoleAdmin}); err != nil {
+        t.Fatalf("Create failed: %v", err)
+    }
+
+    imported, skipped, err := ImportUsers(src, dst)
+    if err != nil || imported != 2 || skipped != 1 {
+        t.Fatalf("Expected 2 imported and 1 skipped, got %d, %d, %v", imported, skipped, err)
+    }
+    if alice, err := dst.Get("alice"); err != nil || alice.Hash != "alice" || alice.Role != RoleOperator {
+        t.Errorf("Expected alice to be imported, got %+v, %v", alice, err)
+    }
+    if bob, _ := dst.Get("bob"); bob.Hash != "existing" {
+        t.Error("Expected existing users to be kept")
+    }
+
+    // Importing again skips everyone
+    imported, skipped, err = ImportUsers(src, dst)
+    if err != nil || imported != 0 || skipped != 3 {
+        t.Errorf("Expected a second import to skip every user, got %d, %d, %v", imported, skipped, err)
+    }
+}
@@ -0,0 +1,95 @@
+//go:build postgres
+
+package service
+
+import (
+    "os"
+    "sync"
+    "testing"
+
+    "gorm.io/driver/postgres"
+    "gorm.io/gorm"
+    "gorm.io/gorm/logger"
+)
+
+// These tests need a Postgres server and run with
+//
+//     TEST_POSTGRES_DSN="host=localhost user=... dbname=..." go test -tags postgres ./internal/auth/service
+//
+// They work in a schema of their own, which is dropped first.
+
+const testSchema = "auth_service_test"
+
+// newTestPostgres opens the test database with a fresh schema on the
+// search path
+func newTestPostgres(t *testing.T) string {
+    t.Helper()
+
+    dsn := os.Getenv("TEST_POSTGRES_DSN")
+    if dsn == "" {
+        t.Skip("TEST_POSTGRES_DSN is not set")
+    }
+
+    db := openTestPostgres(t, dsn)
+    if err := db.Exec("DROP SCHEMA IF EXISTS " + testSchema + " CASCADE").Error; err != nil {
+        t.Fatalf("Failed to drop schema: %v", err)
+    }
+    if err := db.Exec("CREATE SCHEMA " + testSchema).Error; err != nil {
+        t.Fatalf("Failed to create schema: %v", err)
+    }
+    return dsn + " search_path=" + testSchema
+}
+
+func openTestPostgres(t *testing.T, dsn string) *gorm.DB {
+    t.Helper()
+
+    db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    t.Cleanup(func() {
+        if sqlDB, err := db.DB(); err == nil {
+            sqlDB.Close()
+        }
+    })
+    return db
+}
+
+func TestMigrateConcurrently(t *testing.T) {
+    dsn := newTestPostgres(t)
+
+    // Instances starting together wait for each other on the advisory lock
+    // instead of applying the same migration twice
+    const instances = 4
+    dbs := make([]*gorm.DB, instances)
+    for i := range dbs {
+        dbs[i] = openTestPostgres(t, dsn)
+    }
+    errs := make(chan error, instances)
+    var wg sync.WaitGroup
+    for _, db := range dbs {
+        wg.Add(1)
+        go func(db *gorm.DB) {
+            defer wg.Done()
+            _, err := NewGormUserStore(db)
+            errs <- err
+        }(db)
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        if err != nil {
+            t.Errorf("Expected concurrent migrations to succeed, got %v", err)
+        }
+    }
+
+    var count int64
+    dbs[0].Model(&schemaMigration{}).Count(&count)
+    if count != int64(len(migrations)) {
+        t.Errorf("Expected %d applied migrations, got %d", len(migrations), count)
+    }
+}
+
+func TestSharedStateOnPostgres(t *testing.T) {
+    testSharedState(t, openTestPostgres(t, newTestPostgres(t)))
+}
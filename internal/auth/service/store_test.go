@@ -0,0 +1,175 @@
+package service
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/Jeff-Barlow-Spady/edge-device-service/pkg/config"
+)
+
+// newTestService creates a service keeping its state in a temporary
+// directory, which is returned with it
+func newTestService(t *testing.T) (*AuthService, string) {
+    t.Helper()
+
+    dir := t.TempDir()
+    store, err := NewFileUserStore(filepath.Join(dir, "users.json"))
+    if err != nil {
+        t.Fatalf("Failed to open store: %v", err)
+    }
+    state, err := NewFileStateStore(dir, "")
+    if err != nil {
+        t.Fatalf("Failed to open state: %v", err)
+    }
+
+    service, err := NewAuthService(&config.Config{
+        JWT:   config.JWTConfig{Algorithm: "HS256", Secret: "test"},
+        Login: testLoginConfig,
+    }, store, state)
+    if err != nil {
+        t.Fatalf("Failed to create service: %v", err)
+    }
+    return service, dir
+}
+
+func TestConcurrentRegistrations(t *testing.T) {
+    service, dir := newTestService(t)
+    usersFile := filepath.Join(dir, "users.json")
+
+    const users = 8
+    var wg sync.WaitGroup
+    created := make(chan bool, users*2)
+    for i := 0; i < users; i++ {
+        // Register every name twice so that duplicates race as well
+        for j := 0; j < 2; j++ {
+            wg.Add(1)
+            go func(name string) {
+                defer wg.Done()
+                created <- service.CreateUser(name, "password")
+            }(fmt.Sprintf("user%d", i))
+        }
+    }
+
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(2 * time.Minute):
+        t.Fatal("Registrations deadlocked")
+    }
+    close(created)
+
+    successes := 0
+    for ok := range created {
+        if ok {
+            successes++
+        }
+    }
+    if successes != users {
+        t.Errorf("Expected %d successful registrations, got %d", users, successes)
+    }
+
+    reopened, err := NewFileUserStore(usersFile)
+    if err != nil {
+        t.Fatalf("Failed to reopen store: %v", err)
+    }
+    all, _ := reopened.List()
+    if len(all) != users {
+        t.Errorf("Expected %d users on disk, got %d", users, len(all))
+    }
+    if !service.VerifyUser("user7", "password") {
+        t.Error("Expected registered user to verify")
+    }
+}
+
+func TestFileUserStorePermissions(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "users.json")
+    if err := os.WriteFile(path, []byte(`{}`), 0644); err != nil {
+        t.Fatalf("Failed to write file: %v", err)
+    }
+
+    store, err := NewFileUserStore(path)
+    if err != nil {
+        t.Fatalf("Failed to open store: %v", err)
+    }
+    if err := store.Create("alice", User{Role: RoleViewer}); err != nil {
+        t.Fatalf("Create failed: %v", err)
+    }
+
+    info, err := os.Stat(path)
+    if err != nil {
+        t.Fatalf("Stat failed: %v", err)
+    }
+    if perm := info.Mode().Perm(); perm != 0600 {
+        t.Errorf("Expected mode 0600, got %o", perm)
+    }
+
+    leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".users.json.tmp-*"))
+    if len(leftovers) > 0 {
+        t.Errorf("Temporary files left behind: %v", leftovers)
+    }
+}
+
+func TestFileUserStoreLoadErrors(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "users.json")
+    if err := os.WriteFile(path, []byte(`{"alice": `), 0600); err != nil {
+        t.Fatalf("Failed to write file: %v", err)
+    }
+
+    if _, err := NewFileUserStore(path); err == nil {
+        t.Error("Expected error for malformed user file")
+    }
+}
+
+func TestFileUserStoreExternalEdit(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "users.json")
+    store, err := NewFileUserStore(path)
+    if err != nil {
+        t.Fatalf("Failed to open store: %v", err)
+    }
+    if err := store.Create("alice", User{Role: RoleViewer}); err != nil {
+        t.Fatalf("Create failed: %v", err)
+    }
+
+    // An operator adds a user by hand
+    edited := []byte(`{"alice":{"hash":"","role":"viewer","created_at":"2024-01-01T00:00:00Z"},` +
+        `"bob":{"hash":"","role":"admin","created_at":"2024-01-01T00:00:00Z"}}`)
+    if err := os.WriteFile(path, edited, 0600); err != nil {
+        t.Fatalf("Failed to edit file: %v", err)
+    }
+
+    if user, err := store.Get("bob"); err != nil || user.Role != RoleAdmin {
+        t.Errorf("Expected externally added admin bob, got %+v, %v", user, err)
+    }
+
+    // The next write must keep the external change
+    if err := store.Create("carol", User{Role: RoleViewer}); err != nil {
+        t.Fatalf("Create failed: %v", err)
+    }
+    reopened, err := NewFileUserStore(path)
+    if err != nil {
+        t.Fatalf("Failed to reopen store: %v", err)
+    }
+    all, _ := reopened.List()
+    if len(all) != 3 {
+        t.Errorf("Expected 3 users after edit and create, got %d", len(all))
+    }
+
+    // A broken edit is reported and not overwritten
+    if err := os.WriteFile(path, []byte(`not json`), 0600); err != nil {
+        t.Fatalf("Failed to edit file: %v", err)
+    }
+    if err := store.Create("dave", User{}); err == nil {
+        t.Error("Expected error after malformed external edit")
+    }
+    if data, _ := os.ReadFile(path); string(data) != "not json" {
+        t.Error("Malformed file was overwritten")
+    }
+}
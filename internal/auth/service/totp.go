@@ -0,0 +1,403 @@
+package service
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "log"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+)
+
+// RFC 6238 parameters understood by common authenticator apps
+const (
+    totpDigits = 6
+    totpPeriod = 30
+    // totpSkew is the number of periods either side of now that are accepted
+    totpSkew = 1
+
+    recoveryCodeCount = 10
+
+    mfaChallengeMaxAttempts = 5
+)
+
+// MFAChallengeTTL is how long a user has to enter the second factor after
+// their password was accepted
+const MFAChallengeTTL = 5 * time.Minute
+
+var (
+    // ErrInvalidMFACode is returned for wrong, reused or malformed codes
+    ErrInvalidMFACode = errors.New("invalid verification code")
+    // ErrInvalidMFAChallenge is returned for unknown, expired or exhausted
+    // MFA challenge tokens
+    ErrInvalidMFAChallenge = errors.New("invalid or expired mfa challenge")
+    // ErrMFANotPending is returned when confirming without an enrollment
+    ErrMFANotPending = errors.New("no totp enrollment in progress")
+    // ErrMFAAlreadyEnabled is returned when enrolling a second time
+    ErrMFAAlreadyEnabled = errors.New("totp is already enabled")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is returned when enrollment starts
+type TOTPEnrollment struct {
+    Secret string `json:"secret"`
+    URI    string `json:"otpauth_uri"`
+}
+
+// mfaChallenge is a pending second login step
+type mfaChallenge struct {
+    username  string
+    expiresAt time.Time
+    attempts  int
+}
+
+// mfaChallenges holds pending challenges by token hash in memory, since
+// they only live for a few minutes
+type mfaChallenges struct {
+    mu         sync.Mutex
+    challenges map[string]*mfaChallenge
+}
+
+func newMFAChallenges() *mfaChallenges {
+    return &mfaChallenges{challenges: make(map[string]*mfaChallenge)}
+}
+
+func (c *mfaChallenges) addMFAChallenge(hash string, challenge mfaChallenge) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.challenges[hash] = &challenge
+    return nil
+}
+
+func (c *mfaChallenges) attemptMFAChallenge(hash string) (mfaChallenge, bool, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    challenge, exists := c.challenges[hash]
+    if !exists {
+        return mfaChallenge{}, false, nil
+    }
+    challenge.attempts++
+    return *challenge, true, nil
+}
+
+func (c *mfaChallenges) deleteMFAChallenge(hash string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    delete(c.challenges, hash)
+    return nil
+}
+
+// collectGarbage drops expired challenges
+func (c *mfaChallenges) collectGarbage() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    now := time.Now()
+    for hash, challenge := range c.challenges {
+        if now.After(challenge.expiresAt) {
+            delete(c.challenges, hash)
+        }
+    }
+}
+
+// totpCode computes the code for a time step
+func totpCode(secret []byte, step int64) string {
+    var counter [8]byte
+    binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+    mac := hmac.New(sha1.New, secret)
+    mac.Write(counter[:])
+    sum := mac.Sum(nil)
+
+    offset := sum[len(sum)-1] & 0x0f
+    value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// validateTOTP checks code against the steps around now and returns the
+// matching step, which must be later than lastStep to prevent replay
+func validateTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+    key, err := totpEncoding.DecodeString(secret)
+    if err != nil || len(code) != totpDigits {
+        return 0, false
+    }
+
+    current := now.Unix() / totpPeriod
+    for step := current - totpSkew; step <= current+totpSkew; step++ {
+        if step <= lastStep {
+            continue
+        }
+        if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+            return step, true
+        }
+    }
+    return 0, false
+}
+
+// otpauthURI builds the URI authenticator apps scan as a QR code
+func otpauthURI(issuer, account, secret string) string {
+    values := url.Values{}
+    values.Set("secret", secret)
+    values.Set("issuer", issuer)
+    values.Set("algorithm", "SHA1")
+    values.Set("digits", fmt.Sprint(totpDigits))
+    values.Set("period", fmt.Sprint(totpPeriod))
+
+    label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+    return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// BeginTOTPEnrollment generates a new secret for a user. It only takes
+// effect once confirmed with a code from the authenticator app.
+func (s *AuthService) BeginTOTPEnrollment(username string) (TOTPEnrollment, error) {
+    key := make([]byte, 20)
+    if _, err := rand.Read(key); err != nil {
+        return TOTPEnrollment{}, err
+    }
+    secret := totpEncoding.EncodeToString(key)
+
+    err := s.users.Update(username, func(user *User) error {
+        if user.TOTPEnabled {
+            return ErrMFAAlreadyEnabled
+        }
+        user.TOTPPending = secret
+        return nil
+    })
+    if err != nil {
+        return TOTPEnrollment{}, err
+    }
+
+    return TOTPEnrollment{
+        Secret: secret,
+        URI:    otpauthURI(s.mfaIssuer, username, secret),
+    }, nil
+}
+
+// ConfirmTOTP enables TOTP when code matches the pending secret and returns
+// single-use recovery codes, which are only shown here. Existing sessions are
+// revoked, since they were opened without the second factor.
+func (s *AuthService) ConfirmTOTP(username, code string) ([]string, error) {
+    codes, hashes, err := generateRecoveryCodes()
+    if err != nil {
+        return nil, err
+    }
+
+    err = s.users.Update(username, func(user *User) error {
+        if user.TOTPPending == "" {
+            return ErrMFANotPending
+        }
+        step, ok := validateTOTP(user.TOTPPending, code, time.Now(), 0)
+        if !ok {
+            return ErrInvalidMFACode
+        }
+
+        user.TOTPSecret = user.TOTPPending
+        user.TOTPPending = ""
+        user.TOTPEnabled = true
+        user.TOTPLastStep = step
+        user.RecoveryCodes = hashes
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if err := s.RevokeUserSessions(username); err != nil {
+        return nil, err
+    }
+
+    log.Printf("Enabled TOTP for %s", username)
+    return codes, nil
+}
+
+// DisableTOTP turns TOTP off after checking a current or recovery code
+func (s *AuthService) DisableTOTP(username, code string) error {
+    err := s.users.Update(username, func(user *User) error {
+        if !user.verifyMFACode(code, time.Now()) {
+            return ErrInvalidMFACode
+        }
+        user.clearTOTP()
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    log.Printf("Disabled TOTP for %s", username)
+    return nil
+}
+
+// ResetMFA removes a user's second factor, for users who lost both their
+// authenticator and recovery codes. Their sessions are revoked.
+func (s *AuthService) ResetMFA(username string) error {
+    err := s.users.Update(username, func(user *User) error {
+        user.clearTOTP()
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    log.Printf("Reset TOTP for %s", username)
+    return s.RevokeUserSessions(username)
+}
+
+// MFAChallenge returns a short-lived challenge token when username must
+// complete a second login step, or an empty string when it need not
+func (s *AuthService) MFAChallenge(username string) (string, error) {
+    user, err := s.users.Get(username)
+    if err != nil {
+        return "", err
+    }
+    if !user.TOTPEnabled {
+        return "", nil
+    }
+
+    token, err := randomToken(32)
+    if err != nil {
+        return "", err
+    }
+
+    err = s.state.addMFAChallenge(hashToken(token), mfaChallenge{
+        username:  username,
+        expiresAt: time.Now().Add(MFAChallengeTTL),
+    })
+    if err != nil {
+        return "", err
+    }
+    return token, nil
+}
+
+// CompleteMFAChallenge exchanges a challenge token and a TOTP or recovery
+// code presented from ip for the username that passed the first step. A
+// challenge is discarded after too many wrong codes, and wrong codes count
+// as failed logins so that fresh challenges do not allow more guesses.
+func (s *AuthService) CompleteMFAChallenge(token, code, ip string) (string, error) {
+    key := hashToken(token)
+
+    challenge, exists, err := s.state.attemptMFAChallenge(key)
+    if err != nil {
+        return "", err
+    }
+    if !exists || time.Now().After(challenge.expiresAt) || challenge.attempts > mfaChallengeMaxAttempts {
+        if exists {
+            s.state.deleteMFAChallenge(key)
+        }
+        return "", ErrInvalidMFAChallenge
+    }
+    username := challenge.username
+
+    if err := s.limiter.check(username, ip); err != nil {
+        result := "throttled"
+        if errors.Is(err, ErrAccountLocked) {
+            result = "locked"
+        }
+        loginAttempts.WithLabelValues(result).Inc()
+        return "", err
+    }
+
+    err = s.users.Update(username, func(user *User) error {
+        if !user.verifyMFACode(code, time.Now()) {
+            return ErrInvalidMFACode
+        }
+        return nil
+    })
+    if err != nil {
+        if errors.Is(err, ErrInvalidMFACode) {
+            loginAttempts.WithLabelValues("invalid_mfa_code").Inc()
+            if s.limiter.fail(username, ip) {
+                loginLockouts.Inc()
+                log.Printf("Locked account %s after repeated wrong MFA codes from %s", username, ip)
+            }
+        }
+        return "", err
+    }
+
+    s.limiter.succeed(username)
+    if err := s.state.deleteMFAChallenge(key); err != nil {
+        log.Printf("Failed to delete MFA challenge: %v", err)
+    }
+    return username, nil
+}
+
+// verifyMFACode accepts a TOTP code newer than the last one used, or
+// consumes a recovery code
+func (u *User) verifyMFACode(code string, now time.Time) bool {
+    if !u.TOTPEnabled {
+        return false
+    }
+
+    code = strings.TrimSpace(code)
+    if step, ok := validateTOTP(u.TOTPSecret, code, now, u.TOTPLastStep); ok {
+        u.TOTPLastStep = step
+        return true
+    }
+
+    hash := hashToken(strings.ToLower(code))
+    for i, recovery := range u.RecoveryCodes {
+        if subtle.ConstantTimeCompare([]byte(recovery), []byte(hash)) == 1 {
+            u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+func (u *User) clearTOTP() {
+    u.TOTPEnabled = false
+    u.TOTPSecret = ""
+    u.TOTPPending = ""
+    u.TOTPLastStep = 0
+    u.RecoveryCodes = nil
+}
+
+// generateRecoveryCodes returns codes of the form xxxxx-xxxxx and their
+// hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+    codes := make([]string, recoveryCodeCount)
+    hashes := make([]string, recoveryCodeCount)
+    for i := range codes {
+        b := make([]byte, 6)
+        if _, err := rand.Read(b); err != nil {
+            return nil, nil, err
+        }
+        raw := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+        codes[i] = raw[:5] + "-" + raw[5:]
+        hashes[i] = hashToken(codes[i])
+    }
+    return codes, hashes, nil
+}
+
+// mfaRequired reports whether the user's role must use a second factor
+func (s *AuthService) mfaRequired(user User) bool {
+    role := user.Role
+    if role == "" {
+        role = RoleViewer
+    }
+    for _, required := range s.mfaRoles {
+        if required == role {
+            return true
+        }
+    }
+    return false
+}
+
+// grantedScopes returns the scopes a user's sessions and API keys carry.
+// Users whose role requires MFA but who have not enrolled only get viewer
+// scopes until they do.
+func (s *AuthService) grantedScopes(user User) []string {
+    if s.mfaRequired(user) && !user.TOTPEnabled {
+        return append([]string{}, RoleScopes[RoleViewer]...)
+    }
+    return user.EffectiveScopes()
+}
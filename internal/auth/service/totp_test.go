@@ -0,0 +1,172 @@
+package service
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestTOTPCode(t *testing.T) {
+    // RFC 6238 appendix B, SHA-1, truncated to six digits
+    secret := []byte("12345678901234567890")
+    tests := map[int64]string{
+        59:         "287082",
+        1111111109: "081804",
+        1234567890: "005924",
+    }
+    for unix, want := range tests {
+        if got := totpCode(secret, unix/totpPeriod); got != want {
+            t.Errorf("At %d: got %s, want %s", unix, got, want)
+        }
+    }
+}
+
+func TestValidateTOTPReplay(t *testing.T) {
+    secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+    now := time.Unix(59, 0)
+
+    step, ok := validateTOTP(secret, "287082", now, 0)
+    if !ok {
+        t.Fatal("Expected valid code")
+    }
+    if _, ok := validateTOTP(secret, "287082", now, step); ok {
+        t.Error("Expected reused code to be rejected")
+    }
+    if _, ok := validateTOTP(secret, "287082", now.Add(time.Hour), 0); ok {
+        t.Error("Expected stale code to be rejected")
+    }
+}
+
+// enrollTOTP enrolls username and returns its secret and recovery codes
+func enrollTOTP(t *testing.T, service *AuthService, username string) (string, []string) {
+    t.Helper()
+
+    enrollment, err := service.BeginTOTPEnrollment(username)
+    if err != nil {
+        t.Fatalf("Enrollment failed: %v", err)
+    }
+    key, _ := totpEncoding.DecodeString(enrollment.Secret)
+    code := totpCode(key, time.Now().Unix()/totpPeriod)
+
+    codes, err := service.ConfirmTOTP(username, code)
+    if err != nil {
+        t.Fatalf("Confirm failed: %v", err)
+    }
+    if len(codes) != recoveryCodeCount {
+        t.Fatalf("Expected %d recovery codes, got %d", recoveryCodeCount, len(codes))
+    }
+    return enrollment.Secret, codes
+}
+
+func TestMFAChallenge(t *testing.T) {
+    service, _ := newTestService(t)
+    service.AddUser("alice", "pw", RoleOperator)
+
+    challenge, err := service.MFAChallenge("alice")
+    if err != nil || challenge != "" {
+        t.Fatalf("Expected no challenge before enrollment, got %q, %v", challenge, err)
+    }
+
+    _, codes := enrollTOTP(t, service, "alice")
+    if _, err := service.BeginTOTPEnrollment("alice"); !errors.Is(err, ErrMFAAlreadyEnabled) {
+        t.Errorf("Expected ErrMFAAlreadyEnabled, got %v", err)
+    }
+
+    challenge, err = service.MFAChallenge("alice")
+    if err != nil || challenge == "" {
+        t.Fatalf("Expected challenge after enrollment, got %v", err)
+    }
+    if _, err := service.CompleteMFAChallenge(challenge, "000000", "10.0.0.1"); !errors.Is(err, ErrInvalidMFACode) {
+        t.Errorf("Expected ErrInvalidMFACode, got %v", err)
+    }
+
+    // Recovery codes work once
+    username, err := service.CompleteMFAChallenge(challenge, codes[0], "10.0.0.1")
+    if err != nil || username != "alice" {
+        t.Fatalf("Expected recovery code to complete challenge, got %q, %v", username, err)
+    }
+    if _, err := service.CompleteMFAChallenge(challenge, codes[1], "10.0.0.1"); !errors.Is(err, ErrInvalidMFAChallenge) {
+        t.Errorf("Expected used challenge to be rejected, got %v", err)
+    }
+
+    challenge, _ = service.MFAChallenge("alice")
+    if _, err := service.CompleteMFAChallenge(challenge, codes[0], "10.0.0.1"); !errors.Is(err, ErrInvalidMFACode) {
+        t.Errorf("Expected used recovery code to be rejected, got %v", err)
+    }
+
+    // Too many wrong codes discard the challenge
+    for i := 1; i < mfaChallengeMaxAttempts; i++ {
+        service.CompleteMFAChallenge(challenge, "000000", "10.0.0.1")
+    }
+    if _, err := service.CompleteMFAChallenge(challenge, codes[1], "10.0.0.1"); !errors.Is(err, ErrInvalidMFAChallenge) {
+        t.Errorf("Expected exhausted challenge to be rejected, got %v", err)
+    }
+}
+
+func TestMFACodeGuessingLocksAccount(t *testing.T) {
+    service, _ := newTestService(t)
+    // Without backoff only the lockout stops the guessing
+    cfg := testLoginConfig
+    cfg.BackoffBase = 0
+    service.limiter = newLoginLimiter(cfg)
+    service.AddUser("alice", "pw", RoleOperator)
+    enrollTOTP(t, service, "alice")
+
+    // A correct password must not clear the failures of the second factor
+    for i := 0; i < cfg.LockoutThreshold; i++ {
+        if err := service.Authenticate("alice", "pw", "10.0.0.1"); err != nil {
+            t.Fatalf("Round %d: expected password to be accepted, got %v", i, err)
+        }
+        challenge, err := service.MFAChallenge("alice")
+        if err != nil || challenge == "" {
+            t.Fatalf("Round %d: expected a challenge, got %v", i, err)
+        }
+        if _, err := service.CompleteMFAChallenge(challenge, "000000", "10.0.0.1"); !errors.Is(err, ErrInvalidMFACode) {
+            t.Fatalf("Round %d: expected ErrInvalidMFACode, got %v", i, err)
+        }
+    }
+
+    if err := service.Authenticate("alice", "pw", "10.0.0.1"); !errors.Is(err, ErrAccountLocked) {
+        t.Errorf("Expected locked account after repeated wrong codes, got %v", err)
+    }
+}
+
+func TestMFARequiredScopes(t *testing.T) {
+    service, _ := newTestService(t)
+    service.mfaRoles = []string{RoleOperator, RoleAdmin}
+    service.AddUser("alice", "pw", RoleOperator)
+
+    info, _ := service.GetUser("alice")
+    if !info.MFARequired || info.MFAEnabled {
+        t.Fatalf("Expected MFA required but not enabled, got %+v", info)
+    }
+    if len(info.Scopes) != len(RoleScopes[RoleViewer]) {
+        t.Errorf("Expected viewer scopes before enrollment, got %v", info.Scopes)
+    }
+    before, err := service.IssueTokens("alice")
+    if err != nil {
+        t.Fatalf("IssueTokens failed: %v", err)
+    }
+
+    enrollTOTP(t, service, "alice")
+    info, _ = service.GetUser("alice")
+    if len(info.Scopes) != len(RoleScopes[RoleOperator]) {
+        t.Errorf("Expected operator scopes after enrollment, got %v", info.Scopes)
+    }
+
+    // Sessions opened with the password alone must not pick up the scopes
+    if _, ok := service.VerifyTokenClaims(before.AccessToken); ok {
+        t.Error("Expected tokens issued before enrollment to be revoked")
+    }
+    if _, err := service.RefreshTokens(before.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+        t.Errorf("Expected refresh token issued before enrollment to be revoked, got %v", err)
+    }
+
+    if err := service.ResetMFA("alice"); err != nil {
+        t.Fatalf("Reset failed: %v", err)
+    }
+    info, _ = service.GetUser("alice")
+    if info.MFAEnabled || len(info.Scopes) != len(RoleScopes[RoleViewer]) {
+        t.Errorf("Expected reset to drop MFA and scopes, got %+v", info)
+    }
+}
@@ -0,0 +1,379 @@
+package service
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Registration modes for self-service sign-up
+const (
+    // RegistrationInvite requires an invite code issued by an admin
+    RegistrationInvite = "invite"
+    // RegistrationFirstAdmin lets the first user register as admin and
+    // requires invites afterwards
+    RegistrationFirstAdmin = "first-admin"
+    // RegistrationDisabled turns sign-up off; admins create users
+    RegistrationDisabled = "disabled"
+)
+
+var (
+    // ErrRegistrationClosed is returned when sign-up is disabled
+    ErrRegistrationClosed = errors.New("registration is disabled")
+    // ErrInvalidInvite is returned for unknown, used or expired invites
+    ErrInvalidInvite = errors.New("invalid or expired invite")
+    // ErrAccountDisabled is returned when a disabled user logs in
+    ErrAccountDisabled = errors.New("account disabled")
+    // ErrInvalidPassword is returned for empty passwords or a wrong current
+    // password on change
+    ErrInvalidPassword = errors.New("invalid password")
+)
+
+// UserInfo is the public view of a user account
+type UserInfo struct {
+    Username  string    `json:"username"`
+    Role      string    `json:"role"`
+    Scopes    []string  `json:"scopes"`
+    Disabled  bool      `json:"disabled"`
+    CreatedAt time.Time `json:"created_at"`
+
+    MFAEnabled  bool `json:"mfa_enabled"`
+    MFARequired bool `json:"mfa_required"`
+}
+
+func (s *AuthService) userInfo(username string, user User) UserInfo {
+    role := user.Role
+    if role == "" {
+        role = RoleViewer
+    }
+    return UserInfo{
+        Username:  username,
+        Role:      role,
+        Scopes:    s.grantedScopes(user),
+        Disabled:  user.Disabled,
+        CreatedAt: user.CreatedAt,
+
+        MFAEnabled:  user.TOTPEnabled,
+        MFARequired: s.mfaRequired(user),
+    }
+}
+
+// invite is a single-use registration code, stored by hash
+type invite struct {
+    Role      string    `json:"role"`
+    CreatedBy string    `json:"created_by"`
+    ExpiresAt time.Time `json:"expires_at"`
+}
+
+// inviteStore holds outstanding invites keyed by the SHA-256 hash of the
+// code, persisted to a JSON file
+type inviteStore struct {
+    mu      sync.Mutex
+    file    string
+    invites map[string]invite
+}
+
+// newInviteStore loads invites from file. A missing file starts empty; a
+// corrupt one is an error, since the next save would drop every invite.
+func newInviteStore(file string) (*inviteStore, error) {
+    store := &inviteStore{
+        file:    file,
+        invites: make(map[string]invite),
+    }
+
+    data, err := os.ReadFile(file)
+    if errors.Is(err, os.ErrNotExist) {
+        return store, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read invite file %s: %v", file, err)
+    }
+    if len(data) > 0 {
+        if err := json.Unmarshal(data, &store.invites); err != nil {
+            return nil, fmt.Errorf("failed to parse invite file %s: %v", file, err)
+        }
+    }
+    if store.invites == nil {
+        store.invites = make(map[string]invite)
+    }
+    return store, nil
+}
+
+func (i *inviteStore) addInvite(hash string, inv invite) error {
+    i.mu.Lock()
+    i.invites[hash] = inv
+    i.mu.Unlock()
+    return i.save()
+}
+
+func (i *inviteStore) consumeInvite(hash string) (invite, bool, error) {
+    i.mu.Lock()
+    inv, exists := i.invites[hash]
+    delete(i.invites, hash)
+    i.mu.Unlock()
+
+    if !exists {
+        return invite{}, false, nil
+    }
+    return inv, true, i.save()
+}
+
+// collectGarbage saves the invites if any expired, which drops them
+func (i *inviteStore) collectGarbage() error {
+    i.mu.Lock()
+    expired := false
+    now := time.Now()
+    for _, inv := range i.invites {
+        if now.After(inv.ExpiresAt) {
+            expired = true
+            break
+        }
+    }
+    i.mu.Unlock()
+
+    if !expired {
+        return nil
+    }
+    return i.save()
+}
+
+func (i *inviteStore) save() error {
+    i.mu.Lock()
+    defer i.mu.Unlock()
+
+    now := time.Now()
+    for key, inv := range i.invites {
+        if now.After(inv.ExpiresAt) {
+            delete(i.invites, key)
+        }
+    }
+
+    data, err := json.Marshal(i.invites)
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(i.file, data, 0600)
+}
+
+// CreateInvite issues a single-use invite code that registers a user with
+// role. The code is only returned here.
+func (s *AuthService) CreateInvite(createdBy, role string, ttl time.Duration) (string, time.Time, error) {
+    if _, ok := RoleScopes[role]; !ok {
+        return "", time.Time{}, ErrInvalidRole
+    }
+
+    code, err := randomToken(18)
+    if err != nil {
+        return "", time.Time{}, err
+    }
+
+    expiresAt := time.Now().Add(ttl)
+    err = s.state.addInvite(hashToken(code), invite{
+        Role:      role,
+        CreatedBy: createdBy,
+        ExpiresAt: expiresAt,
+    })
+    if err != nil {
+        return "", time.Time{}, err
+    }
+    log.Printf("Invite for role %s created by %s", role, createdBy)
+    return code, expiresAt, nil
+}
+
+// Register creates an account through self-service sign-up according to
+// the registration mode, returning the role it was given
+func (s *AuthService) Register(username, password, inviteCode string) (string, error) {
+    s.registerMu.Lock()
+    defer s.registerMu.Unlock()
+
+    if s.registrationMode == RegistrationDisabled {
+        return "", ErrRegistrationClosed
+    }
+
+    if s.registrationMode == RegistrationFirstAdmin {
+        users, err := s.users.List()
+        if err != nil {
+            return "", err
+        }
+        if len(users) == 0 {
+            if err := s.AddUser(username, password, RoleAdmin); err != nil {
+                return "", err
+            }
+            log.Printf("First user %s registered as admin", username)
+            return RoleAdmin, nil
+        }
+    }
+
+    if inviteCode == "" {
+        return "", ErrInvalidInvite
+    }
+    if _, err := s.users.Get(username); err == nil {
+        return "", ErrUserExists
+    }
+    // Check the password before the invite is used up
+    if err := s.passwords.validate(username, password); err != nil {
+        return "", err
+    }
+
+    inv, exists, err := s.state.consumeInvite(hashToken(inviteCode))
+    if err != nil {
+        return "", err
+    }
+    if !exists || time.Now().After(inv.ExpiresAt) {
+        return "", ErrInvalidInvite
+    }
+    if err := s.AddUser(username, password, inv.Role); err != nil {
+        return "", err
+    }
+    log.Printf("User %s registered with invite from %s", username, inv.CreatedBy)
+    return inv.Role, nil
+}
+
+// AddUser creates an account with the given role. The password must
+// satisfy the password policy.
+func (s *AuthService) AddUser(username, password, role string) error {
+    if _, ok := RoleScopes[role]; !ok {
+        return ErrInvalidRole
+    }
+    if username == "" {
+        return ErrInvalidPassword
+    }
+    if err := s.passwords.validate(username, password); err != nil {
+        return err
+    }
+
+    hash, err := s.passwords.hash(password)
+    if err != nil {
+        return err
+    }
+
+    return s.users.Create(username, User{
+        Hash:      hash,
+        Role:      role,
+        CreatedAt: time.Now(),
+    })
+}
+
+// GetUser returns the public view of a user
+func (s *AuthService) GetUser(username string) (UserInfo, error) {
+    user, err := s.users.Get(username)
+    if err != nil {
+        return UserInfo{}, err
+    }
+    return s.userInfo(username, user), nil
+}
+
+// ListUsers returns every user sorted by username
+func (s *AuthService) ListUsers() ([]UserInfo, error) {
+    users, err := s.users.List()
+    if err != nil {
+        return nil, err
+    }
+
+    infos := make([]UserInfo, 0, len(users))
+    for username, user := range users {
+        infos = append(infos, s.userInfo(username, user))
+    }
+    sort.Slice(infos, func(i, j int) bool {
+        return infos[i].Username < infos[j].Username
+    })
+    return infos, nil
+}
+
+// SetUserDisabled disables or re-enables an account. Disabling revokes its
+// sessions; API keys stop working while the account is disabled.
+func (s *AuthService) SetUserDisabled(username string, disabled bool) error {
+    err := s.users.Update(username, func(user *User) error {
+        user.Disabled = disabled
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    if disabled {
+        log.Printf("Disabled user %s", username)
+        return s.RevokeUserSessions(username)
+    }
+    log.Printf("Enabled user %s", username)
+    return nil
+}
+
+// ResetPassword sets a new password for a user and revokes their sessions
+func (s *AuthService) ResetPassword(username, password string) error {
+    if err := s.passwords.validate(username, password); err != nil {
+        return err
+    }
+
+    hash, err := s.passwords.hash(password)
+    if err != nil {
+        return err
+    }
+
+    err = s.users.Update(username, func(user *User) error {
+        user.Hash = hash
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    return s.RevokeUserSessions(username)
+}
+
+// ChangePassword replaces a user's password after checking the current one
+// presented from ip, revoking all existing sessions. Wrong current
+// passwords count towards the same rate limits and lockout as logins.
+func (s *AuthService) ChangePassword(username, current, password, ip string) error {
+    if err := s.limiter.check(username, ip); err != nil {
+        return err
+    }
+
+    user, err := s.users.Get(username)
+    if err != nil {
+        return err
+    }
+    if ok, _ := s.passwords.verify(user.Hash, current); !ok {
+        if s.limiter.fail(username, ip) {
+            loginLockouts.Inc()
+            log.Printf("Locked account %s after repeated wrong passwords from %s", username, ip)
+        }
+        return ErrInvalidPassword
+    }
+    return s.ResetPassword(username, password)
+}
+
+// DeleteUser removes an account and revokes its sessions, API keys and
+// client certificates, which are listed in the CRL from then on
+func (s *AuthService) DeleteUser(username string) error {
+    if err := s.RevokeUserSessions(username); err != nil {
+        return err
+    }
+    if err := s.users.Delete(username); err != nil {
+        return err
+    }
+
+    keys, err := s.ListAPIKeys(username)
+    if err != nil {
+        log.Printf("Failed to list API keys of deleted user %s: %v", username, err)
+    }
+    for _, key := range keys {
+        if err := s.RevokeAPIKey(key.ID, username); err != nil {
+            log.Printf("Failed to revoke API key %s of deleted user %s: %v", key.ID, username, err)
+        }
+    }
+    for _, cert := range s.ListCertificates(username) {
+        if cert.RevokedAt != nil {
+            continue
+        }
+        if err := s.RevokeCertificate(cert.Serial, username); err != nil {
+            log.Printf("Failed to revoke certificate %s of deleted user %s: %v", cert.Serial, username, err)
+        }
+    }
+    log.Printf("Deleted user %s", username)
+    return nil
+}
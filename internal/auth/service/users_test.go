@@ -0,0 +1,131 @@
+package service
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestRegisterFirstAdminThenInvite(t *testing.T) {
+    service, _ := newTestService(t)
+
+    role, err := service.Register("root", "password", "")
+    if err != nil || role != RoleAdmin {
+        t.Fatalf("Expected first user to become admin, got %q, %v", role, err)
+    }
+
+    if _, err := service.Register("eve", "password", ""); !errors.Is(err, ErrInvalidInvite) {
+        t.Errorf("Expected invite to be required, got %v", err)
+    }
+
+    code, _, err := service.CreateInvite("root", RoleOperator, time.Hour)
+    if err != nil {
+        t.Fatalf("CreateInvite failed: %v", err)
+    }
+    if role, err := service.Register("op", "password", code); err != nil || role != RoleOperator {
+        t.Errorf("Expected operator from invite, got %q, %v", role, err)
+    }
+    if _, err := service.Register("op2", "password", code); !errors.Is(err, ErrInvalidInvite) {
+        t.Errorf("Expected invite to be single use, got %v", err)
+    }
+}
+
+func TestRegisterPasswordPolicyKeepsInvite(t *testing.T) {
+    service, _ := newTestService(t)
+    service.Register("root", "password", "")
+    service.passwords.config.MinLength = 10
+
+    code, _, _ := service.CreateInvite("root", RoleViewer, time.Hour)
+    var policy *PasswordPolicyError
+    if _, err := service.Register("eve", "short", code); !errors.As(err, &policy) {
+        t.Fatalf("Expected policy error, got %v", err)
+    }
+    if _, err := service.Register("eve", "long enough now", code); err != nil {
+        t.Errorf("Expected invite to survive a rejected password, got %v", err)
+    }
+}
+
+func TestRegistrationDisabled(t *testing.T) {
+    service, _ := newTestService(t)
+    service.registrationMode = RegistrationDisabled
+
+    if _, err := service.Register("root", "password", ""); !errors.Is(err, ErrRegistrationClosed) {
+        t.Errorf("Expected ErrRegistrationClosed, got %v", err)
+    }
+}
+
+func TestDisabledUser(t *testing.T) {
+    service, _ := newTestService(t)
+    service.AddUser("alice", "password", RoleOperator)
+    token, err := service.CreateToken("alice")
+    if err != nil {
+        t.Fatalf("CreateToken failed: %v", err)
+    }
+
+    if err := service.SetUserDisabled("alice", true); err != nil {
+        t.Fatalf("Disable failed: %v", err)
+    }
+    if _, ok := service.VerifyTokenClaims(token); ok {
+        t.Error("Expected token of disabled user to be rejected")
+    }
+    if err := service.Authenticate("alice", "password", "10.0.0.1"); !errors.Is(err, ErrAccountDisabled) {
+        t.Errorf("Expected ErrAccountDisabled, got %v", err)
+    }
+
+    if err := service.SetUserDisabled("alice", false); err != nil {
+        t.Fatalf("Enable failed: %v", err)
+    }
+    if err := service.Authenticate("alice", "password", "10.0.0.1"); err != nil {
+        t.Errorf("Expected login after enable, got %v", err)
+    }
+}
+
+func TestChangePassword(t *testing.T) {
+    service, _ := newTestService(t)
+    service.AddUser("alice", "old password", RoleViewer)
+
+    if err := service.ChangePassword("alice", "wrong", "new password", "10.0.0.1"); !errors.Is(err, ErrInvalidPassword) {
+        t.Errorf("Expected ErrInvalidPassword, got %v", err)
+    }
+    if err := service.ChangePassword("alice", "old password", "new password", "10.0.0.1"); err != nil {
+        t.Fatalf("ChangePassword failed: %v", err)
+    }
+    if !service.VerifyUser("alice", "new password") {
+        t.Error("Expected new password to verify")
+    }
+}
+
+func TestChangePasswordRateLimited(t *testing.T) {
+    service, _ := newTestService(t)
+    service.AddUser("alice", "old password", RoleViewer)
+
+    for i := 0; i < testLoginConfig.FreeAttempts; i++ {
+        if err := service.ChangePassword("alice", "wrong", "new password", "10.0.0.1"); !errors.Is(err, ErrInvalidPassword) {
+            t.Fatalf("Attempt %d: expected ErrInvalidPassword, got %v", i+1, err)
+        }
+    }
+
+    var throttled *ThrottledError
+    if err := service.ChangePassword("alice", "old password", "new password", "10.0.0.1"); !errors.As(err, &throttled) {
+        t.Fatalf("Expected guessing the current password to be throttled, got %v", err)
+    }
+    if err := service.Authenticate("alice", "old password", "10.0.0.2"); !errors.As(err, &throttled) {
+        t.Errorf("Expected the backoff to apply to logins too, got %v", err)
+    }
+}
+
+func TestCorruptInviteFile(t *testing.T) {
+    dir := t.TempDir()
+    file := filepath.Join(dir, "invites.json")
+    if err := os.WriteFile(file, []byte("{"), 0600); err != nil {
+        t.Fatalf("Failed to write invites: %v", err)
+    }
+    if _, err := newInviteStore(file); err == nil {
+        t.Error("Expected a corrupt invite file to be an error")
+    }
+    if _, err := newInviteStore(filepath.Join(dir, "missing.json")); err != nil {
+        t.Errorf("Expected a missing invite file to start empty, got %v", err)
+    }
+}
@@ -1,8 +1,10 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"log"
-	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,6 +20,9 @@ var (
 	memoryUsageValue  atomic.Value
 	diskUsageValue    atomic.Value
 	systemUptimeValue atomic.Value
+	piMetricsValue    atomic.Value
+	hostMetricsValue  atomic.Value
+	processValue      atomic.Value
 
 	cpuUsage = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "system_cpu_usage",
@@ -45,7 +50,36 @@ var (
 	serviceHealth = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "service_health_status",
-			Help: "Service Health Status (1 = healthy, 0 = degraded)",
+			Help: "Service Health Status (1 = healthy, 0 = degraded or down)",
+		},
+		[]string{"service"},
+	)
+	serviceHealthState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_health_state",
+			Help: "Service Health State (1 for the current state of each service)",
+		},
+		[]string{"service", "state"},
+	)
+	serviceConsecutiveFailures = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_consecutive_failures",
+			Help: "Consecutive Failed Health Checks per Service",
+		},
+		[]string{"service"},
+	)
+	serviceProbeDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "service_probe_duration_seconds",
+			Help:    "Health Check Latency per Service and Outcome",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"service", "outcome"},
+	)
+	serviceLastSuccess = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_last_success_timestamp_seconds",
+			Help: "Unix Time of the Last Successful Health Check per Service",
 		},
 		[]string{"service"},
 	)
@@ -56,12 +90,46 @@ func init() {
 	memoryUsageValue.Store(float64(0))
 	diskUsageValue.Store(float64(0))
 	systemUptimeValue.Store(float64(0))
+	piMetricsValue.Store(PiMetrics{})
+	hostMetricsValue.Store(HostMetrics{})
+	processValue.Store(map[string]ProcessMetrics{})
+}
+
+// CollectorConfig configures a MetricsCollector
+type CollectorConfig struct {
+	// Services to probe, DefaultServiceChecks when nil
+	Services *ServiceRegistry
+	// SysfsRoot is where board metrics are read, DefaultSysfsRoot when
+	// empty
+	SysfsRoot string
+	// Throttled reads the firmware throttling flags, from SysfsRoot when
+	// nil
+	Throttled ThrottledReader
+	// Collectors enables optional collectors by name, DefaultCollectors
+	// when nil
+	Collectors []string
+	// Mounts whose usage the filesystem collector reports, DefaultMounts
+	// when empty
+	Mounts []string
+	// Processes whose resources the process collector tracks
+	Processes []ProcessTarget
 }
 
 type MetricsCollector struct {
 	startTime time.Time
-	services  map[string]string // service name -> health check URL
-	client    *http.Client
+	services  *ServiceRegistry
+	pi        *PiCollector
+	host      *hostCollector
+	processes *processCollector
+
+	// lastProbe records when each service was last probed, so that checks
+	// run at their own interval, and running the probes still in flight
+	probeMu   sync.Mutex
+	lastProbe map[string]time.Time
+	running   map[string]bool
+
+	stateMu sync.RWMutex
+	states  map[string]*ServiceState
 }
 
 type MetricsData struct {
@@ -71,13 +139,15 @@ type MetricsData struct {
 		DiskUsage   float64 `json:"disk_usage"`
 		Uptime      float64 `json:"uptime"`
 	} `json:"system"`
-	Services map[string]ServiceStatus `json:"services"`
+	Services  map[string]ServiceStatus  `json:"services"`
+	Host      HostMetrics               `json:"host"`
+	Pi        PiMetrics                 `json:"pi"`
+	Processes map[string]ProcessMetrics `json:"processes"`
 }
 
 type ServiceStatus struct {
-	Uptime    float64   `json:"uptime"`
-	Health    string    `json:"health"`
-	LastCheck time.Time `json:"last_check"`
+	Uptime float64 `json:"uptime"`
+	ServiceState
 }
 
 type HealthStatus struct {
@@ -86,19 +156,62 @@ type HealthStatus struct {
 	Checks    map[string]string `json:"checks"`
 }
 
+// NewMetricsCollector creates a collector probing DefaultServiceChecks
 func NewMetricsCollector() *MetricsCollector {
-	collector := &MetricsCollector{
+	return NewMetricsCollectorWithConfig(CollectorConfig{})
+}
+
+// NewMetricsCollectorWithRegistry creates a collector probing the services
+// in registry, which may change while it runs
+func NewMetricsCollectorWithRegistry(registry *ServiceRegistry) *MetricsCollector {
+	return NewMetricsCollectorWithConfig(CollectorConfig{Services: registry})
+}
+
+// NewMetricsCollectorWithConfig creates a collector with custom settings
+func NewMetricsCollectorWithConfig(config CollectorConfig) *MetricsCollector {
+	if config.Services == nil {
+		registry, err := NewServiceRegistry(DefaultServiceChecks())
+		if err != nil {
+			// The defaults are always valid
+			panic(err)
+		}
+		config.Services = registry
+	}
+	return &MetricsCollector{
 		startTime: time.Now(),
-		client:    &http.Client{Timeout: 5 * time.Second},
-		services: map[string]string{
-			"gpio":    "http://gpio-service:8000/health",
-			"metrics": "http://localhost:8000/health",
-		},
+		services:  config.Services,
+		pi:        NewPiCollector(config.SysfsRoot, config.Throttled),
+		host:      newHostCollector(config.Collectors, config.Mounts),
+		processes: newProcessCollector(config.Processes, config.SysfsRoot),
+		lastProbe: make(map[string]time.Time),
+		running:   make(map[string]bool),
+		states:    make(map[string]*ServiceState),
 	}
-	return collector
 }
 
+// Outcomes of a health check
+const (
+	probeSuccess = "success"
+	probeFailure = "failure"
+	probeTimeout = "timeout"
+)
+
+// ProbeResolution is how often RunProbes looks for checks whose interval
+// has elapsed
+const ProbeResolution = time.Second
+
+// UpdateMetrics collects the system metrics and probes the services that
+// are due, waiting for the probes to finish
 func (mc *MetricsCollector) UpdateMetrics() error {
+	if err := mc.UpdateSystemMetrics(); err != nil {
+		return err
+	}
+	mc.ProbeServices(context.Background())
+	return nil
+}
+
+// UpdateSystemMetrics collects CPU, memory, disk and uptime metrics
+func (mc *MetricsCollector) UpdateSystemMetrics() error {
 	// CPU usage
 	cpuPercent, err := cpu.Percent(0, false)
 	if err == nil && len(cpuPercent) > 0 {
@@ -131,27 +244,207 @@ func (mc *MetricsCollector) UpdateMetrics() error {
 	systemUptime.Set(uptime)
 	systemUptimeValue.Store(uptime)
 
-	// Check services health
-	for service, healthURL := range mc.services {
-		serviceUptime.WithLabelValues(service).Set(uptime)
+	// Per-core CPU, load, network, disk I/O and filesystems
+	hostMetrics, err := mc.host.collect()
+	if err != nil {
+		log.Printf("Failed to read host metrics: %v", err)
+	}
+	hostMetricsValue.Store(hostMetrics)
 
-		resp, err := mc.client.Get(healthURL)
+	// Raspberry Pi board metrics
+	if mc.host.enabled[CollectorPi] {
+		piMetrics, err := mc.pi.Collect()
 		if err != nil {
-			serviceHealth.WithLabelValues(service).Set(0)
-			continue
+			log.Printf("Failed to read board metrics: %v", err)
 		}
-		defer resp.Body.Close()
+		piMetrics.export()
+		piMetricsValue.Store(piMetrics)
+	}
 
-		if resp.StatusCode == http.StatusOK {
-			serviceHealth.WithLabelValues(service).Set(1)
-		} else {
-			serviceHealth.WithLabelValues(service).Set(0)
+	// Resources of the edge stack's processes
+	if mc.host.enabled[CollectorProcess] {
+		processMetrics, err := mc.processes.collect()
+		if err != nil {
+			log.Printf("Failed to read process metrics: %v", err)
 		}
+		processValue.Store(processMetrics)
 	}
 
 	return nil
 }
 
+// ProbeServices runs the checks that are due concurrently and waits for
+// them. Each check gets its own deadline from its timeout, and a check
+// still running from an earlier call is not started again, so a hung
+// service delays neither the others nor the next round.
+func (mc *MetricsCollector) ProbeServices(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range mc.dueProbes(time.Now()) {
+		wg.Add(1)
+		go func(p *probe) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := p.run(ctx)
+			latency := time.Since(start)
+			// Stopping is not a failure of the service, and a removed
+			// service keeps no metrics
+			if monitored := mc.probeDone(p.check.Name); monitored && ctx.Err() == nil {
+				mc.recordProbe(p.check, start, latency, err)
+			}
+		}(p)
+	}
+	wg.Wait()
+}
+
+// RunProbes probes the services at their own intervals until ctx is done,
+// independently of the system metrics
+func (mc *MetricsCollector) RunProbes(ctx context.Context) {
+	ticker := time.NewTicker(ProbeResolution)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mc.ProbeServices(ctx)
+		}()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func probeOutcome(err error) string {
+	switch {
+	case err == nil:
+		return probeSuccess
+	case errors.Is(err, context.DeadlineExceeded):
+		return probeTimeout
+	default:
+		// Dialers and HTTP clients do not always wrap the deadline error
+		var timeout interface{ Timeout() bool }
+		if errors.As(err, &timeout) && timeout.Timeout() {
+			return probeTimeout
+		}
+		return probeFailure
+	}
+}
+
+// recordProbe updates the state of a probed service and its metrics
+func (mc *MetricsCollector) recordProbe(check ServiceCheck, at time.Time, latency time.Duration, err error) {
+	mc.stateMu.Lock()
+	state, ok := mc.states[check.Name]
+	if !ok {
+		state = newServiceState()
+		mc.states[check.Name] = state
+	}
+	changed := state.observe(check, at, latency, err)
+	current := *state
+	mc.stateMu.Unlock()
+
+	if changed {
+		if err != nil {
+			log.Printf("Service %s is %s: %v", check.Name, current.Health, err)
+		} else {
+			log.Printf("Service %s is %s", check.Name, current.Health)
+		}
+	}
+
+	service := check.Name
+	serviceUptime.WithLabelValues(service).Set(time.Since(mc.startTime).Seconds())
+	serviceProbeDuration.WithLabelValues(service, probeOutcome(err)).Observe(latency.Seconds())
+	if current.Health == HealthHealthy {
+		serviceHealth.WithLabelValues(service).Set(1)
+	} else {
+		serviceHealth.WithLabelValues(service).Set(0)
+	}
+	for _, health := range healthStates {
+		value := 0.0
+		if health == current.Health {
+			value = 1
+		}
+		serviceHealthState.WithLabelValues(service, health).Set(value)
+	}
+	serviceConsecutiveFailures.WithLabelValues(service).Set(float64(current.ConsecutiveFailures))
+	if !current.LastSuccess.IsZero() {
+		serviceLastSuccess.WithLabelValues(service).Set(float64(current.LastSuccess.Unix()))
+	}
+}
+
+// serviceState returns a copy of the state of service
+func (mc *MetricsCollector) serviceState(service string) ServiceState {
+	mc.stateMu.RLock()
+	defer mc.stateMu.RUnlock()
+
+	if state, ok := mc.states[service]; ok {
+		return *state
+	}
+	return *newServiceState()
+}
+
+// dueProbes returns the probes whose interval has elapsed and that are not
+// running, and marks them as probed at now. Metrics of services removed
+// from the registry are deleted.
+func (mc *MetricsCollector) dueProbes(now time.Time) []*probe {
+	mc.probeMu.Lock()
+	defer mc.probeMu.Unlock()
+
+	probes := mc.services.snapshot()
+	current := make(map[string]bool, len(probes))
+	due := make([]*probe, 0, len(probes))
+	for _, p := range probes {
+		current[p.check.Name] = true
+		if mc.running[p.check.Name] {
+			continue
+		}
+		if last, ok := mc.lastProbe[p.check.Name]; ok && now.Sub(last) < time.Duration(p.check.Interval) {
+			continue
+		}
+		mc.lastProbe[p.check.Name] = now
+		mc.running[p.check.Name] = true
+		due = append(due, p)
+	}
+
+	for service := range mc.lastProbe {
+		if !current[service] {
+			delete(mc.lastProbe, service)
+			mc.forgetService(service)
+		}
+	}
+	return due
+}
+
+// probeDone marks the probe of service as finished and reports whether the
+// service is still monitored
+func (mc *MetricsCollector) probeDone(service string) bool {
+	mc.probeMu.Lock()
+	defer mc.probeMu.Unlock()
+
+	delete(mc.running, service)
+	_, ok := mc.lastProbe[service]
+	return ok
+}
+
+// forgetService drops the state and metrics of a removed service
+func (mc *MetricsCollector) forgetService(service string) {
+	mc.stateMu.Lock()
+	delete(mc.states, service)
+	mc.stateMu.Unlock()
+
+	serviceUptime.DeleteLabelValues(service)
+	serviceHealth.DeleteLabelValues(service)
+	serviceHealthState.DeletePartialMatch(prometheus.Labels{"service": service})
+	serviceProbeDuration.DeletePartialMatch(prometheus.Labels{"service": service})
+	serviceConsecutiveFailures.DeleteLabelValues(service)
+	serviceLastSuccess.DeleteLabelValues(service)
+}
+
 func (mc *MetricsCollector) GetMetrics() MetricsData {
 	var data MetricsData
 
@@ -160,30 +453,26 @@ func (mc *MetricsCollector) GetMetrics() MetricsData {
 	data.System.MemoryUsage = memoryUsageValue.Load().(float64)
 	data.System.DiskUsage = diskUsageValue.Load().(float64)
 	data.System.Uptime = systemUptimeValue.Load().(float64)
+	data.Host = hostMetricsValue.Load().(HostMetrics)
+	data.Pi = piMetricsValue.Load().(PiMetrics)
+	data.Processes = processValue.Load().(map[string]ProcessMetrics)
 
 	data.Services = make(map[string]ServiceStatus)
-	for service := range mc.services {
+	for _, service := range mc.services.Names() {
 		data.Services[service] = ServiceStatus{
-			Uptime:    data.System.Uptime,
-			Health:    mc.getServiceHealth(service),
-			LastCheck: time.Now(),
+			Uptime:       data.System.Uptime,
+			ServiceState: mc.serviceState(service),
 		}
 	}
 
 	return data
 }
 
-func (mc *MetricsCollector) getServiceHealth(service string) string {
-	metric := serviceHealth.WithLabelValues(service)
-	if metric != nil {
-		return "healthy"
-	}
-	return "degraded"
-}
-
 func (mc *MetricsCollector) GetHealth() HealthStatus {
 	memInfo, _ := mem.VirtualMemory()
-	cpuPercent, _ := cpu.Percent(0, false)
+	// CPU usage sampled over the last update interval, since a sample
+	// taken now would only cover the time since the collectors last ran
+	cpuPercent := cpuUsageValue.Load().(float64)
 	diskInfo, _ := disk.Usage("/")
 
 	status := "healthy"
@@ -198,7 +487,7 @@ func (mc *MetricsCollector) GetHealth() HealthStatus {
 		checks["memory"] = "warning"
 	}
 
-	if len(cpuPercent) > 0 && cpuPercent[0] > 90 {
+	if cpuPercent > 90 {
 		status = "degraded"
 		checks["cpu"] = "warning"
 	}
@@ -208,12 +497,13 @@ func (mc *MetricsCollector) GetHealth() HealthStatus {
 		checks["disk"] = "warning"
 	}
 
-	// Check services health
+	// Check services health. Services not probed yet do not count against
+	// the status.
 	allHealthy := true
-	for service := range mc.services {
-		health := mc.getServiceHealth(service)
+	for _, service := range mc.services.Names() {
+		health := mc.serviceState(service).Health
 		checks[service] = health
-		if health != "healthy" {
+		if health == HealthDegraded || health == HealthDown {
 			allHealthy = false
 		}
 	}
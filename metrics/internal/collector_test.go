@@ -12,11 +12,11 @@ func TestNewMetricsCollector(t *testing.T) {
 	if collector == nil {
 		t.Fatal("Expected non-nil collector")
 	}
-	if collector.client == nil {
-		t.Error("Expected non-nil HTTP client")
+	if collector.services == nil {
+		t.Fatal("Expected non-nil service registry")
 	}
-	if len(collector.services) == 0 {
-		t.Error("Expected non-empty services map")
+	if len(collector.services.Names()) == 0 {
+		t.Error("Expected non-empty service registry")
 	}
 }
 
@@ -47,11 +47,13 @@ func TestHealthCheck(t *testing.T) {
 	}))
 	defer server.Close()
 
-	collector := NewMetricsCollector()
-	// Override services map for testing
-	collector.services = map[string]string{
-		"test-service": server.URL,
+	registry, err := NewServiceRegistry([]ServiceCheck{
+		{Name: "test-service", URL: server.URL},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
 	}
+	collector := NewMetricsCollectorWithRegistry(registry)
 
 	health := collector.GetHealth()
 	if health.Status != "healthy" {
@@ -67,7 +69,7 @@ func TestServiceUptime(t *testing.T) {
 	time.Sleep(time.Second) // Ensure some uptime
 	metrics := collector.GetMetrics()
 
-	for service := range collector.services {
+	for _, service := range collector.services.Names() {
 		uptime := metrics.Services[service].Uptime
 		if uptime <= 0 {
 			t.Errorf("Expected positive uptime for service %s, got %v", service, uptime)
@@ -101,10 +103,12 @@ func TestMetricsDataValidation(t *testing.T) {
 			if service == "" {
 				t.Error("Service name should not be empty")
 			}
-			if status.LastCheck.IsZero() {
-				t.Error("Last check time should not be zero")
+			if status.LastCheck.IsZero() != (status.Health == HealthUnknown) {
+				t.Errorf("Last check time should be set once service %s is probed", service)
 			}
-			if status.Health != "healthy" && status.Health != "degraded" {
+			switch status.Health {
+			case HealthUnknown, HealthHealthy, HealthDegraded, HealthDown:
+			default:
 				t.Errorf("Invalid health status for service %s: %s", service, status.Health)
 			}
 		}
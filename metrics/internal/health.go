@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"time"
+)
+
+// Health of a monitored service
+const (
+	HealthUnknown  = "unknown"
+	HealthHealthy  = "healthy"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+)
+
+var healthStates = []string{HealthUnknown, HealthHealthy, HealthDegraded, HealthDown}
+
+// ServiceState is the health of a service derived from its recent probes.
+// It is HealthUnknown until the first probe completes.
+type ServiceState struct {
+	Health              string    `json:"health"`
+	Since               time.Time `json:"since"`
+	LastCheck           time.Time `json:"last_check"`
+	LastSuccess         time.Time `json:"last_success"`
+	LatencyMS           float64   `json:"latency_ms"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+
+	consecutiveSuccesses int
+}
+
+func newServiceState() *ServiceState {
+	return &ServiceState{Health: HealthUnknown}
+}
+
+// observe records a probe result and applies the check's thresholds.
+// It reports whether the health changed.
+func (s *ServiceState) observe(check ServiceCheck, at time.Time, latency time.Duration, err error) bool {
+	s.LastCheck = at
+	s.LatencyMS = float64(latency) / float64(time.Millisecond)
+
+	health := s.Health
+	if err == nil {
+		s.LastSuccess = at
+		s.LastError = ""
+		s.ConsecutiveFailures = 0
+		s.consecutiveSuccesses++
+		// A failing service has to stay up for a while before it counts
+		// as healthy, so that a flapping one does not bounce back
+		if health == HealthUnknown || s.consecutiveSuccesses >= check.RecoverAfter {
+			health = HealthHealthy
+		}
+	} else {
+		s.LastError = err.Error()
+		s.consecutiveSuccesses = 0
+		s.ConsecutiveFailures++
+		switch {
+		case s.ConsecutiveFailures >= check.DownAfter:
+			health = HealthDown
+		case s.ConsecutiveFailures >= check.DegradedAfter && health != HealthDown:
+			health = HealthDegraded
+		}
+	}
+
+	if health == s.Health {
+		return false
+	}
+	s.Health = health
+	s.Since = at
+	return true
+}
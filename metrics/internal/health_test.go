@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestServiceStateHysteresis(t *testing.T) {
+	check := ServiceCheck{Name: "s", DegradedAfter: 1, DownAfter: 3, RecoverAfter: 2}
+	failure := errors.New("connection refused")
+
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"first success", nil, HealthHealthy},
+		{"first failure", failure, HealthDegraded},
+		{"second failure", failure, HealthDegraded},
+		{"third failure", failure, HealthDown},
+		{"single success", nil, HealthDown},
+		{"failure after success", failure, HealthDown},
+		{"recovering", nil, HealthDown},
+		{"recovered", nil, HealthHealthy},
+		{"still healthy", nil, HealthHealthy},
+	}
+
+	state := newServiceState()
+	at := time.Now()
+	for _, tt := range tests {
+		at = at.Add(time.Second)
+		state.observe(check, at, 10*time.Millisecond, tt.err)
+		if state.Health != tt.expected {
+			t.Fatalf("%s: expected %s, got %s", tt.name, tt.expected, state.Health)
+		}
+	}
+
+	if state.ConsecutiveFailures != 0 || state.LastError != "" || !state.LastSuccess.Equal(at) {
+		t.Errorf("Expected failures to be cleared, got %+v", state)
+	}
+	if state.LatencyMS != 10 {
+		t.Errorf("Expected 10ms latency, got %v", state.LatencyMS)
+	}
+}
+
+func TestServiceHealthFromProbes(t *testing.T) {
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	registry, err := NewServiceRegistry([]ServiceCheck{
+		{Name: "test-service", URL: server.URL, Interval: Duration(time.Nanosecond), DownAfter: 2},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	collector := NewMetricsCollectorWithRegistry(registry)
+
+	if health := collector.GetHealth().Checks["test-service"]; health != HealthUnknown {
+		t.Errorf("Expected unknown before the first probe, got %s", health)
+	}
+
+	collector.UpdateMetrics()
+	status := collector.GetMetrics().Services["test-service"]
+	if status.Health != HealthHealthy || status.LastSuccess.IsZero() {
+		t.Errorf("Expected healthy service, got %+v", status)
+	}
+
+	failing.Store(true)
+	for _, expected := range []string{HealthDegraded, HealthDown} {
+		collector.UpdateMetrics()
+		status = collector.GetMetrics().Services["test-service"]
+		if status.Health != expected {
+			t.Errorf("Expected %s, got %s", expected, status.Health)
+		}
+	}
+	if status.ConsecutiveFailures != 2 || status.LastError == "" {
+		t.Errorf("Expected two recorded failures, got %+v", status)
+	}
+
+	health := collector.GetHealth()
+	if health.Status != "degraded" || health.Checks["test-service"] != HealthDown {
+		t.Errorf("Expected degraded status with the service down, got %+v", health)
+	}
+}
+
+func probeCount(t *testing.T, service, outcome string) uint64 {
+	t.Helper()
+
+	var metric dto.Metric
+	observer := serviceProbeDuration.WithLabelValues(service, outcome)
+	if err := observer.(prometheus.Histogram).Write(&metric); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestConcurrentProbes(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hung.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fast.Close()
+
+	timeout := 200 * time.Millisecond
+	registry, err := NewServiceRegistry([]ServiceCheck{
+		{Name: "hung", URL: hung.URL, Timeout: Duration(timeout), Interval: Duration(time.Nanosecond)},
+		{Name: "fast", URL: fast.URL, Interval: Duration(time.Nanosecond)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	collector := NewMetricsCollectorWithRegistry(registry)
+	hungTimeouts, fastSuccesses := probeCount(t, "hung", probeTimeout), probeCount(t, "fast", probeSuccess)
+
+	start := time.Now()
+	collector.ProbeServices(context.Background())
+	if elapsed := time.Since(start); elapsed > 3*timeout {
+		t.Errorf("Expected probes to be bounded by the check timeout, took %v", elapsed)
+	}
+
+	services := collector.GetMetrics().Services
+	if services["fast"].Health != HealthHealthy {
+		t.Errorf("Expected fast service to be healthy, got %+v", services["fast"])
+	}
+	if services["hung"].Health != HealthDegraded {
+		t.Errorf("Expected hung service to be degraded, got %+v", services["hung"])
+	}
+	if probeCount(t, "hung", probeTimeout) != hungTimeouts+1 || probeCount(t, "fast", probeSuccess) != fastSuccesses+1 {
+		t.Error("Expected probe latencies to be recorded by outcome")
+	}
+}
+
+func TestRunningProbeIsNotRepeated(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	registry, _ := NewServiceRegistry([]ServiceCheck{
+		{Name: "slow", URL: server.URL, Interval: Duration(time.Nanosecond)},
+	})
+	collector := NewMetricsCollectorWithRegistry(registry)
+
+	done := make(chan struct{})
+	go func() {
+		collector.ProbeServices(context.Background())
+		close(done)
+	}()
+	<-started
+
+	if due := collector.dueProbes(time.Now()); len(due) != 0 {
+		t.Errorf("Expected the running probe to be skipped, got %d due", len(due))
+	}
+	close(release)
+	<-done
+
+	if due := collector.dueProbes(time.Now()); len(due) != 1 {
+		t.Errorf("Expected the finished probe to be due again, got %d", len(due))
+	}
+}
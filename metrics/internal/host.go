@@ -0,0 +1,360 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+// Names of the optional collectors. The aggregate CPU, memory and root
+// disk usage are always collected.
+const (
+	CollectorCPU        = "cpu"
+	CollectorLoad       = "load"
+	CollectorNetwork    = "network"
+	CollectorDiskIO     = "diskio"
+	CollectorFilesystem = "filesystem"
+	CollectorPi         = "pi"
+	CollectorProcess    = "process"
+)
+
+// DefaultCollectors are enabled unless configured otherwise
+var DefaultCollectors = []string{
+	CollectorCPU, CollectorLoad, CollectorNetwork, CollectorDiskIO, CollectorFilesystem, CollectorPi,
+	CollectorProcess,
+}
+
+// DefaultMounts are the filesystems whose usage is reported by default
+var DefaultMounts = []string{"/"}
+
+var ErrUnknownCollector = errors.New("unknown collector")
+
+// ParseCollectors parses a comma-separated list of collector names
+func ParseCollectors(list string) ([]string, error) {
+	collectors := []string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, collector := range DefaultCollectors {
+			known = known || name == collector
+		}
+		if !known {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownCollector, name)
+		}
+		collectors = append(collectors, name)
+	}
+	return collectors, nil
+}
+
+var (
+	cpuCoreUsage = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "system_cpu_core_usage",
+			Help: "CPU Usage Percentage per Core",
+		},
+		[]string{"core"},
+	)
+	loadAverage = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "system_load_average",
+			Help: "Load Average over 1, 5 and 15 Minutes",
+		},
+		[]string{"period"},
+	)
+	networkCounters = map[string]*prometheus.CounterVec{}
+	diskIORates     = map[string]*prometheus.GaugeVec{}
+	filesystemUsage = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "system_filesystem_usage",
+			Help: "Filesystem Usage Percentage per Mount",
+		},
+		[]string{"mount"},
+	)
+	filesystemFree = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "system_filesystem_free_bytes",
+			Help: "Free Filesystem Space per Mount",
+		},
+		[]string{"mount"},
+	)
+)
+
+func init() {
+	for _, name := range []string{
+		"receive_bytes", "transmit_bytes",
+		"receive_packets", "transmit_packets",
+		"receive_errors", "transmit_errors",
+	} {
+		networkCounters[name] = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "system_network_" + name + "_total",
+				Help: "Network " + strings.ReplaceAll(name, "_", " ") + " per Interface",
+			},
+			[]string{"interface"},
+		)
+	}
+	for _, name := range []string{"read_bytes", "write_bytes", "reads", "writes"} {
+		diskIORates[name] = promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "system_disk_" + name + "_per_second",
+				Help: "Disk " + strings.ReplaceAll(name, "_", " ") + " per Second per Device",
+			},
+			[]string{"device"},
+		)
+	}
+}
+
+// LoadAverage is the system load over 1, 5 and 15 minutes
+type LoadAverage struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+}
+
+// NetworkCounters are the totals of an interface since boot
+type NetworkCounters struct {
+	BytesRecv   uint64 `json:"bytes_recv"`
+	BytesSent   uint64 `json:"bytes_sent"`
+	PacketsRecv uint64 `json:"packets_recv"`
+	PacketsSent uint64 `json:"packets_sent"`
+	ErrorsIn    uint64 `json:"errors_in"`
+	ErrorsOut   uint64 `json:"errors_out"`
+}
+
+// DiskIORate is the I/O of a block device since the previous update
+type DiskIORate struct {
+	ReadBytesPerSec  float64 `json:"read_bytes_per_sec"`
+	WriteBytesPerSec float64 `json:"write_bytes_per_sec"`
+	ReadsPerSec      float64 `json:"reads_per_sec"`
+	WritesPerSec     float64 `json:"writes_per_sec"`
+}
+
+// FilesystemUsage is the usage of a mounted filesystem
+type FilesystemUsage struct {
+	Total       uint64  `json:"total"`
+	Free        uint64  `json:"free"`
+	UsedPercent float64 `json:"used_percent"`
+}
+
+// HostMetrics are the readings of the optional host collectors. Disabled
+// collectors leave their fields empty.
+type HostMetrics struct {
+	CPUPerCore  []float64                  `json:"cpu_per_core,omitempty"`
+	Load        *LoadAverage               `json:"load,omitempty"`
+	Network     map[string]NetworkCounters `json:"network,omitempty"`
+	DiskIO      map[string]DiskIORate      `json:"disk_io,omitempty"`
+	Filesystems map[string]FilesystemUsage `json:"filesystems,omitempty"`
+}
+
+// hostCollector keeps the previous samples needed to turn cumulative
+// counters into Prometheus counters and rates
+type hostCollector struct {
+	enabled map[string]bool
+	mounts  []string
+
+	mu       sync.Mutex
+	prevNet  map[string]net.IOCountersStat
+	prevDisk map[string]disk.IOCountersStat
+	prevAt   time.Time
+}
+
+func newHostCollector(collectors, mounts []string) *hostCollector {
+	if collectors == nil {
+		collectors = DefaultCollectors
+	}
+	if len(mounts) == 0 {
+		mounts = DefaultMounts
+	}
+	enabled := make(map[string]bool, len(collectors))
+	for _, name := range collectors {
+		enabled[name] = true
+	}
+	return &hostCollector{enabled: enabled, mounts: mounts}
+}
+
+// collect reads the enabled collectors, returning what could be read
+// along with any errors
+func (hc *hostCollector) collect() (HostMetrics, error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	var metrics HostMetrics
+	var errs []error
+
+	if hc.enabled[CollectorCPU] {
+		percents, err := cpu.Percent(0, true)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("per-core CPU usage: %w", err))
+		}
+		metrics.CPUPerCore = percents
+		for core, percent := range percents {
+			cpuCoreUsage.WithLabelValues(fmt.Sprint(core)).Set(percent)
+		}
+	}
+
+	if hc.enabled[CollectorLoad] {
+		avg, err := load.Avg()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("load average: %w", err))
+		} else {
+			metrics.Load = &LoadAverage{Load1: avg.Load1, Load5: avg.Load5, Load15: avg.Load15}
+			loadAverage.WithLabelValues("1m").Set(avg.Load1)
+			loadAverage.WithLabelValues("5m").Set(avg.Load5)
+			loadAverage.WithLabelValues("15m").Set(avg.Load15)
+		}
+	}
+
+	if hc.enabled[CollectorNetwork] {
+		network, err := hc.collectNetwork()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("network counters: %w", err))
+		}
+		metrics.Network = network
+	}
+
+	now := time.Now()
+	if hc.enabled[CollectorDiskIO] {
+		rates, err := hc.collectDiskIO(now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("disk I/O: %w", err))
+		}
+		metrics.DiskIO = rates
+	}
+	hc.prevAt = now
+
+	if hc.enabled[CollectorFilesystem] {
+		metrics.Filesystems = make(map[string]FilesystemUsage, len(hc.mounts))
+		for _, mount := range hc.mounts {
+			usage, err := disk.Usage(mount)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("usage of %s: %w", mount, err))
+				filesystemUsage.DeleteLabelValues(mount)
+				filesystemFree.DeleteLabelValues(mount)
+				continue
+			}
+			metrics.Filesystems[mount] = FilesystemUsage{
+				Total:       usage.Total,
+				Free:        usage.Free,
+				UsedPercent: usage.UsedPercent,
+			}
+			filesystemUsage.WithLabelValues(mount).Set(usage.UsedPercent)
+			filesystemFree.WithLabelValues(mount).Set(float64(usage.Free))
+		}
+	}
+
+	return metrics, errors.Join(errs...)
+}
+
+func (hc *hostCollector) collectNetwork() (map[string]NetworkCounters, error) {
+	stats, err := net.IOCounters(true)
+	if err != nil {
+		return nil, err
+	}
+
+	network := make(map[string]NetworkCounters, len(stats))
+	current := make(map[string]net.IOCountersStat, len(stats))
+	for _, stat := range stats {
+		current[stat.Name] = stat
+		network[stat.Name] = NetworkCounters{
+			BytesRecv:   stat.BytesRecv,
+			BytesSent:   stat.BytesSent,
+			PacketsRecv: stat.PacketsRecv,
+			PacketsSent: stat.PacketsSent,
+			ErrorsIn:    stat.Errin,
+			ErrorsOut:   stat.Errout,
+		}
+
+		prev, seen := hc.prevNet[stat.Name]
+		for name, values := range map[string][2]uint64{
+			"receive_bytes":    {prev.BytesRecv, stat.BytesRecv},
+			"transmit_bytes":   {prev.BytesSent, stat.BytesSent},
+			"receive_packets":  {prev.PacketsRecv, stat.PacketsRecv},
+			"transmit_packets": {prev.PacketsSent, stat.PacketsSent},
+			"receive_errors":   {prev.Errin, stat.Errin},
+			"transmit_errors":  {prev.Errout, stat.Errout},
+		} {
+			delta := counterDelta(values[0], values[1], seen)
+			networkCounters[name].WithLabelValues(stat.Name).Add(float64(delta))
+		}
+	}
+
+	for name := range hc.prevNet {
+		if _, ok := current[name]; !ok {
+			for _, counter := range networkCounters {
+				counter.DeleteLabelValues(name)
+			}
+		}
+	}
+	hc.prevNet = current
+	return network, nil
+}
+
+// counterDelta is how much a cumulative kernel counter grew since the
+// previous sample. The first sample counts in full, and a counter that
+// went backwards was reset, e.g. by the interface being recreated.
+func counterDelta(prev, current uint64, seen bool) uint64 {
+	if !seen || current < prev {
+		return current
+	}
+	return current - prev
+}
+
+// collectDiskIO returns the I/O rates of the block devices since the
+// previous update, or none on the first one
+func (hc *hostCollector) collectDiskIO(now time.Time) (map[string]DiskIORate, error) {
+	stats, err := disk.IOCounters()
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]disk.IOCountersStat, len(stats))
+	for name, stat := range stats {
+		// Loop and RAM devices are not storage
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		current[name] = stat
+	}
+
+	rates := make(map[string]DiskIORate, len(current))
+	elapsed := now.Sub(hc.prevAt).Seconds()
+	for name, stat := range current {
+		prev, seen := hc.prevDisk[name]
+		if !seen || elapsed <= 0 {
+			continue
+		}
+		rate := DiskIORate{
+			ReadBytesPerSec:  float64(counterDelta(prev.ReadBytes, stat.ReadBytes, true)) / elapsed,
+			WriteBytesPerSec: float64(counterDelta(prev.WriteBytes, stat.WriteBytes, true)) / elapsed,
+			ReadsPerSec:      float64(counterDelta(prev.ReadCount, stat.ReadCount, true)) / elapsed,
+			WritesPerSec:     float64(counterDelta(prev.WriteCount, stat.WriteCount, true)) / elapsed,
+		}
+		rates[name] = rate
+		diskIORates["read_bytes"].WithLabelValues(name).Set(rate.ReadBytesPerSec)
+		diskIORates["write_bytes"].WithLabelValues(name).Set(rate.WriteBytesPerSec)
+		diskIORates["reads"].WithLabelValues(name).Set(rate.ReadsPerSec)
+		diskIORates["writes"].WithLabelValues(name).Set(rate.WritesPerSec)
+	}
+
+	for name := range hc.prevDisk {
+		if _, ok := current[name]; !ok {
+			for _, gauge := range diskIORates {
+				gauge.DeleteLabelValues(name)
+			}
+		}
+	}
+	hc.prevDisk = current
+	return rates, nil
+}
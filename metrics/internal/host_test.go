@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseCollectors(t *testing.T) {
+	tests := []struct {
+		list     string
+		expected int
+		valid    bool
+	}{
+		{"cpu,load", 2, true},
+		{" network , diskio,", 2, true},
+		{"", 0, true},
+		{"cpu,gpu", 0, false},
+	}
+	for _, tt := range tests {
+		collectors, err := ParseCollectors(tt.list)
+		if !tt.valid {
+			if !errors.Is(err, ErrUnknownCollector) {
+				t.Errorf("ParseCollectors(%q): expected ErrUnknownCollector, got %v", tt.list, err)
+			}
+			continue
+		}
+		if err != nil || len(collectors) != tt.expected {
+			t.Errorf("ParseCollectors(%q): expected %d collectors, got %v, %v", tt.list, tt.expected, collectors, err)
+		}
+		if collectors == nil {
+			t.Errorf("ParseCollectors(%q): expected an empty list to disable all collectors", tt.list)
+		}
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		name     string
+		prev     uint64
+		current  uint64
+		seen     bool
+		expected uint64
+	}{
+		{"first sample", 0, 1500, false, 1500},
+		{"growth", 1000, 1500, true, 500},
+		{"unchanged", 1500, 1500, true, 0},
+		{"reset", 1500, 200, true, 200},
+	}
+	for _, tt := range tests {
+		if delta := counterDelta(tt.prev, tt.current, tt.seen); delta != tt.expected {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.expected, delta)
+		}
+	}
+}
+
+func TestHostCollectors(t *testing.T) {
+	mount := t.TempDir()
+	registry, _ := NewServiceRegistry(nil)
+	collector := NewMetricsCollectorWithConfig(CollectorConfig{
+		Services:   registry,
+		SysfsRoot:  t.TempDir(),
+		Collectors: []string{CollectorLoad, CollectorDiskIO, CollectorFilesystem},
+		Mounts:     []string{"/", mount},
+	})
+
+	// Rates need two samples
+	collector.UpdateSystemMetrics()
+	collector.UpdateSystemMetrics()
+	host := collector.GetMetrics().Host
+
+	if host.Load == nil {
+		t.Error("Expected load averages")
+	}
+	if host.DiskIO == nil {
+		t.Error("Expected disk I/O rates")
+	}
+	if len(host.Filesystems) != 2 || host.Filesystems[mount].Total == 0 {
+		t.Errorf("Expected usage of both mounts, got %+v", host.Filesystems)
+	}
+	if host.CPUPerCore != nil || host.Network != nil {
+		t.Errorf("Expected disabled collectors to be empty, got %+v", host)
+	}
+}
@@ -0,0 +1,334 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DefaultSysfsRoot is where sysfs is mounted on the host
+const DefaultSysfsRoot = "/sys"
+
+// Paths below the sysfs root
+const (
+	thermalPath   = "class/thermal"
+	cpufreqPath   = "devices/system/cpu/cpufreq"
+	throttledPath = "devices/platform/soc/soc:firmware/get_throttled"
+)
+
+// Bits of the firmware's get_throttled value. The same conditions shifted
+// by throttledOccurredShift have occurred since boot.
+const (
+	throttledUnderVoltage    = 1 << 0
+	throttledFrequencyCapped = 1 << 1
+	throttledThrottled       = 1 << 2
+	throttledSoftTempLimit   = 1 << 3
+	throttledOccurredShift   = 16
+)
+
+var (
+	thermalZoneTemperature = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pi_thermal_zone_celsius",
+			Help: "Thermal Zone Temperature in Degrees Celsius",
+		},
+		[]string{"zone", "type"},
+	)
+	cpuFrequency = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pi_cpu_frequency_hertz",
+			Help: "Current CPU Frequency per cpufreq Policy",
+		},
+		[]string{"policy"},
+	)
+	cpuFrequencyMax = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pi_cpu_frequency_max_hertz",
+			Help: "Maximum CPU Frequency per cpufreq Policy",
+		},
+		[]string{"policy"},
+	)
+	throttleState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pi_throttle_state",
+			Help: "Firmware Throttling Flags (1 = set) for now and since boot",
+		},
+		[]string{"condition", "window"},
+	)
+)
+
+// ThrottledReader reads the firmware's get_throttled value
+type ThrottledReader interface {
+	ReadThrottled() (uint32, error)
+}
+
+// SysfsThrottled reads get_throttled from the firmware driver's sysfs
+// attribute, available on Raspberry Pi OS kernels
+type SysfsThrottled struct {
+	Root string
+}
+
+func (s SysfsThrottled) ReadThrottled() (uint32, error) {
+	data, err := os.ReadFile(filepath.Join(s.Root, throttledPath))
+	if err != nil {
+		return 0, err
+	}
+	return parseThrottled(string(data))
+}
+
+// VcgencmdThrottled runs "vcgencmd get_throttled", for kernels without the
+// sysfs attribute
+type VcgencmdThrottled struct {
+	Path string
+}
+
+func (v VcgencmdThrottled) ReadThrottled() (uint32, error) {
+	path := v.Path
+	if path == "" {
+		path = "vcgencmd"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, path, "get_throttled").Output()
+	if err != nil {
+		return 0, err
+	}
+	// Prints throttled=0x50005
+	value := strings.TrimPrefix(strings.TrimSpace(string(out)), "throttled=")
+	return parseThrottled(value)
+}
+
+// parseThrottled parses the hexadecimal value, which sysfs prints without
+// and vcgencmd with the 0x prefix
+func parseThrottled(value string) (uint32, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "0x")
+	parsed, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid get_throttled value %q", value)
+	}
+	return uint32(parsed), nil
+}
+
+// ThermalZone is the temperature of one kernel thermal zone
+type ThermalZone struct {
+	Zone        string  `json:"zone"`
+	Type        string  `json:"type"`
+	Temperature float64 `json:"temperature"`
+}
+
+// CPUFrequency is the frequency of one cpufreq policy, in hertz
+type CPUFrequency struct {
+	Policy  string  `json:"policy"`
+	Current float64 `json:"current"`
+	Min     float64 `json:"min,omitempty"`
+	Max     float64 `json:"max,omitempty"`
+}
+
+// ThrottleFlags are the conditions reported by the firmware
+type ThrottleFlags struct {
+	UnderVoltage    bool `json:"under_voltage"`
+	FrequencyCapped bool `json:"frequency_capped"`
+	Throttled       bool `json:"throttled"`
+	SoftTempLimit   bool `json:"soft_temp_limit"`
+}
+
+func throttleFlags(value uint32) ThrottleFlags {
+	return ThrottleFlags{
+		UnderVoltage:    value&throttledUnderVoltage != 0,
+		FrequencyCapped: value&throttledFrequencyCapped != 0,
+		Throttled:       value&throttledThrottled != 0,
+		SoftTempLimit:   value&throttledSoftTempLimit != 0,
+	}
+}
+
+func (f ThrottleFlags) conditions() map[string]bool {
+	return map[string]bool{
+		"under_voltage":    f.UnderVoltage,
+		"frequency_capped": f.FrequencyCapped,
+		"throttled":        f.Throttled,
+		"soft_temp_limit":  f.SoftTempLimit,
+	}
+}
+
+// Throttling holds the flags that are set now and those that have been set
+// since boot
+type Throttling struct {
+	Raw       uint32        `json:"raw"`
+	Current   ThrottleFlags `json:"current"`
+	SinceBoot ThrottleFlags `json:"since_boot"`
+}
+
+// PiMetrics are the board metrics of a Raspberry Pi. Parts the host does
+// not provide are empty.
+type PiMetrics struct {
+	Thermal    []ThermalZone  `json:"thermal"`
+	CPUFreq    []CPUFrequency `json:"cpufreq"`
+	Throttling *Throttling    `json:"throttling,omitempty"`
+}
+
+// PiCollector reads thermal, cpufreq and throttling state from sysfs
+type PiCollector struct {
+	root      string
+	throttled ThrottledReader
+}
+
+// NewPiCollector creates a collector reading sysfs below root, which
+// defaults to DefaultSysfsRoot, and the throttled flags from throttled,
+// which defaults to the sysfs attribute
+func NewPiCollector(root string, throttled ThrottledReader) *PiCollector {
+	if root == "" {
+		root = DefaultSysfsRoot
+	}
+	if throttled == nil {
+		throttled = SysfsThrottled{Root: root}
+	}
+	return &PiCollector{root: root, throttled: throttled}
+}
+
+// Collect reads the current board metrics. Missing sysfs entries are
+// skipped, so hosts that are not Pis yield empty metrics; other errors are
+// returned along with what could be read.
+func (pc *PiCollector) Collect() (PiMetrics, error) {
+	var metrics PiMetrics
+	var errs []error
+
+	thermal, err := pc.readThermal()
+	metrics.Thermal = thermal
+	errs = append(errs, err)
+
+	cpufreq, err := pc.readCPUFreq()
+	metrics.CPUFreq = cpufreq
+	errs = append(errs, err)
+
+	value, err := pc.throttled.ReadThrottled()
+	if err == nil {
+		metrics.Throttling = &Throttling{
+			Raw:       value,
+			Current:   throttleFlags(value),
+			SinceBoot: throttleFlags(value >> throttledOccurredShift),
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, exec.ErrNotFound) {
+		errs = append(errs, fmt.Errorf("throttled flags: %w", err))
+	}
+
+	return metrics, errors.Join(errs...)
+}
+
+func (pc *PiCollector) readThermal() ([]ThermalZone, error) {
+	dirs, err := filepath.Glob(filepath.Join(pc.root, thermalPath, "thermal_zone*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+
+	zones := make([]ThermalZone, 0, len(dirs))
+	for _, dir := range dirs {
+		// Millidegrees Celsius
+		temp, err := readSysfsInt(filepath.Join(dir, "temp"))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return zones, fmt.Errorf("thermal zone: %w", err)
+		}
+		zoneType, _ := readSysfsString(filepath.Join(dir, "type"))
+		zones = append(zones, ThermalZone{
+			Zone:        strings.TrimPrefix(filepath.Base(dir), "thermal_"),
+			Type:        zoneType,
+			Temperature: float64(temp) / 1000,
+		})
+	}
+	return zones, nil
+}
+
+func (pc *PiCollector) readCPUFreq() ([]CPUFrequency, error) {
+	dirs, err := filepath.Glob(filepath.Join(pc.root, cpufreqPath, "policy*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+
+	policies := make([]CPUFrequency, 0, len(dirs))
+	for _, dir := range dirs {
+		// Kilohertz
+		current, err := readSysfsInt(filepath.Join(dir, "scaling_cur_freq"))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return policies, fmt.Errorf("cpufreq: %w", err)
+		}
+		freq := CPUFrequency{
+			Policy:  strings.TrimPrefix(filepath.Base(dir), "policy"),
+			Current: float64(current) * 1000,
+		}
+		if min, err := readSysfsInt(filepath.Join(dir, "cpuinfo_min_freq")); err == nil {
+			freq.Min = float64(min) * 1000
+		}
+		if max, err := readSysfsInt(filepath.Join(dir, "cpuinfo_max_freq")); err == nil {
+			freq.Max = float64(max) * 1000
+		}
+		policies = append(policies, freq)
+	}
+	return policies, nil
+}
+
+func readSysfsString(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func readSysfsInt(path string) (int64, error) {
+	value, err := readSysfsString(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// export sets the Prometheus gauges, replacing the previous readings so
+// that zones and policies that went away are dropped
+func (m PiMetrics) export() {
+	thermalZoneTemperature.Reset()
+	for _, zone := range m.Thermal {
+		thermalZoneTemperature.WithLabelValues(zone.Zone, zone.Type).Set(zone.Temperature)
+	}
+
+	cpuFrequency.Reset()
+	cpuFrequencyMax.Reset()
+	for _, freq := range m.CPUFreq {
+		cpuFrequency.WithLabelValues(freq.Policy).Set(freq.Current)
+		if freq.Max > 0 {
+			cpuFrequencyMax.WithLabelValues(freq.Policy).Set(freq.Max)
+		}
+	}
+
+	throttleState.Reset()
+	if m.Throttling == nil {
+		return
+	}
+	for window, flags := range map[string]ThrottleFlags{"current": m.Throttling.Current, "since_boot": m.Throttling.SinceBoot} {
+		for condition, set := range flags.conditions() {
+			value := 0.0
+			if set {
+				value = 1
+			}
+			throttleState.WithLabelValues(condition, window).Set(value)
+		}
+	}
+}
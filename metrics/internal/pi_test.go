@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeSysfs builds a sysfs tree like a Raspberry Pi 4's
+func fakeSysfs(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for path, content := range files {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	return root
+}
+
+type staticThrottled struct {
+	value uint32
+	err   error
+}
+
+func (s staticThrottled) ReadThrottled() (uint32, error) {
+	return s.value, s.err
+}
+
+func TestPiCollector(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"class/thermal/thermal_zone0/temp":                    "48686",
+		"class/thermal/thermal_zone0/type":                    "cpu-thermal",
+		"class/thermal/cooling_device0/type":                  "gpio-fan",
+		"devices/system/cpu/cpufreq/policy0/scaling_cur_freq": "600000",
+		"devices/system/cpu/cpufreq/policy0/cpuinfo_min_freq": "600000",
+		"devices/system/cpu/cpufreq/policy0/cpuinfo_max_freq": "1800000",
+		"devices/platform/soc/soc:firmware/get_throttled":     "50005",
+		"devices/system/cpu/cpufreq/policy4/cpuinfo_max_freq": "2400000",
+	})
+
+	metrics, err := NewPiCollector(root, nil).Collect()
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+
+	if len(metrics.Thermal) != 1 || metrics.Thermal[0] != (ThermalZone{Zone: "zone0", Type: "cpu-thermal", Temperature: 48.686}) {
+		t.Errorf("Unexpected thermal zones %+v", metrics.Thermal)
+	}
+	if len(metrics.CPUFreq) != 1 || metrics.CPUFreq[0] != (CPUFrequency{Policy: "0", Current: 600e6, Min: 600e6, Max: 1800e6}) {
+		t.Errorf("Unexpected cpufreq policies %+v", metrics.CPUFreq)
+	}
+
+	throttling := metrics.Throttling
+	if throttling == nil || throttling.Raw != 0x50005 {
+		t.Fatalf("Expected throttled flags 0x50005, got %+v", throttling)
+	}
+	if throttling.Current != (ThrottleFlags{UnderVoltage: true, Throttled: true}) {
+		t.Errorf("Unexpected current flags %+v", throttling.Current)
+	}
+	if throttling.SinceBoot != (ThrottleFlags{UnderVoltage: true, Throttled: true}) {
+		t.Errorf("Unexpected since boot flags %+v", throttling.SinceBoot)
+	}
+}
+
+func TestPiCollectorOnOtherHosts(t *testing.T) {
+	metrics, err := NewPiCollector(t.TempDir(), nil).Collect()
+	if err != nil {
+		t.Errorf("Expected missing sysfs entries to be skipped, got %v", err)
+	}
+	if len(metrics.Thermal) != 0 || len(metrics.CPUFreq) != 0 || metrics.Throttling != nil {
+		t.Errorf("Expected empty metrics, got %+v", metrics)
+	}
+
+	failing := staticThrottled{err: errors.New("VCHI initialization failed")}
+	if _, err := NewPiCollector(t.TempDir(), failing).Collect(); err == nil {
+		t.Error("Expected a failing throttled reader to be reported")
+	}
+}
+
+func TestParseThrottled(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected uint32
+		valid    bool
+	}{
+		{"0x50000", 0x50000, true},
+		{"50005", 0x50005, true},
+		{"e0008", 0xe0008, true},
+		{"0", 0, true},
+		{"0xthrottled", 0, false},
+	}
+	for _, tt := range tests {
+		value, err := parseThrottled(tt.value)
+		if (err == nil) != tt.valid || value != tt.expected {
+			t.Errorf("parseThrottled(%q): expected %#x, got %#x, %v", tt.value, tt.expected, value, err)
+		}
+	}
+}
+
+func TestMetricsIncludePi(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"class/thermal/thermal_zone0/temp": "61000",
+	})
+	registry, _ := NewServiceRegistry(nil)
+	collector := NewMetricsCollectorWithConfig(CollectorConfig{
+		Services:  registry,
+		SysfsRoot: root,
+		Throttled: staticThrottled{value: 0x1},
+	})
+	collector.UpdateSystemMetrics()
+
+	pi := collector.GetMetrics().Pi
+	if len(pi.Thermal) != 1 || pi.Thermal[0].Temperature != 61 {
+		t.Errorf("Expected the zone temperature, got %+v", pi.Thermal)
+	}
+	if pi.Throttling == nil || !pi.Throttling.Current.UnderVoltage {
+		t.Errorf("Expected under-voltage to be reported, got %+v", pi.Throttling)
+	}
+}
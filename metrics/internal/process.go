@@ -0,0 +1,377 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+var ErrInvalidProcessTarget = errors.New("invalid process target")
+
+// The client library's own collector exports process_* for this service,
+// so the tracked processes use service_process_*
+var (
+	processUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_process_up",
+			Help: "Whether Any Process of the Service Is Running (1 = running)",
+		},
+		[]string{"service"},
+	)
+	processCount = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_process_count",
+			Help: "Number of Running Processes per Service",
+		},
+		[]string{"service"},
+	)
+	processCPUUsage = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_process_cpu_usage",
+			Help: "CPU Usage Percentage of One Core per Service",
+		},
+		[]string{"service"},
+	)
+	processRSS = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_process_resident_memory_bytes",
+			Help: "Resident Memory per Service",
+		},
+		[]string{"service"},
+	)
+	processFDs = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_process_open_fds",
+			Help: "Open File Descriptors per Service",
+		},
+		[]string{"service"},
+	)
+	processThreads = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_process_threads",
+			Help: "Threads per Service",
+		},
+		[]string{"service"},
+	)
+	processRestarts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "service_process_restarts_total",
+			Help: "Restarts of the Main Process per Service",
+		},
+		[]string{"service"},
+	)
+)
+
+// ProcessTarget selects the processes of a service, named like its compose
+// service, by exactly one of:
+//
+//   - Name, the process name as in /proc/<pid>/comm (at most 15 characters)
+//   - PIDFile, a file holding the pid of the main process
+//   - CGroup, a cgroup directory whose cgroup.procs lists the processes,
+//     relative to the cgroup mount below the sysfs root unless absolute
+//
+// Seeing the processes of other containers needs the host's pid namespace.
+type ProcessTarget struct {
+	Service string `json:"service"`
+	Name    string `json:"name,omitempty"`
+	PIDFile string `json:"pidfile,omitempty"`
+	CGroup  string `json:"cgroup,omitempty"`
+}
+
+func (t ProcessTarget) validate() error {
+	if t.Service == "" {
+		return fmt.Errorf("%w: service is required", ErrInvalidProcessTarget)
+	}
+	selectors := 0
+	for _, selector := range []string{t.Name, t.PIDFile, t.CGroup} {
+		if selector != "" {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		return fmt.Errorf("%w: %s needs exactly one of name, pidfile and cgroup", ErrInvalidProcessTarget, t.Service)
+	}
+	return nil
+}
+
+// LoadProcessTargets reads targets from a JSON file of the form
+// {"processes": [...]}. A missing file configures none.
+func LoadProcessTargets(file string) ([]ProcessTarget, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Processes []ProcessTarget `json:"processes"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	seen := make(map[string]bool, len(config.Processes))
+	for _, target := range config.Processes {
+		if err := target.validate(); err != nil {
+			return nil, err
+		}
+		if seen[target.Service] {
+			return nil, fmt.Errorf("%w: %s is listed twice", ErrInvalidProcessTarget, target.Service)
+		}
+		seen[target.Service] = true
+	}
+	return config.Processes, nil
+}
+
+// ProcessMetrics are the summed resources of a service's processes
+type ProcessMetrics struct {
+	Up       bool    `json:"up"`
+	Count    int     `json:"count"`
+	MainPID  int32   `json:"main_pid,omitempty"`
+	CPUUsage float64 `json:"cpu_usage"`
+	RSS      uint64  `json:"rss"`
+	FDs      int32   `json:"fds"`
+	Threads  int32   `json:"threads"`
+	Restarts int     `json:"restarts"`
+}
+
+// processID tells a process apart from a later one reusing its pid
+type processID struct {
+	pid     int32
+	created int64
+}
+
+// processState is what the collector remembers about a service between
+// updates
+type processState struct {
+	// main is the oldest process last seen, kept while the service is down
+	// so that its return counts as a restart
+	main     processID
+	cpu      map[processID]float64
+	restarts int
+}
+
+// processCollector samples the processes of each target
+type processCollector struct {
+	targets    []ProcessTarget
+	cgroupRoot string
+
+	mu     sync.Mutex
+	states map[string]*processState
+	prevAt time.Time
+}
+
+func newProcessCollector(targets []ProcessTarget, sysfsRoot string) *processCollector {
+	if sysfsRoot == "" {
+		sysfsRoot = DefaultSysfsRoot
+	}
+	return &processCollector{
+		targets:    targets,
+		cgroupRoot: filepath.Join(sysfsRoot, "fs/cgroup"),
+		states:     make(map[string]*processState, len(targets)),
+	}
+}
+
+// collect samples every target, returning what could be read along with
+// any errors
+func (pc *processCollector) collect() (map[string]ProcessMetrics, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(pc.prevAt).Seconds()
+	if pc.prevAt.IsZero() {
+		elapsed = 0
+	}
+	pc.prevAt = now
+
+	var all []*process.Process
+	var errs []error
+	metrics := make(map[string]ProcessMetrics, len(pc.targets))
+	for _, target := range pc.targets {
+		var procs []*process.Process
+		var err error
+		switch {
+		case target.Name != "":
+			if all == nil {
+				if all, err = process.Processes(); err != nil {
+					break
+				}
+			}
+			procs = processesNamed(all, target.Name)
+		case target.PIDFile != "":
+			procs, err = pc.pidFileProcesses(target.PIDFile)
+		case target.CGroup != "":
+			procs, err = pc.cgroupProcesses(target.CGroup)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("processes of %s: %w", target.Service, err))
+		}
+
+		state, ok := pc.states[target.Service]
+		if !ok {
+			state = &processState{}
+			pc.states[target.Service] = state
+		}
+		m := state.sample(procs, elapsed)
+		if m.Restarts > state.restarts {
+			processRestarts.WithLabelValues(target.Service).Add(float64(m.Restarts - state.restarts))
+		} else {
+			// Exported from the start so that increases are seen
+			processRestarts.WithLabelValues(target.Service).Add(0)
+		}
+		state.restarts = m.Restarts
+		metrics[target.Service] = m
+		m.export(target.Service)
+	}
+	return metrics, errors.Join(errs...)
+}
+
+// sample sums the resources of procs and detects restarts. Processes that
+// exit while being read are skipped.
+func (s *processState) sample(procs []*process.Process, elapsed float64) ProcessMetrics {
+	m := ProcessMetrics{Restarts: s.restarts}
+	cpu := make(map[processID]float64, len(procs))
+	var main processID
+	var cpuSeconds float64
+
+	for _, p := range procs {
+		created, err := p.CreateTime()
+		if err != nil {
+			continue
+		}
+		times, err := p.Times()
+		if err != nil {
+			continue
+		}
+		id := processID{pid: p.Pid, created: created}
+		total := times.User + times.System
+		cpu[id] = total
+		// Processes started since the last sample are counted from the
+		// next one
+		if prev, ok := s.cpu[id]; ok && total >= prev {
+			cpuSeconds += total - prev
+		}
+
+		if memory, err := p.MemoryInfo(); err == nil {
+			m.RSS += memory.RSS
+		}
+		if fds, err := p.NumFDs(); err == nil {
+			m.FDs += fds
+		}
+		if threads, err := p.NumThreads(); err == nil {
+			m.Threads += threads
+		}
+		if main == (processID{}) || created < main.created || (created == main.created && p.Pid < main.pid) {
+			main = id
+		}
+		m.Count++
+	}
+
+	if m.Count > 0 {
+		m.Up = true
+		m.MainPID = main.pid
+		if s.main != (processID{}) && s.main != main {
+			m.Restarts++
+		}
+		s.main = main
+	}
+	if elapsed > 0 {
+		m.CPUUsage = cpuSeconds / elapsed * 100
+	}
+	s.cpu = cpu
+	return m
+}
+
+func (m ProcessMetrics) export(service string) {
+	up := 0.0
+	if m.Up {
+		up = 1
+	}
+	processUp.WithLabelValues(service).Set(up)
+	processCount.WithLabelValues(service).Set(float64(m.Count))
+	processCPUUsage.WithLabelValues(service).Set(m.CPUUsage)
+	processRSS.WithLabelValues(service).Set(float64(m.RSS))
+	processFDs.WithLabelValues(service).Set(float64(m.FDs))
+	processThreads.WithLabelValues(service).Set(float64(m.Threads))
+}
+
+func processesNamed(all []*process.Process, name string) []*process.Process {
+	var procs []*process.Process
+	for _, p := range all {
+		if n, err := p.Name(); err == nil && n == name {
+			procs = append(procs, p)
+		}
+	}
+	return procs
+}
+
+// pidFileProcesses returns the process named by a pidfile, or none when
+// the file or the process is gone
+func (pc *processCollector) pidFileProcesses(file string) ([]*process.Process, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Postgres' postmaster.pid has the pid on its first line
+	line, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	pid, err := strconv.ParseInt(strings.TrimSpace(line), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pid in %s", file)
+	}
+	return existingProcesses([]int32{int32(pid)}), nil
+}
+
+func (pc *processCollector) cgroupProcesses(cgroup string) ([]*process.Process, error) {
+	if !filepath.IsAbs(cgroup) {
+		cgroup = filepath.Join(pc.cgroupRoot, cgroup)
+	}
+	f, err := os.Open(filepath.Join(cgroup, "cgroup.procs"))
+	if errors.Is(err, os.ErrNotExist) {
+		// The container is not running
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pids []int32
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		pid, err := strconv.ParseInt(strings.TrimSpace(scanner.Text()), 10, 32)
+		if err != nil {
+			continue
+		}
+		pids = append(pids, int32(pid))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return existingProcesses(pids), nil
+}
+
+func existingProcesses(pids []int32) []*process.Process {
+	procs := make([]*process.Process, 0, len(pids))
+	for _, pid := range pids {
+		if p, err := process.NewProcess(pid); err == nil {
+			procs = append(procs, p)
+		}
+	}
+	return procs
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+func TestLoadProcessTargets(t *testing.T) {
+	dir := t.TempDir()
+	if targets, err := LoadProcessTargets(filepath.Join(dir, "missing.json")); err != nil || targets != nil {
+		t.Errorf("Expected no targets without a file, got %v, %v", targets, err)
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"valid", `{"processes":[{"service":"gpio","name":"gpiosvc"},{"service":"postgres","pidfile":"/run/postgres.pid"}]}`, true},
+		{"missing service", `{"processes":[{"name":"gpiosvc"}]}`, false},
+		{"no selector", `{"processes":[{"service":"gpio"}]}`, false},
+		{"two selectors", `{"processes":[{"service":"gpio","name":"gpiosvc","cgroup":"gpio"}]}`, false},
+		{"duplicate service", `{"processes":[{"service":"gpio","name":"a"},{"service":"gpio","name":"b"}]}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "processes.json")
+			os.WriteFile(file, []byte(tt.config), 0600)
+
+			_, err := LoadProcessTargets(file)
+			if tt.valid && err != nil {
+				t.Errorf("Expected valid targets, got %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidProcessTarget) {
+				t.Errorf("Expected ErrInvalidProcessTarget, got %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessCollector(t *testing.T) {
+	self, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		t.Fatalf("NewProcess failed: %v", err)
+	}
+	name, err := self.Name()
+	if err != nil {
+		t.Fatalf("Name failed: %v", err)
+	}
+
+	// A pidfile and a fake cgroup naming this process
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "test.pid")
+	os.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600)
+	sysfs := fakeSysfs(t, map[string]string{
+		"fs/cgroup/system.slice/test.scope/cgroup.procs": fmt.Sprint(os.Getpid()),
+	})
+
+	collector := newProcessCollector([]ProcessTarget{
+		{Service: "by-name", Name: name},
+		{Service: "by-pidfile", PIDFile: pidFile},
+		{Service: "by-cgroup", CGroup: "system.slice/test.scope"},
+		{Service: "stopped", CGroup: "system.slice/stopped.scope"},
+	}, sysfs)
+
+	metrics, err := collector.collect()
+	if err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	for _, service := range []string{"by-name", "by-pidfile", "by-cgroup"} {
+		m := metrics[service]
+		if !m.Up || m.Count < 1 || m.RSS == 0 || m.FDs == 0 || m.Threads == 0 {
+			t.Errorf("Expected resources of %s, got %+v", service, m)
+		}
+	}
+	if m := metrics["stopped"]; m.Up || m.Count != 0 {
+		t.Errorf("Expected stopped service to be down, got %+v", m)
+	}
+}
+
+func TestProcessRestarts(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "sleep.pid")
+	start := func() *exec.Cmd {
+		cmd := exec.Command("sleep", "60")
+		if err := cmd.Start(); err != nil {
+			t.Skipf("Cannot start sleep: %v", err)
+		}
+		os.WriteFile(pidFile, []byte(fmt.Sprint(cmd.Process.Pid)), 0600)
+		return cmd
+	}
+	stop := func(cmd *exec.Cmd) {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+
+	collector := newProcessCollector([]ProcessTarget{{Service: "sleep", PIDFile: pidFile}}, "")
+
+	first := start()
+	metrics, _ := collector.collect()
+	if m := metrics["sleep"]; !m.Up || m.Restarts != 0 {
+		t.Fatalf("Expected running process without restarts, got %+v", m)
+	}
+
+	stop(first)
+	metrics, _ = collector.collect()
+	if m := metrics["sleep"]; m.Up || m.Restarts != 0 {
+		t.Errorf("Expected stopped process, got %+v", m)
+	}
+
+	second := start()
+	defer stop(second)
+	metrics, _ = collector.collect()
+	if m := metrics["sleep"]; !m.Up || m.Restarts != 1 || m.MainPID != int32(second.Process.Pid) {
+		t.Errorf("Expected one restart, got %+v", m)
+	}
+	metrics, _ = collector.collect()
+	if m := metrics["sleep"]; m.Restarts != 1 {
+		t.Errorf("Expected the restart to be counted once, got %+v", m)
+	}
+}
@@ -0,0 +1,501 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Kinds of service check
+const (
+	CheckHTTP     = "http"
+	CheckTCP      = "tcp"
+	CheckPostgres = "postgres"
+)
+
+// Defaults applied to checks that leave them unset
+const (
+	DefaultCheckTimeout  = 5 * time.Second
+	DefaultCheckInterval = 15 * time.Second
+	DefaultDegradedAfter = 1
+	DefaultDownAfter     = 3
+	DefaultRecoverAfter  = 2
+)
+
+// maxBodyMatchSize bounds how much of a response body is searched
+const maxBodyMatchSize = 64 << 10
+
+// dsnPassword matches the password in a key/value DSN
+var dsnPassword = regexp.MustCompile(`password=\S+`)
+
+// redactedPassword replaces DSN passwords in responses
+const redactedPassword = "xxxxx"
+
+var (
+	// ErrServiceNotFound is returned for operations on unknown services
+	ErrServiceNotFound = errors.New("service not found")
+	// ErrInvalidCheck is returned for incomplete or malformed checks
+	ErrInvalidCheck = errors.New("invalid service check")
+)
+
+// Duration is a time.Duration written as a string such as "5s" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// TLSOptions configures TLS for HTTP checks of services that terminate
+// TLS themselves
+type TLSOptions struct {
+	CAFile             string `json:"ca_file,omitempty"`
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// ServiceCheck describes how a monitored service is probed. HTTP checks
+// request URL and expect ExpectedStatus and, if set, a body matching the
+// BodyMatch regular expression; TCP checks connect to Address; Postgres
+// checks run a ping over DSN, or connect to Address when DSN is empty.
+//
+// A healthy service becomes degraded after DegradedAfter consecutive failed
+// probes and down after DownAfter; a failing one is healthy again after
+// RecoverAfter consecutive successful probes.
+type ServiceCheck struct {
+	Name           string      `json:"name"`
+	Type           string      `json:"type"`
+	URL            string      `json:"url,omitempty"`
+	Method         string      `json:"method,omitempty"`
+	ExpectedStatus int         `json:"expected_status,omitempty"`
+	BodyMatch      string      `json:"body_match,omitempty"`
+	Address        string      `json:"address,omitempty"`
+	DSN            string      `json:"dsn,omitempty"`
+	Timeout        Duration    `json:"timeout,omitempty"`
+	Interval       Duration    `json:"interval,omitempty"`
+	TLS            *TLSOptions `json:"tls,omitempty"`
+	DegradedAfter  int         `json:"degraded_after,omitempty"`
+	DownAfter      int         `json:"down_after,omitempty"`
+	RecoverAfter   int         `json:"recover_after,omitempty"`
+}
+
+// redacted returns the check with the DSN password removed, for responses
+func (sc ServiceCheck) redacted() ServiceCheck {
+	if sc.DSN == "" {
+		return sc
+	}
+	if u, err := url.Parse(sc.DSN); err == nil && u.User != nil {
+		if _, set := u.User.Password(); set {
+			u.User = url.UserPassword(u.User.Username(), redactedPassword)
+			sc.DSN = u.String()
+			return sc
+		}
+	}
+	sc.DSN = dsnPassword.ReplaceAllString(sc.DSN, "password="+redactedPassword)
+	return sc
+}
+
+// hasRedactedPassword reports whether the DSN carries the placeholder
+// returned in responses instead of a password
+func (sc ServiceCheck) hasRedactedPassword() bool {
+	if u, err := url.Parse(sc.DSN); err == nil && u.User != nil {
+		if password, set := u.User.Password(); set {
+			return password == redactedPassword
+		}
+	}
+	for _, match := range dsnPassword.FindAllString(sc.DSN, -1) {
+		if match == "password="+redactedPassword {
+			return true
+		}
+	}
+	return false
+}
+
+// probe is a validated check ready to run
+type probe struct {
+	check     ServiceCheck
+	bodyMatch *regexp.Regexp
+	client    *http.Client
+}
+
+// newProbe validates check, filling in defaults
+func newProbe(check ServiceCheck) (*probe, error) {
+	if check.Name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidCheck)
+	}
+	if check.Type == "" {
+		check.Type = CheckHTTP
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = Duration(DefaultCheckTimeout)
+	}
+	if check.Interval <= 0 {
+		check.Interval = Duration(DefaultCheckInterval)
+	}
+	if check.DegradedAfter <= 0 {
+		check.DegradedAfter = DefaultDegradedAfter
+	}
+	if check.DownAfter <= 0 {
+		check.DownAfter = DefaultDownAfter
+	}
+	if check.DownAfter < check.DegradedAfter {
+		return nil, fmt.Errorf("%w: %s down_after is below degraded_after", ErrInvalidCheck, check.Name)
+	}
+	if check.RecoverAfter <= 0 {
+		check.RecoverAfter = DefaultRecoverAfter
+	}
+
+	p := &probe{}
+	switch check.Type {
+	case CheckHTTP:
+		u, err := url.Parse(check.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%w: %s needs an http(s) url", ErrInvalidCheck, check.Name)
+		}
+		if check.Method == "" {
+			check.Method = http.MethodGet
+		}
+		check.Method = strings.ToUpper(check.Method)
+		if check.ExpectedStatus == 0 {
+			check.ExpectedStatus = http.StatusOK
+		}
+		if check.BodyMatch != "" {
+			if p.bodyMatch, err = regexp.Compile(check.BodyMatch); err != nil {
+				return nil, fmt.Errorf("%w: %s body_match: %v", ErrInvalidCheck, check.Name, err)
+			}
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if check.TLS != nil {
+			if transport.TLSClientConfig, err = check.TLS.config(); err != nil {
+				return nil, fmt.Errorf("%w: %s tls: %v", ErrInvalidCheck, check.Name, err)
+			}
+		}
+		p.client = &http.Client{
+			Transport: transport,
+			// Redirects are reported as the status they are
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	case CheckTCP:
+		if _, _, err := net.SplitHostPort(check.Address); err != nil {
+			return nil, fmt.Errorf("%w: %s needs a host:port address", ErrInvalidCheck, check.Name)
+		}
+	case CheckPostgres:
+		if check.DSN != "" {
+			if _, err := pgx.ParseConfig(check.DSN); err != nil {
+				return nil, fmt.Errorf("%w: %s dsn: %v", ErrInvalidCheck, check.Name, err)
+			}
+		} else if _, _, err := net.SplitHostPort(check.Address); err != nil {
+			return nil, fmt.Errorf("%w: %s needs a dsn or host:port address", ErrInvalidCheck, check.Name)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidCheck, check.Type)
+	}
+
+	p.check = check
+	return p, nil
+}
+
+func (o *TLSOptions) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if o.CAFile != "" {
+		caPEM, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// run probes the service once, returning why it is unhealthy
+func (p *probe) run(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.check.Timeout))
+	defer cancel()
+
+	switch p.check.Type {
+	case CheckHTTP:
+		return p.runHTTP(ctx)
+	case CheckPostgres:
+		if p.check.DSN != "" {
+			conn, err := pgx.Connect(ctx, p.check.DSN)
+			if err != nil {
+				return err
+			}
+			defer conn.Close(context.Background())
+			return conn.Ping(ctx)
+		}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.check.Address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p *probe) runHTTP(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, p.check.Method, p.check.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != p.check.ExpectedStatus {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if p.bodyMatch != nil {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyMatchSize))
+		if err != nil {
+			return err
+		}
+		if !p.bodyMatch.Match(body) {
+			return fmt.Errorf("body does not match %q", p.check.BodyMatch)
+		}
+	}
+	return nil
+}
+
+// ServiceRegistry holds the monitored services. Changes made at runtime
+// are saved to its file, which is read again on the next start.
+type ServiceRegistry struct {
+	mu     sync.RWMutex
+	file   string
+	probes map[string]*probe
+}
+
+// NewServiceRegistry creates an in-memory registry of checks
+func NewServiceRegistry(checks []ServiceCheck) (*ServiceRegistry, error) {
+	r := &ServiceRegistry{probes: make(map[string]*probe)}
+	for _, check := range checks {
+		p, err := newProbe(check)
+		if err != nil {
+			return nil, err
+		}
+		r.probes[check.Name] = p
+	}
+	return r, nil
+}
+
+// LoadServiceRegistry reads checks from file, a JSON object with a
+// "services" list, or starts from DefaultServiceChecks if it does not
+// exist yet
+func LoadServiceRegistry(file string) (*ServiceRegistry, error) {
+	checks := DefaultServiceChecks()
+	data, err := os.ReadFile(file)
+	if err == nil {
+		var doc struct {
+			Services []ServiceCheck `json:"services"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+		checks = doc.Services
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	r, err := NewServiceRegistry(checks)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	r.file = file
+	return r, nil
+}
+
+// DefaultServiceChecks returns the checks for the compose stack: the GPIO
+// and auth services and, when POSTGRES_HOST is set, Postgres
+func DefaultServiceChecks() []ServiceCheck {
+	checks := []ServiceCheck{
+		{Name: "gpio", Type: CheckHTTP, URL: "http://gpio:8000/health"},
+		{Name: "auth", Type: CheckHTTP, URL: "http://auth:8000/health"},
+	}
+
+	if host := os.Getenv("POSTGRES_HOST"); host != "" {
+		dsn := url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(os.Getenv("POSTGRES_USER"), os.Getenv("POSTGRES_PASSWORD")),
+			Host:   net.JoinHostPort(host, "5432"),
+			Path:   os.Getenv("POSTGRES_DB"),
+		}
+		checks = append(checks, ServiceCheck{Name: "postgres", Type: CheckPostgres, DSN: dsn.String()})
+	}
+	return checks
+}
+
+// List returns the checks sorted by name, with DSN passwords redacted
+func (r *ServiceRegistry) List() []ServiceCheck {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	checks := make([]ServiceCheck, 0, len(r.probes))
+	for _, p := range r.probes {
+		checks = append(checks, p.check.redacted())
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+	return checks
+}
+
+// Names returns the names of the monitored services, sorted
+func (r *ServiceRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.probes))
+	for name := range r.probes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Put adds or replaces a check and returns it with defaults filled in. A
+// DSN with a redacted password, as returned by List, keeps the stored
+// password as long as the rest of the DSN is unchanged.
+func (r *ServiceRegistry) Put(check ServiceCheck) (ServiceCheck, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous, existed := r.probes[check.Name]
+	if check.hasRedactedPassword() {
+		if !existed || previous.check.redacted().DSN != check.DSN {
+			return ServiceCheck{}, fmt.Errorf("%w: %s dsn has a redacted password", ErrInvalidCheck, check.Name)
+		}
+		check.DSN = previous.check.DSN
+	}
+
+	p, err := newProbe(check)
+	if err != nil {
+		return ServiceCheck{}, err
+	}
+
+	r.probes[check.Name] = p
+	if err := r.saveLocked(); err != nil {
+		if existed {
+			r.probes[check.Name] = previous
+		} else {
+			delete(r.probes, check.Name)
+		}
+		return ServiceCheck{}, err
+	}
+	return p.check.redacted(), nil
+}
+
+// Delete stops monitoring a service
+func (r *ServiceRegistry) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous, exists := r.probes[name]
+	if !exists {
+		return ErrServiceNotFound
+	}
+	delete(r.probes, name)
+	if err := r.saveLocked(); err != nil {
+		r.probes[name] = previous
+		return err
+	}
+	return nil
+}
+
+// snapshot returns the current probes, sorted by name
+func (r *ServiceRegistry) snapshot() []*probe {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	probes := make([]*probe, 0, len(r.probes))
+	for _, p := range r.probes {
+		probes = append(probes, p)
+	}
+	sort.Slice(probes, func(i, j int) bool { return probes[i].check.Name < probes[j].check.Name })
+	return probes
+}
+
+func (r *ServiceRegistry) saveLocked() error {
+	if r.file == "" {
+		return nil
+	}
+
+	doc := struct {
+		Services []ServiceCheck `json:"services"`
+	}{Services: make([]ServiceCheck, 0, len(r.probes))}
+	for _, p := range r.probes {
+		doc.Services = append(doc.Services, p.check)
+	}
+	sort.Slice(doc.Services, func(i, j int) bool { return doc.Services[i].Name < doc.Services[j].Name })
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The file may hold database credentials
+	tmp, err := os.CreateTemp(filepath.Dir(r.file), "."+filepath.Base(r.file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.file)
+}
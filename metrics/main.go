@@ -2,18 +2,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/Jeff-Barlow-Spady/docker-setup/services/metrics/internal"
+	"github.com/Jeff-Barlow-Spady/edge-device-service/pkg/middleware/auth"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 )
 
+// adminScope is required to change the monitored services
+const adminScope = "metrics:admin:services"
+
 func main() {
 	// Create context that listens for the interrupt signal from the OS
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
@@ -39,7 +45,57 @@ func main() {
 		Format: "[${time}] ${status} - ${latency} ${method} ${path}\n",
 	}))
 
-	collector := internal.NewMetricsCollector()
+	// Monitored services come from METRICS_SERVICES_FILE, created with the
+	// defaults on the first change made through the API
+	servicesFile := os.Getenv("METRICS_SERVICES_FILE")
+	if servicesFile == "" {
+		servicesFile = "services.json"
+	}
+	registry, err := internal.LoadServiceRegistry(servicesFile)
+	if err != nil {
+		log.Fatalf("Failed to load monitored services: %v", err)
+	}
+	// Board metrics are read from METRICS_SYSFS_ROOT, and the firmware
+	// throttling flags from sysfs or, with METRICS_THROTTLED_SOURCE=vcgencmd,
+	// the vcgencmd tool
+	config := internal.CollectorConfig{
+		Services:  registry,
+		SysfsRoot: os.Getenv("METRICS_SYSFS_ROOT"),
+	}
+	switch source := os.Getenv("METRICS_THROTTLED_SOURCE"); source {
+	case "", "sysfs":
+	case "vcgencmd":
+		config.Throttled = internal.VcgencmdThrottled{Path: os.Getenv("VCGENCMD_PATH")}
+	default:
+		log.Fatalf("Unknown METRICS_THROTTLED_SOURCE %q, expected sysfs or vcgencmd", source)
+	}
+
+	// METRICS_COLLECTORS lists the optional collectors to run, all of them
+	// by default, and METRICS_MOUNTS the filesystems to report usage for
+	if list, ok := os.LookupEnv("METRICS_COLLECTORS"); ok {
+		collectors, err := internal.ParseCollectors(list)
+		if err != nil {
+			log.Fatalf("Invalid METRICS_COLLECTORS: %v", err)
+		}
+		config.Collectors = collectors
+	}
+	for _, mount := range strings.Split(os.Getenv("METRICS_MOUNTS"), ",") {
+		if mount = strings.TrimSpace(mount); mount != "" {
+			config.Mounts = append(config.Mounts, mount)
+		}
+	}
+
+	// Processes of the edge stack come from METRICS_PROCESSES_FILE
+	processesFile := os.Getenv("METRICS_PROCESSES_FILE")
+	if processesFile == "" {
+		processesFile = "processes.json"
+	}
+	processes, err := internal.LoadProcessTargets(processesFile)
+	if err != nil {
+		log.Fatalf("Failed to load process targets: %v", err)
+	}
+	config.Processes = processes
+	collector := internal.NewMetricsCollectorWithConfig(config)
 
 	// Get update interval from environment
 	intervalStr := os.Getenv("METRICS_UPDATE_INTERVAL")
@@ -50,7 +106,7 @@ func main() {
 		}
 	}
 
-	// Update metrics periodically with context
+	// Update system metrics periodically with context
 	go func() {
 		ticker := time.NewTicker(updateInterval)
 		defer ticker.Stop()
@@ -61,17 +117,83 @@ func main() {
 				log.Println("Stopping metrics collection")
 				return
 			case <-ticker.C:
-				if err := collector.UpdateMetrics(); err != nil {
+				if err := collector.UpdateSystemMetrics(); err != nil {
 					log.Printf("Error updating metrics: %v", err)
 				}
 			}
 		}
 	}()
 
-	app.Get("/metrics", func(c *fiber.Ctx) error {
+	// Services are probed concurrently at each check's own interval
+	go collector.RunProbes(ctx)
+
+	// Require a token with metrics:read:* when an auth service is configured;
+	// keys come from its JWKS so no secret is needed here
+	protect := []fiber.Handler{}
+	var requireAdmin []fiber.Handler
+	if authURL := os.Getenv("AUTH_SERVICE_URL"); authURL != "" {
+		log.Printf("Verifying tokens with keys from %s", authURL)
+		requireAuth := auth.New(auth.Config{Verifier: auth.NewJWKSVerifier(authURL)})
+		protect = append(protect,
+			requireAuth,
+			auth.RequireScope(func(c *fiber.Ctx) string { return "metrics:read:*" }),
+		)
+		requireAdmin = append(requireAdmin,
+			requireAuth,
+			auth.RequireScope(func(c *fiber.Ctx) string { return adminScope }),
+		)
+	}
+
+	app.Get("/metrics", append(protect, func(c *fiber.Ctx) error {
 		metrics := collector.GetMetrics()
 		return c.JSON(metrics)
-	})
+	})...)
+
+	app.Get("/services", append(protect, func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"services": registry.List(),
+		})
+	})...)
+
+	// Changing what is monitored needs an admin token, so these routes only
+	// exist when tokens can be verified
+	if requireAdmin != nil {
+		app.Put("/services/:name", append(requireAdmin, func(c *fiber.Ctx) error {
+			var check internal.ServiceCheck
+			if err := c.BodyParser(&check); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+			}
+			check.Name = c.Params("name")
+
+			saved, err := registry.Put(check)
+			if err != nil {
+				if errors.Is(err, internal.ErrInvalidCheck) {
+					return fiber.NewError(fiber.StatusBadRequest, err.Error())
+				}
+				log.Printf("Failed to save service %s: %v", check.Name, err)
+				return fiber.NewError(fiber.StatusInternalServerError, "Failed to save service")
+			}
+			log.Printf("Service %s monitored by %s", check.Name, auth.Subject(c))
+			return c.JSON(saved)
+		})...)
+
+		app.Delete("/services/:name", append(requireAdmin, func(c *fiber.Ctx) error {
+			if err := registry.Delete(c.Params("name")); err != nil {
+				if errors.Is(err, internal.ErrServiceNotFound) {
+					return fiber.NewError(fiber.StatusNotFound, err.Error())
+				}
+				log.Printf("Failed to remove service %s: %v", c.Params("name"), err)
+				return fiber.NewError(fiber.StatusInternalServerError, "Failed to remove service")
+			}
+			log.Printf("Service %s no longer monitored, removed by %s", c.Params("name"), auth.Subject(c))
+			return c.JSON(fiber.Map{
+				"message": "Service removed",
+				"name":    c.Params("name"),
+			})
+		})...)
+	} else {
+		log.Println("AUTH_SERVICE_URL is not set, monitored services cannot be changed at runtime")
+	}
 
 	app.Get("/health", func(c *fiber.Ctx) error {
 		health := collector.GetHealth()
@@ -0,0 +1,307 @@
+// Package audit keeps an append-only, hash-chained log of security
+// relevant events such as logins, token and user changes and pin writes.
+//
+// Events are written as JSON lines. Each event carries the hash of its
+// predecessor and its own hash over its content, so that edited, removed
+// or reordered events are detected by Verify. The file is rotated by size;
+// the chain continues across rotated files.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of audited actions
+const (
+	OutcomeSuccess = "success"
+	OutcomeDenied  = "denied"
+	OutcomeFailure = "failure"
+)
+
+// Default rotation settings
+const (
+	DefaultMaxSize  = 10 << 20
+	DefaultMaxFiles = 10
+)
+
+// maxLineSize bounds a single event when reading the log back
+const maxLineSize = 1 << 20
+
+// Event is a single audit record
+type Event struct {
+	Seq      uint64            `json:"seq"`
+	Time     time.Time         `json:"time"`
+	Service  string            `json:"service"`
+	Actor    string            `json:"actor,omitempty"`
+	Action   string            `json:"action"`
+	Target   string            `json:"target,omitempty"`
+	SourceIP string            `json:"source_ip,omitempty"`
+	Outcome  string            `json:"outcome"`
+	Details  map[string]string `json:"details,omitempty"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+// computeHash returns the hash of the event's content, chained to PrevHash
+func (e Event) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Config configures a Logger
+type Config struct {
+	// Path of the current log file; rotated files are kept next to it
+	Path string
+	// Service names the service recording events
+	Service string
+	// MaxSize is the size in bytes at which the file is rotated
+	MaxSize int64
+	// MaxFiles is the number of rotated files kept
+	MaxFiles int
+}
+
+// Logger appends events to the audit log. A nil Logger discards events, so
+// that auditing can be disabled without checks at every call site.
+type Logger struct {
+	config Config
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	seq      uint64
+	lastHash string
+}
+
+// Open opens or creates the audit log at config.Path and resumes its hash
+// chain
+func Open(config Config) (*Logger, error) {
+	if config.MaxSize <= 0 {
+		config.MaxSize = DefaultMaxSize
+	}
+	if config.MaxFiles <= 0 {
+		config.MaxFiles = DefaultMaxFiles
+	}
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0700); err != nil {
+		return nil, err
+	}
+
+	l := &Logger{config: config}
+
+	// The chain resumes from the last event of the newest non-empty file
+	files, err := l.files()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		last, found, err := lastEvent(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			l.seq, l.lastHash = last.Seq, last.Hash
+			break
+		}
+	}
+
+	if err := l.openFile(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) openFile() error {
+	file, err := os.OpenFile(l.config.Path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+
+	// Start on a new line if the last write was cut short
+	if l.size > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, l.size-1); err == nil && last[0] != '\n' {
+			n, _ := file.Write([]byte{'\n'})
+			l.size += int64(n)
+		}
+	}
+	return nil
+}
+
+// Record appends an event, filling in its sequence number, time, service
+// and hashes
+func (l *Logger) Record(event Event) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return errors.New("audit log is closed")
+	}
+
+	event.Seq = l.seq + 1
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Time = event.Time.UTC()
+	event.Service = l.config.Service
+	if event.Outcome == "" {
+		event.Outcome = OutcomeSuccess
+	}
+	event.PrevHash = l.lastHash
+
+	hash, err := event.computeHash()
+	if err != nil {
+		return err
+	}
+	event.Hash = hash
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > l.config.MaxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	l.seq, l.lastHash = event.Seq, event.Hash
+	return nil
+}
+
+// rotate renames the current file aside, opens a new one and removes the
+// oldest rotated files beyond MaxFiles
+func (l *Logger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+
+	rotated := fmt.Sprintf("%s.%s", l.config.Path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(l.config.Path, rotated); err != nil {
+		return err
+	}
+	if err := l.openFile(); err != nil {
+		return err
+	}
+
+	files, err := l.files()
+	if err != nil {
+		return err
+	}
+	// files ends with the current file
+	rotatedFiles := files[:len(files)-1]
+	for len(rotatedFiles) > l.config.MaxFiles {
+		if err := os.Remove(rotatedFiles[0]); err != nil {
+			return err
+		}
+		rotatedFiles = rotatedFiles[1:]
+	}
+	return nil
+}
+
+// files returns the rotated files, oldest first, followed by the current
+// file if it exists
+func (l *Logger) files() ([]string, error) {
+	rotated, err := filepath.Glob(l.config.Path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	// Rotation suffixes are timestamps of equal length
+	sort.Strings(rotated)
+
+	if _, err := os.Stat(l.config.Path); err == nil {
+		rotated = append(rotated, l.config.Path)
+	}
+	return rotated, nil
+}
+
+// Close closes the log file
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// readEvents calls fn for every line of file, in order, with the decoded
+// event or the reason it could not be decoded
+func readEvents(file string, fn func(line int, event Event, err error) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var event Event
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err := fn(line, event, err); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// lastEvent returns the last readable event in file. Unreadable lines, such
+// as one cut short by a power loss, are skipped here and reported by
+// Verify.
+func lastEvent(file string) (Event, bool, error) {
+	var last Event
+	found := false
+	err := readEvents(file, func(_ int, event Event, err error) error {
+		if err == nil && event.Hash != "" {
+			last, found = event, true
+		}
+		return nil
+	})
+	return last, found, err
+}
@@ -0,0 +1,168 @@
+package audit
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func openTestLog(t *testing.T, maxSize int64) (*Logger, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "audit", "test.log")
+	l, err := Open(Config{Path: path, Service: "test", MaxSize: maxSize, MaxFiles: 3})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, path
+}
+
+func TestRecordAndQuery(t *testing.T) {
+	l, path := openTestLog(t, 0)
+
+	start := time.Now().Add(-time.Second)
+	l.Record(Event{Actor: "alice", Action: "auth.login", SourceIP: "10.0.0.1"})
+	l.Record(Event{Actor: "bob", Action: "auth.login", Outcome: OutcomeDenied})
+	l.Record(Event{Actor: "alice", Action: "pin.write", Target: "4", Details: map[string]string{"value": "true"}})
+
+	events, err := l.Query(Filter{Actor: "alice"})
+	if err != nil || len(events) != 2 || events[1].Target != "4" {
+		t.Fatalf("Expected alice's two events, got %+v, %v", events, err)
+	}
+	if events[0].Outcome != OutcomeSuccess || events[0].Service != "test" {
+		t.Errorf("Expected defaults to be filled in, got %+v", events[0])
+	}
+
+	if events, _ := l.Query(Filter{Action: "pin.*"}); len(events) != 1 {
+		t.Errorf("Expected prefix match on pin.*, got %d events", len(events))
+	}
+	if events, _ := l.Query(Filter{Outcome: OutcomeDenied}); len(events) != 1 || events[0].Actor != "bob" {
+		t.Errorf("Expected bob's denied login, got %+v", events)
+	}
+	if events, _ := l.Query(Filter{Since: start, Until: start.Add(time.Millisecond)}); len(events) != 0 {
+		t.Errorf("Expected no events in the time range, got %d", len(events))
+	}
+	if events, _ := l.Query(Filter{Limit: 2}); len(events) != 2 || events[0].Seq != 2 || events[1].Seq != 3 {
+		t.Errorf("Expected the two newest events in order, got %+v", events)
+	}
+
+	// A reopened log continues the chain
+	l.Close()
+	reopened, err := Open(Config{Path: path, Service: "test"})
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer reopened.Close()
+	reopened.Record(Event{Actor: "carol", Action: "user.create"})
+
+	result, err := reopened.Verify()
+	if err != nil || !result.Valid || result.Events != 4 {
+		t.Fatalf("Expected a valid chain of 4 events, got %+v, %v", result, err)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	l, path := openTestLog(t, 0)
+	for _, actor := range []string{"alice", "bob", "carol"} {
+		l.Record(Event{Actor: actor, Action: "pin.write", Target: "4"})
+	}
+
+	original, _ := os.ReadFile(path)
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+	}{
+		{"edited", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"bob"`, `"mallory"`, 1)
+			return lines
+		}},
+		{"removed", func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		}},
+		{"truncated", func(lines []string) []string {
+			return lines[:2]
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := strings.Split(strings.TrimSpace(string(original)), "\n")
+			os.WriteFile(path, []byte(strings.Join(tt.tamper(lines), "\n")+"\n"), 0600)
+
+			result, err := l.Verify()
+			if err != nil || result.Valid || result.Error == "" {
+				t.Errorf("Expected tampering to be detected, got %+v, %v", result, err)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	l, path := openTestLog(t, 600)
+	for i := 0; i < 20; i++ {
+		if err := l.Record(Event{Actor: "alice", Action: "pin.write", Target: "4"}); err != nil {
+			t.Fatalf("Record failed: %v", err)
+		}
+	}
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 3 {
+		t.Fatalf("Expected 3 rotated files to be kept, got %d", len(rotated))
+	}
+
+	// The oldest kept event anchors the chain after old files are removed
+	result, err := l.Verify()
+	if err != nil || !result.Valid {
+		t.Fatalf("Expected rotated log to verify, got %+v, %v", result, err)
+	}
+	events, _ := l.Query(Filter{Limit: 1})
+	if len(events) != 1 || events[0].Seq != 20 {
+		t.Errorf("Expected the newest event across files, got %+v", events)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	l, _ := openTestLog(t, 0)
+
+	app := fiber.New()
+	app.Post("/login", l.Middleware("auth.login"), func(c *fiber.Ctx) error {
+		SetActor(c, "alice")
+		return c.SendStatus(fiber.StatusUnauthorized)
+	})
+	app.Post("/gpio/:pin/write", l.Middleware("pin.write"), func(c *fiber.Ctx) error {
+		SetDetail(c, "value", "true")
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	for _, path := range []string{"/login", "/gpio/4/write"} {
+		if _, err := app.Test(httptest.NewRequest("POST", path, nil)); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+	}
+
+	events, _ := l.Query(Filter{})
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if events[0].Actor != "alice" || events[0].Outcome != OutcomeDenied || events[0].Details["status"] != "401" {
+		t.Errorf("Unexpected login event %+v", events[0])
+	}
+	if events[1].Target != "4" || events[1].Outcome != OutcomeSuccess || events[1].Details["value"] != "true" {
+		t.Errorf("Unexpected pin event %+v", events[1])
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	if err := l.Record(Event{Action: "auth.login"}); err != nil {
+		t.Errorf("Expected nil logger to discard events, got %v", err)
+	}
+	if events, err := l.Query(Filter{}); err != nil || len(events) != 0 {
+		t.Errorf("Expected no events, got %v, %v", events, err)
+	}
+}
@@ -0,0 +1,165 @@
+package audit
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/Jeff-Barlow-Spady/edge-device-service/pkg/middleware/auth"
+)
+
+// ReadScope is required to query and verify the audit log
+const ReadScope = "audit:read"
+
+// Keys under which handlers annotate the audited request in fiber.Ctx
+// locals
+const (
+	actorLocalsKey   = "audit.actor"
+	targetLocalsKey  = "audit.target"
+	detailsLocalsKey = "audit.details"
+)
+
+// SetActor names the actor of a request that the auth middleware did not
+// authenticate, such as the username of a login
+func SetActor(c *fiber.Ctx, actor string) {
+	c.Locals(actorLocalsKey, actor)
+}
+
+// SetTarget names what the request acted on, overriding the route
+// parameters
+func SetTarget(c *fiber.Ctx, target string) {
+	c.Locals(targetLocalsKey, target)
+}
+
+// SetDetail attaches a detail to the request's audit event. Secrets must
+// never be recorded.
+func SetDetail(c *fiber.Ctx, key, value string) {
+	details, _ := c.Locals(detailsLocalsKey).(map[string]string)
+	if details == nil {
+		details = make(map[string]string)
+		c.Locals(detailsLocalsKey, details)
+	}
+	details[key] = value
+}
+
+// OutcomeForStatus classifies an HTTP status: rejected credentials,
+// permissions and throttling are denials, other errors failures
+func OutcomeForStatus(status int) string {
+	switch {
+	case status < 400:
+		return OutcomeSuccess
+	case status == fiber.StatusUnauthorized, status == fiber.StatusForbidden, status == fiber.StatusTooManyRequests:
+		return OutcomeDenied
+	default:
+		return OutcomeFailure
+	}
+}
+
+// Middleware records an event for action once the rest of the chain has
+// run. Install it before the auth middleware so that rejected requests are
+// recorded too. The actor is the authenticated subject or the one set with
+// SetActor, and the target defaults to the route parameters.
+func (l *Logger) Middleware(action string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+		if l == nil {
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var fiberErr *fiber.Error
+			if errors.As(err, &fiberErr) {
+				status = fiberErr.Code
+			}
+		}
+
+		actor := auth.Subject(c)
+		if actor == "" {
+			actor, _ = c.Locals(actorLocalsKey).(string)
+		}
+
+		target, _ := c.Locals(targetLocalsKey).(string)
+		if target == "" {
+			var params []string
+			for _, name := range c.Route().Params {
+				params = append(params, c.Params(name))
+			}
+			target = strings.Join(params, "/")
+		}
+
+		details, _ := c.Locals(detailsLocalsKey).(map[string]string)
+		if details == nil {
+			details = make(map[string]string, 1)
+		}
+		details["status"] = strconv.Itoa(status)
+
+		if recordErr := l.Record(Event{
+			Actor:    actor,
+			Action:   action,
+			Target:   target,
+			SourceIP: c.IP(),
+			Outcome:  OutcomeForStatus(status),
+			Details:  details,
+		}); recordErr != nil {
+			log.Printf("Failed to record audit event %s: %v", action, recordErr)
+		}
+		return err
+	}
+}
+
+// QueryHandler serves events filtered by the actor, action, outcome, since,
+// until (RFC 3339) and limit query parameters. Callers must hold
+// ReadScope.
+func (l *Logger) QueryHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		filter := Filter{
+			Actor:   c.Query("actor"),
+			Action:  c.Query("action"),
+			Outcome: c.Query("outcome"),
+			Limit:   c.QueryInt("limit", DefaultQueryLimit),
+		}
+		for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if value := c.Query(param); value != "" {
+				parsed, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					return c.Status(400).JSON(fiber.Map{
+						"error": "Invalid " + param + ", expected RFC 3339 time",
+					})
+				}
+				*t = parsed
+			}
+		}
+
+		events, err := l.Query(filter)
+		if err != nil {
+			log.Printf("Audit log query failed: %v", err)
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to read audit log",
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"events": events,
+		})
+	}
+}
+
+// VerifyHandler checks the hash chain of the whole log
+func (l *Logger) VerifyHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		result, err := l.Verify()
+		if err != nil {
+			log.Printf("Audit log verification failed: %v", err)
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to read audit log",
+			})
+		}
+		return c.JSON(result)
+	}
+}
@@ -0,0 +1,167 @@
+package audit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Query limits
+const (
+	DefaultQueryLimit = 100
+	MaxQueryLimit     = 1000
+)
+
+// Filter selects events from the log. Empty fields match every event.
+type Filter struct {
+	Actor string
+	// Action matches exactly, or as a prefix when it ends in "*", e.g.
+	// "pin.*"
+	Action  string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	// Limit keeps the newest matching events
+	Limit int
+}
+
+func (f Filter) matches(event Event) bool {
+	if f.Actor != "" && event.Actor != f.Actor {
+		return false
+	}
+	if f.Action != "" {
+		if prefix := strings.TrimSuffix(f.Action, "*"); prefix != f.Action {
+			if !strings.HasPrefix(event.Action, prefix) {
+				return false
+			}
+		} else if event.Action != f.Action {
+			return false
+		}
+	}
+	if f.Outcome != "" && event.Outcome != f.Outcome {
+		return false
+	}
+	if !f.Since.IsZero() && event.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !event.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Query returns the newest events matching filter, oldest first, across
+// the current and rotated files
+func (l *Logger) Query(filter Filter) ([]Event, error) {
+	if l == nil {
+		return []Event{}, nil
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultQueryLimit
+	}
+	if filter.Limit > MaxQueryLimit {
+		filter.Limit = MaxQueryLimit
+	}
+
+	// Holding the lock keeps rotation from renaming files mid-read
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	files, err := l.files()
+	if err != nil {
+		return nil, err
+	}
+
+	// A ring of the last Limit matches
+	events := make([]Event, 0, filter.Limit)
+	next := 0
+	for _, file := range files {
+		err := readEvents(file, func(_ int, event Event, err error) error {
+			if err != nil || !filter.matches(event) {
+				return nil
+			}
+			if len(events) < filter.Limit {
+				events = append(events, event)
+			} else {
+				events[next] = event
+			}
+			next = (next + 1) % filter.Limit
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(events) == filter.Limit {
+		events = append(events[next:], events[:next]...)
+	}
+	return events, nil
+}
+
+// VerifyResult reports the outcome of checking the hash chain
+type VerifyResult struct {
+	Valid  bool   `json:"valid"`
+	Events int    `json:"events"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Verify checks every event's hash and its link to the previous event. The
+// oldest kept event anchors the chain, since older files are removed by
+// rotation.
+func (l *Logger) Verify() (VerifyResult, error) {
+	if l == nil {
+		return VerifyResult{Valid: true}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	files, err := l.files()
+	if err != nil {
+		return VerifyResult{}, err
+	}
+
+	var result VerifyResult
+	var prev *Event
+	for _, file := range files {
+		err := readEvents(file, func(line int, event Event, err error) error {
+			if err != nil {
+				return fmt.Errorf("%s:%d: unreadable event: %v", file, line, err)
+			}
+			hash, err := event.computeHash()
+			if err != nil {
+				return err
+			}
+			switch {
+			case hash != event.Hash:
+				return fmt.Errorf("%s:%d: event %d has been modified", file, line, event.Seq)
+			case prev != nil && event.PrevHash != prev.Hash:
+				return fmt.Errorf("%s:%d: event %d does not follow event %d", file, line, event.Seq, prev.Seq)
+			case prev != nil && event.Seq != prev.Seq+1:
+				return fmt.Errorf("%s:%d: events %d to %d are missing", file, line, prev.Seq+1, event.Seq-1)
+			}
+			prev = &event
+			result.Events++
+			return nil
+		})
+		if err != nil {
+			result.Error = err.Error()
+			return result, nil
+		}
+	}
+
+	// Events removed from the end of the log leave the chain intact, but
+	// the logger remembers where it ended
+	var last uint64
+	if prev != nil {
+		last = prev.Seq
+	}
+	if last != l.seq {
+		result.Error = fmt.Sprintf("log ends at event %d, expected %d", last, l.seq)
+		return result, nil
+	}
+
+	result.Valid = true
+	return result, nil
+}
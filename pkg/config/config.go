@@ -14,19 +14,38 @@
 	        Port int    `mapstructure:"HTTP_PORT"`
 	    }
 	    
-	    Database struct {
-	        Host     string `mapstructure:"DB_HOST"`
-	        Port     int    `mapstructure:"DB_PORT"`
-	        User     string `mapstructure:"DB_USER"`
-	        Password string `mapstructure:"DB_PASSWORD"`
-	        Name     string `mapstructure:"DB_NAME"`
-	        SSLMode  string `mapstructure:"DB_SSL_MODE"`
-	    }
+	    Database DatabaseConfig `mapstructure:",squash"`
+
+	    // UserStore selects where accounts and the rest of the auth state are
+	    // kept: "file" (JSON files in StateDir, for a single instance) or
+	    // "postgres" (the Database settings, shared by any number of instances)
+	    UserStore string `mapstructure:"USER_STORE"`
+
+	    // StateDir holds the auth service's state files with the file store:
+	    // users, refresh tokens, revocations, API keys, invites and OAuth
+	    // clients
+	    StateDir string `mapstructure:"AUTH_STATE_DIR"`
 	    
-	    JWT struct {
-	        Secret        string        `mapstructure:"JWT_SECRET"`
-	        ExpireMinutes time.Duration `mapstructure:"JWT_EXPIRE_MINUTES"`
-	    }
+	    JWT JWTConfig `mapstructure:",squash"`
+
+	    Login LoginConfig `mapstructure:",squash"`
+
+	    MFA MFAConfig `mapstructure:",squash"`
+
+	    Password PasswordConfig `mapstructure:",squash"`
+
+	    MTLS MTLSConfig `mapstructure:",squash"`
+
+	    Audit AuditConfig `mapstructure:",squash"`
+
+	    // RegistrationMode controls self-service sign-up: "invite",
+	    // "first-admin" (the first user becomes admin, then invites) or
+	    // "disabled"
+	    RegistrationMode string `mapstructure:"REGISTRATION_MODE"`
+
+	    // ForwardAuthCacheTTL is how long forward-auth decisions for a
+	    // credential are reused
+	    ForwardAuthCacheTTL time.Duration `mapstructure:"FORWARD_AUTH_CACHE_TTL"`
 	    
 	    Metrics struct {
 	        Enabled bool   `mapstructure:"METRICS_ENABLED"`
@@ -34,14 +53,146 @@
 	    }
 	}
 
+	// DatabaseConfig holds the Postgres connection settings
+	type DatabaseConfig struct {
+	    Host     string `mapstructure:"DB_HOST"`
+	    Port     int    `mapstructure:"DB_PORT"`
+	    User     string `mapstructure:"DB_USER"`
+	    Password string `mapstructure:"DB_PASSWORD"`
+	    Name     string `mapstructure:"DB_NAME"`
+	    SSLMode  string `mapstructure:"DB_SSL_MODE"`
+	}
+
+	// DSN returns the connection string for the Postgres driver
+	func (c DatabaseConfig) DSN() string {
+	    return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+	        c.Host, c.Port, c.User, c.Password, c.Name, c.SSLMode)
+	}
+
+	// JWTConfig controls token signing and lifetimes
+	type JWTConfig struct {
+	    Secret          string        `mapstructure:"JWT_SECRET"`
+	    ExpireMinutes   int           `mapstructure:"JWT_EXPIRE_MINUTES"`
+	    RefreshTokenTTL time.Duration `mapstructure:"JWT_REFRESH_TOKEN_TTL"`
+
+	    // Algorithm is HS256 (shared Secret) or RS256/EdDSA (keys in KeyFile,
+	    // or the database with the postgres store, published as a JWKS and
+	    // rotated every KeyRotation, with retired keys kept for KeyOverlap)
+	    Algorithm   string        `mapstructure:"JWT_ALGORITHM"`
+	    KeyFile     string        `mapstructure:"JWT_KEY_FILE"`
+	    KeyRotation time.Duration `mapstructure:"JWT_KEY_ROTATION"`
+	    KeyOverlap  time.Duration `mapstructure:"JWT_KEY_OVERLAP"`
+	}
+
+	// LoginConfig controls brute-force protection for password logins. After
+	// FreeAttempts failures for a username (IPFreeAttempts for a client IP)
+	// each further attempt waits BackoffBase, doubling up to BackoffMax. A
+	// username is locked for LockoutDuration after LockoutThreshold failures.
+	type LoginConfig struct {
+	    FreeAttempts     int           `mapstructure:"LOGIN_FREE_ATTEMPTS"`
+	    IPFreeAttempts   int           `mapstructure:"LOGIN_IP_FREE_ATTEMPTS"`
+	    BackoffBase      time.Duration `mapstructure:"LOGIN_BACKOFF_BASE"`
+	    BackoffMax       time.Duration `mapstructure:"LOGIN_BACKOFF_MAX"`
+	    LockoutThreshold int           `mapstructure:"LOGIN_LOCKOUT_THRESHOLD"`
+	    LockoutDuration  time.Duration `mapstructure:"LOGIN_LOCKOUT_DURATION"`
+	}
+
+	// MFAConfig controls TOTP second factors. Users whose role is listed in
+	// RequiredRoles only get viewer scopes until they enroll.
+	type MFAConfig struct {
+	    Issuer        string   `mapstructure:"MFA_ISSUER"`
+	    RequiredRoles []string `mapstructure:"MFA_REQUIRED_ROLES"`
+	}
+
+	// PasswordConfig holds the password policy and hashing parameters.
+	// Stored hashes using another algorithm or cost are upgraded on the
+	// next successful login.
+	type PasswordConfig struct {
+	    MinLength int `mapstructure:"PASSWORD_MIN_LENGTH"`
+	    MaxLength int `mapstructure:"PASSWORD_MAX_LENGTH"`
+	    // BreachedFile lists passwords that must not be used, one per line,
+	    // either in plain text or as SHA-1 hex as published by Have I Been
+	    // Pwned (an optional ":count" suffix is ignored)
+	    BreachedFile string `mapstructure:"PASSWORD_BREACHED_FILE"`
+
+	    // Algorithm is "bcrypt" or "argon2id"
+	    Algorithm     string `mapstructure:"PASSWORD_HASH_ALGORITHM"`
+	    BcryptCost    int    `mapstructure:"PASSWORD_BCRYPT_COST"`
+	    Argon2Time    uint32 `mapstructure:"PASSWORD_ARGON2_TIME"`
+	    Argon2Memory  uint32 `mapstructure:"PASSWORD_ARGON2_MEMORY"`
+	    Argon2Threads uint8  `mapstructure:"PASSWORD_ARGON2_THREADS"`
+	}
+
+	// MTLSConfig controls the local certificate authority that issues client
+	// certificates, and the auth service's mutual TLS listener on Addr. The
+	// CA is generated in CACert/CAKey on first start.
+	type MTLSConfig struct {
+	    Enabled     bool          `mapstructure:"MTLS_ENABLED"`
+	    Addr        string        `mapstructure:"MTLS_ADDR"`
+	    CACert      string        `mapstructure:"MTLS_CA_CERT"`
+	    CAKey       string        `mapstructure:"MTLS_CA_KEY"`
+	    CertTTL     time.Duration `mapstructure:"MTLS_CERT_TTL"`
+	    ServerNames []string      `mapstructure:"MTLS_SERVER_NAMES"`
+	}
+
+	// AuditConfig controls the security audit log. The file is rotated at
+	// MaxSize bytes, keeping MaxFiles rotated files.
+	type AuditConfig struct {
+	    Enabled  bool   `mapstructure:"AUDIT_ENABLED"`
+	    File     string `mapstructure:"AUDIT_FILE"`
+	    MaxSize  int64  `mapstructure:"AUDIT_MAX_SIZE"`
+	    MaxFiles int    `mapstructure:"AUDIT_MAX_FILES"`
+	}
+
+	// AccessTokenTTL returns the lifetime of access tokens
+	func (c JWTConfig) AccessTokenTTL() time.Duration {
+	    return time.Duration(c.ExpireMinutes) * time.Minute
+	}
+
 	func LoadConfig(path string) (*Config, error) {
 	    v := viper.New()
 	    
 	    v.SetDefault("ENVIRONMENT", "development")
 	    v.SetDefault("HTTP_HOST", "0.0.0.0")
 	    v.SetDefault("HTTP_PORT", 8080)
+	    v.SetDefault("DB_HOST", "localhost")
+	    v.SetDefault("DB_PORT", 5432)
 	    v.SetDefault("DB_SSL_MODE", "disable")
-	    v.SetDefault("JWT_EXPIRE_MINUTES", 60)
+	    v.SetDefault("USER_STORE", "file")
+	    v.SetDefault("AUTH_STATE_DIR", "auth")
+	    v.SetDefault("REGISTRATION_MODE", "first-admin")
+	    v.SetDefault("JWT_EXPIRE_MINUTES", 15)
+	    v.SetDefault("JWT_REFRESH_TOKEN_TTL", "720h")
+	    v.SetDefault("JWT_ALGORITHM", "RS256")
+	    v.SetDefault("JWT_KEY_FILE", "auth/signing_keys.json")
+	    v.SetDefault("JWT_KEY_ROTATION", "720h")
+	    v.SetDefault("JWT_KEY_OVERLAP", "24h")
+	    v.SetDefault("LOGIN_FREE_ATTEMPTS", 3)
+	    v.SetDefault("LOGIN_IP_FREE_ATTEMPTS", 10)
+	    v.SetDefault("LOGIN_BACKOFF_BASE", "1s")
+	    v.SetDefault("LOGIN_BACKOFF_MAX", "5m")
+	    v.SetDefault("LOGIN_LOCKOUT_THRESHOLD", 10)
+	    v.SetDefault("LOGIN_LOCKOUT_DURATION", "15m")
+	    v.SetDefault("MFA_ISSUER", "Edge Device")
+	    v.SetDefault("MFA_REQUIRED_ROLES", "operator,admin")
+	    v.SetDefault("PASSWORD_MIN_LENGTH", 10)
+	    v.SetDefault("PASSWORD_MAX_LENGTH", 128)
+	    v.SetDefault("PASSWORD_HASH_ALGORITHM", "bcrypt")
+	    v.SetDefault("PASSWORD_BCRYPT_COST", 10)
+	    v.SetDefault("PASSWORD_ARGON2_TIME", 3)
+	    v.SetDefault("PASSWORD_ARGON2_MEMORY", 65536)
+	    v.SetDefault("PASSWORD_ARGON2_THREADS", 2)
+	    v.SetDefault("FORWARD_AUTH_CACHE_TTL", "10s")
+	    v.SetDefault("MTLS_ENABLED", false)
+	    v.SetDefault("MTLS_ADDR", ":8443")
+	    v.SetDefault("MTLS_CA_CERT", "auth/ca.crt")
+	    v.SetDefault("MTLS_CA_KEY", "auth/ca.key")
+	    v.SetDefault("MTLS_CERT_TTL", "2160h")
+	    v.SetDefault("MTLS_SERVER_NAMES", "auth,localhost")
+	    v.SetDefault("AUDIT_ENABLED", true)
+	    v.SetDefault("AUDIT_FILE", "audit/auth.log")
+	    v.SetDefault("AUDIT_MAX_SIZE", 10485760)
+	    v.SetDefault("AUDIT_MAX_FILES", 10)
 	    v.SetDefault("METRICS_ENABLED", true)
 	    v.SetDefault("METRICS_PATH", "/metrics")
 	    
@@ -51,6 +202,12 @@
 	    v.AddConfigPath(".")
 	    
 	    v.AutomaticEnv()
+	    v.BindEnv("JWT_SECRET", "JWT_SECRET", "JWT_SECRET_KEY")
+	    // docker-compose passes the Postgres image's variable names
+	    v.BindEnv("DB_HOST", "DB_HOST", "POSTGRES_HOST")
+	    v.BindEnv("DB_USER", "DB_USER", "POSTGRES_USER")
+	    v.BindEnv("DB_PASSWORD", "DB_PASSWORD", "POSTGRES_PASSWORD")
+	    v.BindEnv("DB_NAME", "DB_NAME", "POSTGRES_DB")
 	    
 	    if err := v.ReadInConfig(); err != nil {
 	        if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
@@ -0,0 +1,159 @@
+// Package auth provides Fiber middleware that authenticates requests using
+// tokens or API keys issued by the auth service.
+package auth
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Keys under which the Identity and raw token are stored in fiber.Ctx locals
+const (
+	localsKey      = "auth.identity"
+	tokenLocalsKey = "auth.token"
+)
+
+// SubprotocolPrefix marks a WebSocket subprotocol entry carrying a token,
+// for browsers that cannot set headers on WebSocket requests. Clients send
+// e.g. "Sec-WebSocket-Protocol: gpio.v1, bearer.<token>".
+const SubprotocolPrefix = "bearer."
+
+// APIKeyHeader carries an API key for machine clients
+const APIKeyHeader = "X-API-Key"
+
+// Config configures the middleware
+type Config struct {
+	// Verifier validates extracted tokens. Required.
+	Verifier Verifier
+
+	// CookieName is the cookie checked when no Authorization header is
+	// present. Defaults to "access_token".
+	CookieName string
+
+	// QueryParam is the query parameter checked on WebSocket upgrade
+	// requests. Defaults to "access_token".
+	QueryParam string
+
+	// APIKeys validates keys sent in the X-API-Key header. Defaults to
+	// Verifier when it implements APIKeyVerifier; otherwise API keys are
+	// rejected.
+	APIKeys APIKeyVerifier
+
+	// Certificates maps verified client certificates to identities for
+	// services that terminate TLS themselves. Defaults to Verifier when it
+	// implements CertificateVerifier. Tokens and API keys take precedence.
+	Certificates CertificateVerifier
+
+	// Next skips the middleware when it returns true
+	Next func(c *fiber.Ctx) bool
+}
+
+// New creates the authentication middleware
+func New(config Config) fiber.Handler {
+	if config.Verifier == nil {
+		panic("auth: Config.Verifier is required")
+	}
+	if config.CookieName == "" {
+		config.CookieName = "access_token"
+	}
+	if config.QueryParam == "" {
+		config.QueryParam = "access_token"
+	}
+	if config.APIKeys == nil {
+		config.APIKeys, _ = config.Verifier.(APIKeyVerifier)
+	}
+	if config.Certificates == nil {
+		config.Certificates, _ = config.Verifier.(CertificateVerifier)
+	}
+
+	return func(c *fiber.Ctx) error {
+		if config.Next != nil && config.Next(c) {
+			return c.Next()
+		}
+
+		var identity *Identity
+		var err error
+
+		token := extractToken(c, config)
+		apiKey := c.Get(APIKeyHeader)
+		cert := PeerCertificate(c)
+		switch {
+		case token != "":
+			identity, err = config.Verifier.Verify(c.Context(), token)
+		case apiKey != "" && config.APIKeys != nil:
+			identity, err = config.APIKeys.VerifyAPIKey(c.Context(), apiKey, c.IP())
+		case apiKey != "":
+			return unauthorized(c, ErrInvalidToken)
+		case cert != nil && config.Certificates != nil:
+			identity, err = config.Certificates.VerifyCertificate(c.Context(), cert)
+		default:
+			return unauthorized(c, ErrMissingToken)
+		}
+		if err != nil {
+			if errors.Is(err, ErrInvalidToken) {
+				return unauthorized(c, err)
+			}
+			return fiber.NewError(fiber.StatusServiceUnavailable, err.Error())
+		}
+
+		c.Locals(localsKey, identity)
+		c.Locals(tokenLocalsKey, token)
+		return c.Next()
+	}
+}
+
+// IdentityFrom returns the identity attached by the middleware, or nil
+func IdentityFrom(c *fiber.Ctx) *Identity {
+	identity, _ := c.Locals(localsKey).(*Identity)
+	return identity
+}
+
+// TokenFrom returns the raw token the request was authenticated with. It is
+// empty for requests authenticated with an API key or client certificate.
+func TokenFrom(c *fiber.Ctx) string {
+	token, _ := c.Locals(tokenLocalsKey).(string)
+	return token
+}
+
+// Subject returns the authenticated subject, or an empty string
+func Subject(c *fiber.Ctx) string {
+	if identity := IdentityFrom(c); identity != nil {
+		return identity.Subject
+	}
+	return ""
+}
+
+// extractToken looks for a token in the Authorization header, the cookie,
+// and for WebSocket upgrades the subprotocol list and query string
+func extractToken(c *fiber.Ctx, config Config) string {
+	if header := c.Get(fiber.HeaderAuthorization); header != "" {
+		if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+			return strings.TrimSpace(header[7:])
+		}
+		return ""
+	}
+
+	if cookie := c.Cookies(config.CookieName); cookie != "" {
+		return cookie
+	}
+
+	if !strings.EqualFold(c.Get(fiber.HeaderUpgrade), "websocket") {
+		return ""
+	}
+
+	for _, protocol := range strings.Split(c.Get(fiber.HeaderSecWebSocketProtocol), ",") {
+		protocol = strings.TrimSpace(protocol)
+		if strings.HasPrefix(protocol, SubprotocolPrefix) {
+			return strings.TrimPrefix(protocol, SubprotocolPrefix)
+		}
+	}
+
+	return c.Query(config.QueryParam)
+}
+
+func unauthorized(c *fiber.Ctx, err error) error {
+	c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="edge-device"`)
+	return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+}
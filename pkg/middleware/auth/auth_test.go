@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/Jeff-Barlow-Spady/edge-device-service/pkg/jwks"
+)
+
+func signToken(t *testing.T, secret []byte, subject string, expiry time.Duration) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": subject,
+		"exp": time.Now().Add(expiry).Unix(),
+	})
+	signed, err := token.SignedString(secret)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestMiddleware(t *testing.T) {
+	secret := []byte("test-secret")
+	app := fiber.New()
+	app.Get("/protected", New(Config{Verifier: NewSecretVerifier(secret)}), func(c *fiber.Ctx) error {
+		return c.SendString(Subject(c))
+	})
+
+	valid := signToken(t, secret, "alice", time.Hour)
+	tests := []struct {
+		name   string
+		header map[string]string
+		query  string
+		status int
+	}{
+		{"no token", nil, "", fiber.StatusUnauthorized},
+		{"bearer header", map[string]string{"Authorization": "Bearer " + valid}, "", fiber.StatusOK},
+		{"wrong secret", map[string]string{"Authorization": "Bearer " + signToken(t, []byte("other"), "alice", time.Hour)}, "", fiber.StatusUnauthorized},
+		{"expired", map[string]string{"Authorization": "Bearer " + signToken(t, secret, "alice", -time.Hour)}, "", fiber.StatusUnauthorized},
+		{"cookie", map[string]string{"Cookie": "access_token=" + valid}, "", fiber.StatusOK},
+		{"query without upgrade", nil, "?access_token=" + valid, fiber.StatusUnauthorized},
+		{"query on upgrade", map[string]string{"Upgrade": "websocket"}, "?access_token=" + valid, fiber.StatusOK},
+		{"subprotocol", map[string]string{"Upgrade": "websocket", "Sec-WebSocket-Protocol": "gpio.v1, bearer." + valid}, "", fiber.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/protected"+tt.query, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestMatchScope(t *testing.T) {
+	tests := []struct {
+		granted, required string
+		want              bool
+	}{
+		{"gpio:write:17", "gpio:write:17", true},
+		{"gpio:write:17", "gpio:write:18", false},
+		{"gpio:read:*", "gpio:read:4", true},
+		{"gpio:read:*", "gpio:write:4", false},
+		{"gpio:*", "gpio:write:4", true},
+		{"*", "metrics:read:*", true},
+		{"gpio:write", "gpio:write:4", false},
+		{"gpio:*:4", "gpio:write:4", true},
+	}
+
+	for _, tt := range tests {
+		if got := MatchScope(tt.granted, tt.required); got != tt.want {
+			t.Errorf("MatchScope(%q, %q) = %v, want %v", tt.granted, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestJWKSVerifier(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	jwk, err := jwks.NewKey("key-1", pub)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks.Set{Keys: []jwks.Key{jwk}})
+	}))
+	defer server.Close()
+
+	sign := func(kid string) string {
+		token := jwt.NewWithClaims(jwks.SigningMethodEdDSA, jwt.MapClaims{
+			"sub":    "alice",
+			"scopes": []string{"gpio:read:*"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(priv)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return signed
+	}
+
+	verifier := NewJWKSVerifier(server.URL)
+	identity, err := verifier.Verify(context.Background(), sign("key-1"))
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if identity.Subject != "alice" || !identity.HasScope("gpio:read:4") {
+		t.Errorf("Unexpected identity %+v", identity)
+	}
+
+	if _, err := verifier.Verify(context.Background(), sign("unknown")); err != ErrInvalidToken {
+		t.Errorf("Expected ErrInvalidToken for unknown kid, got %v", err)
+	}
+	if _, err := verifier.Verify(context.Background(), signToken(t, []byte("secret"), "alice", time.Hour)); err != ErrInvalidToken {
+		t.Errorf("Expected ErrInvalidToken for HS256 token, got %v", err)
+	}
+}
+
+type stubKeyVerifier struct {
+	*SecretVerifier
+}
+
+func (v stubKeyVerifier) VerifyAPIKey(ctx context.Context, key, remoteIP string) (*Identity, error) {
+	if key != "edk_test.secret" {
+		return nil, ErrInvalidToken
+	}
+	return &Identity{Subject: "gateway"}, nil
+}
+
+func TestAPIKey(t *testing.T) {
+	secret := []byte("test-secret")
+	handler := func(c *fiber.Ctx) error {
+		return c.SendString(Subject(c))
+	}
+
+	withKeys := fiber.New()
+	withKeys.Get("/", New(Config{Verifier: stubKeyVerifier{NewSecretVerifier(secret)}}), handler)
+	withoutKeys := fiber.New()
+	withoutKeys.Get("/", New(Config{Verifier: NewSecretVerifier(secret)}), handler)
+
+	tests := []struct {
+		name   string
+		app    *fiber.App
+		key    string
+		status int
+	}{
+		{"valid key", withKeys, "edk_test.secret", fiber.StatusOK},
+		{"wrong key", withKeys, "edk_test.other", fiber.StatusUnauthorized},
+		{"keys unsupported", withoutKeys, "edk_test.secret", fiber.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(APIKeyHeader, tt.key)
+			resp, err := tt.app.Test(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/Jeff-Barlow-Spady/edge-device-service/pkg/jwks"
+)
+
+const (
+	// jwksRefreshInterval is how often the key set is refetched even when
+	// every kid is known, so retired keys eventually drop out
+	jwksRefreshInterval = 10 * time.Minute
+	// jwksMinRefetch limits refetches triggered by unknown kids
+	jwksMinRefetch = 30 * time.Second
+)
+
+// JWKSVerifier verifies RS256 and EdDSA tokens locally against the public
+// keys the auth service publishes at /.well-known/jwks.json. Keys are
+// cached and refetched periodically or when a token names an unknown kid.
+// API keys are checked remotely since only their hashes exist.
+type JWKSVerifier struct {
+	url    string
+	client *http.Client
+	remote *RemoteVerifier
+
+	mu        sync.Mutex
+	keys      map[string]interface{}
+	algs      map[string]string
+	fetchedAt time.Time
+}
+
+// NewJWKSVerifier creates a verifier that fetches signing keys from the
+// auth service at baseURL
+func NewJWKSVerifier(baseURL string) *JWKSVerifier {
+	return &JWKSVerifier{
+		url:    baseURL + "/.well-known/jwks.json",
+		client: &http.Client{Timeout: 5 * time.Second},
+		remote: NewRemoteVerifier(baseURL),
+	}
+}
+
+// VerifyAPIKey validates an API key with the auth service
+func (v *JWKSVerifier) VerifyAPIKey(ctx context.Context, key, remoteIP string) (*Identity, error) {
+	return v.remote.VerifyAPIKey(ctx, key, remoteIP)
+}
+
+// VerifyCertificate maps a client certificate with the auth service
+func (v *JWKSVerifier) VerifyCertificate(ctx context.Context, cert *x509.Certificate) (*Identity, error) {
+	return v.remote.VerifyCertificate(ctx, cert)
+}
+
+func (v *JWKSVerifier) Verify(ctx context.Context, tokenString string) (*Identity, error) {
+	var fetchErr error
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		alg := token.Method.Alg()
+		if alg != jwks.AlgRS256 && alg != jwks.AlgEdDSA {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+
+		key, keyAlg, err := v.key(ctx, kid)
+		if err != nil {
+			fetchErr = err
+			return nil, err
+		}
+		if key == nil || keyAlg != alg {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		return key, nil
+	})
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	return identityFromToken(token)
+}
+
+// key returns the cached public key for kid, refetching the key set when
+// it is stale or the kid is unknown
+func (v *JWKSVerifier) key(ctx context.Context, kid string) (interface{}, string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, known := v.keys[kid]
+	age := time.Since(v.fetchedAt)
+	if (known && age < jwksRefreshInterval) || (!known && age < jwksMinRefetch) {
+		return key, v.algs[kid], nil
+	}
+
+	if err := v.fetchLocked(ctx); err != nil {
+		// Keep serving cached keys while the auth service is unreachable
+		if known {
+			return key, v.algs[kid], nil
+		}
+		return nil, "", err
+	}
+	return v.keys[kid], v.algs[kid], nil
+}
+
+func (v *JWKSVerifier) fetchLocked(ctx context.Context) error {
+	v.fetchedAt = time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("auth service unavailable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("auth service returned status %d", resp.StatusCode)
+	}
+
+	var set jwks.Set
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("invalid key set: %v", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	algs := make(map[string]string, len(set.Keys))
+	for _, jwk := range set.Keys {
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = pub
+		algs[jwk.Kid] = jwk.Alg
+	}
+	v.keys = keys
+	v.algs = algs
+	return nil
+}
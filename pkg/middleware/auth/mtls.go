@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ClientCertHeader carries a URL-escaped PEM client certificate when a
+// service asks the auth service to map it to an identity
+const ClientCertHeader = "X-Client-Cert"
+
+// PeerCertificate returns the client certificate verified during the TLS
+// handshake, or nil for plain connections and unverified peers
+func PeerCertificate(c *fiber.Ctx) *x509.Certificate {
+	state := c.Context().TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// MutualTLSConfig returns a server TLS configuration that verifies client
+// certificates against the CA in clientCAFile when they are presented.
+// Clients without a certificate can still authenticate with tokens. An
+// empty clientCAFile gives plain server-side TLS.
+func MutualTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	caPEM, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	config.ClientCAs = pool
+	return config, nil
+}
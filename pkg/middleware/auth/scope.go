@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MatchScope reports whether a granted scope covers a required one. Scopes
+// are colon-separated segments; a "*" segment matches any single segment,
+// and a trailing "*" matches any remaining segments.
+func MatchScope(granted, required string) bool {
+	g := strings.Split(granted, ":")
+	r := strings.Split(required, ":")
+
+	for i, segment := range g {
+		if segment == "*" && i == len(g)-1 {
+			return true
+		}
+		if i >= len(r) || (segment != "*" && segment != r[i]) {
+			return false
+		}
+	}
+	return len(g) == len(r)
+}
+
+// HasScope reports whether the identity holds a scope covering required
+func (i *Identity) HasScope(required string) bool {
+	if i == nil {
+		return false
+	}
+	for _, granted := range i.Scopes {
+		if MatchScope(granted, required) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope returns middleware that rejects requests whose identity does
+// not hold the scope computed by scope. It must run after New.
+func RequireScope(scope func(c *fiber.Ctx) string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		required := scope(c)
+		if !IdentityFrom(c).HasScope(required) {
+			return fiber.NewError(fiber.StatusForbidden, "missing required scope "+required)
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	// ErrMissingToken is returned when a request carries no credentials
+	ErrMissingToken = errors.New("missing bearer token")
+	// ErrInvalidToken is returned when credentials are rejected
+	ErrInvalidToken = errors.New("invalid or expired token")
+)
+
+// Identity is the authenticated principal attached to a request
+type Identity struct {
+	Subject string   `json:"subject"`
+	Roles   []string `json:"roles"`
+	Scopes  []string `json:"scopes"`
+}
+
+// Verifier validates a bearer token and returns the identity it carries
+type Verifier interface {
+	Verify(ctx context.Context, token string) (*Identity, error)
+}
+
+// APIKeyVerifier validates an API key presented from remoteIP. Verifiers
+// that also implement it let the middleware accept API keys.
+type APIKeyVerifier interface {
+	VerifyAPIKey(ctx context.Context, key, remoteIP string) (*Identity, error)
+}
+
+// CertificateVerifier maps a client certificate, already verified during
+// the TLS handshake, to an identity. Verifiers that also implement it let
+// the middleware accept mutual TLS.
+type CertificateVerifier interface {
+	VerifyCertificate(ctx context.Context, cert *x509.Certificate) (*Identity, error)
+}
+
+// SecretVerifier verifies HS256 tokens signed with a shared secret
+type SecretVerifier struct {
+	secret []byte
+}
+
+// NewSecretVerifier creates a verifier for tokens signed with secret
+func NewSecretVerifier(secret []byte) *SecretVerifier {
+	return &SecretVerifier{secret: secret}
+}
+
+func (v *SecretVerifier) Verify(ctx context.Context, tokenString string) (*Identity, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return v.secret, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	return identityFromToken(token)
+}
+
+// identityFromToken builds an identity from a verified token's claims
+func identityFromToken(token *jwt.Token) (*Identity, error) {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, ErrInvalidToken
+	}
+
+	return &Identity{
+		Subject: subject,
+		Roles:   stringsClaim(claims["roles"]),
+		Scopes:  stringsClaim(claims["scopes"]),
+	}, nil
+}
+
+// stringsClaim converts a JSON array claim to a string slice
+func stringsClaim(value interface{}) []string {
+	items, _ := value.([]interface{})
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// RemoteVerifier verifies tokens by asking the auth service
+type RemoteVerifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewRemoteVerifier creates a verifier that calls the auth service's
+// /auths/verify endpoint at baseURL
+func NewRemoteVerifier(baseURL string) *RemoteVerifier {
+	return &RemoteVerifier{
+		url:    baseURL + "/auths/verify",
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (v *RemoteVerifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return v.do(req)
+}
+
+// VerifyAPIKey asks the auth service to validate an API key, forwarding
+// the client address for the key's IP allowlist
+func (v *RemoteVerifier) VerifyAPIKey(ctx context.Context, key, remoteIP string) (*Identity, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(APIKeyHeader, key)
+	req.Header.Set("X-Forwarded-For", remoteIP)
+	return v.do(req)
+}
+
+// VerifyCertificate asks the auth service which identity a client
+// certificate maps to and whether it has been revoked
+func (v *RemoteVerifier) VerifyCertificate(ctx context.Context, cert *x509.Certificate) (*Identity, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	req.Header.Set(ClientCertHeader, url.QueryEscape(string(block)))
+	return v.do(req)
+}
+
+func (v *RemoteVerifier) do(req *http.Request) (*Identity, error) {
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("auth service unavailable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrInvalidToken
+	default:
+		return nil, fmt.Errorf("auth service returned status %d", resp.StatusCode)
+	}
+
+	var identity Identity
+	if err := json.NewDecoder(resp.Body).Decode(&identity); err != nil {
+		return nil, fmt.Errorf("invalid auth service response: %v", err)
+	}
+	if identity.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	return &identity, nil
+}